@@ -0,0 +1,124 @@
+package starlet
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+
+	"go.starlark.net/starlark"
+)
+
+// ExecBudget defines the resource limits for each run of a Machine, and the zero value of each field means no limit.
+// The limits are applied to the script executed by the Machine and the modules it loads, and to the functions called by Call, CallWithContext and CallMain,
+// and the run or call is aborted with an ExecError once any of them is exceeded.
+type ExecBudget struct {
+	// MaxSteps is the maximum number of abstract computation steps of the Starlark thread during a run.
+	// Steps are counted by the interpreter for Starlark code only, the time spent in Go builtins is not counted.
+	MaxSteps uint64
+	// MaxOutputBytes is the maximum number of bytes printed by the print function during a run, including the trailing newlines.
+	MaxOutputBytes uint64
+	// MaxOperatorResultSize is the maximum number of elements of lists and tuples, or bytes of strings and bytes, created by the + and * operators and their
+	// augmented assignments, e.g. [0] * n or s += s. The size is checked before the result is allocated.
+	// It's an operator-only guard, not a limit of collection sizes: builtins and methods like list.extend, dict.update, str.join and str.format,
+	// the % operator, and comprehensions are not checked, so the collections growing by them are only bounded by MaxSteps.
+	MaxOperatorResultSize uint64
+}
+
+// IsUnlimited returns true if no limit is set in the budget.
+func (b ExecBudget) IsUnlimited() bool {
+	return b.MaxSteps == 0 && b.MaxOutputBytes == 0 && b.MaxOperatorResultSize == 0
+}
+
+var (
+	// ErrExceedMaxSteps indicates the run is aborted for exceeding the max execution steps.
+	ErrExceedMaxSteps = errors.New("exceeded max execution steps")
+	// ErrExceedMaxOutput indicates the run is aborted for exceeding the max output bytes.
+	ErrExceedMaxOutput = errors.New("exceeded max output bytes")
+	// ErrExceedMaxOperatorResult indicates the run is aborted for exceeding the max operator result size.
+	ErrExceedMaxOperatorResult = errors.New("exceeded max operator result size")
+)
+
+const (
+	// localBudgetTracker is the thread local key of the budget tracker for the run.
+	localBudgetTracker = "starlet_budget_tracker"
+)
+
+// budgetTracker tracks the resource usage of a run against the budget.
+type budgetTracker struct {
+	budget     ExecBudget
+	printFunc  PrintFunc
+	startSteps uint64
+	outputSize uint64
+	exceeded   error
+}
+
+// newBudgetTracker creates a tracker for the given budget, and starts tracking from the current state of the thread.
+func newBudgetTracker(b ExecBudget, thread *starlark.Thread) *budgetTracker {
+	return &budgetTracker{
+		budget:     b,
+		startSteps: thread.ExecutionSteps(),
+	}
+}
+
+// attach sets up the print function of the thread for the output limit, and the tracker for the operator result size limit.
+func (t *budgetTracker) attach(thread *starlark.Thread) {
+	thread.SetLocal(localBudgetTracker, t)
+	t.printFunc = thread.Print
+	if t.budget.MaxOutputBytes == 0 {
+		return
+	}
+	print := thread.Print
+	thread.Print = func(th *starlark.Thread, msg string) {
+		if t.exceeded != nil {
+			return
+		}
+		t.outputSize += uint64(len(msg)) + 1
+		if t.outputSize > t.budget.MaxOutputBytes {
+			t.abort(th, ErrExceedMaxOutput, t.budget.MaxOutputBytes)
+			return
+		}
+		if print != nil {
+			print(th, msg)
+		} else {
+			defaultPrint(th, msg)
+		}
+	}
+}
+
+// detach restores the print function of the thread, and removes the tracker.
+func (t *budgetTracker) detach(thread *starlark.Thread) {
+	thread.Print = t.printFunc
+	thread.SetLocal(localBudgetTracker, nil)
+}
+
+// nextStep returns the absolute step count of the thread for the next budget check.
+func (t *budgetTracker) nextStep(steps uint64) uint64 {
+	if t.budget.MaxSteps > 0 {
+		return t.startSteps + t.budget.MaxSteps
+	}
+	return math.MaxUint64
+}
+
+// onStep checks the budget when the thread reaches the step returned by nextStep.
+func (t *budgetTracker) onStep(thread *starlark.Thread, steps uint64) uint64 {
+	if t.exceeded != nil {
+		return math.MaxUint64
+	}
+	if t.budget.MaxSteps > 0 && steps-t.startSteps >= t.budget.MaxSteps {
+		t.abort(thread, ErrExceedMaxSteps, t.budget.MaxSteps)
+		return math.MaxUint64
+	}
+	return t.nextStep(steps)
+}
+
+// abort records the exceeded limit and cancels the thread.
+func (t *budgetTracker) abort(thread *starlark.Thread, limit error, value uint64) {
+	t.exceeded = fmt.Errorf("%w: %d", limit, value)
+	thread.Cancel(t.exceeded.Error())
+}
+
+// defaultPrint is the default print function of Starlark, used when no print function is set.
+func defaultPrint(_ *starlark.Thread, msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+}
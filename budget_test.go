@@ -0,0 +1,373 @@
+package starlet_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/1set/starlet"
+	"go.starlark.net/starlark"
+)
+
+func TestMachine_SetExecBudget(t *testing.T) {
+	m := starlet.NewDefault()
+	if b := m.GetExecBudget(); !b.IsUnlimited() {
+		t.Errorf("expected unlimited budget, got %v", b)
+	}
+	b := starlet.ExecBudget{MaxSteps: 100, MaxOutputBytes: 10}
+	m.SetExecBudget(b)
+	if act := m.GetExecBudget(); act != b {
+		t.Errorf("expected budget %v, got %v", b, act)
+	}
+	if act := m.GetExecBudget(); act.IsUnlimited() {
+		t.Errorf("expected limited budget, got %v", act)
+	}
+}
+
+func TestMachine_Run_ExecBudget(t *testing.T) {
+	tests := []struct {
+		name    string
+		budget  starlet.ExecBudget
+		code    string
+		wantErr error
+		errMsg  string
+	}{
+		{
+			name:   "unlimited",
+			budget: starlet.ExecBudget{},
+			code: `
+def loop():
+    s = 0
+    for i in range(10000):
+        s += i
+    return s
+x = loop()
+`,
+		},
+		{
+			name:   "within steps",
+			budget: starlet.ExecBudget{MaxSteps: 100000},
+			code: `
+def loop():
+    s = 0
+    for i in range(100):
+        s += i
+    return s
+x = loop()
+`,
+		},
+		{
+			name:    "exceed steps",
+			budget:  starlet.ExecBudget{MaxSteps: 1000},
+			wantErr: starlet.ErrExceedMaxSteps,
+			errMsg:  "starlet: exec: exceeded max execution steps: 1000",
+			code: `
+def loop():
+    for i in range(1 << 30):
+        pass
+loop()
+`,
+		},
+		{
+			name:   "within output",
+			budget: starlet.ExecBudget{MaxOutputBytes: 6},
+			code: `
+print("hello")
+`,
+		},
+		{
+			name:    "exceed output",
+			budget:  starlet.ExecBudget{MaxOutputBytes: 5},
+			wantErr: starlet.ErrExceedMaxOutput,
+			errMsg:  "starlet: exec: exceeded max output bytes: 5",
+			code: `
+print("hello")
+`,
+		},
+		{
+			name:    "exceed output in loop",
+			budget:  starlet.ExecBudget{MaxOutputBytes: 100},
+			wantErr: starlet.ErrExceedMaxOutput,
+			errMsg:  "starlet: exec: exceeded max output bytes: 100",
+			code: `
+def loop():
+    for i in range(1 << 30):
+        print("hello world")
+loop()
+`,
+		},
+		{
+			name:   "within operator result size",
+			budget: starlet.ExecBudget{MaxOperatorResultSize: 1000},
+			code: `
+l = [0] * 1000
+s = "ab" * 250 + "c" * 500
+t = 2 * (1, 2)
+`,
+		},
+		{
+			name:    "exceed operator result size by repetition",
+			budget:  starlet.ExecBudget{MaxOperatorResultSize: 1000},
+			wantErr: starlet.ErrExceedMaxOperatorResult,
+			errMsg:  "starlet: exec: exceeded max operator result size: 1000",
+			code: `
+l = [0] * 1000000000
+`,
+		},
+		{
+			name:    "exceed operator result size by concatenation",
+			budget:  starlet.ExecBudget{MaxOperatorResultSize: 1000},
+			wantErr: starlet.ErrExceedMaxOperatorResult,
+			errMsg:  "starlet: exec: exceeded max operator result size: 1000",
+			code: `
+def double():
+    s = "a"
+    for i in range(64):
+        s = s + s
+double()
+`,
+		},
+		{
+			name:    "exceed operator result size by augmented assignment",
+			budget:  starlet.ExecBudget{MaxOperatorResultSize: 1000},
+			wantErr: starlet.ErrExceedMaxOperatorResult,
+			errMsg:  "starlet: exec: exceeded max operator result size: 1000",
+			code: `
+def double():
+    l = [1]
+    for i in range(64):
+        l += l
+double()
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := starlet.NewDefault()
+			m.SetPrintFunc(starlet.NoopPrintFunc)
+			m.SetExecBudget(tt.budget)
+			m.SetScript("test.star", []byte(tt.code), nil)
+			_, err := m.Run()
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+				return
+			}
+			expectErr(t, err, tt.errMsg)
+		})
+	}
+}
+
+func TestMachine_Run_ExecBudgetReset(t *testing.T) {
+	code := `
+def loop(n):
+    s = 0
+    for i in range(n):
+        s += i
+    return s
+`
+	m := starlet.NewDefault()
+	m.SetExecBudget(starlet.ExecBudget{MaxSteps: 1000})
+	m.SetScript("test.star", []byte(code), nil)
+	if _, err := m.Run(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+
+	// exceed the budget
+	m.SetScript("test.star", []byte(`x = loop(10000)`), nil)
+	if _, err := m.Run(); !errors.Is(err, starlet.ErrExceedMaxSteps) {
+		t.Errorf("expected exceeded steps error, got %v", err)
+		return
+	}
+
+	// the budget is counted for each run
+	m.SetScript("test.star", []byte(`y = loop(10)`), nil)
+	out, err := m.Run()
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if y := out["y"]; y != int64(45) {
+		t.Errorf("expected y=45, got %v", y)
+	}
+
+	// remove the budget
+	m.SetExecBudget(starlet.ExecBudget{})
+	m.SetScript("test.star", []byte(`z = loop(10000)`), nil)
+	if _, err := m.Run(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestMachine_Run_ExecBudgetOperatorSemantics(t *testing.T) {
+	code := `
+def f(a, b=1+2, *args, **kwargs):
+    return a * b
+def extend():
+    l = [1]
+    alias = l
+    l += [2]
+    return alias
+alias = extend()
+d = {"k": [0]}
+d["k"] *= 2
+x = f(2) + f(a=3, b=[1] * 2)[0] + len([i * 2 for i in range(3) if i + 1 < 3])
+y = -(1 + 2) * 3
+`
+	m := starlet.NewDefault()
+	m.SetExecBudget(starlet.ExecBudget{MaxOperatorResultSize: 100})
+	m.SetScript("test.star", []byte(code), nil)
+	out, err := m.Run()
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if a := out["alias"].([]interface{}); len(a) != 2 {
+		t.Errorf("expected in-place concatenation, got %v", a)
+	}
+	if d := out["d"].(map[interface{}]interface{}); len(d["k"].([]interface{})) != 2 {
+		t.Errorf("expected repeated list, got %v", d)
+	}
+	if x, y := out["x"], out["y"]; x != int64(6+1+2) || y != int64(-9) {
+		t.Errorf("unexpected results: x=%v, y=%v", x, y)
+	}
+
+	// errors of the operators are reported as they are
+	m.SetScript("test.star", []byte(`z = 1 + "a"`), nil)
+	_, err = m.Run()
+	expectErr(t, err, `starlark: exec: unknown binary op: int + string`)
+	if e, ok := err.(starlet.ExecError); !ok || e.Position().String() != "test.star:1:7" {
+		t.Errorf("unexpected error position: %v", err)
+	}
+}
+
+func TestMachine_Run_ExecBudgetOperatorOnly(t *testing.T) {
+	// the limit is for the operators only, collections growing by other ways are not checked
+	code := `
+l = [0] * 10
+l.extend(range(100))
+d = {}
+d.update([(i, i) for i in range(100)])
+s = ",".join(["b" for i in range(100)])
+f = "%s%s" % ("a" * 10, "b" * 10)
+r = "{}{}".format("a" * 10, "b" * 10)
+sizes = [len(l), len(d), len(s), len(f), len(r)]
+`
+	m := starlet.NewDefault()
+	m.SetExecBudget(starlet.ExecBudget{MaxOperatorResultSize: 10})
+	m.SetScript("test.star", []byte(code), nil)
+	out, err := m.Run()
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if s := fmt.Sprint(out["sizes"]); s != "[110 100 199 20 20]" {
+		t.Errorf("unexpected sizes: %s", s)
+	}
+
+	// they're bounded by the steps instead
+	m.SetExecBudget(starlet.ExecBudget{MaxSteps: 10000, MaxOperatorResultSize: 10})
+	m.SetScript("test.star", []byte(`
+def grow():
+    l = [0]
+    for i in range(1 << 30):
+        l.extend([i, i])
+grow()
+`), nil)
+	if _, err = m.Run(); !errors.Is(err, starlet.ErrExceedMaxSteps) {
+		t.Errorf("expected exceeded steps error, got %v", err)
+	}
+}
+
+func TestMachine_Run_ExecBudgetLoadedModule(t *testing.T) {
+	modules := MemFS{
+		"loop.star":  "def loop():\n    for i in range(1 << 30):\n        pass\nloop()",
+		"print.star": "def loop():\n    for i in range(1 << 30):\n        print('hello world')\nloop()",
+		"alloc.star": "l = [0] * 1000000000",
+	}
+	tests := []struct {
+		name    string
+		budget  starlet.ExecBudget
+		module  string
+		wantErr error
+	}{
+		{"steps", starlet.ExecBudget{MaxSteps: 10000}, "loop.star", starlet.ErrExceedMaxSteps},
+		{"output", starlet.ExecBudget{MaxOutputBytes: 100}, "print.star", starlet.ErrExceedMaxOutput},
+		{"operator", starlet.ExecBudget{MaxOperatorResultSize: 1000}, "alloc.star", starlet.ErrExceedMaxOperatorResult},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var printed int
+			m := starlet.NewDefault()
+			m.SetPrintFunc(func(_ *starlark.Thread, msg string) { printed++ })
+			m.SetExecBudget(tt.budget)
+			m.SetScript("test.star", []byte(fmt.Sprintf(`load(%q, "*")`, tt.module)), modules)
+			_, err := m.Run()
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if printed > 10 {
+				t.Errorf("expected output limited by the budget, got %d lines", printed)
+			}
+		})
+	}
+}
+
+func TestMachine_Call_ExecBudget(t *testing.T) {
+	code := `
+def loop(n):
+    for i in range(n):
+        pass
+def repeat(n):
+    return [0] * n
+def main(n=0):
+    loop(n)
+`
+	m := starlet.NewDefault()
+	m.SetExecBudget(starlet.ExecBudget{MaxSteps: 1000, MaxOperatorResultSize: 1000})
+	m.SetScript("test.star", []byte(code), nil)
+	if _, err := m.Run(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+
+	tests := []struct {
+		name    string
+		call    func() (interface{}, error)
+		wantErr error
+	}{
+		{"call within", func() (interface{}, error) { return m.Call("loop", 10) }, nil},
+		{"call steps", func() (interface{}, error) { return m.Call("loop", 1<<30) }, starlet.ErrExceedMaxSteps},
+		{"call with context", func() (interface{}, error) {
+			return m.CallWithContext(context.Background(), "repeat", []interface{}{1 << 30}, nil)
+		}, starlet.ErrExceedMaxOperatorResult},
+		{"call main", func() (interface{}, error) {
+			return m.CallMain(context.Background(), starlet.StringAnyMap{"n": 1 << 30})
+		}, starlet.ErrExceedMaxSteps},
+		{"call after exceeded", func() (interface{}, error) { return m.Call("repeat", 10) }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.call()
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if !errors.Is(err, starlet.ErrorKindBudget) {
+				t.Errorf("expected budget error kind, got %v", err)
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package starlet
 
 import (
 	"errors"
-	"fmt"
 	"sync"
 	"sync/atomic"
 	"unsafe"
@@ -21,12 +20,13 @@ import (
 // See Section 9.7 of gopl.io for an explanation of this structure.
 // It also features online deadlock (load cycle) detection.
 type cache struct {
-	cacheMu  sync.Mutex
-	cache    map[string]*entry
-	globals  starlark.StringDict
-	execOpts *syntax.FileOptions
-	loadMod  func(s string) (starlark.StringDict, error) // load from built-in module first
-	readFile func(s string) ([]byte, error)              // and then from file system
+	cacheMu   sync.Mutex
+	cache     map[string]*entry
+	globals   starlark.StringDict
+	execOpts  *syntax.FileOptions
+	progCache ByteCache                                   // cache for compiled programs of source files
+	loadMod   func(s string) (starlark.StringDict, error) // load from built-in module first
+	readFile  func(s string) ([]byte, error)              // and then from file system
 }
 
 type entry struct {
@@ -36,8 +36,16 @@ type entry struct {
 	ready   chan struct{}
 }
 
-func (c *cache) Load(module string) (starlark.StringDict, error) {
-	return c.get(new(cycleChecker), module)
+// localCycleChecker is the thread local key of the cycle checker for the module being loaded by the thread.
+const localCycleChecker = "starlet_load_cycle_checker"
+
+// Load loads the module on the thread, and the loads of nested modules on the same thread share the cycle checker.
+func (c *cache) Load(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	cc, _ := thread.Local(localCycleChecker).(*cycleChecker)
+	if cc == nil {
+		cc = new(cycleChecker)
+	}
+	return c.get(cc, thread, module)
 }
 
 func (c *cache) remove(module string) {
@@ -53,7 +61,7 @@ func (c *cache) reset() {
 }
 
 // get loads and returns an entry (if not already loaded).
-func (c *cache) get(cc *cycleChecker, module string) (starlark.StringDict, error) {
+func (c *cache) get(cc *cycleChecker, thread *starlark.Thread, module string) (starlark.StringDict, error) {
 	c.cacheMu.Lock()
 	e := c.cache[module]
 	if e != nil {
@@ -76,7 +84,7 @@ func (c *cache) get(cc *cycleChecker, module string) (starlark.StringDict, error
 		c.cacheMu.Unlock()
 
 		e.setOwner(cc)
-		e.globals, e.err = c.doLoad(cc, module)
+		e.globals, e.err = c.doLoad(cc, thread, module)
 		e.setOwner(nil)
 
 		// Broadcast that the entry is now ready.
@@ -85,14 +93,13 @@ func (c *cache) get(cc *cycleChecker, module string) (starlark.StringDict, error
 	return e.globals, e.err
 }
 
-func (c *cache) doLoad(cc *cycleChecker, module string) (starlark.StringDict, error) {
-	thread := &starlark.Thread{
-		Print: func(_ *starlark.Thread, msg string) { fmt.Println(msg) },
-		Load: func(_ *starlark.Thread, module string) (starlark.StringDict, error) {
-			// Tunnel the cycle-checker state for this "thread of loading".
-			return c.get(cc, module)
-		},
-	}
+// doLoad loads the module on the thread of the caller, so the thread locals like policy, file system and context,
+// the step limit for budgets and debuggers, and the print function also apply to the loaded modules.
+func (c *cache) doLoad(cc *cycleChecker, thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	// tunnel the cycle-checker state for this "thread of loading"
+	prev := thread.Local(localCycleChecker)
+	thread.SetLocal(localCycleChecker, cc)
+	defer thread.SetLocal(localCycleChecker, prev)
 
 	// 1: load from built-in module, the first field returns nil if not found
 	m, err := c.loadMod(module)
@@ -112,10 +119,17 @@ func (c *cache) doLoad(cc *cycleChecker, module string) (starlark.StringDict, er
 	}
 
 	// 3. execute the source file
-	if c.execOpts == nil {
-		return starlark.ExecFile(thread, module, b, c.globals)
+	opts := c.execOpts
+	if opts == nil {
+		opts = syntax.LegacyFileOptions()
 	}
-	return starlark.ExecFileOptions(c.execOpts, thread, module, b, c.globals)
+	rw := getProgramRewrite(thread)
+	if c.progCache == nil && rw == 0 {
+		return starlark.ExecFileOptions(opts, thread, module, b, c.globals)
+	}
+
+	// 4. or execute the compiled program from cache
+	return execProgram(thread, c.progCache, opts, module, b, c.globals, rw)
 }
 
 // -- concurrent cycle checking --
@@ -2,6 +2,9 @@ package starlet
 
 import (
 	"context"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/1set/starlight/convert"
 	"go.starlark.net/starlark"
@@ -12,6 +15,29 @@ func (m *Machine) Call(name string, args ...interface{}) (out interface{}, err e
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	return m.callInternal(context.TODO(), name, args, nil)
+}
+
+// CallWithTimeout executes a Starlark function or builtin saved in the thread with positional and keyword arguments within a specified timeout, and returns the result.
+func (m *Machine) CallWithTimeout(timeout time.Duration, name string, args []interface{}, kwargs StringAnyMap) (interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return m.callInternal(ctx, name, args, kwargs)
+}
+
+// CallWithContext executes a Starlark function or builtin saved in the thread with positional and keyword arguments within a specified context, and returns the result.
+// The name can be dotted to call a function nested in modules or structs, e.g. "handlers.on_event".
+func (m *Machine) CallWithContext(ctx context.Context, name string, args []interface{}, kwargs StringAnyMap) (interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.callInternal(ctx, name, args, kwargs)
+}
+
+func (m *Machine) callInternal(ctx context.Context, name string, args []interface{}, kwargs StringAnyMap) (out interface{}, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = errorStarlarkPanic("call", r)
@@ -25,15 +51,9 @@ func (m *Machine) Call(name string, args ...interface{}) (out interface{}, err e
 	if m.predeclared == nil || m.thread == nil {
 		return nil, errorStarletErrorf("call", "no function loaded")
 	}
-	var callFunc starlark.Callable
-	if rf, ok := m.predeclared[name]; !ok {
-		return nil, errorStarletErrorf("call", "no such function: %s", name)
-	} else if sf, ok := rf.(*starlark.Function); ok {
-		callFunc = sf
-	} else if sb, ok := rf.(*starlark.Builtin); ok {
-		callFunc = sb
-	} else {
-		return nil, errorStarletErrorf("call", "mistyped function: %s", name)
+	callFunc, err := m.lookupCallable(name)
+	if err != nil {
+		return nil, err
 	}
 
 	// convert arguments
@@ -45,21 +65,81 @@ func (m *Machine) Call(name string, args ...interface{}) (out interface{}, err e
 		}
 		sl = append(sl, sv)
 	}
+	var skw []starlark.Tuple
+	if len(kwargs) > 0 {
+		keys := make([]string, 0, len(kwargs))
+		for k := range kwargs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sv, err := convert.ToValueWithTag(kwargs[k], m.customTag)
+			if err != nil {
+				return nil, errorStarlightConvert("kwargs", err)
+			}
+			skw = append(skw, starlark.Tuple{starlark.String(k), sv})
+		}
+	}
 
-	// reset thread
+	// reset thread, and cancel it when context cancelled
 	m.thread.Uncancel()
-	m.thread.SetLocal("context", context.TODO())
+	ctx, stopWatch := m.watchContext(ctx)
+	defer stopWatch()
+
+	// track resource usage against the budget
+	var tracker *budgetTracker
+	if !m.budget.IsUnlimited() {
+		tracker = newBudgetTracker(m.budget, m.thread)
+		tracker.attach(m.thread)
+		steps := newStepDispatcher(tracker)
+		steps.attach(m.thread)
+		defer func() {
+			steps.detach(m.thread)
+			tracker.detach(m.thread)
+		}()
+	}
 
 	// call and convert result
-	res, err := starlark.Call(m.thread, callFunc, sl, nil)
+	res, err := starlark.Call(m.thread, callFunc, sl, skw)
+	stopWatch()
 	if m.enableOutConv { // convert to interface{} if enabled
 		out = convert.FromValue(res)
 	} else {
 		out = res
 	}
 	// handle error
+	if tracker != nil && tracker.exceeded != nil {
+		return out, errorStarletError("call", tracker.exceeded)
+	}
 	if err != nil {
-		return out, errorStarlarkError("call", err)
+		return out, errorStarlarkError("call", err).withContext(ctx)
 	}
 	return out, nil
 }
+
+// lookupCallable returns the callable of the given name in the predeclared names, and the dotted name is resolved as attributes of modules or structs.
+func (m *Machine) lookupCallable(name string) (starlark.Callable, error) {
+	parts := strings.Split(name, ".")
+	v, ok := m.predeclared[parts[0]]
+	if !ok {
+		return nil, errorStarletErrorf("call", "no such function: %s", name)
+	}
+	for i, attr := range parts[1:] {
+		ha, ok := v.(starlark.HasAttrs)
+		if !ok {
+			return nil, errorStarletErrorf("call", "no attributes in %s: %s", strings.Join(parts[:i+1], "."), v.Type())
+		}
+		av, err := ha.Attr(attr)
+		if err != nil || av == nil {
+			return nil, errorStarletErrorf("call", "no such function: %s", name)
+		}
+		v = av
+	}
+	switch f := v.(type) {
+	case *starlark.Function:
+		return f, nil
+	case *starlark.Builtin:
+		return f, nil
+	}
+	return nil, errorStarletErrorf("call", "mistyped function: %s", name)
+}
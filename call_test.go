@@ -1,10 +1,12 @@
 package starlet_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/1set/starlet"
 	"go.starlark.net/starlark"
@@ -249,3 +251,128 @@ def work(x, y):
 		t.Errorf("got unexpected value: %v", v)
 	}
 }
+
+func TestMachine_CallWithContext(t *testing.T) {
+	m := starlet.NewWithNames(nil, []string{"math", "struct"}, nil)
+	_, err := m.RunScript([]byte(`
+def greet(name, greeting="Hello", punct="!"):
+	return greeting + ", " + name + punct
+
+handlers = struct(on_event=lambda kind, data=None: "got %s: %s" % (kind, data), name="h")
+
+def spin():
+	for i in range(1 << 60):
+		pass
+`), nil)
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+
+	tests := []struct {
+		name    string
+		fn      string
+		args    []interface{}
+		kwargs  starlet.StringAnyMap
+		want    interface{}
+		wantErr string
+	}{
+		{
+			name: "positional only",
+			fn:   "greet",
+			args: []interface{}{"Alice"},
+			want: "Hello, Alice!",
+		},
+		{
+			name:   "keyword arguments",
+			fn:     "greet",
+			args:   []interface{}{"Bob"},
+			kwargs: starlet.StringAnyMap{"greeting": "Hi", "punct": "?"},
+			want:   "Hi, Bob?",
+		},
+		{
+			name:   "keyword only",
+			fn:     "greet",
+			kwargs: starlet.StringAnyMap{"name": "Carol"},
+			want:   "Hello, Carol!",
+		},
+		{
+			name:    "unexpected keyword",
+			fn:      "greet",
+			args:    []interface{}{"Dave"},
+			kwargs:  starlet.StringAnyMap{"mood": "happy"},
+			wantErr: `starlark: call: function greet got an unexpected keyword argument "mood"`,
+		},
+		{
+			name:    "convert kwargs fail",
+			fn:      "greet",
+			kwargs:  starlet.StringAnyMap{"name": make(chan int)},
+			wantErr: `starlight: convert kwargs: type chan int is not a supported starlark type`,
+		},
+		{
+			name:   "dotted struct member",
+			fn:     "handlers.on_event",
+			args:   []interface{}{"click"},
+			kwargs: starlet.StringAnyMap{"data": 42},
+			want:   "got click: 42",
+		},
+		{
+			name: "dotted module member",
+			fn:   "math.pow",
+			args: []interface{}{2, 10},
+			want: float64(1024),
+		},
+		{
+			name:    "dotted missing member",
+			fn:      "handlers.on_missing",
+			wantErr: `starlet: call: no such function: handlers.on_missing`,
+		},
+		{
+			name:    "dotted non-callable member",
+			fn:      "handlers.name",
+			wantErr: `starlet: call: mistyped function: handlers.name`,
+		},
+		{
+			name:    "dotted no attributes",
+			fn:      "greet.x.y",
+			wantErr: `starlet: call: no attributes in greet: function`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.CallWithContext(context.Background(), tt.fn, tt.args, tt.kwargs)
+			if tt.wantErr != "" {
+				expectErr(t, err, tt.wantErr)
+			} else if err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v (%T), got %v (%T)", tt.want, tt.want, got, got)
+			}
+		})
+	}
+
+	// cancelled by context
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err = m.CallWithContext(ctx, "spin", nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancelled error, got %v", err)
+	}
+
+	// cancelled by timeout
+	_, err = m.CallWithTimeout(50*time.Millisecond, "spin", nil, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+
+	// call again after cancellation
+	got, err := m.CallWithTimeout(time.Second, "greet", []interface{}{"Eve"}, nil)
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+	} else if got != "Hello, Eve!" {
+		t.Errorf("unexpected result: %v", got)
+	}
+}
@@ -0,0 +1,151 @@
+package starlet
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sort"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Diagnostic is a problem found in the script by static check without running it.
+type Diagnostic struct {
+	// Kind is the category of the problem, either ErrorKindSyntax or ErrorKindResolve.
+	Kind ErrorKind
+	// Pos is the position of the problem in the script.
+	Pos syntax.Position
+	// Msg is the description of the problem.
+	Msg string
+}
+
+// String returns the position and the description of the problem.
+func (d Diagnostic) String() string {
+	return d.Pos.String() + ": " + d.Msg
+}
+
+// Check parses and resolves the preset script against the current globals and preload modules without running it, and returns all the problems found.
+// Since the parser stops at the first syntax error, there is at most one syntax problem, while all the resolve problems like undefined names are returned in order of position.
+// The returned error is for failures before checking, e.g. no script to check or preload modules fail to load, not for problems in the script.
+func (m *Machine) Check() ([]Diagnostic, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// prepare the source and names
+	name, src, err := m.readScriptSource()
+	if err != nil {
+		return nil, err
+	}
+	predeclared, err := m.getCheckPredeclared()
+	if err != nil {
+		return nil, err
+	}
+
+	// parse and resolve
+	f, err := m.getFileOptions().Parse(name, src, 0)
+	if err != nil {
+		if se, ok := err.(syntax.Error); ok {
+			return []Diagnostic{{Kind: ErrorKindSyntax, Pos: se.Pos, Msg: se.Msg}}, nil
+		}
+		return nil, errorStarlarkError("check", err)
+	}
+	if err = resolve.File(f, predeclared.Has, starlark.Universe.Has); err != nil {
+		el, ok := err.(resolve.ErrorList)
+		if !ok {
+			return nil, errorStarlarkError("check", err)
+		}
+		diags := make([]Diagnostic, 0, len(el))
+		for _, e := range el {
+			diags = append(diags, Diagnostic{Kind: ErrorKindResolve, Pos: e.Pos, Msg: e.Msg})
+		}
+		// sort by position, since function bodies are resolved after the top level
+		sort.SliceStable(diags, func(i, j int) bool {
+			pi, pj := diags[i].Pos, diags[j].Pos
+			return pi.Line < pj.Line || (pi.Line == pj.Line && pi.Col < pj.Col)
+		})
+		return diags, nil
+	}
+	return nil, nil
+}
+
+// Compile parses, resolves and compiles the preset script against the current globals and preload modules without running it.
+// If the script cache is set, the compiled program is saved into the cache, so the following runs of the same script can skip the compilation.
+// It returns an ExecError of ErrorKindSyntax or ErrorKindResolve for the first problem in the script.
+func (m *Machine) Compile() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// prepare the source and names
+	name, src, err := m.readScriptSource()
+	if err != nil {
+		return err
+	}
+	predeclared, err := m.getCheckPredeclared()
+	if err != nil {
+		return err
+	}
+
+	// compile and cache if enabled
+	opts := m.getFileOptions()
+	if m.progCache != nil {
+		_, err = compileProgramWithCache(m.progCache, opts, name, m.cacheSource(src), predeclared.Has, 0)
+	} else {
+		_, _, err = starlark.SourceProgramOptions(opts, name, src, predeclared.Has)
+	}
+	if err != nil {
+		return errorStarlarkError("compile", err)
+	}
+	return nil
+}
+
+// readScriptSource returns the name and content of the preset script, as it would be run.
+func (m *Machine) readScriptSource() (string, []byte, error) {
+	name := m.scriptName
+	if m.scriptContent != nil {
+		if name == "" {
+			name = "eval.star"
+		}
+		return name, m.scriptContent, nil
+	} else if m.scriptFS != nil {
+		if name == "" {
+			return "", nil, errorStarletErrorf("run", "no script name")
+		}
+		rd, err := m.scriptFS.Open(name)
+		if err != nil {
+			return "", nil, errorStarletError("run", err)
+		}
+		defer rd.Close()
+		b, err := ioutil.ReadAll(rd)
+		if err != nil {
+			return "", nil, errorStarletError("run", err)
+		}
+		return name, b, nil
+	}
+	return "", nil, errorStarletErrorf("run", "no script to execute")
+}
+
+// cacheSource returns the source of the preset script for compiling with the cache, which also decides its cache key:
+// the script from the file system is cached by its name, and the script content is cached by the hash of the content.
+func (m *Machine) cacheSource(src []byte) interface{} {
+	if m.scriptContent == nil {
+		return bytes.NewReader(src)
+	}
+	return src
+}
+
+// getCheckPredeclared returns the predeclared names for checking the script, which are the current names if the machine already runs,
+// or the names from globals and preload modules before the first run.
+func (m *Machine) getCheckPredeclared() (starlark.StringDict, error) {
+	if m.predeclared != nil {
+		return m.predeclared, nil
+	}
+	predeclared, err := m.convertInput(m.globals)
+	if err != nil {
+		return nil, errorStarlightConvert("globals", err)
+	}
+	if err = m.preloadMods.LoadAll(predeclared); err != nil {
+		return nil, errorStarletError("preload", err)
+	}
+	return predeclared, nil
+}
@@ -0,0 +1,183 @@
+package starlet_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/1set/starlet"
+	"go.starlark.net/starlark"
+)
+
+func TestMachine_Check(t *testing.T) {
+	tests := []struct {
+		name      string
+		globals   starlet.StringAnyMap
+		preload   []string
+		code      string
+		fs        MemFS
+		wantDiags []string
+		wantKind  starlet.ErrorKind
+		wantErr   string
+	}{
+		{
+			name: "valid",
+			code: `x = 1 + len("abc")`,
+		},
+		{
+			name:      "syntax error",
+			code:      "x = 1\ny = (\nz = 2",
+			wantDiags: []string{"test.star:3:4: got '=', want ')'"},
+			wantKind:  starlet.ErrorKindSyntax,
+		},
+		{
+			name: "all undefined names",
+			code: `
+x = a + 1
+def f():
+    return b
+y = c
+`,
+			wantDiags: []string{
+				"test.star:2:5: undefined: a",
+				"test.star:4:12: undefined: b",
+				"test.star:5:5: undefined: c",
+			},
+			wantKind: starlet.ErrorKindResolve,
+		},
+		{
+			name:    "with globals and preload modules",
+			globals: starlet.StringAnyMap{"a": 1},
+			preload: []string{"math"},
+			code:    `x = a + math.sqrt(4)`,
+		},
+		{
+			name:      "lazyload modules are not predeclared",
+			code:      `x = math.sqrt(4)`,
+			wantDiags: []string{"test.star:1:5: undefined: math"},
+			wantKind:  starlet.ErrorKindResolve,
+		},
+		{
+			name: "from file system",
+			fs:   MemFS{"test.star": `y = undefined_name`},
+			wantDiags: []string{
+				"test.star:1:5: undefined: undefined_name",
+			},
+			wantKind: starlet.ErrorKindResolve,
+		},
+		{
+			name:    "missing file",
+			fs:      MemFS{},
+			wantErr: "starlet: run: file does not exist",
+		},
+		{
+			name:    "bad globals",
+			globals: starlet.StringAnyMap{"ch": make(chan int)},
+			code:    `x = 1`,
+			wantErr: "starlight: convert globals: type chan int is not a supported starlark type",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := starlet.NewWithNames(tt.globals, tt.preload, nil)
+			if tt.fs != nil {
+				m.SetScript("test.star", nil, tt.fs)
+			} else {
+				m.SetScript("test.star", []byte(tt.code), nil)
+			}
+			diags, err := m.Check()
+			if tt.wantErr != "" {
+				expectErr(t, err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				t.Errorf("expected no error, got %v", err)
+				return
+			}
+			if len(diags) != len(tt.wantDiags) {
+				t.Errorf("expected %d diagnostics, got %v", len(tt.wantDiags), diags)
+				return
+			}
+			for i, d := range diags {
+				if d.String() != tt.wantDiags[i] {
+					t.Errorf("expected diagnostic %q, got %q", tt.wantDiags[i], d.String())
+				}
+				if d.Kind != tt.wantKind {
+					t.Errorf("expected kind %v, got %v", tt.wantKind, d.Kind)
+				}
+			}
+
+			// compile returns the first problem
+			err = m.Compile()
+			if len(tt.wantDiags) == 0 {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+			expectErr(t, err, "starlark: compile: test.star:")
+			if !errors.Is(err, tt.wantKind) {
+				t.Errorf("expected error kind %v, got %v", tt.wantKind, err)
+			}
+		})
+	}
+}
+
+func TestMachine_Check_AfterRun(t *testing.T) {
+	m := starlet.NewDefault()
+	m.SetScript("test.star", []byte(`x = 1`), nil)
+	if _, err := m.Run(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+
+	// names from previous runs are predeclared
+	m.SetScript("test.star", []byte(`y = x + 1`), nil)
+	if diags, err := m.Check(); err != nil || len(diags) != 0 {
+		t.Errorf("expected no problem, got %v %v", diags, err)
+	}
+
+	// no script
+	m2 := starlet.NewDefault()
+	if _, err := m2.Check(); err == nil {
+		t.Errorf("expected error for no script, got nil")
+	}
+	if err := m2.Compile(); err == nil {
+		t.Errorf("expected error for no script, got nil")
+	}
+}
+
+func TestMachine_Compile_Cache(t *testing.T) {
+	sc := starlet.NewLRUCache(0, 0, 0)
+	m := starlet.NewWithGlobals(starlet.StringAnyMap{"a": 2})
+	m.SetScriptCache(sc)
+	m.SetScript("test.star", nil, MemFS{"test.star": `b = a * 3`})
+	if err := m.Compile(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if s := sc.Stats(); s.Entries != 1 || s.Hits != 0 {
+		t.Errorf("unexpected cache stats: %+v", s)
+	}
+
+	// run with the compiled program in cache
+	out, err := m.Run()
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if b := out["b"]; b != int64(6) {
+		t.Errorf("expected b=6, got %v", b)
+	}
+	if s := sc.Stats(); s.Entries != 1 || s.Hits != 1 {
+		t.Errorf("unexpected cache stats: %+v", s)
+	}
+
+	// no cache
+	m.SetScriptCache(nil)
+	m.SetPreloadModules(starlet.ModuleLoaderList{func() (starlark.StringDict, error) {
+		return nil, errors.New("oops")
+	}})
+	if err := m.Compile(); err != nil {
+		t.Errorf("expected no error with predeclared names of previous run, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http/cgi"
+	"net/http/fcgi"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/1set/starlet"
+)
+
+const (
+	// fastCGIStdin is the FastCGI address to accept the connections from the listener socket passed as stdin by the web server, e.g. mod_fcgid.
+	fastCGIStdin = "-"
+	// fastCGIUnixPrefix is the prefix of the FastCGI address for Unix domain sockets, e.g. unix:/run/starlet.sock.
+	fastCGIUnixPrefix = "unix:"
+)
+
+// runCGI handles the request from the CGI environment and stdin with the handler script, and writes the response to stdout as RFC 3875 describes.
+func runCGI(setCode func(m *starlet.Machine)) error {
+	tpl, err := newHandlerTemplate()
+	if err != nil {
+		return err
+	}
+	setCode(tpl)
+
+	// the errors are logged to stderr, which is collected by the web server
+	run := starlet.NewHTTPRunner(func() (*starlet.Machine, error) {
+		return tpl, nil
+	})
+	return cgi.Serve(newScriptHandler(run))
+}
+
+// runFastCGI serves the FastCGI requests on the address with the handler script until it's interrupted by SIGINT or SIGTERM.
+// The address is a TCP address, a Unix domain socket with the prefix "unix:", or "-" for the listener socket passed as stdin.
+func runFastCGI(addr string, setCode func(m *starlet.Machine)) error {
+	// prepare machines for concurrent requests
+	tpl, err := newHandlerTemplate()
+	if err != nil {
+		return err
+	}
+	setCode(tpl)
+	pool, err := starlet.NewMachinePool(tpl, runtime.NumCPU())
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+	h := newScriptHandler(pool.HTTPRunner())
+
+	// listen on stdin if the web server spawns the process with the socket
+	if addr == fastCGIStdin {
+		return fcgi.Serve(nil, h)
+	}
+	network := "tcp"
+	if strings.HasPrefix(addr, fastCGIUnixPrefix) {
+		network, addr = "unix", strings.TrimPrefix(addr, fastCGIUnixPrefix)
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+
+	// stop accepting connections on signals
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+
+	log.Printf("FastCGI server is starting on: %s %s\n", network, addr)
+	if err = fcgi.Serve(ln, h); err != nil && ctx.Err() != nil {
+		log.Println("FastCGI server is shutting down")
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/1set/starlet"
+)
+
+// serveCGI runs the handler script for the CGI request of the URI, and returns the output written to stdout.
+func serveCGI(t *testing.T, code, uri string) string {
+	env := map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "example.com",
+		"REQUEST_URI":     uri,
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+
+	out, err := ioutil.TempFile(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	err = runCGI(func(m *starlet.Machine) {
+		m.SetScript("cgi.star", []byte(code), nil)
+	})
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	b, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRunCGI(t *testing.T) {
+	// web servers may spawn CGI scripts without $HOME, e.g. env -i
+	t.Setenv("HOME", "")
+
+	tests := []struct {
+		name string
+		code string
+		uri  string
+		want []string
+	}{
+		{
+			name: "top-level",
+			code: `response.set_text("hello " + request.query["name"][0] + " on " + runtime.os)`,
+			uri:  "/cgi-bin/hello.star?name=world",
+			want: []string{"Status: 200 OK\r\n", "Content-Type: text/plain", "\r\n\r\nhello world on "},
+		},
+		{
+			name: "handle function",
+			code: "def handle(req, resp):\n    resp.set_status(201)\n    resp.set_json({\"path\": req.url})",
+			uri:  "/api",
+			want: []string{"Status: 201 Created\r\n", "Content-Type: application/json", `{"path":"http://example.com/api"}`},
+		},
+		{
+			name: "script error",
+			code: `fail("broken")`,
+			uri:  "/",
+			want: []string{"Status: 500 Internal Server Error\r\n", "Runtime Error: ", "fail: broken"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := serveCGI(t, tt.code, tt.uri)
+			for _, w := range tt.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("expected output contains %q, got %q", w, got)
+				}
+			}
+		})
+	}
+}
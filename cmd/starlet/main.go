@@ -2,6 +2,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"io/ioutil"
@@ -11,8 +12,10 @@ import (
 	"bitbucket.org/neiku/winornot"
 	"github.com/1set/gut/ystring"
 	"github.com/1set/starlet"
+	"github.com/1set/starlet/policy"
 	flag "github.com/spf13/pflag"
 	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
 	"golang.org/x/term"
 )
 
@@ -24,6 +27,17 @@ var (
 	includePath         string
 	codeContent         string
 	webPort             uint16
+	cgiMode             bool
+	fastCGIAddr         string
+	cacheDir            string
+	allowNet            []string
+	allowRead           []string
+	allowWrite          []string
+	allowEnv            []string
+	recordHTTP          string
+	replayHTTP          string
+	httpMatchHeaders    []string
+	historyFile         string
 )
 
 var (
@@ -38,16 +52,84 @@ func init() {
 	flag.StringVarP(&includePath, "include", "i", ".", "include path for Starlark code to load modules from")
 	flag.StringVarP(&codeContent, "code", "c", "", "Starlark code to execute")
 	flag.Uint16VarP(&webPort, "web", "w", 0, "run web server on specified port, it provides request&response structs for Starlark code to handle HTTP requests")
-	flag.Parse()
+	flag.BoolVar(&cgiMode, "cgi", false, "run as a CGI script, it reads the request from the CGI environment and stdin for Starlark code to handle, and writes the response to stdout")
+	flag.StringVar(&fastCGIAddr, "fastcgi", "", "run FastCGI server on the address, e.g. 127.0.0.1:9000, unix:/run/starlet.sock, or - for the socket passed as stdin by the web server")
+	flag.StringVar(&cacheDir, "cache", "", "directory to cache compiled Starlark programs across runs")
+	// any of the permission flags enables the policy, and the capabilities not allowed are denied
+	flag.StringSliceVar(&allowNet, "allow-net", nil, "allow network access to the hosts, e.g. --allow-net=example.com,*.example.org, or all hosts without value; any --allow-* flag denies the capabilities not allowed")
+	flag.StringSliceVar(&allowRead, "allow-read", nil, "allow reading the files and directories, e.g. --allow-read=./data, or all paths without value")
+	flag.StringSliceVar(&allowWrite, "allow-write", nil, "allow writing the files and directories, e.g. --allow-write=/tmp, or all paths without value")
+	flag.StringSliceVar(&allowEnv, "allow-env", nil, "allow accessing the environment variables, e.g. --allow-env=HOME,APP_*, or all variables without value")
+	flag.Lookup("allow-net").NoOptDefVal = policy.Any
+	flag.Lookup("allow-read").NoOptDefVal = string(filepath.Separator)
+	flag.Lookup("allow-write").NoOptDefVal = string(filepath.Separator)
+	flag.Lookup("allow-env").NoOptDefVal = policy.Any
+	flag.StringVar(&recordHTTP, "record-http", "", "record the HTTP exchanges of the http module to the cassette file")
+	flag.StringVar(&replayHTTP, "replay-http", "", "replay the HTTP exchanges of the http module from the cassette file without network access")
+	flag.StringVar(&historyFile, "history", defaultHistoryFile(), "file to save the REPL history, empty to disable")
+	flag.StringSliceVar(&httpMatchHeaders, "http-match-header", nil, "headers to match the requests in addition to method, URL and body when replaying HTTP exchanges")
 
 	// fix for Windows terminal output
 	winornot.EnableANSIControl()
 }
 
 func main() {
+	parseFlags(os.Args[1:])
 	os.Exit(processArgs())
 }
 
+// parseFlags parses the options in the arguments. The options can be anywhere in the arguments, except for
+// the scripts with main() and the serve command, whose arguments after the script name or the command are their own.
+// Like flag.Parse, it exits the program for invalid options.
+func parseFlags(args []string) {
+	// parse the options before the script name first
+	flag.CommandLine.SetInterspersed(false)
+	_ = flag.CommandLine.Parse(args)
+	rest := flag.Args()
+	if len(rest) == 0 || stopsAtDash(args, rest) || subcommand() == "serve" || declaresMain(rest[0]) {
+		return
+	}
+
+	// and then the options mixed with the rest
+	flag.CommandLine.SetInterspersed(true)
+	_ = flag.CommandLine.Parse(rest)
+}
+
+// stopsAtDash returns true if the parsing stops at the terminator "--" before the rest of the arguments.
+func stopsAtDash(args, rest []string) bool {
+	i := len(args) - len(rest) - 1
+	return i >= 0 && args[i] == "--"
+}
+
+// declaresMain returns true if the code from argument or the script file defines main() at the top level.
+func declaresMain(fileName string) bool {
+	var src interface{} = codeContent
+	if ystring.IsBlank(codeContent) {
+		bs, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return false
+		}
+		src = bs
+	}
+	f, err := syntax.LegacyFileOptions().Parse(fileName, src, 0)
+	if err != nil {
+		return false
+	}
+	for _, stmt := range f.Stmts {
+		switch s := stmt.(type) {
+		case *syntax.DefStmt:
+			if s.Name.Name == starlet.MainFuncName {
+				return true
+			}
+		case *syntax.AssignStmt:
+			if id, ok := s.LHS.(*syntax.Ident); ok && id.Name == starlet.MainFuncName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func processArgs() int {
 	// get starlet machine
 	mac := starlet.NewWithNames(nil, preloadModules, lazyLoadModules)
@@ -57,6 +139,24 @@ func processArgs() int {
 	if allowGlobalReassign {
 		mac.EnableGlobalReassign()
 	}
+	if ystring.IsNotBlank(cacheDir) {
+		sc, err := getScriptCache()
+		if err != nil {
+			PrintError(err)
+			return 1
+		}
+		mac.SetScriptCache(sc)
+	}
+	pol, err := getPolicy()
+	if err != nil {
+		PrintError(err)
+		return 1
+	}
+	mac.SetPolicy(pol)
+	if err := setHTTPRecorder(mac); err != nil {
+		PrintError(err)
+		return 1
+	}
 
 	// for local modules
 	var incFS fs.FS
@@ -67,15 +167,38 @@ func processArgs() int {
 	// check arguments
 	nargs := flag.NArg()
 	argCode := ystring.IsNotBlank(codeContent)
+	cmd := subcommand()
 	switch {
-	case webPort > 0:
-		// run web server
+	case cmd == "check":
+		// check scripts without running
+		setMachineExtras(mac, []string{``})
+		return checkScripts(mac, incFS, flag.Args()[1:])
+	case cmd == "serve":
+		// serve the directory of handler scripts
+		return serveCommand(flag.Args()[1:])
+	case cmd == "debug" && nargs >= 2:
+		// debug script interactively
+		setMachineExtras(mac, flag.Args()[1:])
+		return debugScript(mac, incFS, flag.Arg(1))
+	case webPort > 0 || cgiMode || fastCGIAddr != "":
+		// run web server or CGI
 		var setCode func(m *starlet.Machine)
 		if argCode {
 			// run code string from argument
 			setCode = func(m *starlet.Machine) {
 				m.SetScript("web.star", []byte(codeContent), incFS)
 			}
+		} else if nargs == 1 && cgiMode {
+			// run code from file read once, as the path of CGI scripts is usually absolute
+			fileName := flag.Arg(0)
+			bs, err := ioutil.ReadFile(fileName)
+			if err != nil {
+				PrintError(err)
+				return 1
+			}
+			setCode = func(m *starlet.Machine) {
+				m.SetScript(filepath.Base(fileName), bs, incFS)
+			}
 		} else if nargs == 1 {
 			// run code from file
 			fileName := flag.Arg(0)
@@ -87,8 +210,17 @@ func processArgs() int {
 			PrintError(fmt.Errorf("no code to run as web server"))
 			return 1
 		}
-		// start web server
-		if err := runWebServer(webPort, setCode); err != nil {
+		// start web server or handle the CGI request
+		var err error
+		switch {
+		case cgiMode:
+			err = runCGI(setCode)
+		case fastCGIAddr != "":
+			err = runFastCGI(fastCGIAddr, setCode)
+		default:
+			err = runWebServer(webPort, setCode)
+		}
+		if err != nil {
 			PrintError(err)
 			return 1
 		}
@@ -96,10 +228,11 @@ func processArgs() int {
 		// run code string from argument
 		setMachineExtras(mac, append([]string{`-c`}, flag.Args()...))
 		mac.SetScript("direct.star", []byte(codeContent), incFS)
-		_, err := mac.Run()
-		if err != nil {
-			PrintError(err)
-			return 1
+		if _, err := mac.Run(); err != nil {
+			return exitCodeOf(err)
+		}
+		if mac.HasMain() {
+			return runScriptMain(mac, "-c <code>", flag.Args())
 		}
 	case nargs == 0 && !argCode:
 		// run REPL
@@ -109,7 +242,7 @@ func processArgs() int {
 		}
 		setMachineExtras(mac, []string{``})
 		mac.SetScript("repl", nil, incFS)
-		mac.REPL()
+		mac.REPLWithConfig(starlet.REPLConfig{HistoryFile: historyFile})
 		if stdinIsTerminal {
 			fmt.Println()
 		}
@@ -124,8 +257,10 @@ func processArgs() int {
 		setMachineExtras(mac, flag.Args())
 		mac.SetScript(filepath.Base(fileName), bs, incFS)
 		if _, err := mac.Run(); err != nil {
-			PrintError(err)
-			return 1
+			return exitCodeOf(err)
+		}
+		if mac.HasMain() {
+			return runScriptMain(mac, fileName, flag.Args()[1:])
 		}
 	default:
 		flag.Usage()
@@ -134,6 +269,41 @@ func processArgs() int {
 	return 0
 }
 
+// subcommand returns the name of the subcommand in the arguments, or empty if the first argument is not a subcommand.
+// A script file with the same name takes precedence, e.g. "starlet check" runs the file ./check if it exists.
+func subcommand() string {
+	name := flag.Arg(0)
+	switch name {
+	case "check", "serve", "debug":
+	default:
+		return ""
+	}
+	if fi, err := os.Stat(name); err == nil && fi.Mode().IsRegular() {
+		return ""
+	}
+	return name
+}
+
+// defaultHistoryFile returns the default file to save the REPL history in the home directory, or empty if the home directory is unknown.
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".starlet_history")
+}
+
+// exitCodeOf returns the process exit code for the error of running script.
+// The exit code from exit() in the script is returned as is, and other errors are printed and return 1.
+func exitCodeOf(err error) int {
+	var ee starlet.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode()
+	}
+	PrintError(err)
+	return 1
+}
+
 // PrintError prints the error to stderr,
 // or its backtrace if it is a Starlark evaluation error.
 func PrintError(err error) {
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	flag "github.com/spf13/pflag"
+)
+
+func TestSubcommand(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "debug"), []byte(`print("script")`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "serve"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"check", "a.star"}, "check"},
+		{[]string{"serve", "."}, "serve"}, // directories don't shadow the subcommand
+		{[]string{"debug", "a.star"}, ""}, // the script file named debug takes precedence
+		{[]string{"run.star", "check"}, ""},
+	}
+	for _, tt := range tests {
+		if err := flag.CommandLine.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		if got := subcommand(); got != tt.want {
+			t.Errorf("subcommand(%v) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	dir := t.TempDir()
+	for name, code := range map[string]string{
+		"plain.star": `print(sys.argv)`,
+		"main.star":  "def main(name = \"\"):\n    print(name)",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plain, main := filepath.Join(dir, "plain.star"), filepath.Join(dir, "main.star")
+
+	tests := []struct {
+		name      string
+		args      []string
+		recursion bool
+		rest      []string
+	}{
+		{"options before script", []string{"-r", plain, "a"}, true, []string{plain, "a"}},
+		{"options after script", []string{plain, "-r", "a"}, true, []string{plain, "a"}},
+		{"options after dash", []string{"--", plain, "-r"}, false, []string{plain, "-r"}},
+		{"arguments for main", []string{main, "-r", "--name", "x"}, false, []string{main, "-r", "--name", "x"}},
+		{"options before main", []string{"-r", main, "--name", "x"}, true, []string{main, "--name", "x"}},
+		{"code with main", []string{"-c", "def main():\n    pass", "x", "-r"}, false, []string{"x", "-r"}},
+		{"serve command", []string{"serve", "-t", "1s", dir}, false, []string{"serve", "-t", "1s", dir}},
+		{"check command", []string{"check", "-r", plain}, true, []string{"check", plain}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowRecursion, codeContent = false, ""
+			parseFlags(tt.args)
+			if allowRecursion != tt.recursion {
+				t.Errorf("expected recursion %v, got %v", tt.recursion, allowRecursion)
+			}
+			if got := flag.Args(); strings.Join(got, " ") != strings.Join(tt.rest, " ") {
+				t.Errorf("expected arguments %q, got %q", tt.rest, got)
+			}
+		})
+	}
+}
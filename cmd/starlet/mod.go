@@ -2,59 +2,168 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/1set/gut/ystring"
 	"github.com/1set/starlet"
 	"github.com/1set/starlet/dataconv"
 	shttp "github.com/1set/starlet/lib/http"
+	"github.com/1set/starlet/policy"
+	flag "github.com/spf13/pflag"
 	"go.starlark.net/starlark"
 )
 
 func runWebServer(port uint16, setCode func(m *starlet.Machine)) error {
+	// prepare machines for concurrent requests
+	tpl, err := newHandlerTemplate()
+	if err != nil {
+		return err
+	}
+	setCode(tpl)
+	pool, err := starlet.NewMachinePool(tpl, runtime.NumCPU())
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// prepare envs
-		resp := shttp.NewServerResponse()
-		glb := starlet.StringAnyMap{
-			"request":  shttp.ConvertServerRequest(r),
-			"response": resp.Struct(),
-		}
+	mux.Handle("/", newScriptHandler(pool.HTTPRunner()))
 
-		// run code
-		mac := starlet.NewWithNames(glb, preloadModules, lazyLoadModules)
-		setCode(mac)
-		_, err := mac.Run()
+	log.Printf("Server is starting on port: %d\n", port)
+	return listenAndServe(&http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux, ReadHeaderTimeout: defaultReadHeaderTimeout}, defaultShutdownTimeout)
+}
 
-		// handle error
-		if err != nil {
-			log.Printf("Runtime Error: %v\n", err)
-			w.Header().Set("Content-Type", "text/plain")
-			w.WriteHeader(http.StatusInternalServerError)
-			if _, err := fmt.Fprintf(w, "Runtime Error: %v", err); err != nil {
-				log.Printf("Error writing response: %v", err)
+// newHandlerTemplate returns the Machine with the settings from the flags for running handler scripts, without the script.
+func newHandlerTemplate() (*starlet.Machine, error) {
+	sc, err := getScriptCache()
+	if err != nil {
+		return nil, err
+	}
+	tpl := starlet.NewWithNames(nil, preloadModules, lazyLoadModules)
+	tpl.SetScriptCache(sc)
+	if allowRecursion {
+		tpl.EnableRecursionSupport()
+	}
+	if allowGlobalReassign {
+		tpl.EnableGlobalReassign()
+	}
+	pol, err := getPolicy()
+	if err != nil {
+		return nil, err
+	}
+	tpl.SetPolicy(pol)
+	if err = setHTTPRecorder(tpl); err != nil {
+		return nil, err
+	}
+	return tpl, nil
+}
+
+// newScriptHandler returns the handler running the handler scripts by the runner, and the errors are logged and written as the error pages.
+func newScriptHandler(run shttp.Runner) http.Handler {
+	return shttp.NewHandler(run, shttp.WithErrorHandler(runtimeErrorPage), shttp.WithErrorLogger(logRuntimeError))
+}
+
+// runtimeErrorPage writes the error of the handler script as the error page.
+func runtimeErrorPage(w http.ResponseWriter, r *http.Request, code int, err error) {
+	http.Error(w, fmt.Sprintf("Runtime Error: %v", err), code)
+}
+
+// logRuntimeError logs the error of the handler script for the request.
+func logRuntimeError(r *http.Request, err error) {
+	log.Printf("Runtime Error: %s %s: %v\n", r.Method, r.URL.Path, err)
+}
+
+// getScriptCache returns the cache for compiled programs, it's on disk if the cache directory is set, otherwise in memory.
+func getScriptCache() (starlet.ByteCache, error) {
+	if ystring.IsBlank(cacheDir) {
+		return starlet.NewMemoryCache(), nil
+	}
+	return starlet.NewFileCache(cacheDir, 0)
+}
+
+// getPolicy returns the permission policy from the --allow-* flags, or nil to allow everything if none of them is set.
+// The paths are made absolute, and exit() is always allowed for the exit code.
+func getPolicy() (*policy.Policy, error) {
+	set := false
+	for _, name := range []string{"allow-net", "allow-read", "allow-write", "allow-env"} {
+		set = set || flag.CommandLine.Changed(name)
+	}
+	if !set {
+		return nil, nil
+	}
+	absPaths := func(paths []string) ([]string, error) {
+		res := make([]string, 0, len(paths))
+		for _, p := range paths {
+			abs, err := filepath.Abs(p)
+			if err != nil {
+				return nil, err
 			}
-			return
+			res = append(res, abs)
 		}
+		return res, nil
+	}
 
-		// handle response
-		if err = resp.Write(w); err != nil {
-			w.Header().Add("Content-Type", "text/plain")
-			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = w.Write([]byte(err.Error()))
+	pol := &policy.Policy{NetHosts: allowNet, EnvVars: allowEnv, Exit: true}
+	var err error
+	if pol.ReadPaths, err = absPaths(allowRead); err != nil {
+		return nil, err
+	}
+	if pol.WritePaths, err = absPaths(allowWrite); err != nil {
+		return nil, err
+	}
+	return pol, nil
+}
+
+var (
+	httpRecorder    *shttp.Recorder
+	httpRecorderErr error
+	httpRecorderSet sync.Once
+)
+
+// setHTTPRecorder replaces the http module of the machine with the one recording or replaying by the cassette from the flags, it does nothing if no cassette is set.
+// The recorder is shared by all machines.
+func setHTTPRecorder(m *starlet.Machine) error {
+	httpRecorderSet.Do(func() {
+		switch {
+		case recordHTTP != "" && replayHTTP != "":
+			httpRecorderErr = errors.New("cannot record and replay HTTP exchanges at the same time")
+		case recordHTTP != "":
+			httpRecorder, httpRecorderErr = shttp.NewRecorder(recordHTTP, shttp.ModeRecord, httpMatchHeaders...)
+		case replayHTTP != "":
+			httpRecorder, httpRecorderErr = shttp.NewRecorder(replayHTTP, shttp.ModeReplay, httpMatchHeaders...)
 		}
 	})
+	if httpRecorder == nil || httpRecorderErr != nil {
+		return httpRecorderErr
+	}
 
-	log.Printf("Server is starting on port: %d\n", port)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
-	if err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	// the added loader overrides the builtin http module of the same name
+	loader := shttp.NewModule(shttp.WithRecorder(httpRecorder)).LoadModule
+	for _, name := range preloadModules {
+		if name == shttp.ModuleName {
+			m.AddPreloadModules(starlet.ModuleLoaderList{loader})
+			break
+		}
 	}
-	return err
+	for _, name := range lazyLoadModules {
+		if name == shttp.ModuleName {
+			m.AddLazyloadModules(starlet.ModuleLoaderMap{shttp.ModuleName: loader})
+			break
+		}
+	}
+	return nil
 }
 
 func runWebServerLegacy(port uint16, setCode func(m *starlet.Machine)) error {
@@ -87,6 +196,248 @@ func runWebServerLegacy(port uint16, setCode func(m *starlet.Machine)) error {
 	return err
 }
 
+// checkScripts checks the given script files without running them, prints all the problems found, and returns the exit code.
+func checkScripts(m *starlet.Machine, incFS fs.FS, fileNames []string) int {
+	if len(fileNames) == 0 {
+		PrintError(fmt.Errorf("no script to check"))
+		return 1
+	}
+	failed := 0
+	for _, fileName := range fileNames {
+		bs, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			PrintError(err)
+			failed++
+			continue
+		}
+		m.SetScript(fileName, bs, incFS)
+		diags, err := m.Check()
+		if err != nil {
+			PrintError(err)
+			failed++
+			continue
+		}
+		for _, d := range diags {
+			fmt.Fprintln(os.Stderr, d)
+		}
+		if len(diags) > 0 {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// debugScript runs the given script file with an interactive debugger on stdin, it stops at the first line, and returns the exit code.
+func debugScript(m *starlet.Machine, incFS fs.FS, fileName string) int {
+	bs, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		PrintError(err)
+		return 1
+	}
+	scriptName := filepath.Base(fileName)
+	input := bufio.NewScanner(os.Stdin)
+	var dbg *starlet.Debugger
+	dbg = starlet.NewDebugger(func(s *starlet.DebugStop) starlet.DebugAction {
+		fmt.Fprintf(os.Stderr, "[%s] %s in %s\n", s.Reason, s.Pos, s.Function)
+		return debugPrompt(dbg, s, input, scriptName)
+	})
+	dbg.Pause()
+	m.SetDebugger(dbg)
+	m.SetScript(scriptName, bs, incFS)
+	if _, err := m.Run(); err != nil {
+		return exitCodeOf(err)
+	}
+	return 0
+}
+
+const debugHelp = `commands:
+  b, break [file:]line  set a breakpoint
+  d, delete [file:]line remove a breakpoint
+  s, step               step into the next line
+  n, next               step over to the next line
+  o, out                step out of the current function
+  c, continue           continue to the next breakpoint
+  l, locals             print local variables
+  g, globals            print global variables
+  p, print name         print a variable
+  bt, stack             print the call stack
+  q, quit               abort the script
+  h, help               print this help`
+
+// debugPrompt reads and handles the debugger commands from the input until an action to resume is given.
+func debugPrompt(dbg *starlet.Debugger, s *starlet.DebugStop, input *bufio.Scanner, scriptName string) starlet.DebugAction {
+	for {
+		fmt.Fprint(os.Stderr, "(debug) ")
+		if !input.Scan() {
+			// no more input, run to the end
+			return starlet.DebugContinue
+		}
+		fields := strings.Fields(input.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		cmd, args := fields[0], fields[1:]
+		switch cmd {
+		case "s", "step":
+			return starlet.DebugStepInto
+		case "n", "next":
+			return starlet.DebugStepOver
+		case "o", "out":
+			return starlet.DebugStepOut
+		case "c", "continue":
+			return starlet.DebugContinue
+		case "q", "quit":
+			return starlet.DebugAbort
+		case "b", "break", "d", "delete":
+			if len(args) != 1 {
+				fmt.Fprintln(os.Stderr, "usage:", cmd, "[file:]line")
+				continue
+			}
+			file, line, err := parseBreakpoint(args[0], scriptName)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			if cmd == "b" || cmd == "break" {
+				dbg.SetBreakpoint(file, line)
+				fmt.Fprintf(os.Stderr, "breakpoint set at %s:%d\n", file, line)
+			} else if dbg.ClearBreakpoint(file, line) {
+				fmt.Fprintf(os.Stderr, "breakpoint removed at %s:%d\n", file, line)
+			} else {
+				fmt.Fprintf(os.Stderr, "no breakpoint at %s:%d\n", file, line)
+			}
+		case "l", "locals":
+			printStringDict(s.Locals())
+		case "g", "globals":
+			printStringDict(s.Globals())
+		case "p", "print":
+			for _, name := range args {
+				if v, ok := s.Lookup(name); ok {
+					fmt.Fprintf(os.Stderr, "%s = %s\n", name, v)
+				} else {
+					fmt.Fprintf(os.Stderr, "%s is not defined\n", name)
+				}
+			}
+		case "bt", "stack":
+			for _, fr := range s.Stack() {
+				fmt.Fprintf(os.Stderr, "  %s: in %s\n", fr.Pos, fr.Name)
+			}
+		case "h", "help":
+			fmt.Fprintln(os.Stderr, debugHelp)
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command: %s, type h for help\n", cmd)
+		}
+	}
+}
+
+// parseBreakpoint parses the breakpoint in the format of [file:]line, the file defaults to the script name.
+func parseBreakpoint(s, scriptName string) (string, int, error) {
+	file, lineStr := scriptName, s
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		file, lineStr = s[:i], s[i+1:]
+	}
+	line, err := strconv.Atoi(lineStr)
+	if err != nil || line <= 0 {
+		return "", 0, fmt.Errorf("invalid line number: %s", lineStr)
+	}
+	return file, line, nil
+}
+
+// printStringDict prints the variables in the dict sorted by name.
+func printStringDict(d starlark.StringDict) {
+	for _, k := range d.Keys() {
+		fmt.Fprintf(os.Stderr, "%s = %s\n", k, d[k])
+	}
+}
+
+// runScriptMain calls the entrypoint function of the script after the run, with the arguments parsed as flags by the parameter schema, and returns the exit code.
+// The parameter names are used as flag names with underscores replaced by dashes, e.g. "dry_run" for --dry-run.
+func runScriptMain(m *starlet.Machine, script string, args []string) int {
+	params, err := m.Params()
+	if err != nil {
+		PrintError(err)
+		return 1
+	}
+
+	// build flags from the schema
+	fset := flag.NewFlagSet(script, flag.ContinueOnError)
+	fset.SortFlags = false
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: starlet [options] %s [flags]\n", script)
+		if len(params) > 0 {
+			fmt.Fprintf(os.Stderr, "\nFlags:\n%s", fset.FlagUsages())
+		}
+	}
+	values := make(map[string]func() interface{}, len(params))
+	for _, p := range params {
+		name := strings.ReplaceAll(p.Name, "_", "-")
+		usage := p.Help
+		if p.Required {
+			usage = strings.TrimSpace(usage + " (required)")
+		}
+		switch p.Type {
+		case starlet.ParamInt:
+			def, _ := p.Default.(int64)
+			if i, ok := p.Default.(int); ok {
+				def = int64(i)
+			}
+			v := fset.Int64(name, def, usage)
+			values[p.Name] = func() interface{} { return *v }
+		case starlet.ParamFloat:
+			def, _ := p.Default.(float64)
+			v := fset.Float64(name, def, usage)
+			values[p.Name] = func() interface{} { return *v }
+		case starlet.ParamBool:
+			def, _ := p.Default.(bool)
+			v := fset.Bool(name, def, usage)
+			values[p.Name] = func() interface{} { return *v }
+		case starlet.ParamList:
+			var def []string
+			if l, ok := p.Default.([]interface{}); ok {
+				for _, e := range l {
+					def = append(def, fmt.Sprint(e))
+				}
+			}
+			v := fset.StringSlice(name, def, usage)
+			values[p.Name] = func() interface{} { return *v }
+		default:
+			def, _ := p.Default.(string)
+			v := fset.String(name, def, usage)
+			values[p.Name] = func() interface{} { return *v }
+		}
+	}
+
+	// parse flags, and only pass the given ones, so the schema fills the defaults and checks the required
+	if err = fset.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		PrintError(err)
+		fset.Usage()
+		return 2
+	}
+	if fset.NArg() > 0 {
+		PrintError(fmt.Errorf("unexpected arguments: %s", strings.Join(fset.Args(), " ")))
+		fset.Usage()
+		return 2
+	}
+	kwargs := make(starlet.StringAnyMap, len(values))
+	for _, p := range params {
+		if fset.Changed(strings.ReplaceAll(p.Name, "_", "-")) {
+			kwargs[p.Name] = values[p.Name]()
+		}
+	}
+
+	// call the entrypoint
+	if _, err = m.CallMain(context.Background(), kwargs); err != nil {
+		return exitCodeOf(err)
+	}
+	return 0
+}
+
 func setMachineExtras(m *starlet.Machine, args []string) {
 	sysLoader := loadSysModule(args)
 	m.AddPreloadModules(starlet.ModuleLoaderList{sysLoader})
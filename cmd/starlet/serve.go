@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/1set/starlet"
+	shttp "github.com/1set/starlet/lib/http"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	// defaultShutdownTimeout is the default time to wait for the active requests on shutdown.
+	defaultShutdownTimeout = 10 * time.Second
+	// defaultReadHeaderTimeout is the time to read the request headers, so slow clients can't hold the connections forever.
+	defaultReadHeaderTimeout = 10 * time.Second
+	// routeParamPrefix and routeParamSuffix enclose the names of the path parameters in the file names, e.g. users/[id].star.
+	routeParamPrefix = "["
+	routeParamSuffix = "]"
+)
+
+var (
+	// routeMethods are the HTTP methods can be used as the suffix of the file names, e.g. users.post.star.
+	routeMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+)
+
+// serveCommand parses the arguments of the serve command, and serves the directory of handler scripts until it's shut down, then returns the exit code.
+func serveCommand(args []string) int {
+	var (
+		addr            string
+		timeout         time.Duration
+		shutdownTimeout time.Duration
+		reloadInterval  time.Duration
+		accessLog       string
+	)
+	fset := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fset.SortFlags = false
+	fset.StringVarP(&addr, "addr", "a", ":8080", "address to listen on")
+	fset.DurationVarP(&timeout, "timeout", "t", 30*time.Second, "timeout of each request, 0 for no timeout")
+	fset.DurationVar(&shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "time to wait for the active requests on shutdown")
+	fset.DurationVar(&reloadInterval, "reload-interval", time.Second, "interval to check the handler files for changes, 0 to disable hot reload")
+	fset.StringVar(&accessLog, "access-log", "-", "file to append the access logs to, - for stderr, empty to disable")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: starlet [options] serve [flags] <dir>\n\n")
+		fmt.Fprintf(os.Stderr, "Serve the .star handler files in the directory, mapped to URL paths by file names:\n")
+		fmt.Fprintf(os.Stderr, "  index.star -> /, users.star -> /users, users/[id].star -> /users/{id}, users.post.star -> POST /users\n")
+		fmt.Fprintf(os.Stderr, "Files and directories starting with _ are not served, e.g. _lib.star for load().\n")
+		fmt.Fprintf(os.Stderr, "Handlers can define handle(request, response) with before_request and after_request hooks instead of top-level code.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n%s", fset.FlagUsages())
+	}
+	if err := fset.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		PrintError(err)
+		fset.Usage()
+		return 2
+	}
+	if fset.NArg() != 1 {
+		PrintError(fmt.Errorf("serve requires exactly one directory of handlers"))
+		fset.Usage()
+		return 2
+	}
+
+	// access logs
+	var logger *log.Logger
+	switch accessLog {
+	case "":
+	case "-":
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	default:
+		f, err := os.OpenFile(accessLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			PrintError(err)
+			return 1
+		}
+		defer f.Close()
+		logger = log.New(f, "", log.LstdFlags)
+	}
+
+	if err := runServe(fset.Arg(0), addr, timeout, shutdownTimeout, reloadInterval, logger); err != nil {
+		PrintError(err)
+		return 1
+	}
+	return 0
+}
+
+// runServe serves the directory of handler scripts with the routes reloaded on changes, and shuts down gracefully on SIGINT or SIGTERM.
+func runServe(dir, addr string, timeout, shutdownTimeout, reloadInterval time.Duration, accessLogger *log.Logger) error {
+	rt, err := newRouter(dir)
+	if err != nil {
+		return err
+	}
+
+	// machines shared by all routes, the handler script is set for each request
+	tpl, err := newHandlerTemplate()
+	if err != nil {
+		return err
+	}
+	pool, err := starlet.NewMachinePool(tpl, runtime.NumCPU())
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	var h http.Handler = &routeHandler{router: rt, pool: pool, fsys: os.DirFS(dir), timeout: timeout}
+	if accessLogger != nil {
+		h = withAccessLog(accessLogger, h)
+	}
+
+	// hot reload the routes
+	done := make(chan struct{})
+	defer close(done)
+	if reloadInterval > 0 {
+		go rt.watch(reloadInterval, done)
+	}
+
+	for _, r := range rt.list() {
+		log.Printf("Route: %s\n", r)
+	}
+	log.Printf("Server is starting on: %s\n", addr)
+	return listenAndServe(&http.Server{Addr: addr, Handler: h, ReadHeaderTimeout: defaultReadHeaderTimeout}, shutdownTimeout)
+}
+
+// listenAndServe serves until it fails to listen, or shuts down gracefully on SIGINT or SIGTERM by waiting for the active requests up to the timeout.
+func listenAndServe(srv *http.Server, shutdownTimeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Server is shutting down")
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(sctx)
+}
+
+// route is a handler script mapped to the URL path pattern and method.
+type route struct {
+	segments []string
+	method   string
+	file     string
+}
+
+func (r *route) String() string {
+	method := r.method
+	if method == "" {
+		method = "*"
+	}
+	return fmt.Sprintf("%s /%s -> %s", method, strings.Join(r.segments, "/"), r.file)
+}
+
+// isParam reports whether the segment of the pattern is a path parameter.
+func isParam(seg string) bool {
+	return strings.HasPrefix(seg, routeParamPrefix) && strings.HasSuffix(seg, routeParamSuffix)
+}
+
+// newRoute creates the route of the file by its slash-separated path relative to the directory.
+func newRoute(file string) *route {
+	name := strings.TrimSuffix(file, ".star")
+	r := &route{file: file}
+
+	// the method suffix of the base name
+	dir, base := path.Split(name)
+	if i := strings.LastIndex(base, "."); i > 0 {
+		for _, m := range routeMethods {
+			if strings.EqualFold(base[i+1:], m) {
+				r.method, base = m, base[:i]
+				break
+			}
+		}
+	}
+
+	// the path segments without index
+	for _, seg := range strings.Split(dir+base, "/") {
+		if seg != "" {
+			r.segments = append(r.segments, seg)
+		}
+	}
+	if n := len(r.segments); n > 0 && r.segments[n-1] == "index" {
+		r.segments = r.segments[:n-1]
+	}
+	return r
+}
+
+// match returns the path parameters if the route matches the path segments.
+func (r *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, seg := range r.segments {
+		if isParam(seg) {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[seg[len(routeParamPrefix):len(seg)-len(routeParamSuffix)]] = segments[i]
+		} else if seg != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// lessSpecific reports whether the route should be matched after the other one: static segments take precedence over parameters, and methods over any method.
+func (r *route) lessSpecific(o *route) bool {
+	for i := 0; i < len(r.segments) && i < len(o.segments); i++ {
+		if p, q := isParam(r.segments[i]), isParam(o.segments[i]); p != q {
+			return p
+		}
+	}
+	return r.method == "" && o.method != ""
+}
+
+// router maps the requests to the handler scripts in the directory, the routes are reloaded on changes of the files.
+type router struct {
+	dir    string
+	mu     sync.RWMutex
+	routes []*route
+	sig    string
+}
+
+// newRouter creates a router with the routes of the handler scripts in the directory.
+func newRouter(dir string) (*router, error) {
+	rt := &router{dir: dir}
+	if _, err := rt.reload(); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// scan returns the routes of the handler scripts in the directory, and the signature of the files for detecting changes.
+func (rt *router) scan() ([]*route, string, error) {
+	var (
+		routes []*route
+		sig    strings.Builder
+		seen   = make(map[string]string)
+	)
+	err := filepath.Walk(rt.dir, func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != rt.dir && strings.HasPrefix(info.Name(), "_") && info.IsDir() {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || filepath.Ext(p) != ".star" {
+			return nil
+		}
+		rel, err := filepath.Rel(rt.dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		fmt.Fprintf(&sig, "%s:%d:%d\n", rel, info.Size(), info.ModTime().UnixNano())
+		if strings.HasPrefix(info.Name(), "_") {
+			return nil
+		}
+
+		r := newRoute(rel)
+		key := r.method + " /" + strings.Join(r.segments, "/")
+		if prev, ok := seen[key]; ok {
+			return fmt.Errorf("duplicate route %s for %s and %s", key, prev, rel)
+		}
+		seen[key] = rel
+		routes = append(routes, r)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[j].lessSpecific(routes[i])
+	})
+	return routes, sig.String(), nil
+}
+
+// reload scans the directory again, and replaces the routes if any file is changed, it reports whether the routes are replaced.
+// The routes are kept on errors, e.g. duplicate routes.
+func (rt *router) reload() (bool, error) {
+	routes, sig, err := rt.scan()
+	if err != nil {
+		return false, err
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if sig == rt.sig {
+		return false, nil
+	}
+	rt.routes, rt.sig = routes, sig
+	return true, nil
+}
+
+// watch reloads the routes at the interval until the done channel is closed.
+func (rt *router) watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if changed, err := rt.reload(); err != nil {
+				log.Printf("Reload Error: %v\n", err)
+			} else if changed {
+				log.Printf("Handlers reloaded with %d routes\n", len(rt.list()))
+			}
+		}
+	}
+}
+
+// list returns the current routes.
+func (rt *router) list() []*route {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.routes
+}
+
+// match returns the most specific route for the method and path with its path parameters,
+// or the allowed methods of the path if no route matches the method.
+func (rt *router) match(method, urlPath string) (*route, map[string]string, []string) {
+	var segments []string
+	for _, seg := range strings.Split(urlPath, "/") {
+		if seg != "" {
+			segments = append(segments, seg)
+		}
+	}
+	var allowed []string
+	for _, r := range rt.list() {
+		params, ok := r.match(segments)
+		if !ok {
+			continue
+		}
+		if r.method == "" || r.method == method {
+			return r, params, nil
+		}
+		allowed = append(allowed, r.method)
+	}
+	return nil, nil, allowed
+}
+
+// routeHandler runs the handler script of the matched route for each request.
+type routeHandler struct {
+	router  *router
+	pool    *starlet.MachinePool
+	fsys    fs.FS
+	timeout time.Duration
+}
+
+func (h *routeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt, params, allowed := h.router.match(r.Method, r.URL.Path)
+	if rt == nil {
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	// run the handler script of the route with the params
+	run := func(ctx context.Context, fn func(e shttp.Executor) error) error {
+		// the scripts from the file system are cached by names, so the content is set for the changes to be compiled again
+		code, err := fs.ReadFile(h.fsys, rt.file)
+		if err != nil {
+			return err
+		}
+		return h.pool.Do(ctx, func(mac *starlet.Machine) error {
+			mac.SetScript(rt.file, code, h.fsys)
+			return fn(mac.HTTPExecutor())
+		})
+	}
+	r = shttp.WithPathParams(r.WithContext(ctx), params)
+	newScriptHandler(run).ServeHTTP(w, r)
+}
+
+// withAccessLog logs the requests handled by the handler, with the status code, size and duration.
+func withAccessLog(logger *log.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		logger.Printf("%s %q %d %d %s\n", r.RemoteAddr, r.Method+" "+r.URL.RequestURI()+" "+r.Proto, sw.status, sw.size, time.Since(start))
+	})
+}
+
+// statusWriter records the status code and size of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Flush flushes the streamed response if the underlying writer supports it.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/1set/starlet"
+)
+
+// writeHandlers writes the handler files into the directory, with the names in slash-separated paths.
+func writeHandlers(t *testing.T, dir string, files map[string]string) {
+	for name, code := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// listRoutes returns the current routes of the router as strings.
+func listRoutes(rt *router) string {
+	var ss []string
+	for _, r := range rt.list() {
+		ss = append(ss, r.String())
+	}
+	return strings.Join(ss, "|")
+}
+
+func TestNewRoute(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"index.star", "* / -> index.star"},
+		{"users.star", "* /users -> users.star"},
+		{"users/index.star", "* /users -> users/index.star"},
+		{"users/[id].star", "* /users/[id] -> users/[id].star"},
+		{"users.post.star", "POST /users -> users.post.star"},
+		{"users/index.get.star", "GET /users -> users/index.get.star"},
+		{"items/[id].Delete.star", "DELETE /items/[id] -> items/[id].Delete.star"},
+		{"api/v1.2.star", "* /api/v1.2 -> api/v1.2.star"},
+	}
+	for _, tt := range tests {
+		if got := newRoute(tt.file).String(); got != tt.want {
+			t.Errorf("newRoute(%q) = %q, want %q", tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestRoute_Match(t *testing.T) {
+	tests := []struct {
+		file   string
+		path   []string
+		ok     bool
+		params map[string]string
+	}{
+		{"index.star", nil, true, nil},
+		{"index.star", []string{"users"}, false, nil},
+		{"users.star", []string{"users"}, true, nil},
+		{"users.star", []string{"posts"}, false, nil},
+		{"users/[id].star", []string{"users", "42"}, true, map[string]string{"id": "42"}},
+		{"users/[id].star", []string{"users"}, false, nil},
+		{"users/[id].star", []string{"posts", "42"}, false, nil},
+		{"users/[id]/posts/[pid].star", []string{"users", "1", "posts", "2"}, true, map[string]string{"id": "1", "pid": "2"}},
+	}
+	for _, tt := range tests {
+		params, ok := newRoute(tt.file).match(tt.path)
+		if ok != tt.ok {
+			t.Errorf("route %q matches %v: expected %v, got %v", tt.file, tt.path, tt.ok, ok)
+			continue
+		}
+		if len(params) != len(tt.params) {
+			t.Errorf("route %q matches %v: expected params %v, got %v", tt.file, tt.path, tt.params, params)
+			continue
+		}
+		for k, v := range tt.params {
+			if params[k] != v {
+				t.Errorf("route %q matches %v: expected params %v, got %v", tt.file, tt.path, tt.params, params)
+				break
+			}
+		}
+	}
+}
+
+func TestRoute_LessSpecific(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"users/[id].star", "users/me.star", true},
+		{"users/me.star", "users/[id].star", false},
+		{"users.star", "users.get.star", true},
+		{"users.get.star", "users.star", false},
+		{"users.get.star", "users.post.star", false},
+		{"[a]/me.star", "users/[id].star", true},
+		{"users/[id].star", "users/[id].star", false},
+	}
+	for _, tt := range tests {
+		if got := newRoute(tt.a).lessSpecific(newRoute(tt.b)); got != tt.want {
+			t.Errorf("%q less specific than %q: expected %v, got %v", tt.a, tt.b, tt.want, got)
+		}
+	}
+}
+
+func TestRouter_Reload(t *testing.T) {
+	dir := t.TempDir()
+	writeHandlers(t, dir, map[string]string{
+		"index.star":        `response.set_text("home")`,
+		"users/[id].star":   `response.set_text("user")`,
+		"users/me.star":     `response.set_text("me")`,
+		"_lib.star":         `x = 1`,
+		"_private/key.star": `x = 2`,
+		"notes.txt":         `not a handler`,
+	})
+
+	rt, err := newRouter(dir)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	exp := "* / -> index.star|* /users/me -> users/me.star|* /users/[id] -> users/[id].star"
+	if act := listRoutes(rt); act != exp {
+		t.Errorf("unexpected routes: %s", act)
+	}
+
+	// no changes
+	if changed, err := rt.reload(); err != nil || changed {
+		t.Errorf("expected no changes, got %v, %v", changed, err)
+	}
+
+	// changes of the private files also reload, as they can be loaded by handlers
+	writeHandlers(t, dir, map[string]string{"_lib.star": `x = 100`})
+	if changed, err := rt.reload(); err != nil || !changed {
+		t.Errorf("expected changes, got %v, %v", changed, err)
+	}
+
+	// new routes
+	writeHandlers(t, dir, map[string]string{"users.post.star": `response.set_status(201)`})
+	if changed, err := rt.reload(); err != nil || !changed {
+		t.Errorf("expected changes, got %v, %v", changed, err)
+	}
+	exp = "POST /users -> users.post.star|* / -> index.star|* /users/me -> users/me.star|* /users/[id] -> users/[id].star"
+	if act := listRoutes(rt); act != exp {
+		t.Errorf("unexpected routes: %s", act)
+	}
+
+	// duplicate routes keep the previous ones
+	writeHandlers(t, dir, map[string]string{"users/index.post.star": `response.set_status(202)`})
+	if changed, err := rt.reload(); err == nil || changed {
+		t.Errorf("expected duplicate route error, got %v, %v", changed, err)
+	} else if !strings.Contains(err.Error(), "duplicate route POST /users") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if act := listRoutes(rt); act != exp {
+		t.Errorf("unexpected routes: %s", act)
+	}
+}
+
+func TestRouteHandler(t *testing.T) {
+	dir := t.TempDir()
+	writeHandlers(t, dir, map[string]string{
+		"index.star":       `response.set_text("home")`,
+		"users/[id].star":  `response.set_text("user " + request.params["id"])`,
+		"users/me.star":    `response.set_text("me")`,
+		"users.post.star":  "def handle(req, resp):\n    resp.set_status(201)\n    resp.set_json({\"method\": req.method})",
+		"broken.star":      `fail("broken")`,
+		"_lib.star":        `x = 1`,
+		"items.get.star":   `response.set_text("items")`,
+		"items.patch.star": `response.set_text("patched")`,
+	})
+	rt, err := newRouter(dir)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	tpl, err := newHandlerTemplate()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pool, err := starlet.NewMachinePool(tpl, runtime.NumCPU())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer pool.Close()
+	srv := httptest.NewServer(&routeHandler{router: rt, pool: pool, fsys: os.DirFS(dir)})
+	defer srv.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+		body   string
+		allow  string
+	}{
+		{http.MethodGet, "/", http.StatusOK, "home", ""},
+		{http.MethodGet, "/users/42", http.StatusOK, "user 42", ""},
+		{http.MethodGet, "/users/me", http.StatusOK, "me", ""},
+		{http.MethodPost, "/users", http.StatusCreated, `{"method":"POST"}`, ""},
+		{http.MethodGet, "/users", http.StatusMethodNotAllowed, "Method Not Allowed", "POST"},
+		{http.MethodDelete, "/items", http.StatusMethodNotAllowed, "Method Not Allowed", "GET, PATCH"},
+		{http.MethodGet, "/_lib", http.StatusNotFound, "404 page not found", ""},
+		{http.MethodGet, "/missing", http.StatusNotFound, "404 page not found", ""},
+		{http.MethodGet, "/broken", http.StatusInternalServerError, "fail: broken", ""},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("%s %s: expected no error, got %v", tt.method, tt.path, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.code, resp.StatusCode)
+		}
+		if !strings.Contains(string(body), tt.body) {
+			t.Errorf("%s %s: expected body contains %q, got %q", tt.method, tt.path, tt.body, body)
+		}
+		if allow := resp.Header.Get("Allow"); allow != tt.allow {
+			t.Errorf("%s %s: expected Allow %q, got %q", tt.method, tt.path, tt.allow, allow)
+		}
+	}
+}
+
+func TestRouteHandler_Reload(t *testing.T) {
+	dir := t.TempDir()
+	writeHandlers(t, dir, map[string]string{
+		"users.star": "load(\"_lib.star\", \"x\")\nresponse.set_text(\"v1 %d\" % x)",
+		"_lib.star":  `x = 1`,
+	})
+	rt, err := newRouter(dir)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	tpl, err := newHandlerTemplate()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pool, err := starlet.NewMachinePool(tpl, 1)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer pool.Close()
+	h := &routeHandler{router: rt, pool: pool, fsys: os.DirFS(dir)}
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users", nil))
+		return rec.Body.String()
+	}
+	if body := get(); body != "v1 1" {
+		t.Errorf("unexpected body: %q", body)
+	}
+
+	// the changed handler and module are picked up by the same machine with the script cache
+	writeHandlers(t, dir, map[string]string{
+		"users.star": "load(\"_lib.star\", \"x\")\nresponse.set_text(\"v2 %d\" % x)",
+		"_lib.star":  `x = 2`,
+	})
+	if _, err := rt.reload(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if body := get(); body != "v2 2" {
+		t.Errorf("unexpected body: %q", body)
+	}
+}
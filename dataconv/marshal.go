@@ -49,6 +49,8 @@ func Marshal(data interface{}) (v starlark.Value, err error) {
 		v = starlark.Float(x)
 	case time.Time:
 		v = startime.Time(x)
+	case time.Duration:
+		v = startime.Duration(x)
 	case []interface{}:
 		var elems = make([]starlark.Value, len(x))
 		for i, val := range x {
@@ -162,6 +164,8 @@ func Unmarshal(x starlark.Value) (val interface{}, err error) {
 		val = string(v)
 	case startime.Time:
 		val = time.Time(v)
+	case startime.Duration:
+		val = time.Duration(v)
 	case *starlark.Dict:
 		var (
 			dictVal starlark.Value
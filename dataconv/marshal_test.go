@@ -84,6 +84,7 @@ func TestMarshal(t *testing.T) {
 		{42., starlark.Float(42), ""},
 		{time.Unix(1588540633, 0), startime.Time(time.Unix(1588540633, 0)), ""},
 		{now, startime.Time(now), ""},
+		{time.Minute, startime.Duration(time.Minute), ""},
 		{[]byte("Aloha"), starlark.Bytes("Aloha"), ""},
 		{[]string{"hello", "world"}, starlark.NewList([]starlark.Value{starlark.String("hello"), starlark.String("world")}), ""},
 		{[]interface{}{42}, starlark.NewList([]starlark.Value{starlark.MakeInt(42)}), ""},
@@ -254,6 +255,7 @@ func TestUnmarshal(t *testing.T) {
 		{starlark.Float(0), 0., ""},
 		{startime.Time(time.Unix(1588540633, 0)), time.Unix(1588540633, 0), ""},
 		{startime.Time(now), now, ""},
+		{startime.Duration(time.Minute), time.Minute, ""},
 		{starlark.NewList([]starlark.Value{starlark.MakeInt(42)}), []interface{}{42}, ""},
 		{strDict, map[string]interface{}{"foo": 42}, ""},
 		{intDict, map[interface{}]interface{}{42 * 2: 42}, ""},
@@ -0,0 +1,367 @@
+package starlet
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// DebugAction is the action to resume the execution after the debugger stops.
+type DebugAction int
+
+const (
+	// DebugContinue resumes the execution until the next breakpoint or pause.
+	DebugContinue DebugAction = iota
+	// DebugStepInto resumes the execution and stops at the next line, including the lines in the functions called.
+	DebugStepInto
+	// DebugStepOver resumes the execution and stops at the next line of the current function or its callers.
+	DebugStepOver
+	// DebugStepOut resumes the execution and stops at the next line of the callers of the current function.
+	DebugStepOut
+	// DebugAbort cancels the execution of the script.
+	DebugAbort
+)
+
+// DebugStopReason is the reason why the debugger stops.
+type DebugStopReason string
+
+const (
+	// StopBreakpoint means the execution reaches a breakpoint.
+	StopBreakpoint DebugStopReason = "breakpoint"
+	// StopStep means the execution reaches the next line after a step action.
+	StopStep DebugStopReason = "step"
+	// StopPause means the execution is paused by Debugger.Pause.
+	StopPause DebugStopReason = "pause"
+)
+
+// ErrDebugAborted indicates the run is aborted by the debugger with DebugAbort.
+var ErrDebugAborted = errors.New("aborted by debugger")
+
+// Breakpoint is a location in the script to stop the execution at.
+type Breakpoint struct {
+	// File is the file name of the script, it matches either the full name or the base name of the file.
+	File string
+	// Line is the line number in the file, starting from 1.
+	Line int
+}
+
+// Debugger stops the execution of scripts run by Machine at breakpoints or steps, and lets the caller inspect the state and decide how to resume.
+// The execution stops when it reaches a new line of the script, i.e. after the first instruction of the line is executed, which usually loads a value.
+// Lines are as precise as the line table of compiled Starlark code, so a function stops at the line of def on entry,
+// and simple statements like assignments of constants may be attributed to the previous line.
+//
+// It's safe for concurrent use, but it should be set to only one machine at a time, since the stops of multiple scripts are indistinguishable.
+// Like Hooks, it observes every execution step of the script, so the execution is noticeably slower with it set.
+type Debugger struct {
+	onStop      func(s *DebugStop) DebugAction
+	mu          sync.Mutex
+	breakpoints map[Breakpoint]struct{}
+	pause       bool
+}
+
+// NewDebugger creates a new Debugger with the callback to be called when the execution stops.
+// The callback is called synchronously on the goroutine running the script, and the execution resumes with the action it returns.
+func NewDebugger(onStop func(s *DebugStop) DebugAction) *Debugger {
+	return &Debugger{
+		onStop:      onStop,
+		breakpoints: make(map[Breakpoint]struct{}),
+	}
+}
+
+// SetBreakpoint adds a breakpoint at the given line of the file.
+func (d *Debugger) SetBreakpoint(file string, line int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.breakpoints[Breakpoint{File: file, Line: line}] = struct{}{}
+}
+
+// ClearBreakpoint removes the breakpoint at the given line of the file, and returns true if it exists.
+func (d *Debugger) ClearBreakpoint(file string, line int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	bp := Breakpoint{File: file, Line: line}
+	if _, ok := d.breakpoints[bp]; !ok {
+		return false
+	}
+	delete(d.breakpoints, bp)
+	return true
+}
+
+// ClearAllBreakpoints removes all the breakpoints.
+func (d *Debugger) ClearAllBreakpoints() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.breakpoints = make(map[Breakpoint]struct{})
+}
+
+// Breakpoints returns all the breakpoints sorted by file and line.
+func (d *Debugger) Breakpoints() []Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	bps := make([]Breakpoint, 0, len(d.breakpoints))
+	for bp := range d.breakpoints {
+		bps = append(bps, bp)
+	}
+	sort.Slice(bps, func(i, j int) bool {
+		if bps[i].File != bps[j].File {
+			return bps[i].File < bps[j].File
+		}
+		return bps[i].Line < bps[j].Line
+	})
+	return bps
+}
+
+// Pause stops the execution at the next line of the running script, or at the first line of the next run if no script is running.
+func (d *Debugger) Pause() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.pause = true
+}
+
+// takePause returns true and clears the pause request if the pause is requested.
+func (d *Debugger) takePause() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p := d.pause
+	d.pause = false
+	return p
+}
+
+// hasBreakpoint returns true if there's a breakpoint at the given position.
+func (d *Debugger) hasBreakpoint(pos syntax.Position) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.breakpoints) == 0 {
+		return false
+	}
+	line := int(pos.Line)
+	if _, ok := d.breakpoints[Breakpoint{File: pos.Filename(), Line: line}]; ok {
+		return true
+	}
+	_, ok := d.breakpoints[Breakpoint{File: filepath.Base(pos.Filename()), Line: line}]
+	return ok
+}
+
+// DebugStop describes the state of the script when the debugger stops, and it's only valid until the callback returns.
+type DebugStop struct {
+	// Reason is the reason why the execution stops.
+	Reason DebugStopReason
+	// Pos is the position of the current line.
+	Pos syntax.Position
+	// Function is the name of the current function, e.g. "<toplevel>" for the top level of the script.
+	Function string
+	// Depth is the depth of the current function in the call stack, and it's 0 for the top level of the script.
+	Depth   int
+	thread  *starlark.Thread
+	session *debugSession
+}
+
+// Stack returns the call stack of the script, the innermost frame first.
+func (s *DebugStop) Stack() starlark.CallStack {
+	cs := s.thread.CallStack()
+	for i, j := 0, len(cs)-1; i < j; i, j = i+1, j-1 {
+		cs[i], cs[j] = cs[j], cs[i]
+	}
+	return cs
+}
+
+// Locals returns the local variables assigned in the current function, it's empty for the top level of the script.
+// The variables captured by nested functions are not included, as their values are kept in cells which can't be read.
+func (s *DebugStop) Locals() starlark.StringDict {
+	fr := s.thread.DebugFrame(0)
+	fn, ok := fr.Callable().(*starlark.Function)
+	if !ok || s.Depth == 0 {
+		return starlark.StringDict{}
+	}
+	bindings := s.session.localBindings(fn)
+	locals := make(starlark.StringDict, len(bindings))
+	for i, b := range bindings {
+		if b.Scope == resolve.Cell {
+			continue
+		}
+		if v := fr.Local(i); v != nil {
+			locals[b.First.Name] = v
+		}
+	}
+	return locals
+}
+
+// Globals returns the global variables assigned in the script of the current function.
+func (s *DebugStop) Globals() starlark.StringDict {
+	if fn, ok := s.thread.DebugFrame(0).Callable().(*starlark.Function); ok {
+		return fn.Globals()
+	}
+	return starlark.StringDict{}
+}
+
+// Lookup returns the value of the given name in the locals, the globals, the predeclared names or the universal builtins in order, and false if not found.
+func (s *DebugStop) Lookup(name string) (starlark.Value, bool) {
+	if v, ok := s.Locals()[name]; ok {
+		return v, true
+	}
+	if v, ok := s.Globals()[name]; ok {
+		return v, true
+	}
+	if v, ok := s.session.predeclared[name]; ok {
+		return v, true
+	}
+	if v, ok := starlark.Universe[name]; ok {
+		return v, true
+	}
+	return nil, false
+}
+
+// debugSession observes each execution step of a run to find the lines to stop at for the debugger.
+type debugSession struct {
+	dbg         *Debugger
+	predeclared starlark.StringDict
+	opts        *syntax.FileOptions
+	readFile    func(name string) ([]byte, error)
+	funcs       map[funcKey]*resolve.Function
+	resolved    map[string]bool
+	lines       []int32
+	action      DebugAction
+	baseDepth   int
+	aborted     bool
+}
+
+// funcKey is the position of a function in the scripts.
+type funcKey struct {
+	file      string
+	line, col int32
+}
+
+// newDebugSession creates a session of the debugger for a run with the predeclared names,
+// and the options and reader of the script files to find the names of local variables.
+func newDebugSession(d *Debugger, predeclared starlark.StringDict, opts *syntax.FileOptions, readFile func(name string) ([]byte, error)) *debugSession {
+	return &debugSession{
+		dbg:         d,
+		predeclared: predeclared,
+		opts:        opts,
+		readFile:    readFile,
+		funcs:       make(map[funcKey]*resolve.Function),
+		resolved:    make(map[string]bool),
+	}
+}
+
+// localBindings returns the local variables of the function in the same order as DebugFrame.Local.
+// The names are not kept by compiled functions, so they're resolved from the source file of the function again, and nil if it fails.
+func (s *debugSession) localBindings(fn *starlark.Function) []*resolve.Binding {
+	pos := fn.Position()
+	file := pos.Filename()
+	if !s.resolved[file] {
+		s.resolved[file] = true
+		s.resolveFile(file)
+	}
+	if f := s.funcs[funcKey{file, pos.Line, pos.Col}]; f != nil {
+		return f.Locals
+	}
+	return nil
+}
+
+// resolveFile parses and resolves the source file, and records the functions defined in it.
+func (s *debugSession) resolveFile(name string) {
+	src, err := s.readFile(name)
+	if err != nil {
+		return
+	}
+	f, err := s.opts.Parse(name, src, 0)
+	if err != nil {
+		return
+	}
+	// local variables are bound by assignments in functions, so all other names are assumed to be defined
+	isDefined := func(string) bool { return true }
+	if err = resolve.File(f, isDefined, isDefined); err != nil {
+		return
+	}
+	syntax.Walk(f, func(n syntax.Node) bool {
+		var fn interface{}
+		switch n := n.(type) {
+		case *syntax.DefStmt:
+			fn = n.Function
+		case *syntax.LambdaExpr:
+			fn = n.Function
+		}
+		if rf, ok := fn.(*resolve.Function); ok {
+			s.funcs[funcKey{name, rf.Pos.Line, rf.Pos.Col}] = rf
+		}
+		return true
+	})
+}
+
+// nextStep returns the next step count to observe, i.e. every step.
+func (s *debugSession) nextStep(steps uint64) uint64 {
+	return steps + 1
+}
+
+// onStep stops the execution if it reaches a new line that matches a breakpoint, a pause or the step action.
+func (s *debugSession) onStep(thread *starlark.Thread, steps uint64) uint64 {
+	// steps only happen in Starlark functions
+	fr := thread.DebugFrame(0)
+	fn, ok := fr.Callable().(*starlark.Function)
+	if !ok {
+		return steps + 1
+	}
+
+	// check if it's a new line of the frame
+	depth := thread.CallStackDepth()
+	pos := fr.Position()
+	if len(s.lines) > depth {
+		s.lines = s.lines[:depth]
+	}
+	for len(s.lines) < depth {
+		s.lines = append(s.lines, 0)
+	}
+	if s.lines[depth-1] == pos.Line {
+		return steps + 1
+	}
+	s.lines[depth-1] = pos.Line
+
+	// find the reason to stop
+	var reason DebugStopReason
+	switch {
+	case s.dbg.takePause():
+		reason = StopPause
+	case s.dbg.hasBreakpoint(pos):
+		reason = StopBreakpoint
+	case s.action == DebugStepInto,
+		s.action == DebugStepOver && depth <= s.baseDepth,
+		s.action == DebugStepOut && depth < s.baseDepth:
+		reason = StopStep
+	default:
+		return steps + 1
+	}
+
+	// stop and wait for the action
+	s.action = DebugContinue
+	if s.dbg.onStop != nil {
+		s.action = s.dbg.onStop(&DebugStop{
+			Reason:   reason,
+			Pos:      pos,
+			Function: fn.Name(),
+			Depth:    depth - 1,
+			thread:   thread,
+			session:  s,
+		})
+	}
+	s.baseDepth = depth
+	if s.action == DebugAbort {
+		s.aborted = true
+		thread.Cancel(ErrDebugAborted.Error())
+		return math.MaxUint64
+	}
+	return steps + 1
+}
@@ -0,0 +1,249 @@
+package starlet_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/1set/starlet"
+)
+
+const debugTestScript = `
+def add(a, b):
+    c = a + b
+    return c
+
+def calc(n):
+    s = 0
+    for i in range(n):
+        s = add(s, i)
+    return s
+
+x = calc(3)
+y = x * 2
+`
+
+func TestDebugger_Breakpoints(t *testing.T) {
+	d := starlet.NewDebugger(nil)
+	d.SetBreakpoint("b.star", 3)
+	d.SetBreakpoint("a.star", 5)
+	d.SetBreakpoint("a.star", 2)
+	if act := fmt.Sprint(d.Breakpoints()); act != "[{a.star 2} {a.star 5} {b.star 3}]" {
+		t.Errorf("unexpected breakpoints: %s", act)
+	}
+	if !d.ClearBreakpoint("a.star", 5) {
+		t.Errorf("expected breakpoint cleared")
+	}
+	if d.ClearBreakpoint("a.star", 5) {
+		t.Errorf("expected no breakpoint to clear")
+	}
+	d.ClearAllBreakpoints()
+	if bps := d.Breakpoints(); len(bps) != 0 {
+		t.Errorf("expected no breakpoints, got %v", bps)
+	}
+}
+
+func TestMachine_SetDebugger(t *testing.T) {
+	tests := []struct {
+		name    string
+		bps     []int
+		pause   bool
+		actions []starlet.DebugAction
+		want    []string
+		wantErr error
+	}{
+		{
+			name: "no breakpoints",
+		},
+		{
+			name:    "breakpoint in loop",
+			bps:     []int{9},
+			actions: []starlet.DebugAction{starlet.DebugContinue},
+			want: []string{
+				"breakpoint calc:9 i=0 n=3 s=0",
+				"breakpoint calc:9 i=1 n=3 s=0",
+				"breakpoint calc:9 i=2 n=3 s=1",
+				"breakpoint calc:9 i=2 n=3 s=3", // the end of loop shares the line of its last statement
+			},
+		},
+		{
+			name:    "step into",
+			bps:     []int{9},
+			actions: []starlet.DebugAction{starlet.DebugStepInto, starlet.DebugStepInto, starlet.DebugAbort},
+			want: []string{
+				"breakpoint calc:9 i=0 n=3 s=0",
+				"step add:3 a=0 b=0",
+				"step add:4 a=0 b=0 c=0",
+			},
+			wantErr: starlet.ErrDebugAborted,
+		},
+		{
+			name:    "step over",
+			bps:     []int{9},
+			actions: []starlet.DebugAction{starlet.DebugStepOver, starlet.DebugStepOver, starlet.DebugAbort},
+			want: []string{
+				"breakpoint calc:9 i=0 n=3 s=0",
+				"step calc:8 i=0 n=3 s=0",
+				"breakpoint calc:9 i=1 n=3 s=0",
+			},
+			wantErr: starlet.ErrDebugAborted,
+		},
+		{
+			name:    "step out",
+			pause:   true,
+			actions: []starlet.DebugAction{starlet.DebugStepOver, starlet.DebugStepOver, starlet.DebugStepInto, starlet.DebugStepOut, starlet.DebugContinue},
+			want: []string{
+				"pause <toplevel>:2",
+				"step <toplevel>:6",
+				"step <toplevel>:12",
+				"step calc:6 n=3", // the entry of function is at the line of def
+				"step <toplevel>:13",
+			},
+		},
+		{
+			name:    "breakpoint before step out",
+			bps:     []int{3},
+			actions: []starlet.DebugAction{starlet.DebugStepOut, starlet.DebugStepOut, starlet.DebugAbort},
+			want: []string{
+				"breakpoint add:3 a=0 b=0",
+				"step calc:8 i=0 n=3 s=0",
+				"breakpoint add:3 a=0 b=1",
+			},
+			wantErr: starlet.ErrDebugAborted,
+		},
+		{
+			name:    "pause on entry",
+			pause:   true,
+			actions: []starlet.DebugAction{starlet.DebugStepOver, starlet.DebugStepOver, starlet.DebugStepOver},
+			want: []string{
+				"pause <toplevel>:2",
+				"step <toplevel>:6",
+				"step <toplevel>:12",
+				"step <toplevel>:13",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stops []string
+			d := starlet.NewDebugger(func(s *starlet.DebugStop) starlet.DebugAction {
+				var sb strings.Builder
+				fmt.Fprintf(&sb, "%s %s:%d", s.Reason, s.Function, s.Pos.Line)
+				for _, k := range s.Locals().Keys() {
+					fmt.Fprintf(&sb, " %s=%s", k, s.Locals()[k])
+				}
+				stops = append(stops, sb.String())
+				if len(tt.actions) == 0 {
+					return starlet.DebugContinue
+				}
+				a := tt.actions[0]
+				if len(tt.actions) > 1 {
+					tt.actions = tt.actions[1:]
+				}
+				return a
+			})
+			for _, l := range tt.bps {
+				d.SetBreakpoint("test.star", l)
+			}
+			if tt.pause {
+				d.Pause()
+			}
+
+			m := starlet.NewDefault()
+			m.SetDebugger(d)
+			m.SetScript("test.star", []byte(debugTestScript), nil)
+			out, err := m.Run()
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) || !errors.Is(err, starlet.ErrorKindCancelled) {
+					t.Errorf("expected error %v, got %v", tt.wantErr, err)
+				}
+			} else if err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if y := out["y"]; y != int64(6) {
+				t.Errorf("expected y=6, got %v", y)
+			}
+			if act, exp := strings.Join(stops, "\n"), strings.Join(tt.want, "\n"); act != exp {
+				t.Errorf("unexpected stops:\n%s\nexpected:\n%s", act, exp)
+			}
+		})
+	}
+}
+
+func TestDebugStop_Inspect(t *testing.T) {
+	var (
+		stack   string
+		globals []string
+		lookups []string
+	)
+	d := starlet.NewDebugger(func(s *starlet.DebugStop) starlet.DebugAction {
+		stack = s.Stack().String()
+		globals = s.Globals().Keys()
+		for _, name := range []string{"c", "calc", "g", "len", "none"} {
+			v, ok := s.Lookup(name)
+			lookups = append(lookups, fmt.Sprintf("%s:%v:%v", name, ok, v))
+		}
+		return starlet.DebugContinue
+	})
+	d.SetBreakpoint("test.star", 4)
+
+	m := starlet.NewWithGlobals(starlet.StringAnyMap{"g": 1})
+	m.SetDebugger(d)
+	m.SetScript("test.star", []byte(debugTestScript), nil)
+	if _, err := m.Run(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	expStack := "Traceback (most recent call last):\n  test.star:4:12: in add\n  test.star:9:16: in calc\n  test.star:12:9: in <toplevel>\n"
+	if stack != expStack {
+		t.Errorf("unexpected stack:\n%s", stack)
+	}
+	if act := strings.Join(globals, ","); act != "add,calc" {
+		t.Errorf("unexpected globals: %s", act)
+	}
+	if act := strings.Join(lookups[:5], " "); act != "c:true:0 calc:true:<function calc> g:true:1 len:true:<built-in function len> none:false:<nil>" {
+		t.Errorf("unexpected lookups: %s", act)
+	}
+}
+
+func TestMachine_SetDebugger_LoadedModule(t *testing.T) {
+	var stops []string
+	d := starlet.NewDebugger(func(s *starlet.DebugStop) starlet.DebugAction {
+		sb := strings.Builder{}
+		fmt.Fprintf(&sb, "%s %s:%d:%d", s.Reason, s.Function, s.Pos.Line, s.Depth)
+		for _, k := range s.Locals().Keys() {
+			fmt.Fprintf(&sb, " %s=%s", k, s.Locals()[k])
+		}
+		stops = append(stops, sb.String())
+		return starlet.DebugContinue
+	})
+	d.SetBreakpoint("calc.star", 3)
+	d.SetBreakpoint("calc.star", 8)
+
+	scripts := MemFS{
+		"calc.star": `
+def scale(n, k):
+    m = n * k
+    return m
+
+def counter(n):
+    total = n
+    inc = lambda: total + 1
+    return inc()
+
+r = scale(2, 3)
+`,
+	}
+	m := starlet.NewDefault()
+	m.SetDebugger(d)
+	m.SetScript("main.star", []byte("load(\"calc.star\", \"scale\", \"counter\")\nx = scale(4, 5)\ny = counter(1)"), scripts)
+	if _, err := m.Run(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	// the variables captured by nested functions are not shown
+	exp := "breakpoint scale:3:2 k=3 n=2|breakpoint scale:3:1 k=5 n=4|breakpoint counter:8:1 n=1|breakpoint lambda:8:2"
+	if act := strings.Join(stops, "|"); act != exp {
+		t.Errorf("unexpected stops: %s", act)
+	}
+}
@@ -0,0 +1,306 @@
+package starlet
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/1set/starlet/dataconv"
+	"github.com/1set/starlight/convert"
+	"go.starlark.net/starlark"
+)
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// RunInto executes a preset script within a specified context, and decodes the global variables after the run into the Go struct pointed to by out.
+// See Decode for the rules of decoding.
+func (m *Machine) RunInto(ctx context.Context, out interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.runInternal(ctx, nil, true); err != nil {
+		return err
+	}
+	return decodeStringDict(m.predeclared, out, m.customTag)
+}
+
+// Decode decodes the current global variables of the machine into the Go struct pointed to by out.
+//
+// Each exported field is mapped to the global variable named by the custom tag of the machine (default to "starlark"), or the field name if no tag is set,
+// and fields tagged with "-" are skipped. It returns an error for any missing global variable, unless the field is tagged with the "optional" option, e.g. `starlark:"name,optional"`.
+//
+// The values are converted by dataconv.Unmarshal first, and then assigned to the fields with type checks:
+// lists, tuples and sets map to slices or arrays, dicts map to maps, and dicts, structs and modules map to nested structs with the same rules,
+// and time values map to time.Time and time.Duration. None maps to the zero value of pointers, slices, maps and interfaces.
+func (m *Machine) Decode(out interface{}) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return decodeStringDict(m.predeclared, out, m.customTag)
+}
+
+// decodeStringDict decodes the Starlark values into the Go struct pointed to by out.
+func decodeStringDict(d starlark.StringDict, out interface{}, tag string) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return errorStarletDecode(fmt.Errorf("want non-nil pointer to struct, got %T", out))
+	}
+	if tag == "" {
+		tag = convert.DefaultPropertyTag
+	}
+
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		name, optional, ok := decodeFieldName(rt.Field(i), tag)
+		if !ok {
+			continue
+		}
+		sv, found := d[name]
+		if !found {
+			if optional {
+				continue
+			}
+			return errorStarletDecode(fmt.Errorf("%s: missing global variable", name))
+		}
+		gv, err := dataconv.Unmarshal(sv)
+		if err != nil {
+			return errorStarletDecode(fmt.Errorf("%s: %w", name, err))
+		}
+		if err := decodeValue(rv.Field(i), gv, name, tag); err != nil {
+			return errorStarletDecode(err)
+		}
+	}
+	return nil
+}
+
+// decodeFieldName returns the name of the struct field for decoding, whether it's optional, and false if it should be skipped.
+func decodeFieldName(f reflect.StructField, tag string) (name string, optional bool, ok bool) {
+	if f.PkgPath != "" {
+		// Skip unexported fields
+		return "", false, false
+	}
+	parts := strings.Split(f.Tag.Get(tag), ",")
+	if parts[0] == "-" {
+		return "", false, false
+	}
+	name = parts[0]
+	if name == "" {
+		name = f.Name
+	}
+	for _, opt := range parts[1:] {
+		if opt == "optional" {
+			optional = true
+		}
+	}
+	return name, optional, true
+}
+
+// decodeValue assigns the Go value unmarshalled from Starlark to the destination, and the path is used for error messages.
+func decodeValue(dst reflect.Value, src interface{}, path, tag string) error {
+	mismatch := func() error {
+		return fmt.Errorf("%s: cannot decode %s into %s", path, describeGoValue(src), dst.Type())
+	}
+
+	// for None
+	if src == nil {
+		switch dst.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+			dst.Set(reflect.Zero(dst.Type()))
+			return nil
+		}
+		return mismatch()
+	}
+
+	// for special types
+	switch dst.Type() {
+	case timeType:
+		t, ok := src.(time.Time)
+		if !ok {
+			return mismatch()
+		}
+		dst.Set(reflect.ValueOf(t))
+		return nil
+	case durationType:
+		d, ok := src.(time.Duration)
+		if !ok {
+			return mismatch()
+		}
+		dst.SetInt(int64(d))
+		return nil
+	}
+
+	sv := reflect.ValueOf(src)
+	switch dst.Kind() {
+	case reflect.Interface:
+		if !sv.Type().AssignableTo(dst.Type()) {
+			return mismatch()
+		}
+		dst.Set(sv)
+	case reflect.Ptr:
+		nv := reflect.New(dst.Type().Elem())
+		if err := decodeValue(nv.Elem(), src, path, tag); err != nil {
+			return err
+		}
+		dst.Set(nv)
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return mismatch()
+		}
+		dst.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := src.(int)
+		if !ok {
+			return mismatch()
+		}
+		if dst.OverflowInt(int64(i)) {
+			return fmt.Errorf("%s: value %d overflows %s", path, i, dst.Type())
+		}
+		dst.SetInt(int64(i))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, ok := src.(int)
+		if !ok {
+			return mismatch()
+		}
+		if i < 0 || dst.OverflowUint(uint64(i)) {
+			return fmt.Errorf("%s: value %d overflows %s", path, i, dst.Type())
+		}
+		dst.SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		switch x := src.(type) {
+		case float64:
+			dst.SetFloat(x)
+		case int:
+			dst.SetFloat(float64(x))
+		default:
+			return mismatch()
+		}
+	case reflect.String:
+		s, ok := src.(string)
+		if !ok {
+			return mismatch()
+		}
+		dst.SetString(s)
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			// for bytes
+			if s, ok := src.(string); ok {
+				dst.SetBytes([]byte(s))
+				return nil
+			}
+		}
+		l, ok := src.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		ns := reflect.MakeSlice(dst.Type(), len(l), len(l))
+		for i, e := range l {
+			if err := decodeValue(ns.Index(i), e, fmt.Sprintf("%s[%d]", path, i), tag); err != nil {
+				return err
+			}
+		}
+		dst.Set(ns)
+	case reflect.Array:
+		l, ok := src.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		if len(l) != dst.Len() {
+			return fmt.Errorf("%s: cannot decode %d items into %s", path, len(l), dst.Type())
+		}
+		for i, e := range l {
+			if err := decodeValue(dst.Index(i), e, fmt.Sprintf("%s[%d]", path, i), tag); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		nm := reflect.MakeMap(dst.Type())
+		setItem := func(k, v interface{}) error {
+			ip := fmt.Sprintf("%s[%v]", path, k)
+			kv := reflect.New(dst.Type().Key()).Elem()
+			if err := decodeValue(kv, k, ip, tag); err != nil {
+				return err
+			}
+			vv := reflect.New(dst.Type().Elem()).Elem()
+			if err := decodeValue(vv, v, ip, tag); err != nil {
+				return err
+			}
+			nm.SetMapIndex(kv, vv)
+			return nil
+		}
+		switch m := src.(type) {
+		case map[string]interface{}:
+			for k, v := range m {
+				if err := setItem(k, v); err != nil {
+					return err
+				}
+			}
+		case map[interface{}]interface{}:
+			for k, v := range m {
+				if err := setItem(k, v); err != nil {
+					return err
+				}
+			}
+		default:
+			return mismatch()
+		}
+		dst.Set(nm)
+	case reflect.Struct:
+		m, ok := src.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		dt := dst.Type()
+		for i := 0; i < dt.NumField(); i++ {
+			name, optional, ok := decodeFieldName(dt.Field(i), tag)
+			if !ok {
+				continue
+			}
+			fp := path + "." + name
+			v, found := m[name]
+			if !found {
+				if optional {
+					continue
+				}
+				return fmt.Errorf("%s: missing field", fp)
+			}
+			if err := decodeValue(dst.Field(i), v, fp, tag); err != nil {
+				return err
+			}
+		}
+	default:
+		return mismatch()
+	}
+	return nil
+}
+
+// describeGoValue returns the Starlark-like type name of the unmarshalled Go value for error messages.
+func describeGoValue(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "None"
+	case bool:
+		return "bool"
+	case int:
+		return "int"
+	case float64:
+		return "float"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}, map[interface{}]interface{}:
+		return "dict"
+	case time.Time:
+		return "time"
+	case time.Duration:
+		return "duration"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,225 @@
+package starlet_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/1set/starlet"
+)
+
+type decodeItem struct {
+	Name  string   `starlark:"name"`
+	Price float64  `starlark:"price"`
+	Tags  []string `starlark:",optional"`
+}
+
+type decodeResult struct {
+	Count   int                `starlark:"count"`
+	Ratio   float32            `starlark:"ratio"`
+	OK      bool               `starlark:"ok"`
+	Title   string             `starlark:"title"`
+	Raw     []byte             `starlark:"raw"`
+	Items   []decodeItem       `starlark:"items"`
+	Scores  map[string]int     `starlark:"scores"`
+	Pair    [2]int             `starlark:"pair"`
+	Meta    *decodeItem        `starlark:"meta"`
+	Nothing map[string]int     `starlark:"nothing"`
+	When    time.Time          `starlark:"when"`
+	Wait    time.Duration      `starlark:"wait"`
+	Any     interface{}        `starlark:"any"`
+	Extra   string             `starlark:"extra,optional"`
+	Skipped string             `starlark:"-"`
+	Nested  map[string][]int64 `starlark:"nested"`
+	hidden  int
+}
+
+func TestMachine_RunInto(t *testing.T) {
+	code := `
+load("time", "time", "parse_duration")
+count = 3
+ratio = 0.5
+ok = True
+title = "hello"
+raw = b"abc"
+items = [
+	{"name": "apple", "price": 1.5, "Tags": ["red", "sweet"]},
+	struct(name="pear", price=2, Tags=[]),
+]
+scores = {"a": 1, "b": 2}
+pair = (7, 8)
+meta = {"name": "meta", "price": 0.0, "Tags": ["x"]}
+nothing = None
+when = time(year=2023, month=4, day=5)
+wait = parse_duration("1m30s")
+any = [1, "two"]
+nested = {"odd": [1, 3], "even": [2]}
+`
+	m := starlet.NewWithNames(nil, []string{"struct"}, []string{"time"})
+	m.SetScriptContent([]byte(code))
+
+	var out decodeResult
+	out.Skipped = "keep"
+	if err := m.RunInto(context.Background(), &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if out.Count != 3 || out.Ratio != 0.5 || !out.OK || out.Title != "hello" || string(out.Raw) != "abc" {
+		t.Errorf("unexpected scalars: %+v", out)
+	}
+	if len(out.Items) != 2 || out.Items[0].Name != "apple" || out.Items[0].Price != 1.5 || len(out.Items[0].Tags) != 2 || out.Items[1].Name != "pear" || out.Items[1].Price != 2 {
+		t.Errorf("unexpected items: %+v", out.Items)
+	}
+	if out.Scores["a"] != 1 || out.Scores["b"] != 2 || out.Pair != [2]int{7, 8} {
+		t.Errorf("unexpected scores or pair: %v %v", out.Scores, out.Pair)
+	}
+	if out.Meta == nil || out.Meta.Name != "meta" || out.Nothing != nil {
+		t.Errorf("unexpected meta or nothing: %v %v", out.Meta, out.Nothing)
+	}
+	if out.When.Year() != 2023 || out.When.Month() != time.April || out.When.Day() != 5 {
+		t.Errorf("unexpected time: %v", out.When)
+	}
+	if out.Wait != 90*time.Second {
+		t.Errorf("unexpected duration: %v", out.Wait)
+	}
+	if l, ok := out.Any.([]interface{}); !ok || len(l) != 2 {
+		t.Errorf("unexpected any: %v", out.Any)
+	}
+	if out.Extra != "" || out.Skipped != "keep" {
+		t.Errorf("unexpected optional or skipped: %q %q", out.Extra, out.Skipped)
+	}
+	if len(out.Nested["odd"]) != 2 || out.Nested["even"][0] != 2 {
+		t.Errorf("unexpected nested: %v", out.Nested)
+	}
+}
+
+func TestMachine_Decode(t *testing.T) {
+	type custom struct {
+		Value int `sl:"value"`
+		Name  string
+	}
+
+	m := starlet.NewDefault()
+	m.SetCustomTag("sl")
+	if _, err := m.RunScript([]byte(`value = 42; Name = "x"`), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var out custom
+	if err := m.Decode(&out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Value != 42 || out.Name != "x" {
+		t.Errorf("unexpected result: %+v", out)
+	}
+}
+
+func TestMachine_Decode_Errors(t *testing.T) {
+	code := `
+num = 300
+neg = -1
+text = "abc"
+items = [{"name": "a", "price": 1}, {"name": "b", "price": "free"}]
+partial = {"name": "c"}
+pair = [1, 2, 3]
+nothing = None
+`
+	tests := []struct {
+		name string
+		out  interface{}
+		want string
+	}{
+		{
+			name: "not a pointer",
+			out:  struct{}{},
+			want: "starlet: decode: want non-nil pointer to struct, got struct {}",
+		},
+		{
+			name: "nil pointer",
+			out:  (*struct{})(nil),
+			want: "starlet: decode: want non-nil pointer to struct, got *struct {}",
+		},
+		{
+			name: "missing global",
+			out: &struct {
+				Missing int `starlark:"missing"`
+			}{},
+			want: "starlet: decode: missing: missing global variable",
+		},
+		{
+			name: "mistyped",
+			out: &struct {
+				Text int `starlark:"text"`
+			}{},
+			want: "starlet: decode: text: cannot decode string into int",
+		},
+		{
+			name: "overflow",
+			out: &struct {
+				Num int8 `starlark:"num"`
+			}{},
+			want: "starlet: decode: num: value 300 overflows int8",
+		},
+		{
+			name: "negative unsigned",
+			out: &struct {
+				Neg uint `starlark:"neg"`
+			}{},
+			want: "starlet: decode: neg: value -1 overflows uint",
+		},
+		{
+			name: "nested mistyped",
+			out: &struct {
+				Items []decodeItem `starlark:"items"`
+			}{},
+			want: "starlet: decode: items[1].price: cannot decode string into float64",
+		},
+		{
+			name: "nested missing",
+			out: &struct {
+				Partial decodeItem `starlark:"partial"`
+			}{},
+			want: "starlet: decode: partial.price: missing field",
+		},
+		{
+			name: "array length",
+			out: &struct {
+				Pair [2]int `starlark:"pair"`
+			}{},
+			want: "starlet: decode: pair: cannot decode 3 items into [2]int",
+		},
+		{
+			name: "none into int",
+			out: &struct {
+				Nothing int `starlark:"nothing"`
+			}{},
+			want: "starlet: decode: nothing: cannot decode None into int",
+		},
+	}
+
+	m := starlet.NewDefault()
+	if _, err := m.RunScript([]byte(code), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := m.Decode(tt.out)
+			expectErr(t, err, tt.want)
+
+			var ee starlet.ExecError
+			if !errors.As(err, &ee) || ee.Kind() != starlet.ErrorKindConversion {
+				t.Errorf("expected conversion error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMachine_RunInto_ScriptError(t *testing.T) {
+	m := starlet.NewDefault()
+	m.SetScriptContent([]byte(`x = 1 / 0`))
+	var out struct {
+		X int `starlark:"x"`
+	}
+	err := m.RunInto(context.Background(), &out)
+	expectErr(t, err, "starlark: exec: floating-point division by zero")
+}
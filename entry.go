@@ -0,0 +1,310 @@
+package starlet
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/1set/starlet/dataconv"
+	"github.com/1set/starlight/convert"
+	"go.starlark.net/starlark"
+)
+
+const (
+	// MainFuncName is the name of the optional entrypoint function of scripts, it's called with parameters as keyword arguments, i.e. main(**kwargs).
+	MainFuncName = "main"
+	// ParamsVarName is the name of the optional global variable declaring the parameter schema of the entrypoint function.
+	ParamsVarName = "PARAMS"
+)
+
+// ParamType is the type of parameter declared in the schema of scripts.
+type ParamType string
+
+const (
+	// ParamString is for string parameters, it's the default type if not specified.
+	ParamString ParamType = "string"
+	// ParamInt is for integer parameters.
+	ParamInt ParamType = "int"
+	// ParamFloat is for floating-point parameters, integers are also accepted.
+	ParamFloat ParamType = "float"
+	// ParamBool is for boolean parameters, it defaults to False if not specified.
+	ParamBool ParamType = "bool"
+	// ParamList is for list of strings parameters.
+	ParamList ParamType = "list"
+)
+
+// Param is a parameter of the entrypoint function declared in the script.
+//
+// The schema is a dict of parameter names to their specs in the global variable PARAMS, and the order of the names is kept, e.g.
+//
+//	PARAMS = {
+//	    "name": {"type": "string", "default": "world", "help": "who to greet"},
+//	    "times": {"type": "int", "help": "how many times to greet"},
+//	}
+//
+// Parameters without default values are required, except for bool parameters which default to False.
+type Param struct {
+	// Name is the name of the keyword argument for the entrypoint function.
+	Name string
+	// Type is the type of the parameter.
+	Type ParamType
+	// Help is the description of the parameter.
+	Help string
+	// Default is the default value of the parameter converted to Go, it's nil for required parameters.
+	Default interface{}
+	// Required indicates the parameter has no default value and must be provided.
+	Required bool
+
+	defaultValue starlark.Value
+}
+
+// HasMain returns true if the entrypoint function is defined in the global variables after the run.
+func (m *Machine) HasMain() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.predeclared[MainFuncName].(starlark.Callable)
+	return ok
+}
+
+// Params returns the parameter schema declared in the global variables after the run, and nil if no schema is declared.
+func (m *Machine) Params() ([]Param, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.parseParams()
+}
+
+// RunMain executes the preset script within a specified context, and calls the entrypoint function with the arguments validated against the parameter schema, and returns the result.
+func (m *Machine) RunMain(ctx context.Context, args StringAnyMap) (interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.runInternal(ctx, nil, true); err != nil {
+		return nil, err
+	}
+	return m.callMain(ctx, args)
+}
+
+// CallMain calls the entrypoint function defined in the last run within a specified context, with the arguments validated against the parameter schema, and returns the result.
+// Missing arguments are filled with default values, and it returns an error for unknown, missing required or mistyped arguments before calling.
+// If no schema is declared, the arguments are passed as is.
+func (m *Machine) CallMain(ctx context.Context, args StringAnyMap) (interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.callMain(ctx, args)
+}
+
+func (m *Machine) callMain(ctx context.Context, args StringAnyMap) (interface{}, error) {
+	if _, ok := m.predeclared[MainFuncName].(starlark.Callable); !ok {
+		return nil, errorStarletErrorf("main", "no %s function", MainFuncName)
+	}
+	params, err := m.parseParams()
+	if err != nil {
+		return nil, err
+	}
+
+	// validate and fill arguments
+	kwargs := args
+	if params != nil {
+		if kwargs, err = validateArgs(params, args); err != nil {
+			return nil, err
+		}
+	}
+
+	// call the entrypoint, and handle exit() like the run
+	out, err := m.callInternal(ctx, MainFuncName, nil, kwargs)
+	if err != nil && isSystemExit(err) {
+		err = m.exitCodeError()
+	}
+	return out, err
+}
+
+// parseParams parses the parameter schema from the global variable.
+func (m *Machine) parseParams() ([]Param, error) {
+	v, ok := m.predeclared[ParamsVarName]
+	if !ok || v == starlark.None {
+		return nil, nil
+	}
+	d, ok := v.(*starlark.Dict)
+	if !ok {
+		return nil, errorStarletErrorf("params", "%s must be a dict, got %s", ParamsVarName, v.Type())
+	}
+
+	params := make([]Param, 0, d.Len())
+	for _, item := range d.Items() {
+		name, ok := starlark.AsString(item[0])
+		if !ok || name == "" {
+			return nil, errorStarletErrorf("params", "invalid parameter name: %s", item[0])
+		}
+		spec, ok := item[1].(*starlark.Dict)
+		if !ok {
+			return nil, errorStarletErrorf("params", "spec of parameter %q must be a dict, got %s", name, item[1].Type())
+		}
+		p, err := parseParamSpec(name, spec)
+		if err != nil {
+			return nil, errorStarletErrorf("params", "parameter %q: %v", name, err)
+		}
+		params = append(params, p)
+	}
+	return params, nil
+}
+
+// parseParamSpec parses the spec dict of a parameter.
+func parseParamSpec(name string, spec *starlark.Dict) (Param, error) {
+	p := Param{Name: name, Type: ParamString}
+	for _, item := range spec.Items() {
+		key, _ := starlark.AsString(item[0])
+		switch key {
+		case "type":
+			s, ok := starlark.AsString(item[1])
+			if !ok {
+				return p, fmt.Errorf("type must be a string, got %s", item[1].Type())
+			}
+			switch t := ParamType(s); t {
+			case ParamString, ParamInt, ParamFloat, ParamBool, ParamList:
+				p.Type = t
+			default:
+				return p, fmt.Errorf("unknown type: %s", s)
+			}
+		case "help":
+			s, ok := starlark.AsString(item[1])
+			if !ok {
+				return p, fmt.Errorf("help must be a string, got %s", item[1].Type())
+			}
+			p.Help = s
+		case "default":
+			p.defaultValue = item[1]
+		default:
+			return p, fmt.Errorf("unknown spec key: %s", item[0])
+		}
+	}
+
+	// check the default value after the type is known
+	switch {
+	case p.defaultValue != nil:
+		dv, err := checkParamValue(p.Type, p.defaultValue)
+		if err != nil {
+			return p, fmt.Errorf("default value: %w", err)
+		}
+		p.defaultValue = dv
+	case p.Type == ParamBool:
+		p.defaultValue = starlark.False
+	default:
+		p.Required = true
+	}
+	if p.defaultValue != nil {
+		p.Default = convert.FromValue(p.defaultValue)
+	}
+	return p, nil
+}
+
+// validateArgs checks the arguments against the parameters, and returns the arguments with default values filled.
+func validateArgs(params []Param, args StringAnyMap) (StringAnyMap, error) {
+	known := make(map[string]struct{}, len(params))
+	for _, p := range params {
+		known[p.Name] = struct{}{}
+	}
+	var unknown []string
+	for name := range args {
+		if _, ok := known[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, errorStarletErrorf("main", "unknown parameter: %s", strings.Join(unknown, ", "))
+	}
+
+	kwargs := make(StringAnyMap, len(params))
+	for _, p := range params {
+		a, ok := args[p.Name]
+		if !ok {
+			if p.Required {
+				return nil, errorStarletErrorf("main", "missing required parameter: %s", p.Name)
+			}
+			// copy the default list, so it won't be changed across calls
+			if l, ok := p.defaultValue.(*starlark.List); ok {
+				kwargs[p.Name] = copyStarlarkList(l)
+			} else {
+				kwargs[p.Name] = p.defaultValue
+			}
+			continue
+		}
+		sv, ok := a.(starlark.Value)
+		if !ok {
+			var err error
+			if sv, err = dataconv.Marshal(a); err != nil {
+				return nil, errorStarletErrorf("main", "parameter %s: %v", p.Name, err)
+			}
+		}
+		sv, err := checkParamValue(p.Type, sv)
+		if err != nil {
+			return nil, errorStarletErrorf("main", "parameter %s: %v", p.Name, err)
+		}
+		kwargs[p.Name] = sv
+	}
+	return kwargs, nil
+}
+
+// checkParamValue checks the value against the parameter type, and returns the value converted if needed, e.g. int to float, tuple to list.
+func checkParamValue(t ParamType, v starlark.Value) (starlark.Value, error) {
+	mistyped := func() error {
+		return fmt.Errorf("want %s, got %s", t, v.Type())
+	}
+	switch t {
+	case ParamString:
+		if _, ok := v.(starlark.String); !ok {
+			return nil, mistyped()
+		}
+	case ParamInt:
+		if _, ok := v.(starlark.Int); !ok {
+			return nil, mistyped()
+		}
+	case ParamFloat:
+		switch x := v.(type) {
+		case starlark.Float:
+		case starlark.Int:
+			return x.Float(), nil
+		default:
+			return nil, mistyped()
+		}
+	case ParamBool:
+		if _, ok := v.(starlark.Bool); !ok {
+			return nil, mistyped()
+		}
+	case ParamList:
+		var elems []starlark.Value
+		switch x := v.(type) {
+		case *starlark.List:
+			elems = listElems(x)
+		case starlark.Tuple:
+			elems = x
+		default:
+			return nil, mistyped()
+		}
+		for _, e := range elems {
+			if _, ok := e.(starlark.String); !ok {
+				return nil, fmt.Errorf("want list of string, got %s in list", e.Type())
+			}
+		}
+		return starlark.NewList(elems), nil
+	}
+	return v, nil
+}
+
+// listElems returns a copy of the elements of the list.
+func listElems(l *starlark.List) []starlark.Value {
+	elems := make([]starlark.Value, l.Len())
+	for i := range elems {
+		elems[i] = l.Index(i)
+	}
+	return elems
+}
+
+// copyStarlarkList returns a shallow copy of the list, which is not frozen.
+func copyStarlarkList(l *starlark.List) *starlark.List {
+	return starlark.NewList(listElems(l))
+}
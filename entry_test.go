@@ -0,0 +1,185 @@
+package starlet_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/1set/starlet"
+	"go.starlark.net/starlark"
+)
+
+const entryScript = `
+PARAMS = {
+	"name": {"type": "string", "default": "world", "help": "who to greet"},
+	"times": {"type": "int", "help": "how many times"},
+	"ratio": {"type": "float", "default": 1},
+	"loud": {"type": "bool"},
+	"tags": {"type": "list", "default": ["a"]},
+}
+
+def main(name, times, ratio, loud, tags):
+	tags.append("x")
+	msg = ("hello " + name) * times
+	if loud:
+		msg = msg.upper()
+	return {"msg": msg, "ratio": ratio, "tags": tags}
+`
+
+func TestMachine_Params(t *testing.T) {
+	m := starlet.NewDefault()
+	if _, err := m.RunScript([]byte(entryScript), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !m.HasMain() {
+		t.Errorf("expected main function")
+	}
+	params, err := m.Params()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, p := range params {
+		got = append(got, p.Name+":"+string(p.Type))
+	}
+	want := []string{"name:string", "times:int", "ratio:float", "loud:bool", "tags:list"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected params %v, got %v", want, got)
+	}
+	if p := params[0]; p.Help != "who to greet" || p.Default != "world" || p.Required {
+		t.Errorf("unexpected param: %+v", p)
+	}
+	if p := params[1]; !p.Required || p.Default != nil {
+		t.Errorf("expected required param: %+v", p)
+	}
+	if p := params[2]; p.Default != 1.0 {
+		t.Errorf("expected float default, got %+v", p)
+	}
+	if p := params[3]; p.Required || p.Default != false {
+		t.Errorf("expected bool default false, got %+v", p)
+	}
+
+	// no schema and no main
+	m2 := starlet.NewDefault()
+	if _, err := m2.RunScript([]byte(`x = 1`), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m2.HasMain() {
+		t.Errorf("expected no main function")
+	}
+	if params, err := m2.Params(); err != nil || params != nil {
+		t.Errorf("expected no params, got %v, %v", params, err)
+	}
+	_, err = m2.CallMain(context.Background(), nil)
+	expectErr(t, err, "starlet: main: no main function")
+}
+
+func TestMachine_RunMain(t *testing.T) {
+	m := starlet.NewDefault()
+	m.SetScriptContent([]byte(entryScript))
+	out, err := m.RunMain(context.Background(), starlet.StringAnyMap{"times": 2, "loud": true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp := map[interface{}]interface{}{
+		"msg":   "HELLO WORLDHELLO WORLD",
+		"ratio": 1.0,
+		"tags":  []interface{}{"a", "x"},
+	}
+	if !reflect.DeepEqual(out, exp) {
+		t.Errorf("expected %v, got %v", exp, out)
+	}
+
+	// defaults are not changed by the previous call
+	out, err = m.CallMain(context.Background(), starlet.StringAnyMap{"times": 1, "name": "bob", "ratio": 2, "tags": []string{"b"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp = map[interface{}]interface{}{
+		"msg":   "hello bob",
+		"ratio": 2.0,
+		"tags":  []interface{}{"b", "x"},
+	}
+	if !reflect.DeepEqual(out, exp) {
+		t.Errorf("expected %v, got %v", exp, out)
+	}
+	out, err = m.CallMain(context.Background(), starlet.StringAnyMap{"times": 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tags := out.(map[interface{}]interface{})["tags"]; !reflect.DeepEqual(tags, []interface{}{"a", "x"}) {
+		t.Errorf("expected default tags, got %v", tags)
+	}
+}
+
+func TestMachine_CallMain_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args starlet.StringAnyMap
+		want string
+	}{
+		{"missing required", nil, "starlet: main: missing required parameter: times"},
+		{"unknown", starlet.StringAnyMap{"times": 1, "color": "red"}, "starlet: main: unknown parameter: color"},
+		{"mistyped", starlet.StringAnyMap{"times": "two"}, "starlet: main: parameter times: want int, got string"},
+		{"mistyped float", starlet.StringAnyMap{"times": 1, "ratio": "x"}, "starlet: main: parameter ratio: want float, got string"},
+		{"mistyped list", starlet.StringAnyMap{"times": 1, "tags": []interface{}{1}}, "starlet: main: parameter tags: want list of string, got int in list"},
+		{"starlark value", starlet.StringAnyMap{"times": starlark.String("1")}, "starlet: main: parameter times: want int, got string"},
+	}
+
+	m := starlet.NewDefault()
+	if _, err := m.RunScript([]byte(entryScript), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.CallMain(context.Background(), tt.args)
+			expectErr(t, err, tt.want)
+		})
+	}
+}
+
+func TestMachine_Params_InvalidSchema(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{`PARAMS = [1]`, "starlet: params: PARAMS must be a dict, got list"},
+		{`PARAMS = {1: {}}`, "starlet: params: invalid parameter name: 1"},
+		{`PARAMS = {"a": "int"}`, `starlet: params: spec of parameter "a" must be a dict, got string`},
+		{`PARAMS = {"a": {"type": "date"}}`, `starlet: params: parameter "a": unknown type: date`},
+		{`PARAMS = {"a": {"kind": "int"}}`, `starlet: params: parameter "a": unknown spec key: "kind"`},
+		{`PARAMS = {"a": {"type": "int", "default": "1"}}`, `starlet: params: parameter "a": default value: want int, got string`},
+		{`PARAMS = {"a": {"help": 1}}`, `starlet: params: parameter "a": help must be a string, got int`},
+	}
+	for _, tt := range tests {
+		m := starlet.NewDefault()
+		if _, err := m.RunScript([]byte(tt.code+"\ndef main(**kwargs): pass"), nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_, err := m.Params()
+		expectErr(t, err, tt.want)
+		_, err = m.CallMain(context.Background(), nil)
+		expectErr(t, err, tt.want)
+	}
+}
+
+func TestMachine_CallMain_NoSchema(t *testing.T) {
+	m := starlet.NewWithNames(nil, []string{"go_idiomatic"}, nil)
+	m.SetScriptContent([]byte(`
+def main(**kwargs):
+	if kwargs.get("quit"):
+		exit(3)
+	return sorted(kwargs.keys())
+`))
+	out, err := m.RunMain(context.Background(), starlet.StringAnyMap{"b": 1, "a": 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(out, []interface{}{"a", "b"}) {
+		t.Errorf("unexpected result: %v", out)
+	}
+
+	// exit code from main
+	_, err = m.CallMain(context.Background(), starlet.StringAnyMap{"quit": true})
+	expectErr(t, err, "starlet: run: exit code: 3")
+}
@@ -1,17 +1,81 @@
 package starlet
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strings"
 
+	"github.com/1set/starlet/policy"
+	"go.starlark.net/resolve"
 	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
 )
 
+// ErrorKind is the category of an ExecError. It also implements the error interface, so it can be used as the target of errors.Is, e.g. errors.Is(err, ErrorKindSyntax).
+type ErrorKind uint8
+
+const (
+	// ErrorKindUnknown is for errors not in other categories, e.g. invalid arguments.
+	ErrorKindUnknown ErrorKind = iota
+	// ErrorKindSyntax is for syntax errors found when parsing the script.
+	ErrorKindSyntax
+	// ErrorKindResolve is for errors found when resolving names of the script, e.g. undefined names.
+	ErrorKindResolve
+	// ErrorKindRuntime is for errors raised during the execution, including panics.
+	ErrorKindRuntime
+	// ErrorKindCancelled is for executions cancelled by the context.
+	ErrorKindCancelled
+	// ErrorKindTimeout is for executions cancelled by the deadline of the context.
+	ErrorKindTimeout
+	// ErrorKindExit is for executions ended by exit() with non-zero code.
+	ErrorKindExit
+	// ErrorKindConversion is for failures of data conversion between Go and Starlark.
+	ErrorKindConversion
+	// ErrorKindLoad is for failures of loading modules, including load() in the script.
+	ErrorKindLoad
+	// ErrorKindBudget is for executions aborted for exceeding the budget.
+	ErrorKindBudget
+	// ErrorKindPermission is for capabilities denied by the permission policy of the machine.
+	ErrorKindPermission
+)
+
+var errorKindNames = map[ErrorKind]string{
+	ErrorKindUnknown:    "unknown error",
+	ErrorKindSyntax:     "syntax error",
+	ErrorKindResolve:    "resolve error",
+	ErrorKindRuntime:    "runtime error",
+	ErrorKindCancelled:  "cancelled",
+	ErrorKindTimeout:    "timed out",
+	ErrorKindExit:       "exit",
+	ErrorKindConversion: "conversion error",
+	ErrorKindLoad:       "load error",
+	ErrorKindBudget:     "budget exceeded",
+	ErrorKindPermission: "permission denied",
+}
+
+// String returns the name of the error kind.
+func (k ErrorKind) String() string {
+	if n, ok := errorKindNames[k]; ok {
+		return n
+	}
+	return fmt.Sprintf("error kind %d", uint8(k))
+}
+
+// Error returns the name of the error kind, it makes ErrorKind usable as the target of errors.Is.
+func (k ErrorKind) Error() string {
+	return k.String()
+}
+
 // ExecError is a custom error type for Starlet execution errors.
 type ExecError struct {
-	pkg   string // dependency source package or component name
-	act   string // error happens when doing this action
-	cause error  // the cause of the error
-	hint  string // additional hint for the error
+	pkg   string             // dependency source package or component name
+	act   string             // error happens when doing this action
+	cause error              // the cause of the error
+	hint  string             // additional hint for the error
+	kind  ErrorKind          // category of the error
+	pos   syntax.Position    // position in the script where the error happens
+	stack starlark.CallStack // Starlark call stack when the error happens
 }
 
 // Unwrap returns the cause of the error.
@@ -19,6 +83,55 @@ func (e ExecError) Unwrap() error {
 	return e.cause
 }
 
+// Is reports whether the error matches the target, the target can be an ErrorKind, or context.Canceled or context.DeadlineExceeded for cancelled or timed out executions.
+func (e ExecError) Is(target error) bool {
+	switch t := target.(type) {
+	case ErrorKind:
+		return t != ErrorKindUnknown && e.kind == t
+	}
+	switch target {
+	case context.Canceled:
+		return e.kind == ErrorKindCancelled
+	case context.DeadlineExceeded:
+		return e.kind == ErrorKindTimeout
+	}
+	return false
+}
+
+// Kind returns the category of the error.
+func (e ExecError) Kind() ErrorKind {
+	return e.kind
+}
+
+// Position returns the position in the script where the error happens, it's invalid if the position is unknown.
+// For runtime errors, it's the position of the innermost Starlark function call in the call stack.
+func (e ExecError) Position() syntax.Position {
+	return e.pos
+}
+
+// File returns the name of the script file where the error happens, or an empty string if unknown.
+func (e ExecError) File() string {
+	if !e.pos.IsValid() {
+		return ""
+	}
+	return e.pos.Filename()
+}
+
+// Line returns the 1-based line number in the script where the error happens, or zero if unknown.
+func (e ExecError) Line() int {
+	return int(e.pos.Line)
+}
+
+// Column returns the 1-based column number in the script where the error happens, or zero if unknown.
+func (e ExecError) Column() int {
+	return int(e.pos.Col)
+}
+
+// CallStack returns the Starlark call stack when the error happens, from the outermost to the innermost, or nil if it's not a runtime error.
+func (e ExecError) CallStack() starlark.CallStack {
+	return e.stack
+}
+
 // Error returns the error message.
 func (e ExecError) Error() string {
 	s := fmt.Sprintf("%s: %s: %v", e.pkg, e.act, e.cause)
@@ -36,6 +149,7 @@ func errorStarlarkPanic(action string, v interface{}) ExecError {
 		pkg:   `starlark`,
 		act:   action,
 		cause: fmt.Errorf("panic: %v", v),
+		kind:  ErrorKindRuntime,
 	}
 }
 
@@ -50,12 +164,14 @@ func errorStarlarkError(action string, err error) ExecError {
 	if se, ok := err.(*starlark.EvalError); ok {
 		hint = se.Backtrace()
 	}
-	return ExecError{
+	e := ExecError{
 		pkg:   `starlark`,
 		act:   action,
 		cause: err,
 		hint:  hint,
 	}
+	e.kind, e.pos, e.stack = inspectStarlarkError(err)
+	return e
 }
 
 // errorStarletError creates an ExecError for starlet.
@@ -64,11 +180,31 @@ func errorStarletError(action string, err error) ExecError {
 	if e, ok := err.(ExecError); ok {
 		return e
 	}
-	return ExecError{
+	e := ExecError{
 		pkg:   `starlet`,
 		act:   action,
 		cause: err,
 	}
+	if isBudgetError(err) {
+		e.kind = ErrorKindBudget
+	} else if errors.Is(err, ErrDebugAborted) {
+		e.kind = ErrorKindCancelled
+	}
+	return e
+}
+
+// errorStarletLoad creates an ExecError for starlet module loading.
+func errorStarletLoad(err error) ExecError {
+	// don't wrap if the error is already an ExecError
+	if e, ok := err.(ExecError); ok {
+		return e
+	}
+	return ExecError{
+		pkg:   `starlet`,
+		act:   `load`,
+		cause: err,
+		kind:  ErrorKindLoad,
+	}
 }
 
 // errorStarletErrorf creates an ExecError for starlet with a formatted message.
@@ -90,5 +226,113 @@ func errorStarlightConvert(target string, err error) ExecError {
 		pkg:   `starlight`,
 		act:   fmt.Sprintf("convert %s", target),
 		cause: err,
+		kind:  ErrorKindConversion,
+	}
+}
+
+// errorStarletDecode creates an ExecError for decoding the global variables into Go values.
+func errorStarletDecode(err error) ExecError {
+	return ExecError{
+		pkg:   `starlet`,
+		act:   `decode`,
+		cause: err,
+		kind:  ErrorKindConversion,
+	}
+}
+
+// withContext returns a copy of the error with the kind of cancellation or timeout, if the execution is cancelled by the done context.
+func (e ExecError) withContext(ctx context.Context) ExecError {
+	if ctx == nil || ctx.Err() == nil || e.kind != ErrorKindRuntime {
+		return e
+	}
+	var ee *starlark.EvalError
+	if !errors.As(e.cause, &ee) || !strings.HasPrefix(ee.Msg, "Starlark computation cancelled") {
+		return e
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		e.kind = ErrorKindTimeout
+	} else {
+		e.kind = ErrorKindCancelled
+	}
+	return e
+}
+
+// errorStarletExit creates an ExecError for the script exits with a non-zero code.
+func errorStarletExit(code uint8) ExecError {
+	return ExecError{
+		pkg:   `starlet`,
+		act:   `run`,
+		cause: ExitError{code: code},
+		kind:  ErrorKindExit,
 	}
 }
+
+// ExitError is the cause of ExecError when the script calls exit() with a non-zero code, it can be retrieved by errors.As.
+type ExitError struct {
+	code uint8
+}
+
+// Error returns the error message with the exit code.
+func (e ExitError) Error() string {
+	return fmt.Sprintf("exit code: %d", e.code)
+}
+
+// ExitCode returns the exit code passed to exit() by the script.
+func (e ExitError) ExitCode() int {
+	return int(e.code)
+}
+
+// loadError is the error of loading a module via load() in the script, it keeps the original error message.
+type loadError struct {
+	module string
+	cause  error
+}
+
+func (e loadError) Error() string {
+	return e.cause.Error()
+}
+
+func (e loadError) Unwrap() error {
+	return e.cause
+}
+
+// inspectStarlarkError returns the kind, position and call stack of the error from Starlark.
+func inspectStarlarkError(err error) (kind ErrorKind, pos syntax.Position, stack starlark.CallStack) {
+	var (
+		ee *starlark.EvalError
+		se syntax.Error
+		re resolve.ErrorList
+		le loadError
+	)
+	switch {
+	case errors.As(err, &ee):
+		kind = ErrorKindRuntime
+		if errors.As(err, &le) {
+			kind = ErrorKindLoad
+		} else if policy.IsPermissionError(err) {
+			kind = ErrorKindPermission
+		}
+		stack = ee.CallStack
+		// find the innermost frame in the script, skipping builtins
+		for i := 0; i < len(stack); i++ {
+			if p := stack.At(i).Pos; p.IsValid() && p.Filename() != "<builtin>" {
+				pos = p
+				break
+			}
+		}
+	case errors.As(err, &se):
+		kind = ErrorKindSyntax
+		pos = se.Pos
+	case errors.As(err, &re) && len(re) > 0:
+		kind = ErrorKindResolve
+		pos = re[0].Pos
+	case isBudgetError(err):
+		kind = ErrorKindBudget
+	}
+	return
+}
+
+// isBudgetError returns true if the error is caused by exceeding the budget.
+func isBudgetError(err error) bool {
+	return errors.Is(err, ErrExceedMaxSteps) || errors.Is(err, ErrExceedMaxOutput) || errors.Is(err, ErrExceedMaxOperatorResult)
+}
@@ -0,0 +1,244 @@
+package starlet_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/1set/starlet"
+	"go.starlark.net/starlark"
+)
+
+func TestErrorKind_String(t *testing.T) {
+	tests := []struct {
+		kind starlet.ErrorKind
+		want string
+	}{
+		{starlet.ErrorKindUnknown, "unknown error"},
+		{starlet.ErrorKindSyntax, "syntax error"},
+		{starlet.ErrorKindResolve, "resolve error"},
+		{starlet.ErrorKindRuntime, "runtime error"},
+		{starlet.ErrorKindCancelled, "cancelled"},
+		{starlet.ErrorKindTimeout, "timed out"},
+		{starlet.ErrorKindExit, "exit"},
+		{starlet.ErrorKindConversion, "conversion error"},
+		{starlet.ErrorKindLoad, "load error"},
+		{starlet.ErrorKindBudget, "budget exceeded"},
+		{starlet.ErrorKindPermission, "permission denied"},
+		{starlet.ErrorKind(100), "error kind 100"},
+	}
+	for _, tt := range tests {
+		if s := tt.kind.String(); s != tt.want {
+			t.Errorf("expected %q, got %q", tt.want, s)
+		}
+		if s := tt.kind.Error(); s != tt.want {
+			t.Errorf("expected %q, got %q", tt.want, s)
+		}
+	}
+}
+
+func TestExecError_Kind(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		globals  starlet.StringAnyMap
+		preload  starlet.ModuleLoaderList
+		budget   starlet.ExecBudget
+		timeout  time.Duration
+		wantKind starlet.ErrorKind
+		wantPos  string
+		wantFile string
+		wantLine int
+		wantCol  int
+		wantErr  string
+	}{
+		{
+			name:     "syntax",
+			code:     "x = 1\ny = (",
+			wantKind: starlet.ErrorKindSyntax,
+			wantPos:  "test.star:2:6",
+			wantFile: "test.star",
+			wantLine: 2,
+			wantCol:  6,
+			wantErr:  "starlark: exec: test.star:2:6: got end of file, want primary expression",
+		},
+		{
+			name:     "resolve",
+			code:     "x = 1\ny = z + 1",
+			wantKind: starlet.ErrorKindResolve,
+			wantPos:  "test.star:2:5",
+			wantFile: "test.star",
+			wantLine: 2,
+			wantCol:  5,
+			wantErr:  "starlark: exec: test.star:2:5: undefined: z",
+		},
+		{
+			name: "runtime",
+			code: `
+def f(x):
+    return 1 // x
+f(0)
+`,
+			wantKind: starlet.ErrorKindRuntime,
+			wantPos:  "test.star:3:14",
+			wantFile: "test.star",
+			wantLine: 3,
+			wantCol:  14,
+			wantErr:  "starlark: exec: floored division by zero",
+		},
+		{
+			name:     "runtime in builtin",
+			code:     "\nx = int('abc')",
+			wantKind: starlet.ErrorKindRuntime,
+			wantPos:  "test.star:2:8",
+			wantFile: "test.star",
+			wantLine: 2,
+			wantCol:  8,
+			wantErr:  "starlark: exec: int: invalid literal with base 10: abc",
+		},
+		{
+			name:     "load",
+			code:     `load("nonexist.star", "a")`,
+			wantKind: starlet.ErrorKindLoad,
+			wantPos:  "test.star:1:1",
+			wantFile: "test.star",
+			wantLine: 1,
+			wantCol:  1,
+			wantErr:  "starlark: exec: cannot load nonexist.star:",
+		},
+		{
+			name: "preload",
+			preload: starlet.ModuleLoaderList{func() (starlark.StringDict, error) {
+				return nil, errors.New("oops")
+			}},
+			code:     `x = 1`,
+			wantKind: starlet.ErrorKindLoad,
+			wantErr:  "starlet: load: oops",
+		},
+		{
+			name:     "conversion",
+			globals:  starlet.StringAnyMap{"ch": make(chan int)},
+			code:     `x = 1`,
+			wantKind: starlet.ErrorKindConversion,
+			wantErr:  "starlight: convert globals: type chan int is not a supported starlark type",
+		},
+		{
+			name:     "exit",
+			code:     `load("go_idiomatic", "exit"); exit(3)`,
+			wantKind: starlet.ErrorKindExit,
+			wantErr:  "starlet: run: exit code: 3",
+		},
+		{
+			name: "timeout",
+			code: `
+def f():
+    for i in range(1 << 30):
+        pass
+f()
+`,
+			timeout:  50 * time.Millisecond,
+			wantKind: starlet.ErrorKindTimeout,
+			wantPos:  "test.star:3:5",
+			wantFile: "test.star",
+			wantLine: 3,
+			wantCol:  5,
+			wantErr:  "starlark: exec: Starlark computation cancelled: context cancelled",
+		},
+		{
+			name: "budget",
+			code: `
+def f():
+    for i in range(1 << 30):
+        pass
+f()
+`,
+			budget:   starlet.ExecBudget{MaxSteps: 100},
+			wantKind: starlet.ErrorKindBudget,
+			wantErr:  "starlet: exec: exceeded max execution steps: 100",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := starlet.NewWithNames(tt.globals, nil, []string{"go_idiomatic"})
+			m.SetPreloadModules(tt.preload)
+			m.SetExecBudget(tt.budget)
+			m.SetScript("test.star", []byte(tt.code), MemFS{})
+
+			var err error
+			if tt.timeout > 0 {
+				_, err = m.RunWithTimeout(tt.timeout, nil)
+			} else {
+				_, err = m.Run()
+			}
+			expectErr(t, err, tt.wantErr)
+
+			var ee starlet.ExecError
+			if !errors.As(err, &ee) {
+				t.Errorf("expected ExecError, got %T", err)
+				return
+			}
+			if ee.Kind() != tt.wantKind {
+				t.Errorf("expected kind %v, got %v", tt.wantKind, ee.Kind())
+			}
+			if !errors.Is(err, tt.wantKind) {
+				t.Errorf("expected errors.Is(err, %v) to be true", tt.wantKind)
+			}
+			if errors.Is(err, starlet.ErrorKindUnknown) {
+				t.Errorf("expected errors.Is(err, %v) to be false", starlet.ErrorKindUnknown)
+			}
+			if tt.wantPos != "" {
+				if p := ee.Position(); !p.IsValid() || p.String() != tt.wantPos {
+					t.Errorf("expected position %q, got %q", tt.wantPos, p)
+				}
+			} else if ee.Position().IsValid() {
+				t.Errorf("expected invalid position, got %q", ee.Position())
+			}
+			if ee.File() != tt.wantFile || ee.Line() != tt.wantLine || ee.Column() != tt.wantCol {
+				t.Errorf("expected %s:%d:%d, got %s:%d:%d", tt.wantFile, tt.wantLine, tt.wantCol, ee.File(), ee.Line(), ee.Column())
+			}
+		})
+	}
+}
+
+func TestExecError_Context(t *testing.T) {
+	code := `
+def f():
+    for i in range(1 << 30):
+        pass
+f()
+`
+	m := starlet.NewDefault()
+	m.SetScript("test.star", []byte(code), nil)
+
+	// timed out
+	_, err := m.RunWithTimeout(50*time.Millisecond, nil)
+	if !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if !errors.Is(err, starlet.ErrorKindTimeout) {
+		t.Errorf("expected timeout kind, got %v", err)
+	}
+
+	// cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err = m.RunWithContext(ctx, nil)
+	if !errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected cancelled, got %v", err)
+	}
+
+	// call stack from outermost to innermost
+	var ee starlet.ExecError
+	if !errors.As(err, &ee) {
+		t.Errorf("expected ExecError, got %T", err)
+		return
+	}
+	cs := ee.CallStack()
+	if len(cs) != 2 || cs[0].Name != "<toplevel>" || cs[1].Name != "f" {
+		t.Errorf("unexpected call stack: %v", cs)
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	itn "github.com/1set/starlet/internal"
 	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
 )
 
 // execStarlarkFile executes a Starlark file with the given filename and source, and returns the global environment and any error encountered.
@@ -18,24 +19,48 @@ func (m *Machine) execStarlarkFile(filename string, src interface{}, allowCache
 	thread := m.thread
 	predeclared := m.predeclared
 	hasCache := m.progCache != nil
+	rw := getProgramRewrite(thread)
 
 	// if cache is not enabled or not allowed, just execute the original source
-	if !hasCache || !allowCache {
+	if (!hasCache || !allowCache) && rw == 0 {
 		return starlark.ExecFileOptions(opts, thread, filename, src, predeclared)
 	}
 
-	// for compiled program and cache key
+	// compile or load the program from cache
+	progCache := m.progCache
+	if !allowCache {
+		progCache = nil
+	}
+	return execProgram(thread, progCache, opts, filename, src, predeclared, rw)
+}
+
+// execProgram compiles the source or loads the compiled program from the cache, and executes it with the predeclared values.
+// For the rewritten program, the operators are checked against the operator result size limit of the budget, and the calls are traced for the hooks and profiler.
+func execProgram(thread *starlark.Thread, progCache ByteCache, opts *syntax.FileOptions, filename string, src interface{}, predeclared starlark.StringDict, rw programRewrite) (starlark.StringDict, error) {
+	prog, err := compileProgramWithCache(progCache, opts, filename, src, predeclared.Has, rw)
+	if err != nil {
+		return nil, err
+	}
+	predeclared = rw.predeclared(predeclared)
+
+	// execute the compiled program
+	g, err := prog.Init(thread, predeclared)
+	g.Freeze()
+	return g, err
+}
+
+// compileProgramWithCache returns the compiled program of the given source, it tries to load the compiled program from the cache first,
+// and saves the compiled program to the cache after compilation. The cache is skipped if it's nil.
+func compileProgramWithCache(progCache ByteCache, opts *syntax.FileOptions, filename string, src interface{}, isPredeclared func(string) bool, rw programRewrite) (*starlark.Program, error) {
 	var (
 		prog *starlark.Program
 		err  error
-		//key = fmt.Sprintf("%d:%s", starlark.CompilerVersion, filename)
-		key = getCacheKey(filename, src)
+		key  = getCacheKey(opts, filename, src) + rw.cacheKeySuffix()
 	)
 
-	// try to load compiled program from cache first
-	if hasCache {
-		// if cache is enabled, try to load compiled bytes from cache first
-		if cb, ok := m.progCache.Get(key); ok {
+	// if cache is enabled, try to load compiled bytes from cache first
+	if progCache != nil {
+		if cb, ok := progCache.Get(key); ok {
 			// load program from compiled bytes
 			if prog, err = starlark.CompiledProgram(bytes.NewReader(cb)); err != nil {
 				// if failed, remove the result and continue
@@ -47,35 +72,72 @@ func (m *Machine) execStarlarkFile(filename string, src interface{}, allowCache
 	// if program is not loaded from cache, compile and cache it
 	if prog == nil {
 		// parse, resolve, and compile a Starlark source file.
-		if _, prog, err = starlark.SourceProgramOptions(opts, filename, src, predeclared.Has); err != nil {
+		if prog, err = compileProgram(opts, filename, src, isPredeclared, rw); err != nil {
 			return nil, err
 		}
+		if progCache == nil {
+			return prog, nil
+		}
 		// dump the compiled program to bytes
 		buf := new(bytes.Buffer)
 		if err = prog.Write(buf); err != nil {
 			return nil, err
 		}
 		// save the compiled bytes to cache
-		_ = m.progCache.Set(key, buf.Bytes())
+		_ = progCache.Set(key, buf.Bytes())
 	}
+	return prog, nil
+}
 
-	// execute the compiled program
-	g, err := prog.Init(thread, predeclared)
-	g.Freeze()
-	return g, err
+// compileProgram parses, resolves, and compiles a Starlark source file, and applies the rewrites to the syntax tree if any.
+func compileProgram(opts *syntax.FileOptions, filename string, src interface{}, isPredeclared func(string) bool, rw programRewrite) (*starlark.Program, error) {
+	if rw == 0 {
+		_, prog, err := starlark.SourceProgramOptions(opts, filename, src, isPredeclared)
+		return prog, err
+	}
+	f, err := opts.Parse(filename, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	rw.apply(f)
+	return starlark.FileProgram(f, func(name string) bool {
+		return rw.isRewriteName(name) || isPredeclared(name)
+	})
 }
 
-func getCacheKey(filename string, src interface{}) string {
-	var k string
+// getCacheKey returns the cache key of the compiled program, which consists of the compiler version, the file options affecting the compilation and the file name,
+// and the hash of the source if it's given as the content instead of a reader.
+func getCacheKey(opts *syntax.FileOptions, filename string, src interface{}) string {
+	k := fmt.Sprintf("%d:%s:%s", starlark.CompilerVersion, getOptionsKey(opts), filename)
 	switch s := src.(type) {
 	case string:
-		k = itn.GetStringMD5(s)
+		k += ":" + itn.GetStringMD5(s)
 	case []byte:
-		k = itn.GetBytesMD5(s)
-	default:
-		k = filename
+		k += ":" + itn.GetBytesMD5(s)
+	}
+	return k
+}
+
+// getOptionsKey returns the enabled file options as letters, e.g. "sr" for Set and Recursion.
+func getOptionsKey(opts *syntax.FileOptions) string {
+	flags := []struct {
+		on bool
+		c  byte
+	}{
+		{opts.Set, 's'},
+		{opts.While, 'w'},
+		{opts.TopLevelControl, 't'},
+		{opts.GlobalReassign, 'g'},
+		{opts.LoadBindsGlobally, 'l'},
+		{opts.Recursion, 'r'},
+	}
+	k := make([]byte, 0, len(flags))
+	for _, f := range flags {
+		if f.on {
+			k = append(k, f.c)
+		}
 	}
-	return fmt.Sprintf("%d:%s", starlark.CompilerVersion, k)
+	return string(k)
 }
 
 // ByteCache is an interface for caching byte data, used for caching compiled Starlark programs.
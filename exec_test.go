@@ -1,6 +1,7 @@
 package starlet_test
 
 import (
+	"context"
 	"reflect"
 	"testing"
 
@@ -137,3 +138,42 @@ func BenchmarkRunMemoryCache(b *testing.B) {
 		_, _ = m.Run()
 	}
 }
+
+func TestMachine_Run_LoadCache(t *testing.T) {
+	fs := MemFS{
+		"lib.star":  `def double(x): return x * 2`,
+		"main.star": `load("lib.star", "double"); y = double(x)`,
+	}
+	sc := starlet.NewLRUCache(0, 0, 0)
+	for i := 0; i < 3; i++ {
+		m := starlet.NewDefault()
+		m.SetScriptCache(sc)
+		m.SetScript("main.star", nil, fs)
+		out, err := m.RunWithContext(context.Background(), starlet.StringAnyMap{"x": i})
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+			return
+		}
+		if y := out["y"]; y != int64(i*2) {
+			t.Errorf("expected y=%d, got %v", i*2, y)
+		}
+	}
+
+	// compiled programs of both main script and loaded module are cached
+	s := sc.Stats()
+	if s.Entries != 2 || s.Misses != 2 || s.Hits != 4 {
+		t.Errorf("unexpected cache stats: %+v", s)
+	}
+
+	// loaded module with different content is cached separately
+	fs["lib.star"] = `def double(x): return x + x`
+	m := starlet.NewDefault()
+	m.SetScriptCache(sc)
+	m.SetScript("main.star", nil, fs)
+	if _, err := m.RunWithContext(context.Background(), starlet.StringAnyMap{"x": 1}); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if s = sc.Stats(); s.Entries != 3 {
+		t.Errorf("unexpected cache stats: %+v", s)
+	}
+}
@@ -0,0 +1,281 @@
+package starlet
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	itn "github.com/1set/starlet/internal"
+	"go.starlark.net/starlark"
+)
+
+const (
+	// fileCacheExt is the file extension of cached files in FileCache.
+	fileCacheExt = ".starc"
+	// fileCacheTempPrefix is the name prefix of temporary files in FileCache.
+	fileCacheTempPrefix = ".tmp-"
+)
+
+// FileCache is a file system backed ByteCache, which stores each value in a separate file under the directory, so the compiled programs survive across processes.
+//
+// Files are written atomically via renaming temporary files, and the least recently used ones are evicted once the total size exceeds the limit.
+// The file names contain the current starlark.CompilerVersion, files of other versions are removed when the cache is opened, and never read.
+type FileCache struct {
+	_        itn.DoNotCompare
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+	lru      *list.List
+	items    map[string]*list.Element
+}
+
+// fileCacheItem is an item of the LRU list in FileCache.
+type fileCacheItem struct {
+	name string
+	size int64
+}
+
+// NewFileCache creates a FileCache in the given directory, and creates the directory if it doesn't exist.
+// The maxBytes limits the total size of cached files, and zero or negative value means no limit.
+// Existing files of the current compiler version are loaded as cached, and files of other versions are removed.
+func NewFileCache(dir string, maxBytes int64) (*FileCache, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("empty cache directory")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &FileCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+	if err := c.scan(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Dir returns the directory of the cache.
+func (c *FileCache) Dir() string {
+	return c.dir
+}
+
+// Size returns the total size of cached files in bytes.
+func (c *FileCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+// Get returns the value for the given key, and whether the key exists.
+func (c *FileCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := c.fileName(key)
+	el, ok := c.items[name]
+	if !ok {
+		// it may be written by other processes
+		fi, err := os.Stat(filepath.Join(c.dir, name))
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil, false
+		}
+		el = c.add(name, fi.Size())
+	}
+
+	// read the content, and drop it if it's gone
+	path := filepath.Join(c.dir, name)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		c.remove(el)
+		return nil, false
+	}
+
+	// mark as recently used, and persist the access time for the next process
+	c.lru.MoveToFront(el)
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return b, true
+}
+
+// Set sets the value for the given key, and evicts the least recently used files if the total size exceeds the limit.
+func (c *FileCache) Set(key string, value []byte) error {
+	size := int64(len(value))
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return fmt.Errorf("value size %d exceeds cache limit %d", size, c.maxBytes)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// write to a temporary file and rename it
+	name := c.fileName(key)
+	if err := c.writeFile(name, value); err != nil {
+		return err
+	}
+
+	// update the index and evict if needed
+	if el, ok := c.items[name]; ok {
+		c.remove(el)
+	}
+	c.add(name, size)
+	c.evict()
+	return nil
+}
+
+// Delete removes the value for the given key.
+func (c *FileCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := c.fileName(key)
+	if el, ok := c.items[name]; ok {
+		c.remove(el)
+	}
+	if err := os.Remove(filepath.Join(c.dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Purge removes all the cached files.
+func (c *FileCache) Purge() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var lastErr error
+	for name := range c.items {
+		if err := os.Remove(filepath.Join(c.dir, name)); err != nil && !os.IsNotExist(err) {
+			lastErr = err
+		}
+	}
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.size = 0
+	return lastErr
+}
+
+// fileName returns the cache file name for the given key, which is prefixed with the current compiler version.
+func (c *FileCache) fileName(key string) string {
+	return fmt.Sprintf("%d-%s%s", starlark.CompilerVersion, itn.GetStringMD5(key), fileCacheExt)
+}
+
+// writeFile writes the value to the named file atomically.
+func (c *FileCache) writeFile(name string, value []byte) error {
+	f, err := ioutil.TempFile(c.dir, fileCacheTempPrefix)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err = f.Write(value); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, filepath.Join(c.dir, name)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// scan loads existing files in the directory into the index ordered by modification time, and removes temporary files and files of other compiler versions.
+func (c *FileCache) scan() error {
+	fis, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	type found struct {
+		name  string
+		size  int64
+		mtime time.Time
+	}
+	var files []found
+	for _, fi := range fis {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(name, fileCacheTempPrefix) {
+			_ = os.Remove(filepath.Join(c.dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, fileCacheExt) {
+			continue
+		}
+		if ver, ok := parseFileCacheVersion(name); !ok || ver != starlark.CompilerVersion {
+			_ = os.Remove(filepath.Join(c.dir, name))
+			continue
+		}
+		files = append(files, found{name: name, size: fi.Size(), mtime: fi.ModTime()})
+	}
+
+	// add from the oldest to the newest, so the newest is at the front
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mtime.Before(files[j].mtime)
+	})
+	for _, f := range files {
+		c.add(f.name, f.size)
+	}
+	c.evict()
+	return nil
+}
+
+// add adds the named file of the given size to the front of the index.
+func (c *FileCache) add(name string, size int64) *list.Element {
+	el := c.lru.PushFront(&fileCacheItem{name: name, size: size})
+	c.items[name] = el
+	c.size += size
+	return el
+}
+
+// remove removes the element from the index without removing the file.
+func (c *FileCache) remove(el *list.Element) {
+	it := el.Value.(*fileCacheItem)
+	c.lru.Remove(el)
+	delete(c.items, it.name)
+	c.size -= it.size
+}
+
+// evict removes the least recently used files until the total size is within the limit.
+func (c *FileCache) evict() {
+	if c.maxBytes <= 0 {
+		return
+	}
+	for c.size > c.maxBytes {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		c.remove(el)
+		_ = os.Remove(filepath.Join(c.dir, el.Value.(*fileCacheItem).name))
+	}
+}
+
+// parseFileCacheVersion returns the compiler version in the name of cached file.
+func parseFileCacheVersion(name string) (int, bool) {
+	idx := strings.Index(name, "-")
+	if idx <= 0 {
+		return 0, false
+	}
+	ver, err := strconv.Atoi(name[:idx])
+	if err != nil {
+		return 0, false
+	}
+	return ver, true
+}
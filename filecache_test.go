@@ -0,0 +1,218 @@
+package starlet_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/1set/starlet"
+	"go.starlark.net/starlark"
+)
+
+func TestNewFileCache(t *testing.T) {
+	if _, err := starlet.NewFileCache("", 0); err == nil {
+		t.Errorf("expected error for empty dir, got nil")
+	}
+
+	// create the directory
+	dir := filepath.Join(t.TempDir(), "a", "b")
+	fc, err := starlet.NewFileCache(dir, 0)
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if fc.Dir() != dir {
+		t.Errorf("expected dir %q, got %q", dir, fc.Dir())
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		t.Errorf("expected directory created, got %v", err)
+	}
+}
+
+func TestFileCache_GetSet(t *testing.T) {
+	dir := t.TempDir()
+	fc, err := starlet.NewFileCache(dir, 0)
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if _, ok := fc.Get("none"); ok {
+		t.Errorf("expected miss for non-existing key")
+	}
+	if err := fc.Set("key1", []byte("value1")); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if v, ok := fc.Get("key1"); !ok || string(v) != "value1" {
+		t.Errorf("expected value1, got %q %v", v, ok)
+	}
+	if err := fc.Set("key1", []byte("value11")); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if v, ok := fc.Get("key1"); !ok || string(v) != "value11" {
+		t.Errorf("expected value11, got %q %v", v, ok)
+	}
+	if s := fc.Size(); s != 7 {
+		t.Errorf("expected size 7, got %d", s)
+	}
+
+	// no temporary files left
+	fis, _ := ioutil.ReadDir(dir)
+	if len(fis) != 1 {
+		t.Errorf("expected 1 file, got %d", len(fis))
+	}
+
+	// persisted for another instance
+	fc2, err := starlet.NewFileCache(dir, 0)
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if v, ok := fc2.Get("key1"); !ok || string(v) != "value11" {
+		t.Errorf("expected value11 from new instance, got %q %v", v, ok)
+	}
+
+	// written by another instance
+	if err := fc2.Set("key2", []byte("value2")); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if v, ok := fc.Get("key2"); !ok || string(v) != "value2" {
+		t.Errorf("expected value2 from old instance, got %q %v", v, ok)
+	}
+
+	// deleted by another instance
+	if err := fc2.Delete("key1"); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if _, ok := fc.Get("key1"); ok {
+		t.Errorf("expected miss for deleted key")
+	}
+	if err := fc.Delete("key1"); err != nil {
+		t.Errorf("expected no error for deleting twice, got %v", err)
+	}
+
+	// purge all
+	if err := fc.Purge(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if _, ok := fc.Get("key2"); ok {
+		t.Errorf("expected miss for purged key")
+	}
+	if s := fc.Size(); s != 0 {
+		t.Errorf("expected size 0, got %d", s)
+	}
+}
+
+func TestFileCache_Evict(t *testing.T) {
+	dir := t.TempDir()
+	fc, err := starlet.NewFileCache(dir, 30)
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if err := fc.Set("large", bytes.Repeat([]byte("x"), 31)); err == nil {
+		t.Errorf("expected error for too large value, got nil")
+	}
+
+	// fill the cache and use the first one
+	for i := 0; i < 3; i++ {
+		if err := fc.Set(fmt.Sprintf("key%d", i), bytes.Repeat([]byte("x"), 10)); err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	}
+	if _, ok := fc.Get("key0"); !ok {
+		t.Errorf("expected hit for key0")
+	}
+
+	// the least recently used one is evicted
+	if err := fc.Set("key3", bytes.Repeat([]byte("x"), 10)); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	for k, exp := range map[string]bool{"key0": true, "key1": false, "key2": true, "key3": true} {
+		if _, ok := fc.Get(k); ok != exp {
+			t.Errorf("expected %s hit=%v, got %v", k, exp, ok)
+		}
+	}
+	if s := fc.Size(); s != 30 {
+		t.Errorf("expected size 30, got %d", s)
+	}
+
+	// evicted on open with smaller limit, by modification time
+	old := time.Now().Add(-time.Hour)
+	fis, _ := ioutil.ReadDir(dir)
+	for _, fi := range fis {
+		_ = os.Chtimes(filepath.Join(dir, fi.Name()), old, old)
+	}
+	if _, ok := fc.Get("key2"); !ok {
+		t.Errorf("expected hit for key2")
+	}
+	fc2, err := starlet.NewFileCache(dir, 10)
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if s := fc2.Size(); s != 10 {
+		t.Errorf("expected size 10, got %d", s)
+	}
+	if fis, _ = ioutil.ReadDir(dir); len(fis) != 1 {
+		t.Errorf("expected 1 file, got %d", len(fis))
+	}
+	if _, ok := fc2.Get("key2"); !ok {
+		t.Errorf("expected hit for key2")
+	}
+}
+
+func TestFileCache_Version(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]bool{
+		fmt.Sprintf("%d-0123456789abcdef0123456789abcdef.starc", starlark.CompilerVersion-1): false,
+		"abc-0123456789abcdef0123456789abcdef.starc":                                         false,
+		".tmp-12345": false,
+		"readme.txt": true,
+	}
+	for name := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Errorf("failed to write file: %v", err)
+			return
+		}
+	}
+	if _, err := starlet.NewFileCache(dir, 0); err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	for name, exist := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != exist {
+			t.Errorf("expected %s exists=%v, got %v", name, exist, err)
+		}
+	}
+}
+
+func TestFileCache_Machine(t *testing.T) {
+	dir := t.TempDir()
+	code := `x = 1 + 2`
+	for i := 0; i < 2; i++ {
+		fc, err := starlet.NewFileCache(dir, 0)
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+			return
+		}
+		if i > 0 && fc.Size() == 0 {
+			t.Errorf("expected compiled program cached")
+		}
+
+		m := starlet.NewDefault()
+		m.SetScriptCache(fc)
+		m.SetScript("test.star", []byte(code), nil)
+		out, err := m.Run()
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+			return
+		}
+		if out["x"] != int64(3) {
+			t.Errorf("expected x=3, got %v", out["x"])
+		}
+	}
+}
@@ -4,6 +4,8 @@ go 1.18
 
 require (
 	github.com/1set/starlight v0.1.2
+	github.com/chzyer/readline v0.0.0-20180603132655-2972be24d48e
+	github.com/google/pprof v0.0.0-20220318212150-b2ab0324ddda
 	github.com/google/uuid v1.6.0
 	github.com/h2so5/here v0.0.0-20200815043652-5e14eb691fae
 	github.com/montanaflynn/stats v0.7.1
@@ -14,7 +16,6 @@ require (
 )
 
 require (
-	github.com/chzyer/readline v0.0.0-20180603132655-2972be24d48e // indirect
 	go.uber.org/multierr v1.9.0 // indirect
 	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
 )
@@ -0,0 +1,86 @@
+package starlet
+
+import (
+	"context"
+
+	libhttp "github.com/1set/starlet/lib/http"
+	"go.starlark.net/starlark"
+)
+
+// HTTPRunner returns the runner for the http handler of lib/http, which acquires a Machine from the pool for each request and releases it after the request is handled.
+func (p *MachinePool) HTTPRunner() libhttp.Runner {
+	return func(ctx context.Context, fn func(e libhttp.Executor) error) error {
+		return p.Do(ctx, func(m *Machine) error {
+			return fn(m.HTTPExecutor())
+		})
+	}
+}
+
+// NewHTTPRunner returns the runner for the http handler of lib/http, which creates a Machine by the factory for each request.
+func NewHTTPRunner(factory func() (*Machine, error)) libhttp.Runner {
+	return func(ctx context.Context, fn func(e libhttp.Executor) error) error {
+		m, err := factory()
+		if err != nil {
+			return err
+		}
+		return fn(m.HTTPExecutor())
+	}
+}
+
+// HTTPExecutor returns the executor of the Machine for the http handler of lib/http, which runs the script and calls the functions defined by it with Starlark values.
+func (m *Machine) HTTPExecutor() libhttp.Executor {
+	return machineExecutor{m}
+}
+
+// machineExecutor implements libhttp.Executor for the Machine.
+type machineExecutor struct {
+	m *Machine
+}
+
+func (e machineExecutor) Exec(ctx context.Context, extras starlark.StringDict) error {
+	_, err := e.m.RunWithContext(ctx, castStringDictToAnyMap(extras))
+	return err
+}
+
+func (e machineExecutor) Has(name string) bool {
+	m := e.m
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.predeclared == nil {
+		return false
+	}
+	_, err := m.lookupCallable(name)
+	return err == nil
+}
+
+func (e machineExecutor) Call(ctx context.Context, name string, args ...starlark.Value) (out starlark.Value, err error) {
+	m := e.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = errorStarlarkPanic("call", r)
+		}
+	}()
+	if m.predeclared == nil || m.thread == nil {
+		return nil, errorStarletErrorf("call", "no function loaded")
+	}
+	callFunc, err := m.lookupCallable(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// reset thread, and cancel it when context cancelled
+	m.thread.Uncancel()
+	ctx, stopWatch := m.watchContext(ctx)
+	defer stopWatch()
+
+	res, err := starlark.Call(m.thread, callFunc, args, nil)
+	stopWatch()
+	if err != nil {
+		return res, errorStarlarkError("call", err).withContext(ctx)
+	}
+	return res, nil
+}
@@ -0,0 +1,143 @@
+package starlet_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/1set/starlet"
+	libhttp "github.com/1set/starlet/lib/http"
+	"go.starlark.net/starlark"
+)
+
+func TestMachinePool_HTTPRunner(t *testing.T) {
+	tpl := starlet.NewDefault()
+	tpl.SetGlobals(starlet.StringAnyMap{"greeting": "hello"})
+	tpl.SetScript("handler.star", []byte(`
+def before_request(req, resp):
+	if not req.headers.get("X-Token"):
+		resp.set_status(401)
+		resp.set_text("denied")
+		return False
+
+def handle(req, resp):
+	if req.url == "/slow":
+		for i in range(100000000):
+			pass
+	resp.set_text(greeting + " " + req.params.get("name", "world"))
+
+def after_request(req, resp):
+	resp.add_header("X-Served-By", "starlet")
+`), nil)
+	p, err := starlet.NewMachinePool(tpl, 2)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer p.Close()
+
+	timeout := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), 50*time.Millisecond)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+	h := libhttp.NewHandler(p.HTTPRunner(), libhttp.WithMiddleware(timeout))
+
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		params     map[string]string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "handled", path: "/", token: "t", params: map[string]string{"name": "pool"}, wantStatus: http.StatusOK, wantBody: "hello pool"},
+		{name: "skipped", path: "/", wantStatus: http.StatusUnauthorized, wantBody: "denied"},
+		{name: "timeout", path: "/slow", token: "t", wantStatus: http.StatusGatewayTimeout, wantBody: "Gateway Timeout\n"},
+		{name: "after timeout", path: "/", token: "t", wantStatus: http.StatusOK, wantBody: "hello world"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("X-Token", tt.token)
+			}
+			if tt.params != nil {
+				req = libhttp.WithPathParams(req, tt.params)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus || rec.Body.String() != tt.wantBody {
+				t.Errorf("unexpected response: got %d %q, want %d %q", rec.Code, rec.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			if tt.wantStatus != http.StatusGatewayTimeout && rec.Header().Get("X-Served-By") != "starlet" {
+				t.Errorf("after_request is not called: %v", rec.Header())
+			}
+		})
+	}
+	if s := p.Stats(); s.InUse != 0 || s.Acquires != uint64(len(tests)) {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
+
+func TestNewHTTPRunner(t *testing.T) {
+	var cnt int
+	h := libhttp.NewHandler(starlet.NewHTTPRunner(func() (*starlet.Machine, error) {
+		cnt++
+		if cnt > 1 {
+			return nil, errors.New("no machine")
+		}
+		m := starlet.NewDefault()
+		m.SetScript("top.star", []byte(`response.set_text("top-level " + request.method)`), nil)
+		return m, nil
+	}), libhttp.WithErrorHandler(func(w http.ResponseWriter, r *http.Request, code int, err error) {
+		http.Error(w, fmt.Sprintf("%d %v", code, err), code)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "top-level POST" {
+		t.Errorf("unexpected response: %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusInternalServerError || rec.Body.String() != "500 no machine\n" {
+		t.Errorf("unexpected response: %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMachine_HTTPExecutor(t *testing.T) {
+	m := starlet.NewDefault()
+	e := m.HTTPExecutor()
+	if e.Has("handle") {
+		t.Errorf("expected no function before exec")
+	}
+	if _, err := e.Call(context.Background(), "handle"); err == nil {
+		t.Errorf("expected error for call before exec, got nil")
+	}
+
+	m.SetScript("exec.star", []byte(`
+def handle(x):
+	return x * 2
+def boom():
+	fail("boom")
+value = 1
+`), nil)
+	if err := e.Exec(context.Background(), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !e.Has("handle") || e.Has("value") || e.Has("missing") {
+		t.Errorf("unexpected functions found")
+	}
+	if v, err := e.Call(context.Background(), "handle", starlark.MakeInt(21)); err != nil || v.String() != "42" {
+		t.Errorf("unexpected result: %v, %v", v, err)
+	}
+	_, err := e.Call(context.Background(), "boom")
+	expectErr(t, err, "starlark: call: fail: boom")
+}
@@ -98,3 +98,61 @@ func TestSetOutputConversionEnabled(t *testing.T) {
 		t.Errorf("Expected output conversion to be enabled, but it wasn't")
 	}
 }
+
+func TestREPLSession_Do(t *testing.T) {
+	m := NewWithNames(StringAnyMap{"_hidden": 1, "value": 2}, []string{"json"}, nil)
+	r := &replSession{m: m}
+	if err := r.init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		line   string
+		want   []string
+		length int
+	}{
+		{line: ":re", want: []string{"set"}, length: 2},
+		{line: ":reset ", want: nil},
+		{line: "val", want: []string{"ue"}, length: 3},
+		{line: "x = le", want: []string{"n"}, length: 2},
+		{line: "_hi", want: []string{"dden"}, length: 3},
+		{line: "json.en", want: []string{"code"}, length: 2},
+		{line: "print(json.dec", want: []string{"ode"}, length: 3},
+		{line: "value.x", want: nil},
+		{line: "missing.x", want: nil},
+		{line: "1", want: nil},
+		{line: "", want: nil},
+	}
+	for _, tt := range tests {
+		res, length := r.Do([]rune(tt.line), len(tt.line))
+		var got []string
+		for _, s := range res {
+			got = append(got, string(s))
+		}
+		if !reflect.DeepEqual(got, tt.want) || (tt.want != nil && length != tt.length) {
+			t.Errorf("Do(%q) = %q, %d; want %q, %d", tt.line, got, length, tt.want, tt.length)
+		}
+	}
+
+	// the private names are hidden without prefix
+	res, _ := r.Do([]rune("x = "), 4)
+	for _, s := range res {
+		if string(s) == "_hidden" {
+			t.Errorf("unexpected private name completed")
+		}
+	}
+}
+
+func TestNextIndent(t *testing.T) {
+	tests := map[string]string{
+		"x = 1":                "",
+		"def f():":             "    ",
+		"    if x:  ":          "        ",
+		"        return x":     "        ",
+		"\tfor i in range(3):": "\t    ",
+	}
+	for line, want := range tests {
+		if got := nextIndent(line); got != want {
+			t.Errorf("nextIndent(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
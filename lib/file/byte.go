@@ -2,7 +2,10 @@ package file
 
 import (
 	"bufio"
+	"io"
 	"os"
+
+	"github.com/1set/starlet/vfs"
 )
 
 var (
@@ -37,26 +40,36 @@ func ReadFileString(path string) (string, error) {
 
 // WriteFileBytes writes the given data into a file.
 func WriteFileBytes(path string, data []byte) error {
-	return openFileWriteBytes(path, createFileFlag, data)
+	return openFileWriteBytes(vfs.Host, path, createFileFlag, data)
 }
 
 // WriteFileString writes the given content string into a file.
 func WriteFileString(path string, content string) error {
-	return openFileWriteString(path, createFileFlag, content)
+	return openFileWriteString(vfs.Host, path, createFileFlag, content)
 }
 
 // AppendFileBytes writes the given data to the end of a file.
 func AppendFileBytes(path string, data []byte) error {
-	return openFileWriteBytes(path, appendFileFlag, data)
+	return openFileWriteBytes(vfs.Host, path, appendFileFlag, data)
 }
 
 // AppendFileString appends the given content string to the end of a file.
 func AppendFileString(path string, content string) error {
-	return openFileWriteString(path, appendFileFlag, content)
+	return openFileWriteString(vfs.Host, path, appendFileFlag, content)
+}
+
+// readFileBytes reads the whole named file in the file system and returns the contents.
+func readFileBytes(sys vfs.System, path string) ([]byte, error) {
+	file, err := sys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
 }
 
-func openFileWriteBytes(path string, flag int, data []byte) error {
-	file, err := os.OpenFile(path, flag, filePerm)
+func openFileWriteBytes(sys vfs.System, path string, flag int, data []byte) error {
+	file, err := sys.OpenFile(path, flag, filePerm)
 	if err != nil {
 		return err
 	}
@@ -68,8 +81,8 @@ func openFileWriteBytes(path string, flag int, data []byte) error {
 	return err
 }
 
-func openFileWriteString(path string, flag int, content string) error {
-	file, err := os.OpenFile(path, flag, filePerm)
+func openFileWriteString(sys vfs.System, path string, flag int, content string) error {
+	file, err := sys.OpenFile(path, flag, filePerm)
 	if err != nil {
 		return err
 	}
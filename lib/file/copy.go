@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/1set/starlet/vfs"
 	"go.starlark.net/starlark"
 )
 
@@ -20,7 +21,7 @@ func copyFile(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple,
 	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "src", &src, "dst", &dst, "overwrite?", &overwrite); err != nil {
 		return starlark.None, err
 	}
-	dp, err := copyFileGo(src, dst, overwrite)
+	dp, err := copyFileGo(vfs.GetThreadFS(thread), src, dst, overwrite)
 	if err != nil {
 		return nil, err
 	}
@@ -31,7 +32,7 @@ func copyFile(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple,
 // If the destination file exists and overwrite is false, an error is returned.
 // Symbolic links are followed on both source and destination.
 // Errors occurred while setting the mode or access and modification times are ignored.
-func copyFileGo(src, dst string, overwrite bool) (string, error) {
+func copyFileGo(sys vfs.System, src, dst string, overwrite bool) (string, error) {
 	// No empty input
 	if src == emptyStr {
 		return emptyStr, errors.New("source path is empty")
@@ -41,7 +42,7 @@ func copyFileGo(src, dst string, overwrite bool) (string, error) {
 	}
 
 	// Open the source file.
-	srcFile, err := os.Open(src)
+	srcFile, err := sys.Open(src)
 	if err != nil {
 		return emptyStr, fmt.Errorf("open source file: %w", err)
 	}
@@ -58,12 +59,12 @@ func copyFileGo(src, dst string, overwrite bool) (string, error) {
 	}
 
 	// Check if dst is a directory, and adjust the destination path if it is
-	dstStat, err := os.Stat(dst)
+	dstStat, err := sys.Stat(dst)
 	if err == nil {
 		if dstStat.IsDir() {
 			dst = filepath.Join(dst, filepath.Base(src))
 			// Check adjusted destination path
-			dstStat, err = os.Stat(dst)
+			dstStat, err = sys.Stat(dst)
 		}
 	}
 	if err != nil && !os.IsNotExist(err) {
@@ -74,7 +75,7 @@ func copyFileGo(src, dst string, overwrite bool) (string, error) {
 	// for destination file exists
 	if err == nil {
 		// If the source and destination files are the same, return an error.
-		if os.SameFile(srcStat, dstStat) {
+		if sys.SameFile(srcStat, dstStat) {
 			return emptyStr, fmt.Errorf("source and destination are the same file: %s", src)
 		}
 		// If overwrite is false, return an error if the destination file exists.
@@ -84,7 +85,7 @@ func copyFileGo(src, dst string, overwrite bool) (string, error) {
 	}
 
 	// Create the destination file.
-	dstFile, err := os.Create(dst)
+	dstFile, err := sys.OpenFile(dst, createFileFlag, 0666)
 	if err != nil {
 		return emptyStr, fmt.Errorf("cannot create file: %w", err)
 	}
@@ -96,7 +97,7 @@ func copyFileGo(src, dst string, overwrite bool) (string, error) {
 	}
 
 	// Attempt to set the mode, times file to match the source file, i.e. ignore the errors
-	_ = os.Chmod(dst, srcStat.Mode())
-	_ = os.Chtimes(dst, srcStat.ModTime(), srcStat.ModTime())
+	_ = sys.Chmod(dst, srcStat.Mode())
+	_ = sys.Chtimes(dst, srcStat.ModTime(), srcStat.ModTime())
 	return dst, nil
 }
@@ -7,6 +7,7 @@ import (
 
 	dc "github.com/1set/starlet/dataconv"
 	tps "github.com/1set/starlet/dataconv/types"
+	"github.com/1set/starlet/vfs"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
 )
@@ -32,8 +33,8 @@ func LoadModule() (starlark.StringDict, error) {
 					"stat":          starlark.NewBuiltin(ModuleName+".stat", getFileStat),
 					"trim_bom":      starlark.NewBuiltin(ModuleName+".trim_bom", trimBom),
 					"count_lines":   starlark.NewBuiltin(ModuleName+".count_lines", countLinesInFile),
-					"head_lines":    readTopOrBottomLines("head_lines", ReadFirstLines),
-					"tail_lines":    readTopOrBottomLines("tail_lines", ReadLastLines),
+					"head_lines":    readTopOrBottomLines("head_lines", readFirstLines),
+					"tail_lines":    readTopOrBottomLines("tail_lines", readLastLines),
 					"read_bytes":    wrapReadFile("read_bytes", readBytes),
 					"read_string":   wrapReadFile("read_string", readString),
 					"read_lines":    wrapReadFile("read_lines", readLines),
@@ -79,7 +80,7 @@ func countLinesInFile(thread *starlark.Thread, b *starlark.Builtin, args starlar
 		return starlark.None, err
 	}
 	// do the work
-	cnt, err := CountFileLines(fp.GoString())
+	cnt, err := countFileLines(vfs.GetThreadFS(thread), fp.GoString())
 	if err != nil {
 		return nil, err
 	}
@@ -87,7 +88,7 @@ func countLinesInFile(thread *starlark.Thread, b *starlark.Builtin, args starlar
 }
 
 // readTopOrBottomLines wraps the file reading functions for top or bottom lines to be used in Starlark.
-func readTopOrBottomLines(funcName string, workLoad func(name string, n int) ([]string, error)) starlark.Callable {
+func readTopOrBottomLines(funcName string, workLoad func(sys vfs.System, name string, n int) ([]string, error)) starlark.Callable {
 	return starlark.NewBuiltin(ModuleName+"."+funcName, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 		// unpack arguments
 		var (
@@ -103,7 +104,7 @@ func readTopOrBottomLines(funcName string, workLoad func(name string, n int) ([]
 		}
 
 		// read lines
-		ls, err := workLoad(fp.GoString(), int(nInt))
+		ls, err := workLoad(vfs.GetThreadFS(thread), fp.GoString(), int(nInt))
 		if err != nil {
 			return nil, err
 		}
@@ -118,19 +119,19 @@ func readTopOrBottomLines(funcName string, workLoad func(name string, n int) ([]
 }
 
 // wrapReadFile wraps the file reading functions to be used in Starlark.
-func wrapReadFile(funcName string, workLoad func(name string) (starlark.Value, error)) starlark.Callable {
+func wrapReadFile(funcName string, workLoad func(sys vfs.System, name string) (starlark.Value, error)) starlark.Callable {
 	return starlark.NewBuiltin(ModuleName+"."+funcName, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 		var fp tps.StringOrBytes
 		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &fp); err != nil {
 			return starlark.None, err
 		}
-		return workLoad(fp.GoString())
+		return workLoad(vfs.GetThreadFS(thread), fp.GoString())
 	})
 }
 
 // readBytes reads the whole named file and returns the contents as bytes.
-func readBytes(name string) (starlark.Value, error) {
-	data, err := ReadFileBytes(name)
+func readBytes(sys vfs.System, name string) (starlark.Value, error) {
+	data, err := readFileBytes(sys, name)
 	if err != nil {
 		return nil, err
 	}
@@ -138,8 +139,8 @@ func readBytes(name string) (starlark.Value, error) {
 }
 
 // readString reads the whole named file and returns the contents as string.
-func readString(name string) (starlark.Value, error) {
-	data, err := ReadFileString(name)
+func readString(sys vfs.System, name string) (starlark.Value, error) {
+	data, err := readFileBytes(sys, name)
 	if err != nil {
 		return nil, err
 	}
@@ -147,8 +148,8 @@ func readString(name string) (starlark.Value, error) {
 }
 
 // readLines reads the whole named file and returns the contents as a list of lines.
-func readLines(name string) (starlark.Value, error) {
-	ls, err := ReadFileLines(name)
+func readLines(sys vfs.System, name string) (starlark.Value, error) {
+	ls, err := readFileLines(sys, name)
 	if err != nil {
 		return nil, err
 	}
@@ -160,7 +161,7 @@ func readLines(name string) (starlark.Value, error) {
 }
 
 // wrapWriteFile wraps the file writing functions to be used in Starlark.
-func wrapWriteFile(funcName string, override bool, workLoad func(name, funcName string, override bool, data starlark.Value) error) starlark.Callable {
+func wrapWriteFile(funcName string, override bool, workLoad func(sys vfs.System, name, funcName string, override bool, data starlark.Value) error) starlark.Callable {
 	fullName := ModuleName + "." + funcName
 	return starlark.NewBuiltin(fullName, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 		var (
@@ -170,15 +171,14 @@ func wrapWriteFile(funcName string, override bool, workLoad func(name, funcName
 		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &fp, "data", &data); err != nil {
 			return starlark.None, err
 		}
-		return starlark.None, workLoad(fp.GoString(), fullName, override, data)
+		return starlark.None, workLoad(vfs.GetThreadFS(thread), fp.GoString(), fullName, override, data)
 	})
 }
 
 // writeBytes writes the given data in bytes into a file.
-func writeBytes(name, funcName string, override bool, data starlark.Value) error {
-	wf := AppendFileBytes
-	if override {
-		wf = WriteFileBytes
+func writeBytes(sys vfs.System, name, funcName string, override bool, data starlark.Value) error {
+	wf := func(name string, data []byte) error {
+		return openFileWriteBytes(sys, name, fileWriteFlag(override), data)
 	}
 	// treat starlark.Bytes and starlark.String as the same type
 	switch v := data.(type) {
@@ -192,10 +192,9 @@ func writeBytes(name, funcName string, override bool, data starlark.Value) error
 }
 
 // writeString writes the given data in string into a file.
-func writeString(name, funcName string, override bool, data starlark.Value) error {
-	wf := AppendFileString
-	if override {
-		wf = WriteFileString
+func writeString(sys vfs.System, name, funcName string, override bool, data starlark.Value) error {
+	wf := func(name string, data string) error {
+		return openFileWriteString(sys, name, fileWriteFlag(override), data)
 	}
 	// treat starlark.Bytes and starlark.String as the same type
 	switch v := data.(type) {
@@ -209,10 +208,9 @@ func writeString(name, funcName string, override bool, data starlark.Value) erro
 }
 
 // writeLines writes the lines into a file. The data should be a list, a tuple or a set of strings.
-func writeLines(name, funcName string, override bool, data starlark.Value) error {
-	wf := AppendFileLines
-	if override {
-		wf = WriteFileLines
+func writeLines(sys vfs.System, name, funcName string, override bool, data starlark.Value) error {
+	wf := func(name string, data []string) error {
+		return openFileWriteLines(sys, name, fileWriteFlag(override), data)
 	}
 	// handle all types of iterable, and allow string or bytes
 	switch v := data.(type) {
@@ -231,6 +229,14 @@ func writeLines(name, funcName string, override bool, data starlark.Value) error
 	}
 }
 
+// fileWriteFlag returns the flag to open files for writing, truncating for override or appending.
+func fileWriteFlag(override bool) int {
+	if override {
+		return createFileFlag
+	}
+	return appendFileFlag
+}
+
 func convIterStrings(lst starlark.Iterable) (lines []string) {
 	iter := lst.Iterate()
 	defer iter.Done()
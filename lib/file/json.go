@@ -5,12 +5,13 @@ import (
 	"strings"
 
 	"github.com/1set/starlet/dataconv"
+	"github.com/1set/starlet/vfs"
 	"go.starlark.net/starlark"
 )
 
 // readJSON reads the whole named file and decodes the contents as JSON for Starlark.
-func readJSON(name string) (starlark.Value, error) {
-	data, err := ReadFileBytes(name)
+func readJSON(sys vfs.System, name string) (starlark.Value, error) {
+	data, err := readFileBytes(sys, name)
 	if err != nil {
 		return nil, err
 	}
@@ -18,12 +19,12 @@ func readJSON(name string) (starlark.Value, error) {
 }
 
 // readJSONL reads the whole named file and decodes the contents as JSON lines for Starlark.
-func readJSONL(name string) (starlark.Value, error) {
+func readJSONL(sys vfs.System, name string) (starlark.Value, error) {
 	var (
 		cnt    int
 		values []starlark.Value
 	)
-	if err := readFileByLine(name, func(line string) error {
+	if err := readFileByLine(sys, name, func(line string) error {
 		cnt++
 		// skip empty lines
 		if strings.TrimSpace(line) == emptyStr {
@@ -43,10 +44,9 @@ func readJSONL(name string) (starlark.Value, error) {
 }
 
 // writeJSON writes the given JSON as string into a file.
-func writeJSON(name, funcName string, override bool, data starlark.Value) error {
-	wf := AppendFileString
-	if override {
-		wf = WriteFileString
+func writeJSON(sys vfs.System, name, funcName string, override bool, data starlark.Value) error {
+	wf := func(name string, data string) error {
+		return openFileWriteString(sys, name, fileWriteFlag(override), data)
 	}
 	// treat starlark.Bytes and starlark.String as the same type, just convert to string, for other types, encode to JSON
 	switch v := data.(type) {
@@ -65,10 +65,9 @@ func writeJSON(name, funcName string, override bool, data starlark.Value) error
 }
 
 // writeJSONL writes the given JSON lines into a file.
-func writeJSONL(name, funcName string, override bool, data starlark.Value) error {
-	wf := AppendFileLines
-	if override {
-		wf = WriteFileLines
+func writeJSONL(sys vfs.System, name, funcName string, override bool, data starlark.Value) error {
+	wf := func(name string, data []string) error {
+		return openFileWriteLines(sys, name, fileWriteFlag(override), data)
 	}
 
 	// handle all types of iterable, and allow string or bytes, for other types, encode to lines of JSON
@@ -5,7 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
+
+	"github.com/1set/starlet/vfs"
 )
 
 // LineFunc stands for a handler for each line string.
@@ -19,46 +20,66 @@ var (
 
 // ReadFileLines reads all lines from the given file (the line ending chars are not included).
 func ReadFileLines(path string) (lines []string, err error) {
-	err = readFileByLine(path, func(l string) error {
-		lines = append(lines, l)
-		return nil
-	})
-	return
+	return readFileLines(vfs.Host, path)
 }
 
 // CountFileLines counts all lines from the given file (the line ending chars are not included).
 func CountFileLines(path string) (count int, err error) {
-	err = readFileByLine(path, func(l string) error {
-		count++
-		return nil
-	})
-	return
+	return countFileLines(vfs.Host, path)
 }
 
 // WriteFileLines writes the given lines as a text file.
 func WriteFileLines(path string, lines []string) error {
-	return openFileWriteLines(path, createFileFlag, lines)
+	return openFileWriteLines(vfs.Host, path, createFileFlag, lines)
 }
 
 // AppendFileLines appends the given lines to the end of a text file.
 func AppendFileLines(path string, lines []string) error {
-	return openFileWriteLines(path, appendFileFlag, lines)
+	return openFileWriteLines(vfs.Host, path, appendFileFlag, lines)
 }
 
 // ReadFirstLines reads the top n lines from the given file (the line ending chars are not included), or lesser lines if the given file doesn't contain enough line ending chars.
 func ReadFirstLines(path string, n int) (lines []string, err error) {
-	var f *os.File
-	if f, err = os.Open(path); err != nil {
+	return readFirstLines(vfs.Host, path, n)
+}
+
+// ReadLastLines reads the bottom n lines from the given file (the line ending chars are not included), or lesser lines if the given file doesn't contain enough line ending chars.
+func ReadLastLines(path string, n int) (lines []string, err error) {
+	return readLastLines(vfs.Host, path, n)
+}
+
+// readFileLines reads all lines from the given file in the file system.
+func readFileLines(sys vfs.System, path string) (lines []string, err error) {
+	err = readFileByLine(sys, path, func(l string) error {
+		lines = append(lines, l)
+		return nil
+	})
+	return
+}
+
+// countFileLines counts all lines from the given file in the file system.
+func countFileLines(sys vfs.System, path string) (count int, err error) {
+	err = readFileByLine(sys, path, func(l string) error {
+		count++
+		return nil
+	})
+	return
+}
+
+// readFirstLines reads the top n lines from the given file in the file system.
+func readFirstLines(sys vfs.System, path string, n int) (lines []string, err error) {
+	f, err := sys.Open(path)
+	if err != nil {
 		return
 	}
 	defer f.Close()
 	return extractIOTopLines(f, n)
 }
 
-// ReadLastLines reads the bottom n lines from the given file (the line ending chars are not included), or lesser lines if the given file doesn't contain enough line ending chars.
-func ReadLastLines(path string, n int) (lines []string, err error) {
-	var f *os.File
-	if f, err = os.Open(path); err != nil {
+// readLastLines reads the bottom n lines from the given file in the file system.
+func readLastLines(sys vfs.System, path string, n int) (lines []string, err error) {
+	f, err := sys.Open(path)
+	if err != nil {
 		return
 	}
 	defer f.Close()
@@ -107,18 +128,18 @@ func extractIOBottomLines(rd io.Reader, n int) ([]string, error) {
 	return append(result[pos:], result[0:pos]...), nil
 }
 
-// readFileByLine iterates the given file by lines (the line ending chars are not included).
-func readFileByLine(path string, callback LineFunc) (err error) {
-	var file *os.File
-	if file, err = os.Open(path); err != nil {
+// readFileByLine iterates the given file in the file system by lines (the line ending chars are not included).
+func readFileByLine(sys vfs.System, path string, callback LineFunc) (err error) {
+	file, err := sys.Open(path)
+	if err != nil {
 		return
 	}
 	defer file.Close()
 	return readIOByLine(file, callback)
 }
 
-func openFileWriteLines(path string, flag int, lines []string) error {
-	file, err := os.OpenFile(path, flag, filePerm)
+func openFileWriteLines(sys vfs.System, path string, flag int, lines []string) error {
+	file, err := sys.OpenFile(path, flag, filePerm)
 	if err != nil {
 		return err
 	}
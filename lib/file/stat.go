@@ -12,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/1set/starlet/vfs"
 	stdtime "go.starlark.net/lib/time"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
@@ -21,6 +22,7 @@ import (
 type FileStat struct {
 	os.FileInfo
 	fullPath string
+	sys      vfs.System
 }
 
 // Struct returns a starlark struct with file information.
@@ -58,10 +60,10 @@ func (f *FileStat) Struct() *starlarkstruct.Struct {
 		"size":       starlark.MakeInt64(f.Size()),
 		"type":       starlark.String(modeStr),
 		"modified":   stdtime.Time(f.ModTime()),
-		"get_md5":    starlark.NewBuiltin("get_md5", genFileHashFunc(f.fullPath, md5.New)),
-		"get_sha1":   starlark.NewBuiltin("get_sha1", genFileHashFunc(f.fullPath, sha1.New)),
-		"get_sha256": starlark.NewBuiltin("get_sha256", genFileHashFunc(f.fullPath, sha256.New)),
-		"get_sha512": starlark.NewBuiltin("get_sha512", genFileHashFunc(f.fullPath, sha512.New)),
+		"get_md5":    starlark.NewBuiltin("get_md5", genFileHashFunc(f.sys, f.fullPath, md5.New)),
+		"get_sha1":   starlark.NewBuiltin("get_sha1", genFileHashFunc(f.sys, f.fullPath, sha1.New)),
+		"get_sha256": starlark.NewBuiltin("get_sha256", genFileHashFunc(f.sys, f.fullPath, sha256.New)),
+		"get_sha512": starlark.NewBuiltin("get_sha512", genFileHashFunc(f.sys, f.fullPath, sha512.New)),
 	}
 	return starlarkstruct.FromStringDict(starlark.String("file_stat"), fields)
 }
@@ -75,30 +77,32 @@ func getFileStat(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tup
 		return starlark.None, err
 	}
 	// get file stat
-	var statFn func(string) (os.FileInfo, error)
+	sys := vfs.GetThreadFS(thread)
+	statFn := sys.Lstat
 	if followSymlink {
-		statFn = os.Stat
-	} else {
-		statFn = os.Lstat
+		statFn = sys.Stat
 	}
 	stat, err := statFn(inputPath)
 	if err != nil {
 		return none, fmt.Errorf("%s: %w", b.Name(), err)
 	}
 	// get file abs path
-	absPath, err := filepath.Abs(inputPath)
+	absPath, err := sys.Abs(inputPath)
 	if err != nil {
 		return none, fmt.Errorf("%s: %w", b.Name(), err)
 	}
 	// return file stat
-	fs := &FileStat{stat, absPath}
+	fs := &FileStat{stat, absPath, sys}
 	return fs.Struct(), nil
 }
 
-func genFileHashFunc(fp string, algo func() hash.Hash) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+func genFileHashFunc(sys vfs.System, fp string, algo func() hash.Hash) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
 	return func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 		// open file
-		file, err := os.Open(fp)
+		if sys == nil {
+			sys = vfs.Host
+		}
+		file, err := sys.Open(fp)
 		if err != nil {
 			return none, fmt.Errorf("%s: %w", fn.Name(), err)
 		}
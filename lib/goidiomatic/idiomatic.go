@@ -12,6 +12,7 @@ import (
 
 	"github.com/1set/starlet/dataconv"
 	tps "github.com/1set/starlet/dataconv/types"
+	"github.com/1set/starlet/policy"
 	"github.com/1set/starlight/convert"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
@@ -284,6 +285,9 @@ func exit(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwa
 	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "code?", &code); err != nil {
 		return none, err
 	}
+	if err := policy.GetThreadPolicy(thread).CheckExit(); err != nil {
+		return none, err
+	}
 	thread.SetLocal("exit_code", code)
 	return none, ErrSystemExit
 }
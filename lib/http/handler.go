@@ -0,0 +1,252 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/1set/starlet/policy"
+	"go.starlark.net/starlark"
+)
+
+// Names of the functions defined by handler scripts, which are called by Handler for each request with the request and response.
+const (
+	// FuncHandle is the function to handle the request, the top-level code of the script handles the request if it's not defined.
+	FuncHandle = "handle"
+	// FuncBeforeRequest is the function called before handle, and handle is skipped if it returns False.
+	// It's rejected for the scripts without handle, as their top-level code has already handled the request before it can be called.
+	FuncBeforeRequest = "before_request"
+	// FuncAfterRequest is the function called after the request is handled, even if handle is skipped.
+	FuncAfterRequest = "after_request"
+)
+
+var (
+	// MaxRequestBodySize is the default max size in bytes of request bodies read by Handler, 0 for no limit, override with WithMaxRequestBodySize.
+	MaxRequestBodySize int64 = 32 << 20
+)
+
+// Executor executes the handler script for a request, and calls the functions defined by it.
+// It's implemented for starlet Machines by Machine.HTTPExecutor, as this package can't depend on starlet.
+type Executor interface {
+	// Exec runs the script with the extra predeclared values.
+	Exec(ctx context.Context, extras starlark.StringDict) error
+	// Has reports whether the script defines the function of the name after Exec.
+	Has(name string) bool
+	// Call calls the function of the name defined by the script with the arguments, and returns the result.
+	Call(ctx context.Context, name string, args ...starlark.Value) (starlark.Value, error)
+}
+
+// Runner provides an Executor for each request and calls fn with it, e.g. by acquiring a Machine from a pool or creating one by a factory.
+// The Executor is not used after fn returns, so it can be released.
+type Runner func(ctx context.Context, fn func(e Executor) error) error
+
+// Middleware is a Go middleware wrapping the http.Handler.
+type Middleware func(next http.Handler) http.Handler
+
+// ErrorHandler writes the error page for the failed request with the status code.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, code int, err error)
+
+// ErrorLogger logs the error of the failed request, it's called for all errors, even if the error page can't be written for the streamed response.
+type ErrorLogger func(r *http.Request, err error)
+
+// HandlerOption is the setting for creating a Handler.
+type HandlerOption func(h *Handler)
+
+// WithMiddleware adds the Go middlewares to wrap the handler, the first one is the outermost.
+func WithMiddleware(mws ...Middleware) HandlerOption {
+	return func(h *Handler) {
+		h.middlewares = append(h.middlewares, mws...)
+	}
+}
+
+// WithErrorHandler sets the handler to write error pages, nil for DefaultErrorHandler.
+func WithErrorHandler(eh ErrorHandler) HandlerOption {
+	return func(h *Handler) {
+		h.onError = eh
+	}
+}
+
+// WithErrorLogger sets the logger for the errors of requests.
+func WithErrorLogger(el ErrorLogger) HandlerOption {
+	return func(h *Handler) {
+		h.logError = el
+	}
+}
+
+// WithMaxRequestBodySize sets the max size in bytes of request bodies, 0 for no limit.
+// The requests with larger bodies fail with ErrBodyTooLarge and the status code 413 before running the script.
+func WithMaxRequestBodySize(n int64) HandlerOption {
+	return func(h *Handler) {
+		h.maxBodySize = n
+	}
+}
+
+// DefaultErrorHandler writes the status text as the error page without the details of the error.
+func DefaultErrorHandler(w http.ResponseWriter, r *http.Request, code int, err error) {
+	http.Error(w, http.StatusText(code), code)
+}
+
+// Handler is an http.Handler running the Starlark handler script for each request, with the predeclared request and response.
+//
+// The script handles the request by its top-level code, or by the handle(request, response) function if it's defined.
+// Starlark middlewares are the functions before_request(request, response) and after_request(request, response) defined by the script or loaded from modules,
+// before_request is called before handle, and handle is skipped if it returns False, e.g. for the redirect to login; after_request is called after the request is handled.
+// The scripts defining before_request must handle the request by handle, otherwise it's an error, since their top-level code runs before before_request can be called.
+// The Go middlewares wrap the handler, and the errors and panics of both scripts and middlewares are written as error pages by the ErrorHandler.
+type Handler struct {
+	run         Runner
+	middlewares []Middleware
+	onError     ErrorHandler
+	logError    ErrorLogger
+	maxBodySize int64
+	handler     http.Handler
+}
+
+// NewHandler creates a Handler running the handler script by the Runner for each request.
+func NewHandler(run Runner, opts ...HandlerOption) *Handler {
+	h := &Handler{run: run, maxBodySize: MaxRequestBodySize}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.onError == nil {
+		h.onError = DefaultErrorHandler
+	}
+	var next http.Handler = http.HandlerFunc(h.serveScript)
+	for i := len(h.middlewares) - 1; i >= 0; i-- {
+		next = h.middlewares[i](next)
+	}
+	h.handler = next
+	return h
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if v := recover(); v != nil {
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			h.fail(w, r, http.StatusInternalServerError, fmt.Errorf("panic: %v", v))
+		}
+	}()
+	h.handler.ServeHTTP(w, r)
+}
+
+// serveScript runs the handler script for the request, and writes the response or the error page.
+func (h *Handler) serveScript(w http.ResponseWriter, r *http.Request) {
+	// limit the body before it's read into memory and parsed as forms
+	if limit := h.maxBodySize; limit > 0 && r.Body != nil {
+		if r.ContentLength > limit {
+			h.fail(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrBodyTooLarge, r.ContentLength, limit))
+			return
+		}
+		r.Body = &limitedBody{ReadCloser: r.Body, left: limit, limit: limit}
+	}
+	sr, err := NewExportedServerRequest(r)
+	if errors.Is(err, ErrBodyTooLarge) {
+		h.fail(w, r, http.StatusRequestEntityTooLarge, err)
+		return
+	} else if err != nil {
+		h.fail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	resp := NewServerResponse()
+	resp.Bind(w, r)
+	reqv, respv := sr.Struct(), resp.Struct()
+
+	ctx := r.Context()
+	err = h.run(ctx, func(e Executor) error {
+		if err := e.Exec(ctx, starlark.StringDict{"request": reqv, "response": respv}); err != nil {
+			return err
+		}
+		if e.Has(FuncBeforeRequest) && !e.Has(FuncHandle) {
+			return errBeforeRequestWithoutHandle
+		}
+		if e.Has(FuncHandle) {
+			skip := false
+			if e.Has(FuncBeforeRequest) {
+				v, err := e.Call(ctx, FuncBeforeRequest, reqv, respv)
+				if err != nil {
+					return err
+				}
+				skip = v == starlark.False
+			}
+			if !skip {
+				if _, err := e.Call(ctx, FuncHandle, reqv, respv); err != nil {
+					return err
+				}
+			}
+		}
+		if e.Has(FuncAfterRequest) {
+			if _, err := e.Call(ctx, FuncAfterRequest, reqv, respv); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// the error page can't be written if the response is already streamed
+	if err != nil {
+		if resp.Streamed() {
+			h.log(r, err)
+		} else {
+			h.fail(w, r, errorStatusCode(err), err)
+		}
+		return
+	}
+	if err = resp.Write(w); err != nil {
+		h.fail(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+// errBeforeRequestWithoutHandle is the error for scripts defining before_request without handle.
+var errBeforeRequestWithoutHandle = fmt.Errorf("%s requires %s, as the top-level code runs before it", FuncBeforeRequest, FuncHandle)
+
+// fail logs the error, and writes the error page with the status code.
+func (h *Handler) fail(w http.ResponseWriter, r *http.Request, code int, err error) {
+	h.log(r, err)
+	h.onError(w, r, code, err)
+}
+
+// log logs the error if the logger is set.
+func (h *Handler) log(r *http.Request, err error) {
+	if h.logError != nil {
+		h.logError(r, err)
+	}
+}
+
+// errorStatusCode returns the status code for the error of running scripts.
+func errorStatusCode(err error) int {
+	switch {
+	case policy.IsPermissionError(err):
+		return http.StatusForbidden
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// limitedBody is the request body failing with ErrBodyTooLarge if it's longer than the limit, as the length may be unknown before reading.
+type limitedBody struct {
+	io.ReadCloser
+	left  int64
+	limit int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// read one more byte to find the body exceeding the limit
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.left {
+		n, b.left = int(b.left), 0
+		return n, fmt.Errorf("%w: exceeds the limit of %d bytes", ErrBodyTooLarge, b.limit)
+	}
+	b.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,342 @@
+package http_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	itn "github.com/1set/starlet/internal"
+	lh "github.com/1set/starlet/lib/http"
+	"go.starlark.net/starlark"
+)
+
+// scriptExecutor is a simple executor running the script with a new thread, for testing without starlet Machines.
+type scriptExecutor struct {
+	script  string
+	thread  *starlark.Thread
+	globals starlark.StringDict
+}
+
+func (e *scriptExecutor) Exec(ctx context.Context, extras starlark.StringDict) (err error) {
+	e.thread = &starlark.Thread{Name: "test"}
+	e.globals, err = starlark.ExecFile(e.thread, "handler.star", e.script, extras)
+	return err
+}
+
+func (e *scriptExecutor) Has(name string) bool {
+	_, ok := e.globals[name].(starlark.Callable)
+	return ok
+}
+
+func (e *scriptExecutor) Call(ctx context.Context, name string, args ...starlark.Value) (starlark.Value, error) {
+	return starlark.Call(e.thread, e.globals[name], args, nil)
+}
+
+func scriptRunner(script string) lh.Runner {
+	return func(ctx context.Context, fn func(e lh.Executor) error) error {
+		return fn(&scriptExecutor{script: script})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tagMiddleware := func(tag string) lh.Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Chain", tag)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	panicMiddleware := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("oops")
+		})
+	}
+	detailedErrorPage := func(w http.ResponseWriter, r *http.Request, code int, err error) {
+		http.Error(w, fmt.Sprintf("%d: %v", code, err), code)
+	}
+
+	tests := []struct {
+		name       string
+		script     string
+		run        lh.Runner
+		opts       []lh.HandlerOption
+		path       string
+		wantStatus int
+		wantBody   string
+		wantHeader map[string]string
+	}{
+		{
+			name: `top-level`,
+			script: itn.HereDoc(`
+				response.set_text("hello " + request.url)
+			`),
+			path:       "/hi",
+			wantStatus: http.StatusOK,
+			wantBody:   "hello /hi",
+		},
+		{
+			name: `handle function`,
+			script: itn.HereDoc(`
+				def handle(req, resp):
+					resp.set_status(201)
+					resp.set_text("handled " + req.method)
+			`),
+			wantStatus: http.StatusCreated,
+			wantBody:   "handled GET",
+		},
+		{
+			name: `before and after request`,
+			script: itn.HereDoc(`
+				def before_request(req, resp):
+					resp.add_header("X-Calls", "before")
+				def handle(req, resp):
+					resp.add_header("X-Calls", "handle")
+				def after_request(req, resp):
+					resp.add_header("X-Calls", "after")
+					resp.set_text("done")
+			`),
+			wantStatus: http.StatusOK,
+			wantBody:   "done",
+			wantHeader: map[string]string{"X-Calls": "before,handle,after"},
+		},
+		{
+			name: `before request skips handle`,
+			script: itn.HereDoc(`
+				def before_request(req, resp):
+					if req.url != "/login":
+						resp.redirect("/login")
+						return False
+				def handle(req, resp):
+					fail("not skipped")
+				def after_request(req, resp):
+					resp.add_header("X-After", "yes")
+			`),
+			path:       "/admin",
+			wantStatus: http.StatusFound,
+			wantHeader: map[string]string{"Location": "/login", "X-After": "yes"},
+		},
+		{
+			name: `after request for top-level`,
+			script: itn.HereDoc(`
+				response.set_text("top")
+				def after_request(req, resp):
+					resp.add_header("X-After", "yes")
+			`),
+			wantStatus: http.StatusOK,
+			wantBody:   "top",
+			wantHeader: map[string]string{"X-After": "yes"},
+		},
+		{
+			name: `before request without handle`,
+			script: itn.HereDoc(`
+				response.set_text("top")
+				def before_request(req, resp):
+					return False
+			`),
+			opts:       []lh.HandlerOption{lh.WithErrorHandler(detailedErrorPage)},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   "500: before_request requires handle, as the top-level code runs before it\n",
+		},
+		{
+			name: `script error`,
+			script: itn.HereDoc(`
+				def handle(req, resp):
+					fail("secret")
+			`),
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   "Internal Server Error\n",
+		},
+		{
+			name: `custom error page`,
+			script: itn.HereDoc(`
+				def after_request(req, resp):
+					fail("broken")
+			`),
+			opts:       []lh.HandlerOption{lh.WithErrorHandler(detailedErrorPage)},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   "500: fail: broken\n",
+		},
+		{
+			name: `timeout`,
+			run: func(ctx context.Context, fn func(e lh.Executor) error) error {
+				return context.DeadlineExceeded
+			},
+			wantStatus: http.StatusGatewayTimeout,
+			wantBody:   "Gateway Timeout\n",
+		},
+		{
+			name: `go middlewares`,
+			script: itn.HereDoc(`
+				response.set_text("ok")
+			`),
+			opts:       []lh.HandlerOption{lh.WithMiddleware(tagMiddleware("a"), tagMiddleware("b")), lh.WithMiddleware(tagMiddleware("c"))},
+			wantStatus: http.StatusOK,
+			wantBody:   "ok",
+			wantHeader: map[string]string{"X-Chain": "a,b,c"},
+		},
+		{
+			name:       `panic in middleware`,
+			opts:       []lh.HandlerOption{lh.WithMiddleware(panicMiddleware), lh.WithErrorHandler(detailedErrorPage)},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   "500: panic: oops\n",
+		},
+		{
+			name: `error after streaming`,
+			script: itn.HereDoc(`
+				response.write("partial")
+				fail("broken")
+			`),
+			wantStatus: http.StatusOK,
+			wantBody:   "partial",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run := tt.run
+			if run == nil {
+				run = scriptRunner(tt.script)
+			}
+			path := tt.path
+			if path == "" {
+				path = "/"
+			}
+			rec := httptest.NewRecorder()
+			lh.NewHandler(run, tt.opts...).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("unexpected status: got %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("unexpected body: got %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+			for k, v := range tt.wantHeader {
+				if got := strings.Join(rec.Header().Values(k), ","); got != v {
+					t.Errorf("unexpected header %s: got %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_AbortPanic(t *testing.T) {
+	h := lh.NewHandler(scriptRunner(""), lh.WithMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		})
+	}))
+	defer func() {
+		if r := recover(); !errors.Is(r.(error), http.ErrAbortHandler) {
+			t.Errorf("unexpected panic: %v", r)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	t.Error("expected panic")
+}
+
+func TestHandler_ErrorLogger(t *testing.T) {
+	var logged []string
+	h := lh.NewHandler(scriptRunner(itn.HereDoc(`
+		def handle(req, resp):
+			if req.url == "/stream":
+				resp.write("partial")
+			fail("broken")
+	`)), lh.WithErrorLogger(func(r *http.Request, err error) {
+		logged = append(logged, r.URL.Path+": "+err.Error())
+	}))
+	for _, path := range []string{"/", "/stream"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if exp := []string{"/: fail: broken", "/stream: fail: broken"}; strings.Join(logged, "|") != strings.Join(exp, "|") {
+		t.Errorf("unexpected logs: %q, want %q", logged, exp)
+	}
+}
+
+func TestHandler_MaxRequestBodySize(t *testing.T) {
+	script := `response.set_text("%d" % len(request.body))`
+	tests := []struct {
+		name     string
+		body     string
+		chunked  bool
+		opts     []lh.HandlerOption
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "default limit",
+			body:     strings.Repeat("a", 1000),
+			wantCode: http.StatusOK,
+			wantBody: "1000",
+		},
+		{
+			name:     "within limit",
+			body:     strings.Repeat("a", 10),
+			opts:     []lh.HandlerOption{lh.WithMaxRequestBodySize(10)},
+			wantCode: http.StatusOK,
+			wantBody: "10",
+		},
+		{
+			name:     "content length exceeds limit",
+			body:     strings.Repeat("a", 11),
+			opts:     []lh.HandlerOption{lh.WithMaxRequestBodySize(10)},
+			wantCode: http.StatusRequestEntityTooLarge,
+			wantBody: "body too large: 11 bytes exceeds the limit of 10 bytes",
+		},
+		{
+			name:     "chunked body within limit",
+			body:     strings.Repeat("a", 10),
+			chunked:  true,
+			opts:     []lh.HandlerOption{lh.WithMaxRequestBodySize(10)},
+			wantCode: http.StatusOK,
+			wantBody: "10",
+		},
+		{
+			name:     "chunked body exceeds limit",
+			body:     strings.Repeat("a", 11),
+			chunked:  true,
+			opts:     []lh.HandlerOption{lh.WithMaxRequestBodySize(10)},
+			wantCode: http.StatusRequestEntityTooLarge,
+			wantBody: "body too large: exceeds the limit of 10 bytes",
+		},
+		{
+			name:     "form exceeds limit",
+			body:     "name=" + strings.Repeat("a", 100),
+			opts:     []lh.HandlerOption{lh.WithMaxRequestBodySize(50)},
+			wantCode: http.StatusRequestEntityTooLarge,
+			wantBody: "body too large",
+		},
+		{
+			name:     "no limit",
+			body:     strings.Repeat("a", 100),
+			chunked:  true,
+			opts:     []lh.HandlerOption{lh.WithMaxRequestBodySize(0)},
+			wantCode: http.StatusOK,
+			wantBody: "100",
+		},
+	}
+	detailedErrorPage := func(w http.ResponseWriter, r *http.Request, code int, err error) {
+		http.Error(w, err.Error(), code)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			opts := append([]lh.HandlerOption{lh.WithErrorHandler(detailedErrorPage)}, tt.opts...)
+			lh.NewHandler(scriptRunner(script), opts...).ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("expected status %d, got %d", tt.wantCode, rec.Code)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, tt.wantBody) {
+				t.Errorf("expected body contains %q, got %q", tt.wantBody, body)
+			}
+		})
+	}
+}
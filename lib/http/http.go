@@ -6,6 +6,7 @@ package http
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"mime/multipart"
@@ -19,6 +20,8 @@ import (
 	"github.com/1set/starlet/dataconv"
 	"github.com/1set/starlet/dataconv/types"
 	itn "github.com/1set/starlet/internal"
+	"github.com/1set/starlet/policy"
+	"github.com/1set/starlet/vfs"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
 )
@@ -35,11 +38,13 @@ var (
 	SkipInsecureVerify = false
 	// DisableRedirect controls whether to follow redirects, override with a custom value before calling LoadModule.
 	DisableRedirect = false
+	// MaxBodySize is the default max size in bytes of response bodies read into memory, 0 for no limit, override with a custom value before calling LoadModule.
+	MaxBodySize int64 = 0
 	// Client is the http client used to create the http module, override with a custom client before calling LoadModule.
 	Client *http.Client
 	// Guard is a global RequestGuard used in LoadModule, override with a custom implementation before calling LoadModule.
 	Guard RequestGuard
-	// ConfigLock is a global lock for settings, use it to ensure thread safety when setting.
+	// ConfigLock is a global lock for the package-level settings above, use it to ensure thread safety when setting.
 	ConfigLock sync.RWMutex
 )
 
@@ -49,39 +54,132 @@ type RequestGuard interface {
 	Allowed(thread *starlark.Thread, req *http.Request) (*http.Request, error)
 }
 
-// LoadModule creates an http Module
+// LoadModule creates an http Module with the package-level settings, each call has its own settings.
 func LoadModule() (starlark.StringDict, error) {
 	return NewModule().LoadModule()
 }
 
 // Module defines the actual HTTP module with methods for making requests.
+// Its settings are separate from other modules, so modules with different clients, guards and timeouts can be used by multiple machines at the same time.
 type Module struct {
-	cli *http.Client
-	rg  RequestGuard
+	mu              sync.RWMutex
+	cli             *http.Client
+	rg              RequestGuard
+	userAgent       string
+	timeout         float64
+	skipVerify      bool
+	disableRedirect bool
+	maxBodySize     int64
+	recorder        *Recorder
 }
 
-// NewModule creates a new http module with default settings.
-func NewModule() *Module {
-	m := &Module{}
-	if Client != nil {
-		m.cli = Client
+// Option is the setting for creating an http Module.
+type Option func(m *Module)
+
+// WithClient sets the http client for the module, nil for creating clients for each request.
+func WithClient(c *http.Client) Option {
+	return func(m *Module) {
+		m.cli = c
 	}
-	if Guard != nil {
-		m.rg = Guard
+}
+
+// WithGuard sets the request guard for the module, nil for no guard.
+func WithGuard(g RequestGuard) Option {
+	return func(m *Module) {
+		m.rg = g
+	}
+}
+
+// WithUserAgent sets the default user agent for the requests of the module, empty for not setting it.
+func WithUserAgent(ua string) Option {
+	return func(m *Module) {
+		m.userAgent = ua
+	}
+}
+
+// WithTimeout sets the default timeout in seconds for the requests of the module.
+func WithTimeout(sec float64) Option {
+	return func(m *Module) {
+		m.timeout = sec
+	}
+}
+
+// WithSkipInsecureVerify sets whether to skip TLS verification by default for the requests of the module.
+func WithSkipInsecureVerify(skip bool) Option {
+	return func(m *Module) {
+		m.skipVerify = skip
+	}
+}
+
+// WithDisableRedirect sets whether not to follow redirects by default for the requests of the module.
+func WithDisableRedirect(disable bool) Option {
+	return func(m *Module) {
+		m.disableRedirect = disable
+	}
+}
+
+// WithMaxBodySize sets the max size in bytes of response bodies read into memory by body() and json(), 0 for no limit.
+// Streaming by iter_content(), read() and save() is not limited.
+func WithMaxBodySize(n int64) Option {
+	return func(m *Module) {
+		m.maxBodySize = n
+	}
+}
+
+// NewModule creates a new http module with the package-level settings as defaults, and the given options override them.
+func NewModule(opts ...Option) *Module {
+	ConfigLock.RLock()
+	m := &Module{
+		cli:             Client,
+		rg:              Guard,
+		userAgent:       UserAgent,
+		timeout:         TimeoutSecond,
+		skipVerify:      SkipInsecureVerify,
+		disableRedirect: DisableRedirect,
+		maxBodySize:     MaxBodySize,
+	}
+	ConfigLock.RUnlock()
+	for _, opt := range opts {
+		opt(m)
 	}
 	return m
 }
 
 // SetClient sets the http client for this module, useful for setting custom clients for testing or multiple loadings.
 func (m *Module) SetClient(c *http.Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.cli = c
 }
 
 // SetGuard sets the request guard for this module, useful for setting custom guards for testing or multiple loadings.
 func (m *Module) SetGuard(g RequestGuard) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.rg = g
 }
 
+// SetTimeout sets the default timeout in seconds for the requests of this module.
+func (m *Module) SetTimeout(sec float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.timeout = sec
+}
+
+// SetMaxBodySize sets the max size in bytes of response bodies read into memory for this module, 0 for no limit.
+func (m *Module) SetMaxBodySize(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxBodySize = n
+}
+
+// GetTimeout returns the default timeout in seconds for the requests of this module.
+func (m *Module) GetTimeout() float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.timeout
+}
+
 // LoadModule creates an http Module.
 func (m *Module) LoadModule() (starlark.StringDict, error) {
 	return starlark.StringDict{
@@ -105,13 +203,14 @@ func (m *Module) StringDict() starlark.StringDict {
 		sd[name] = starlark.NewBuiltin(ModuleName+"."+name, m.reqMethod(name))
 	}
 	sd["call"] = starlark.NewBuiltin(ModuleName+".call", m.callMethod)
-	sd["set_timeout"] = starlark.NewBuiltin(ModuleName+".set_timeout", setRequestTimeout)
-	sd["get_timeout"] = starlark.NewBuiltin(ModuleName+".get_timeout", getRequestTimeout)
+	sd["session"] = starlark.NewBuiltin(ModuleName+".session", m.newSession)
+	sd["set_timeout"] = starlark.NewBuiltin(ModuleName+".set_timeout", m.setRequestTimeout)
+	sd["get_timeout"] = starlark.NewBuiltin(ModuleName+".get_timeout", m.getRequestTimeout)
 	return sd
 }
 
-// setRequestTimeout sets the timeout for http requests
-func setRequestTimeout(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+// setRequestTimeout sets the timeout for http requests of this module
+func (m *Module) setRequestTimeout(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var timeout types.FloatOrInt
 	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "timeout", &timeout); err != nil {
 		return nil, err
@@ -119,26 +218,27 @@ func setRequestTimeout(thread *starlark.Thread, b *starlark.Builtin, args starla
 	if timeout < 0 {
 		return nil, fmt.Errorf("%s: timeout must be non-negative", b.Name())
 	}
-	// update the global TimeoutSecond variable which influences all future HTTP requests.
-	ConfigLock.Lock()
-	defer ConfigLock.Unlock()
-	TimeoutSecond = float64(timeout)
+	// update the timeout of this module only, which influences its future HTTP requests.
+	m.SetTimeout(float64(timeout))
 	return starlark.None, nil
 }
 
-// getRequestTimeout returns the current timeout for http requests
-func getRequestTimeout(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+// getRequestTimeout returns the current timeout for http requests of this module
+func (m *Module) getRequestTimeout(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	// check the arguments: no arguments
 	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
 		return nil, err
 	}
-	ConfigLock.RLock()
-	defer ConfigLock.RUnlock()
-	return starlark.Float(TimeoutSecond), nil
+	return starlark.Float(m.GetTimeout()), nil
 }
 
 // callMethod is a general function for making http requests which takes the method name and arguments.
 func (m *Module) callMethod(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return callByName(thread, b, args, kwargs, m.reqMethod)
+}
+
+// callByName calls the builtin function of the request method named by the first argument with the rest arguments.
+func callByName(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple, reqMethod func(method string) builtinFunc) (starlark.Value, error) {
 	// check the arguments, the first argument is the method name
 	var fv types.StringOrBytes
 	if len(args) < 1 {
@@ -151,91 +251,122 @@ func (m *Module) callMethod(thread *starlark.Thread, b *starlark.Builtin, args s
 	method := strings.ToLower(fv.GoString())
 	for _, name := range supportedMethods {
 		if method == name {
-			return m.reqMethod(name)(thread, b, args[1:], kwargs)
+			return reqMethod(name)(thread, b, args[1:], kwargs)
 		}
 	}
 	return nil, fmt.Errorf("unsupported method: %s", method)
 }
 
+// builtinFunc is the signature of starlark builtin functions.
+type builtinFunc = func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error)
+
 // reqMethod is a factory function for generating starlark builtin functions for different http request methods
-func (m *Module) reqMethod(method string) func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+func (m *Module) reqMethod(method string) builtinFunc {
 	return func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-		var (
-			getDefaultDict = func() *types.NullableDict { return types.NewNullableDict(starlark.NewDict(0)) }
-			urlv           starlark.String
-			params         = getDefaultDict()                   // default None, expect Dict
-			headers        = getDefaultDict()                   // default None, expect Dict
-			auth           starlark.Tuple                       // default empty Tuple, expect Tuple of two strings
-			body           = types.NewNullableStringOrBytes("") // default None, expect string
-			jsonBody       starlark.Value                       // default None, expect JSON serializable object
-			formBody       = getDefaultDict()                   // default None, expect Dict
-			formEncoding   starlark.String                      // default empty string, expect string
-			timeout        = types.FloatOrInt(TimeoutSecond)
-			allowRedirect  = starlark.Bool(!DisableRedirect)
-			verifySSL      = starlark.Bool(!SkipInsecureVerify)
-		)
-
-		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "url", &urlv, "params?", params, "headers", headers, "body", body, "json_body", &jsonBody, "form_body", formBody, "form_encoding", &formEncoding,
-			"auth?", &auth, "timeout?", &timeout, "allow_redirects?", &allowRedirect, "verify?", &verifySSL); err != nil {
-			return nil, err
-		}
+		return m.doRequest(thread, b, method, args, kwargs, nil)
+	}
+}
 
-		rawURL, err := AsString(urlv)
-		if err != nil {
-			return nil, err
-		}
-		if err = setQueryParams(&rawURL, params.Value()); err != nil {
-			return nil, err
-		}
+// doRequest makes the http request of the method with the arguments, and the session if not nil provides the base URL, default headers, cookies and retries.
+func (m *Module) doRequest(thread *starlark.Thread, b *starlark.Builtin, method string, args starlark.Tuple, kwargs []starlark.Tuple, sess *session) (starlark.Value, error) {
+	m.mu.RLock()
+	cli, rg, userAgent, maxBodySize, rec := m.cli, m.rg, m.userAgent, m.maxBodySize, m.recorder
+	defTimeout, skipVerify, disableRedirect := m.timeout, m.skipVerify, m.disableRedirect
+	m.mu.RUnlock()
 
-		// hack for postForm
-		if method == "postForm" {
-			method = "post"
-			formEncoding = formEncodingURL
-		}
+	var (
+		getDefaultDict = func() *types.NullableDict { return types.NewNullableDict(starlark.NewDict(0)) }
+		urlv           starlark.String
+		params         = getDefaultDict()                   // default None, expect Dict
+		headers        = getDefaultDict()                   // default None, expect Dict
+		auth           starlark.Tuple                       // default empty Tuple, expect Tuple of two strings
+		body           = types.NewNullableStringOrBytes("") // default None, expect string
+		jsonBody       starlark.Value                       // default None, expect JSON serializable object
+		formBody       = getDefaultDict()                   // default None, expect Dict
+		formEncoding   starlark.String                      // default empty string, expect string
+		files          = getDefaultDict()                   // default None, expect Dict of field name to file path
+		timeout        = types.FloatOrInt(defTimeout)
+		allowRedirect  = starlark.Bool(!disableRedirect)
+		verifySSL      = starlark.Bool(!skipVerify)
+	)
 
-		req, err := http.NewRequest(strings.ToUpper(method), rawURL, nil)
-		if err != nil {
-			return nil, err
-		}
-		if m.rg != nil {
-			req, err = m.rg.Allowed(thread, req)
-			if err != nil {
-				return nil, err
-			}
-		}
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "url", &urlv, "params?", params, "headers", headers, "body", body, "json_body", &jsonBody, "form_body", formBody, "form_encoding", &formEncoding,
+		"auth?", &auth, "timeout?", &timeout, "allow_redirects?", &allowRedirect, "verify?", &verifySSL, "files?", files); err != nil {
+		return nil, err
+	}
 
-		if err = setHeaders(req, headers.Value()); err != nil {
-			return nil, err
-		}
-		if err = setAuth(req, auth); err != nil {
-			return nil, err
-		}
-		if err = setBody(req, body, formBody.Value(), formEncoding, jsonBody); err != nil {
-			return nil, err
-		}
+	rawURL, err := AsString(urlv)
+	if err != nil {
+		return nil, err
+	}
+	if rawURL, err = sess.resolveURL(rawURL); err != nil {
+		return nil, err
+	}
+	if err = setQueryParams(&rawURL, params.Value()); err != nil {
+		return nil, err
+	}
+
+	// hack for postForm, the method is not changed in place as the builtin is shared by threads
+	verb := method
+	if verb == "postForm" {
+		verb = "post"
+		formEncoding = formEncodingURL
+	}
 
-		cli := m.getHTTPClient(float64(timeout), bool(allowRedirect), bool(verifySSL))
-		res, err := cli.Do(req)
+	req, err := http.NewRequest(strings.ToUpper(verb), rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rg != nil {
+		req, err = rg.Allowed(thread, req)
 		if err != nil {
 			return nil, err
 		}
+	}
+	pol := policy.GetThreadPolicy(thread)
+	if err = pol.CheckNet(req.URL.Host); err != nil {
+		return nil, err
+	}
 
-		r := &Response{*res}
-		return r.Struct(), nil
+	if err = sess.setHeaders(req, headers.Value(), userAgent); err != nil {
+		return nil, err
+	}
+	if err = setAuth(req, auth); err != nil {
+		return nil, err
+	}
+	if fd := files.Value(); fd != nil && fd.Len() > 0 {
+		err = setFileBody(req, vfs.GetThreadFS(thread), formBody.Value(), fd)
+	} else {
+		err = setBody(req, body, formBody.Value(), formEncoding, jsonBody)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cli = sess.client(cli, float64(timeout), bool(allowRedirect), bool(verifySSL))
+	if rec != nil {
+		cli = rec.wrap(cli)
+	}
+	cli = guardRedirect(cli, pol)
+	res, err := sess.do(thread, cli, req)
+	if err != nil {
+		return nil, err
 	}
+
+	r := &Response{Response: *res, maxBodySize: maxBodySize}
+	return r.Struct(), nil
 }
 
-func (m *Module) getHTTPClient(timeoutSec float64, allowRedirect, verifySSL bool) *http.Client {
+func getHTTPClient(cli *http.Client, timeoutSec float64, allowRedirect, verifySSL bool) *http.Client {
 	// return existing client if set
-	if m.cli != nil {
-		return m.cli
+	if cli != nil {
+		return cli
 	}
 	// set timeout to 30 seconds if it's negative
 	if timeoutSec < 0 {
 		timeoutSec = 30
 	}
-	cli := &http.Client{Timeout: time.Duration(timeoutSec * float64(time.Second))}
+	cli = &http.Client{Timeout: time.Duration(timeoutSec * float64(time.Second))}
 	// skip TLS verification if set
 	if !verifySSL {
 		tr := http.DefaultTransport.(*http.Transport).Clone()
@@ -251,6 +382,28 @@ func (m *Module) getHTTPClient(timeoutSec float64, allowRedirect, verifySSL bool
 	return cli
 }
 
+// guardRedirect returns a copy of the client checking the hosts of redirects by the policy, or the client itself for a nil policy.
+func guardRedirect(cli *http.Client, pol *policy.Policy) *http.Client {
+	if pol == nil {
+		return cli
+	}
+	c := *cli
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if err := pol.CheckNet(req.URL.Host); err != nil {
+			return err
+		}
+		if cli.CheckRedirect != nil {
+			return cli.CheckRedirect(req, via)
+		}
+		// the default policy of http.Client
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &c
+}
+
 // AsString unquotes a starlark string value
 func AsString(x starlark.Value) (string, error) {
 	return strconv.Unquote(x.String())
@@ -319,7 +472,7 @@ func setAuth(req *http.Request, auth starlark.Tuple) error {
 	return fmt.Errorf("expected two values for auth params tuple")
 }
 
-func setHeaders(req *http.Request, headers *starlark.Dict) error {
+func setHeaders(req *http.Request, headers *starlark.Dict, userAgent string) error {
 	var (
 		keys    = headers.Keys()
 		UAKey   = "User-Agent"
@@ -349,8 +502,8 @@ func setHeaders(req *http.Request, headers *starlark.Dict) error {
 		}
 	}
 
-	if UserAgent != "" && !isUASet {
-		req.Header.Set(UAKey, UserAgent)
+	if userAgent != "" && !isUASet {
+		req.Header.Set(UAKey, userAgent)
 	}
 	return nil
 }
@@ -480,17 +633,24 @@ func setBody(req *http.Request, body *types.NullableStringOrBytes, formData *sta
 // Response represents an HTTP response, wrapping a Go http.Response with Starlark methods.
 type Response struct {
 	http.Response
+	maxBodySize int64
+	streamErr   error
+	drained     bool
 }
 
 // Struct turns a response into a *starlark.Struct
 func (r *Response) Struct() *starlarkstruct.Struct {
 	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
-		"url":         starlark.String(r.Request.URL.String()),
-		"status_code": starlark.MakeInt(r.StatusCode),
-		"headers":     r.HeadersDict(),
-		"encoding":    starlark.String(strings.Join(r.TransferEncoding, ",")),
-		"body":        starlark.NewBuiltin("body", r.Text),
-		"json":        starlark.NewBuiltin("json", r.JSON),
+		"url":          starlark.String(r.Request.URL.String()),
+		"status_code":  starlark.MakeInt(r.StatusCode),
+		"headers":      r.HeadersDict(),
+		"encoding":     starlark.String(strings.Join(r.TransferEncoding, ",")),
+		"body":         starlark.NewBuiltin("body", r.Text),
+		"json":         starlark.NewBuiltin("json", r.JSON),
+		"iter_content": starlark.NewBuiltin("iter_content", r.iterContent),
+		"read":         starlark.NewBuiltin("read", r.read),
+		"save":         starlark.NewBuiltin("save", r.save),
+		"close":        starlark.NewBuiltin("close", r.close),
 	})
 }
 
@@ -507,30 +667,22 @@ func (r *Response) HeadersDict() *starlark.Dict {
 
 // Text returns the raw data as a string
 func (r *Response) Text(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	data, err := ioutil.ReadAll(r.Body)
+	data, err := r.readBody()
 	if err != nil {
 		return nil, err
 	}
 
-	// reset reader to allow multiple calls
-	_ = r.Body.Close()
-	r.Body = ioutil.NopCloser(bytes.NewReader(data))
-
 	// wraps as result
 	return starlark.String(data), nil
 }
 
 // JSON attempts to parse the response body as JSON
 func (r *Response) JSON(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := r.readBody()
 	if err != nil {
 		return nil, err
 	}
 
-	// reset reader to allow multiple calls
-	_ = r.Body.Close()
-	r.Body = ioutil.NopCloser(bytes.NewReader(body))
-
 	// use internal marshaler to support starlark types, returns None on error
 	sv, err := dataconv.UnmarshalStarlarkJSON(body)
 	if err != nil {
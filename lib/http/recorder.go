@@ -0,0 +1,423 @@
+package http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// RecordMode is the mode of a Recorder.
+type RecordMode uint8
+
+const (
+	// ModeReplay replays the exchanges from the cassette without network access, and fails for requests not found in it.
+	ModeReplay RecordMode = iota
+	// ModeRecord sends the requests to the real endpoints, and saves the exchanges to the cassette.
+	ModeRecord
+)
+
+// ErrNoInteraction is returned in ModeReplay for requests not found in the cassette.
+var ErrNoInteraction = errors.New("no recorded interaction")
+
+// RedactedValue replaces the values of the redacted headers in the cassette.
+const RedactedValue = "REDACTED"
+
+// DefaultRedactHeaders are the headers redacted in the cassette by default, as they usually carry credentials.
+var DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "X-Auth-Token"}
+
+// Cassette is the recorded HTTP exchanges saved as a JSON file.
+type Cassette struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// Interaction is a recorded pair of HTTP request and response.
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// RecordedRequest is the request of an Interaction.
+type RecordedRequest struct {
+	Method  string       `json:"method"`
+	URL     string       `json:"url"`
+	Headers http.Header  `json:"headers,omitempty"`
+	Body    RecordedBody `json:"body"`
+}
+
+// RecordedResponse is the response of an Interaction.
+type RecordedResponse struct {
+	StatusCode int          `json:"status_code"`
+	Headers    http.Header  `json:"headers,omitempty"`
+	Body       RecordedBody `json:"body"`
+}
+
+// RecordedBody is the body of the recorded request or response, it's saved as a string if it's valid UTF-8, otherwise as a base64 encoded object.
+type RecordedBody []byte
+
+// MarshalJSON implements json.Marshaler.
+func (b RecordedBody) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(b) {
+		return json.Marshal(string(b))
+	}
+	return json.Marshal(map[string]string{"base64": base64.StdEncoding.EncodeToString(b)})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (b *RecordedBody) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*b = RecordedBody(s)
+		return nil
+	}
+	var obj struct {
+		Base64 string `json:"base64"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	raw, err := base64.StdEncoding.DecodeString(obj.Base64)
+	if err != nil {
+		return err
+	}
+	*b = raw
+	return nil
+}
+
+// Recorder is an http.RoundTripper to record the real HTTP exchanges to a cassette file, or replay them from it offline for deterministic tests.
+// In ModeReplay, requests are matched by method, URL, body and the selected headers, and the matched interactions are replayed in the recorded order.
+// Multipart bodies are matched by the parts, so the uploads with random boundaries can be replayed.
+// The values of the redacted headers, DefaultRedactHeaders unless set by SetRedactHeaders, are saved as RedactedValue in both requests and responses.
+// It's safe for concurrent use, and can be set for the http module by WithRecorder.
+type Recorder struct {
+	mu            sync.Mutex
+	path          string
+	mode          RecordMode
+	matchHeaders  []string
+	redactHeaders map[string]bool
+	transport     http.RoundTripper
+	cassette      *Cassette
+	used          []bool
+}
+
+// NewRecorder creates a Recorder for the cassette file in the given mode, and the headers are also used to match requests in ModeReplay.
+// The cassette file must exist for ModeReplay, and it's overwritten by the exchanges recorded in ModeRecord.
+func NewRecorder(path string, mode RecordMode, matchHeaders ...string) (*Recorder, error) {
+	r := &Recorder{
+		path:      path,
+		mode:      mode,
+		transport: http.DefaultTransport,
+		cassette:  &Cassette{},
+	}
+	r.setRedactHeaders(DefaultRedactHeaders)
+	for _, h := range matchHeaders {
+		r.matchHeaders = append(r.matchHeaders, http.CanonicalHeaderKey(h))
+	}
+	switch mode {
+	case ModeReplay:
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, r.cassette); err != nil {
+			return nil, fmt.Errorf("invalid cassette %s: %w", path, err)
+		}
+		r.used = make([]bool, len(r.cassette.Interactions))
+	case ModeRecord:
+	default:
+		return nil, fmt.Errorf("unknown record mode: %d", mode)
+	}
+	return r, nil
+}
+
+// SetTransport sets the underlying transport to send the requests in ModeRecord, nil for http.DefaultTransport.
+func (r *Recorder) SetTransport(rt http.RoundTripper) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	r.transport = rt
+}
+
+// SetRedactHeaders sets the headers to redact in the cassette instead of DefaultRedactHeaders, and none for no redaction.
+// The redacted headers selected for matching requests in ModeReplay are matched by the number of values only.
+func (r *Recorder) SetRedactHeaders(headers ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setRedactHeaders(headers)
+}
+
+func (r *Recorder) setRedactHeaders(headers []string) {
+	r.redactHeaders = make(map[string]bool, len(headers))
+	for _, h := range headers {
+		r.redactHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+}
+
+// redact returns a copy of the headers with the values of the redacted headers replaced, the caller must hold the lock.
+func (r *Recorder) redact(h http.Header) http.Header {
+	h = h.Clone()
+	for k, vs := range h {
+		if r.redactHeaders[k] {
+			for i := range vs {
+				vs[i] = RedactedValue
+			}
+		}
+	}
+	return h
+}
+
+// Client returns a new http client using the Recorder as the transport.
+func (r *Recorder) Client() *http.Client {
+	return &http.Client{Transport: r}
+}
+
+// WithRecorder sets the module to record or replay the requests by the Recorder as the transport of the clients,
+// so the timeout, redirect and TLS verification settings of requests still apply while recording or replaying.
+func WithRecorder(r *Recorder) Option {
+	return func(m *Module) {
+		m.recorder = r
+	}
+}
+
+// wrap returns a copy of the client with the Recorder as the transport, and the original transport sends the requests to record.
+func (r *Recorder) wrap(cli *http.Client) *http.Client {
+	c := *cli
+	c.Transport = &recorderTransport{r: r, base: cli.Transport}
+	return &c
+}
+
+// recorderTransport records or replays the requests by the Recorder, and sends the requests to record by the base transport.
+type recorderTransport struct {
+	r    *Recorder
+	base http.RoundTripper
+}
+
+func (t *recorderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.r.roundTrip(req, t.base)
+}
+
+// Interactions returns the number of interactions in the cassette.
+func (r *Recorder) Interactions() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.cassette.Interactions)
+}
+
+// RoundTrip records or replays the HTTP exchange of the request.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	return r.roundTrip(req, nil)
+}
+
+// roundTrip records or replays the HTTP exchange of the request, the request to record is sent by the base transport, or the one of the Recorder if it's nil.
+func (r *Recorder) roundTrip(req *http.Request, base http.RoundTripper) (*http.Response, error) {
+	// read the request body, and restore it for the transport
+	var reqBody []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if reqBody, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	if r.mode == ModeReplay {
+		return r.replay(req, reqBody)
+	}
+	return r.record(req, reqBody, base)
+}
+
+// replay returns the response of the first unused matched interaction, or the last matched one if all are used.
+func (r *Recorder) replay(req *http.Request, body []byte) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	header := r.redact(req.Header)
+	found := -1
+	for i, it := range r.cassette.Interactions {
+		if !r.match(it, req, header, body) {
+			continue
+		}
+		found = i
+		if !r.used[i] {
+			break
+		}
+	}
+	if found < 0 {
+		return nil, fmt.Errorf("%w: %s %s", ErrNoInteraction, req.Method, req.URL)
+	}
+	r.used[found] = true
+	return r.cassette.Interactions[found].Response.build(req), nil
+}
+
+// match reports whether the interaction matches the request with the redacted headers.
+// Multipart bodies are matched by the parts regardless of the order, as the boundary is random and the parts may be written in any order.
+func (r *Recorder) match(it *Interaction, req *http.Request, header http.Header, body []byte) bool {
+	rr := it.Request
+	if rr.Method != req.Method || rr.URL != req.URL.String() || !equalBody(rr.Headers, rr.Body, header, body) {
+		return false
+	}
+	for _, h := range r.matchHeaders {
+		if fmt.Sprint(headerValues(rr.Headers, h)) != fmt.Sprint(headerValues(header, h)) {
+			return false
+		}
+	}
+	return true
+}
+
+// headerValues returns the values of the header to match, without the parameters of multipart content types, e.g. the boundary.
+func headerValues(h http.Header, key string) []string {
+	vs := h.Values(key)
+	if key != "Content-Type" {
+		return vs
+	}
+	out := make([]string, len(vs))
+	for i, v := range vs {
+		if mt, _, err := mime.ParseMediaType(v); err == nil && strings.HasPrefix(mt, "multipart/") {
+			v = mt
+		}
+		out[i] = v
+	}
+	return out
+}
+
+// equalBody reports whether the bodies of the requests with the headers are equal, the multipart bodies are compared by the parts.
+func equalBody(h1 http.Header, b1 []byte, h2 http.Header, b2 []byte) bool {
+	p1, ok1 := multipartParts(h1, b1)
+	p2, ok2 := multipartParts(h2, b2)
+	if !ok1 || !ok2 {
+		return bytes.Equal(b1, b2)
+	}
+	if len(p1) != len(p2) {
+		return false
+	}
+	for i := range p1 {
+		if p1[i] != p2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// multipartParts returns the sorted parts of the multipart body with the headers of each part, or false if it's not a valid multipart body.
+func multipartParts(h http.Header, body []byte) ([]string, bool) {
+	mt, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mt, "multipart/") || params["boundary"] == "" {
+		return nil, false
+	}
+	var parts []string
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, false
+		}
+		content, err := ioutil.ReadAll(p)
+		if err != nil {
+			return nil, false
+		}
+		parts = append(parts, fmt.Sprint(p.Header)+"\n"+string(content))
+	}
+	sort.Strings(parts)
+	return parts, true
+}
+
+// record sends the request by the transport, and saves the exchange to the cassette file.
+func (r *Recorder) record(req *http.Request, body []byte, rt http.RoundTripper) (*http.Response, error) {
+	if rt == nil {
+		r.mu.Lock()
+		rt = r.transport
+		r.mu.Unlock()
+	}
+
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resBody, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(resBody))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	it := &Interaction{
+		Request: RecordedRequest{
+			Method:  req.Method,
+			URL:     req.URL.String(),
+			Headers: r.redact(req.Header),
+			Body:    body,
+		},
+		Response: RecordedResponse{
+			StatusCode: res.StatusCode,
+			Headers:    r.redact(res.Header),
+			Body:       resBody,
+		},
+	}
+	r.cassette.Interactions = append(r.cassette.Interactions, it)
+	if err = r.save(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// save writes the cassette to the file, the caller must hold the lock.
+func (r *Recorder) save() error {
+	data, err := json.MarshalIndent(r.cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so the cassette is never left half-written
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+// build creates the http response of the recorded one for the request.
+func (rr RecordedResponse) build(req *http.Request) *http.Response {
+	header := rr.Headers.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(rr.StatusCode) + " " + http.StatusText(rr.StatusCode),
+		StatusCode:    rr.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(rr.Body)),
+		ContentLength: int64(len(rr.Body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,290 @@
+package http_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	itn "github.com/1set/starlet/internal"
+	lh "github.com/1set/starlet/lib/http"
+	"go.starlark.net/starlark"
+)
+
+func TestRecorder(t *testing.T) {
+	hits := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Hits", fmt.Sprint(hits))
+		switch r.URL.Path {
+		case "/binary":
+			w.Write([]byte{0xff, 0xfe, 0x00, 0x01})
+		default:
+			fmt.Fprintf(w, "%s %s %s %s", r.Method, r.URL.RequestURI(), r.Header.Get("X-Tenant"), b)
+		}
+	}))
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+	predecl := starlark.StringDict{"test_server_url": starlark.String(ts.URL)}
+	script := itn.HereDoc(`
+		load('http', 'get', 'post')
+		r1 = get(test_server_url + "/hello", params={"a": "1"}, headers={"X-Tenant": "t1"})
+		assert.eq(r1.body(), "GET /hello?a=1 t1 ")
+		assert.eq(r1.headers["X-Hits"], "1")
+		r2 = post(test_server_url + "/items", json_body={"name": "x"})
+		assert.eq(r2.body(), 'POST /items  {"name":"x"}')
+		r3 = post(test_server_url + "/items", json_body={"name": "x"})
+		assert.eq(r3.headers["X-Hits"], "3")
+		r4 = get(test_server_url + "/binary")
+		assert.eq(r4.status_code, 200)
+		assert.eq(len(r4.body()), 4)
+	`)
+
+	// record the real exchanges
+	rec, err := lh.NewRecorder(cassette, lh.ModeRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := lh.NewModule(lh.WithRecorder(rec))
+	if _, err := itn.ExecModuleWithErrorTest(t, lh.ModuleName, md.LoadModule, script, "", predecl); err != nil {
+		t.Fatalf("record: unexpected error: %v", err)
+	}
+	if n := rec.Interactions(); n != 4 || hits != 4 {
+		t.Fatalf("expected 4 interactions and hits, got %d, %d", n, hits)
+	}
+	data, err := ioutil.ReadFile(cassette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(data); !strings.Contains(s, `"base64": "//4AAQ=="`) || !strings.Contains(s, `"body": "{\"name\":\"x\"}"`) {
+		t.Errorf("unexpected cassette: %s", s)
+	}
+
+	// replay offline in the recorded order
+	ts.Close()
+	rep, err := lh.NewRecorder(cassette, lh.ModeReplay, "x-tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	md = lh.NewModule()
+	md.SetClient(rep.Client())
+	if _, err := itn.ExecModuleWithErrorTest(t, lh.ModuleName, md.LoadModule, script, "", predecl); err != nil {
+		t.Fatalf("replay: unexpected error: %v", err)
+	}
+
+	// requests not recorded
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"url", `load('http', 'get'); get(test_server_url + "/hello", params={"a": "2"}, headers={"X-Tenant": "t1"})`},
+		{"method", `load('http', 'put'); put(test_server_url + "/items", json_body={"name": "x"})`},
+		{"body", `load('http', 'post'); post(test_server_url + "/items", json_body={"name": "y"})`},
+		{"header", `load('http', 'get'); get(test_server_url + "/hello", params={"a": "1"}, headers={"X-Tenant": "t2"})`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := itn.ExecModuleWithErrorTest(t, lh.ModuleName, md.LoadModule, tt.script, "no recorded interaction", predecl)
+			if !errors.Is(err, lh.ErrNoInteraction) {
+				t.Errorf("expected no interaction error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNewRecorder_Error(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := lh.NewRecorder(filepath.Join(dir, "missing.json"), lh.ModeReplay); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+	bad := filepath.Join(dir, "bad.json")
+	if err := ioutil.WriteFile(bad, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lh.NewRecorder(bad, lh.ModeReplay); err == nil || !strings.Contains(err.Error(), "invalid cassette") {
+		t.Errorf("expected invalid cassette error, got %v", err)
+	}
+	if _, err := lh.NewRecorder(bad, lh.RecordMode(9)); err == nil || err.Error() != "unknown record mode: 9" {
+		t.Errorf("expected unknown mode error, got %v", err)
+	}
+}
+
+func TestRecorder_Redact(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "cookie-secret"})
+		fmt.Fprint(w, r.Header.Get("X-Tenant"))
+	}))
+	defer ts.Close()
+	predecl := starlark.StringDict{"test_server_url": starlark.String(ts.URL)}
+	script := itn.HereDoc(`
+		load('http', 'get')
+		r = get(test_server_url, headers={"Authorization": "Bearer token-secret", "X-Api-Key": "key-secret", "X-Tenant": "t1"})
+		assert.eq(r.body(), "t1")
+	`)
+	record := func(t *testing.T, setup func(rec *lh.Recorder)) string {
+		cassette := filepath.Join(t.TempDir(), "cassette.json")
+		rec, err := lh.NewRecorder(cassette, lh.ModeRecord)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if setup != nil {
+			setup(rec)
+		}
+		if _, err := itn.ExecModuleWithErrorTest(t, lh.ModuleName, lh.NewModule(lh.WithRecorder(rec)).LoadModule, script, "", predecl); err != nil {
+			t.Fatalf("record: unexpected error: %v", err)
+		}
+		data, err := ioutil.ReadFile(cassette)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// credentials are redacted by default
+	data := record(t, nil)
+	for _, secret := range []string{"token-secret", "key-secret", "cookie-secret"} {
+		if strings.Contains(data, secret) {
+			t.Errorf("unexpected %s in cassette: %s", secret, data)
+		}
+	}
+	if !strings.Contains(data, `"REDACTED"`) || !strings.Contains(data, `"t1"`) {
+		t.Errorf("unexpected cassette: %s", data)
+	}
+
+	// redacted headers are matched by the number of values
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+	if err := ioutil.WriteFile(cassette, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := lh.NewRecorder(cassette, lh.ModeReplay, "Authorization", "X-Tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := lh.NewModule(lh.WithRecorder(rep))
+	if _, err := itn.ExecModuleWithErrorTest(t, lh.ModuleName, md.LoadModule, strings.Replace(script, "token-secret", "other-token", 1), "", predecl); err != nil {
+		t.Errorf("replay: unexpected error: %v", err)
+	}
+	if _, err := itn.ExecModuleWithErrorTest(t, lh.ModuleName, md.LoadModule, `load('http', 'get'); get(test_server_url, headers={"X-Tenant": "t1"})`, "no recorded interaction", predecl); !errors.Is(err, lh.ErrNoInteraction) {
+		t.Errorf("expected no interaction error, got %v", err)
+	}
+
+	// no redaction
+	if data := record(t, func(rec *lh.Recorder) { rec.SetRedactHeaders() }); !strings.Contains(data, "token-secret") || !strings.Contains(data, "cookie-secret") {
+		t.Errorf("unexpected cassette without redaction: %s", data)
+	}
+}
+
+func TestRecorder_ClientSettings(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "/ok", http.StatusFound)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+			fmt.Fprint(w, "slow")
+		default:
+			fmt.Fprint(w, "ok")
+		}
+	}))
+	defer ts.Close()
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+	predecl := starlark.StringDict{"test_server_url": starlark.String(ts.URL)}
+	script := itn.HereDoc(`
+		load('http', 'get')
+		r1 = get(test_server_url + "/redirect", allow_redirects=False)
+		assert.eq(r1.status_code, 302)
+		assert.eq(r1.headers["Location"], "/ok")
+		r2 = get(test_server_url + "/redirect")
+		assert.eq(r2.status_code, 200)
+		assert.eq(r2.body(), "ok")
+	`)
+
+	// the settings of requests apply while recording
+	rec, err := lh.NewRecorder(cassette, lh.ModeRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := lh.NewModule(lh.WithRecorder(rec))
+	if _, err := itn.ExecModuleWithErrorTest(t, lh.ModuleName, md.LoadModule, script, "", predecl); err != nil {
+		t.Fatalf("record: unexpected error: %v", err)
+	}
+	if n := rec.Interactions(); n != 3 {
+		t.Errorf("expected 3 interactions, got %d", n)
+	}
+	if _, err := itn.ExecModuleWithErrorTest(t, lh.ModuleName, md.LoadModule, `load('http', 'get'); get(test_server_url + "/slow", timeout=0.05)`, "Client.Timeout exceeded", predecl); err == nil {
+		t.Errorf("record: expected timeout error, got nil")
+	}
+
+	// and while replaying
+	ts.Close()
+	rep, err := lh.NewRecorder(cassette, lh.ModeReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := itn.ExecModuleWithErrorTest(t, lh.ModuleName, lh.NewModule(lh.WithRecorder(rep)).LoadModule, script, "", predecl); err != nil {
+		t.Errorf("replay: unexpected error: %v", err)
+	}
+}
+
+func TestRecorder_Multipart(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, fh, err := r.FormFile("doc")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		b, _ := ioutil.ReadAll(f)
+		fmt.Fprintf(w, "%s|%s|%s|%s", r.FormValue("kind"), r.FormValue("lang"), fh.Filename, b)
+	}))
+	dir := t.TempDir()
+	src := filepath.Join(dir, "report.txt")
+	if err := ioutil.WriteFile(src, []byte("file content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cassette := filepath.Join(dir, "cassette.json")
+	predecl := starlark.StringDict{
+		"test_server_url": starlark.String(ts.URL),
+		"src_file":        starlark.String(src),
+	}
+	script := itn.HereDoc(`
+		load('http', 'post')
+		res = post(test_server_url + "/upload", form_body={"kind": "report", "lang": "en"}, files={"doc": src_file})
+		assert.eq(res.body(), "report|en|report.txt|file content")
+	`)
+
+	// record the upload
+	rec, err := lh.NewRecorder(cassette, lh.ModeRecord, "Content-Type")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := itn.ExecModuleWithErrorTest(t, lh.ModuleName, lh.NewModule(lh.WithRecorder(rec)).LoadModule, script, "", predecl); err != nil {
+		t.Fatalf("record: unexpected error: %v", err)
+	}
+
+	// the upload with another boundary is replayed, but not with other parts
+	ts.Close()
+	rep, err := lh.NewRecorder(cassette, lh.ModeReplay, "Content-Type")
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := lh.NewModule(lh.WithRecorder(rep))
+	for i := 0; i < 3; i++ {
+		if _, err := itn.ExecModuleWithErrorTest(t, lh.ModuleName, md.LoadModule, script, "", predecl); err != nil {
+			t.Errorf("replay #%d: unexpected error: %v", i, err)
+		}
+	}
+	if _, err := itn.ExecModuleWithErrorTest(t, lh.ModuleName, md.LoadModule, strings.Replace(script, `"en"`, `"fr"`, 1), "no recorded interaction", predecl); !errors.Is(err, lh.ErrNoInteraction) {
+		t.Errorf("expected no interaction error, got %v", err)
+	}
+}
@@ -2,13 +2,23 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/1set/starlet/dataconv"
 	tps "github.com/1set/starlet/dataconv/types"
+	"github.com/1set/starlet/vfs"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
 )
@@ -16,8 +26,18 @@ import (
 var (
 	structNameRequest  = starlark.String("Request")
 	structNameResponse = starlark.String("Response")
+	structNameFile     = starlark.String("UploadedFile")
 )
 
+// pathParamsKey is the context key of the path parameters of requests.
+type pathParamsKey struct{}
+
+// WithPathParams returns a shallow copy of the request with the path parameters matched by the router, e.g. {"id": "42"} for /users/42 of /users/{id}.
+// They are exported as the params of the request for Starlark scripts.
+func WithPathParams(r *http.Request, params map[string]string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params))
+}
+
 // ExportedServerRequest encapsulates HTTP request data in a format accessible to both Go code and Starlark scripts.
 // This struct bridges Go's HTTP handling features with Starlark's dynamic scripting capabilities, enabling seamless
 // interaction and manipulation of request properties in Go, while providing a structured, read-only view of the request
@@ -41,15 +61,26 @@ var (
 // modifications and protecting against potential security threats. Developers are encouraged to validate all modifications
 // and interactions with the request data to maintain the server's security posture.
 type ExportedServerRequest struct {
-	Method   string         // The HTTP method (e.g., GET, POST, PUT, DELETE)
-	URL      *url.URL       // The request URL
-	Proto    string         // The protocol used for the request (e.g., HTTP/1.1)
-	Host     string         // The host specified in the request
-	Remote   string         // The remote address of the client
-	Header   http.Header    // The HTTP headers included in the request
-	Encoding []string       // The transfer encodings specified in the request
-	Body     []byte         // The request body data
-	JSONData starlark.Value // The request body data as Starlark value
+	Method   string                     // The HTTP method (e.g., GET, POST, PUT, DELETE)
+	URL      *url.URL                   // The request URL
+	Proto    string                     // The protocol used for the request (e.g., HTTP/1.1)
+	Host     string                     // The host specified in the request
+	Remote   string                     // The remote address of the client
+	Header   http.Header                // The HTTP headers included in the request
+	Encoding []string                   // The transfer encodings specified in the request
+	Body     []byte                     // The request body data
+	JSONData starlark.Value             // The request body data as Starlark value
+	Cookies  []*http.Cookie             // The cookies sent with the request
+	Form     url.Values                 // The form data in the body of urlencoded or multipart forms
+	Files    map[string][]*UploadedFile // The uploaded files of multipart forms
+	Params   map[string]string          // The path parameters set by WithPathParams
+}
+
+// UploadedFile is a file uploaded in the multipart form of the request.
+type UploadedFile struct {
+	Filename    string // The name of the file given by the client
+	ContentType string // The content type of the file part
+	Data        []byte // The content of the file
 }
 
 // NewExportedServerRequest creates a new ExportedServerRequest from an http.Request.
@@ -83,7 +114,8 @@ func NewExportedServerRequest(r *http.Request) (*ExportedServerRequest, error) {
 	}
 
 	// create the exported request
-	return &ExportedServerRequest{
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	sr := &ExportedServerRequest{
 		Method:   r.Method,
 		URL:      r.URL,
 		Proto:    r.Proto,
@@ -93,7 +125,53 @@ func NewExportedServerRequest(r *http.Request) (*ExportedServerRequest, error) {
 		Encoding: r.TransferEncoding,
 		Body:     body,
 		JSONData: sv,
-	}, nil
+		Cookies:  r.Cookies(),
+		Params:   params,
+	}
+
+	// parse form data, invalid forms are left empty as invalid JSON
+	sr.Form, sr.Files = parseFormBody(r.Header.Get("Content-Type"), body)
+	return sr, nil
+}
+
+// parseFormBody parses the body of urlencoded or multipart forms, and returns nil for other content types or invalid forms.
+func parseFormBody(contentType string, body []byte) (url.Values, map[string][]*UploadedFile) {
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil || len(body) == 0 {
+		return nil, nil
+	}
+	switch mt {
+	case formEncodingURL:
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, nil
+		}
+		return form, nil
+	case formEncodingMultipart:
+		// the body is already in memory, so the files are kept in memory instead of temporary files
+		mf, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(int64(len(body)))
+		if err != nil {
+			return nil, nil
+		}
+		defer mf.RemoveAll()
+		files := make(map[string][]*UploadedFile, len(mf.File))
+		for field, fhs := range mf.File {
+			for _, fh := range fhs {
+				f, err := fh.Open()
+				if err != nil {
+					return nil, nil
+				}
+				data, err := ioutil.ReadAll(f)
+				_ = f.Close()
+				if err != nil {
+					return nil, nil
+				}
+				files[field] = append(files[field], &UploadedFile{Filename: fh.Filename, ContentType: fh.Header.Get("Content-Type"), Data: data})
+			}
+		}
+		return url.Values(mf.Value), files
+	}
+	return nil, nil
 }
 
 // Struct returns a Starlark struct representation of the ExportedServerRequest, which exposes the following fields to Starlark scripts:
@@ -107,7 +185,38 @@ func NewExportedServerRequest(r *http.Request) (*ExportedServerRequest, error) {
 //   - encoding: The transfer encodings specified in the request
 //   - body: The request body data
 //   - json: The request body data as Starlark value, if it is valid JSON or None otherwise
+//   - cookies: The cookies sent with the request, a dict of names to values
+//   - form: The form data of urlencoded or multipart forms in the body
+//   - files: The uploaded files of multipart forms, a dict of field names to lists of structs with filename, content_type, size and content
+//   - params: The path parameters set by WithPathParams
 func (r *ExportedServerRequest) Struct() *starlarkstruct.Struct {
+	// cookies, the first one wins for the duplicate names
+	cookies := &starlark.Dict{}
+	for _, c := range r.Cookies {
+		if _, found, _ := cookies.Get(starlark.String(c.Name)); !found {
+			_ = cookies.SetKey(starlark.String(c.Name), starlark.String(c.Value))
+		}
+	}
+	// uploaded files
+	files := &starlark.Dict{}
+	for field, list := range r.Files {
+		l := make([]starlark.Value, len(list))
+		for i, f := range list {
+			l[i] = starlarkstruct.FromStringDict(structNameFile, starlark.StringDict{
+				"filename":     starlark.String(f.Filename),
+				"content_type": starlark.String(f.ContentType),
+				"size":         starlark.MakeInt(len(f.Data)),
+				"content":      starlark.Bytes(f.Data),
+			})
+		}
+		_ = files.SetKey(starlark.String(field), starlark.NewList(l))
+	}
+	// path parameters
+	params := &starlark.Dict{}
+	for k, v := range r.Params {
+		_ = params.SetKey(starlark.String(k), starlark.String(v))
+	}
+
 	// prepare struct members
 	sd := starlark.StringDict{
 		"method":   starlark.String(r.Method),
@@ -120,6 +229,10 @@ func (r *ExportedServerRequest) Struct() *starlarkstruct.Struct {
 		"encoding": sliceStr2List(r.Encoding),
 		"body":     starlark.String(r.Body),
 		"json":     r.JSONData,
+		"cookies":  cookies,
+		"form":     mapStrs2Dict(r.Form),
+		"files":    files,
+		"params":   params,
 	}
 	// create struct
 	return starlarkstruct.FromStringDict(structNameRequest, sd)
@@ -192,6 +305,29 @@ type ServerResponse struct {
 	contentType string
 	dataType    contentDataType
 	data        []byte
+	cookies     []*http.Cookie
+	file        *responseFile
+	writer      http.ResponseWriter
+	request     *http.Request
+	streamed    bool
+}
+
+// responseFile is the file to send as the response body.
+type responseFile struct {
+	sys  vfs.System
+	name string
+}
+
+// Bind binds the response to the writer and request of the HTTP exchange before running scripts.
+// It enables streaming by write(), flush() and send_event() while scripts are running, and range requests for send_file().
+func (r *ServerResponse) Bind(w http.ResponseWriter, req *http.Request) {
+	r.writer = w
+	r.request = req
+}
+
+// Streamed reports whether the status code and headers are already sent by streaming, so the error of scripts can't be sent as the response.
+func (r *ServerResponse) Streamed() bool {
+	return r.streamed
 }
 
 // Struct returns a Starlark struct representation of the ServerResponse, which exposes the following methods to Starlark scripts:
@@ -203,6 +339,14 @@ type ServerResponse struct {
 //   - set_json(data): Sets the response data as JSON, marshaling the given Starlark value to JSON.
 //   - set_text(data): Sets the response data as plain text.
 //   - set_html(data): Sets the response data as HTML.
+//   - set_cookie(name, value, ...): Adds a cookie to set by the response.
+//   - redirect(url, code=302): Redirects to the URL with the status code.
+//   - send_file(path, content_type=""): Sends the file as the response body with the status code, and range requests supported if bound and the status code is 200.
+//   - write(data): Writes the data to the client immediately, the status code and headers are sent before the first write.
+//   - flush(): Flushes the data written to the client.
+//   - send_event(data, event="", id="", retry=0): Sends a server-sent event to the client immediately.
+//
+// The streaming methods write, flush and send_event require the response bound to the writer by Bind.
 func (r *ServerResponse) Struct() *starlarkstruct.Struct {
 	// prepare struct members
 	sd := starlark.StringDict{
@@ -214,6 +358,12 @@ func (r *ServerResponse) Struct() *starlarkstruct.Struct {
 		"set_json":         starlark.NewBuiltin("set_json", r.setJSONData),
 		"set_text":         starlark.NewBuiltin("set_text", r.setData(contentDataText)),
 		"set_html":         starlark.NewBuiltin("set_html", r.setData(contentDataHTML)),
+		"set_cookie":       starlark.NewBuiltin("set_cookie", r.setCookie),
+		"redirect":         starlark.NewBuiltin("redirect", r.redirect),
+		"send_file":        starlark.NewBuiltin("send_file", r.sendFile),
+		"write":            starlark.NewBuiltin("write", r.write),
+		"flush":            starlark.NewBuiltin("flush", r.flush),
+		"send_event":       starlark.NewBuiltin("send_event", r.sendEvent),
 	}
 	// create struct
 	return starlarkstruct.FromStringDict(structNameResponse, sd)
@@ -247,7 +397,17 @@ func (d *ExportedServerResponse) Write(w http.ResponseWriter) (err error) {
 }
 
 // Write writes the response to http.ResponseWriter.
+// For the streamed response, only the buffered data is flushed, as the status code and headers are already sent.
 func (r *ServerResponse) Write(w http.ResponseWriter) (err error) {
+	if r.streamed {
+		if f, ok := r.writer.(http.Flusher); ok {
+			f.Flush()
+		}
+		return nil
+	}
+	if r.file != nil {
+		return r.writeFile(w)
+	}
 	d := r.Export()
 	return d.Write(w)
 }
@@ -293,6 +453,11 @@ func (r *ServerResponse) Export() *ExportedServerResponse {
 	}
 	resp.Header.Set("Content-Type", contentType)
 
+	// cookies
+	for _, c := range r.cookies {
+		resp.Header.Add("Set-Cookie", c.String())
+	}
+
 	// for later use
 	return &resp
 }
@@ -302,6 +467,9 @@ func (r *ServerResponse) setStatus(thread *starlark.Thread, b *starlark.Builtin,
 	if err := starlark.UnpackPositionalArgs(b.Name(), args, nil, 1, &code); err != nil {
 		return nil, err
 	}
+	if err := r.checkNotStreamed(b); err != nil {
+		return nil, err
+	}
 	if code < 100 || code > 599 {
 		return nil, errors.New("invalid status code")
 	}
@@ -314,6 +482,9 @@ func (r *ServerResponse) addHeaderValue(thread *starlark.Thread, b *starlark.Bui
 	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key, "value", &value); err != nil {
 		return nil, err
 	}
+	if err := r.checkNotStreamed(b); err != nil {
+		return nil, err
+	}
 	k, v := key.GoString(), value.GoString()
 	if r.headers == nil {
 		r.headers = make(map[string][]string)
@@ -327,6 +498,9 @@ func (r *ServerResponse) setContentType(thread *starlark.Thread, b *starlark.Bui
 	if err := starlark.UnpackPositionalArgs(b.Name(), args, nil, 1, &ct); err != nil {
 		return nil, err
 	}
+	if err := r.checkNotStreamed(b); err != nil {
+		return nil, err
+	}
 	r.contentType = ct.GoString()
 	return starlark.None, nil
 }
@@ -338,6 +512,9 @@ func (r *ServerResponse) setData(dt contentDataType) func(thread *starlark.Threa
 		if err := starlark.UnpackPositionalArgs(b.Name(), args, nil, 1, &data); err != nil {
 			return nil, err
 		}
+		if err := r.checkNotStreamed(b); err != nil {
+			return nil, err
+		}
 		r.dataType = dt
 		r.data = data.GoBytes()
 		return starlark.None, nil
@@ -350,6 +527,9 @@ func (r *ServerResponse) setJSONData(thread *starlark.Thread, b *starlark.Builti
 	if err := starlark.UnpackPositionalArgs(b.Name(), args, nil, 1, &data); err != nil {
 		return nil, err
 	}
+	if err := r.checkNotStreamed(b); err != nil {
+		return nil, err
+	}
 	// convert to JSON
 	bs, err := dataconv.MarshalStarlarkJSON(data, 0)
 	if err != nil {
@@ -361,6 +541,273 @@ func (r *ServerResponse) setJSONData(thread *starlark.Thread, b *starlark.Builti
 	return starlark.None, nil
 }
 
+// checkNotStreamed returns an error for changing the response after it's streamed, as the status code and headers are already sent.
+func (r *ServerResponse) checkNotStreamed(b *starlark.Builtin) error {
+	if r.streamed {
+		return fmt.Errorf("%s: response is already streamed", b.Name())
+	}
+	return nil
+}
+
+// setCookie adds a cookie to set by the response.
+func (r *ServerResponse) setCookie(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name, value, domain, sameSite string
+		path                          = "/"
+		maxAge                        int
+		secure, httpOnly              bool
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name, "value", &value, "path?", &path, "domain?", &domain, "max_age?", &maxAge,
+		"secure?", &secure, "http_only?", &httpOnly, "same_site?", &sameSite); err != nil {
+		return nil, err
+	}
+	if err := r.checkNotStreamed(b); err != nil {
+		return nil, err
+	}
+	c := &http.Cookie{Name: name, Value: value, Path: path, Domain: domain, MaxAge: maxAge, Secure: secure, HttpOnly: httpOnly}
+	switch strings.ToLower(sameSite) {
+	case "":
+	case "lax":
+		c.SameSite = http.SameSiteLaxMode
+	case "strict":
+		c.SameSite = http.SameSiteStrictMode
+	case "none":
+		c.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("%s: invalid same_site: %q", b.Name(), sameSite)
+	}
+	if err := c.Valid(); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	r.cookies = append(r.cookies, c)
+	return starlark.None, nil
+}
+
+// redirect sets the status code and location for redirecting to the URL.
+func (r *ServerResponse) redirect(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		loc  string
+		code = http.StatusFound
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "url", &loc, "code?", &code); err != nil {
+		return nil, err
+	}
+	if err := r.checkNotStreamed(b); err != nil {
+		return nil, err
+	}
+	if code < 300 || code > 308 {
+		return nil, fmt.Errorf("%s: invalid redirect status code: %d", b.Name(), code)
+	}
+	r.statusCode = code
+	if r.headers == nil {
+		r.headers = make(map[string][]string)
+	}
+	r.headers["Location"] = []string{loc}
+	return starlark.None, nil
+}
+
+// sendFile sets the file in the file system of the thread to send as the response body, it's opened when the response is written.
+func (r *ServerResponse) sendFile(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name, ct string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "path", &name, "content_type?", &ct); err != nil {
+		return nil, err
+	}
+	if err := r.checkNotStreamed(b); err != nil {
+		return nil, err
+	}
+	sys := vfs.GetThreadFS(thread)
+	fi, err := sys.Stat(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%s: %s is a directory", b.Name(), name)
+	}
+	r.file = &responseFile{sys: sys, name: name}
+	if ct != "" {
+		r.contentType = ct
+	}
+	return starlark.None, nil
+}
+
+// writeFile writes the file as the response body by http.ServeContent, which detects the content type if not set, and handles range and conditional requests of the bound request.
+// If a status code other than 200 is set, e.g. by set_status(404) or redirect(), the whole file is written with the status code instead, without range and conditional requests.
+func (r *ServerResponse) writeFile(w http.ResponseWriter) error {
+	f, err := r.file.sys.Open(r.file.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		rs = bytes.NewReader(data)
+	}
+
+	// headers and cookies
+	h := w.Header()
+	copyHeader(h, r.headers)
+	for _, c := range r.cookies {
+		h.Add("Set-Cookie", c.String())
+	}
+	if r.contentType != "" {
+		h.Set("Content-Type", r.contentType)
+	}
+	req := r.request
+	if req == nil {
+		req = &http.Request{Method: http.MethodGet, Header: make(http.Header)}
+	}
+	if r.statusCode > 0 && r.statusCode != http.StatusOK {
+		return writeFileWithStatus(w, req, r.statusCode, fi, rs)
+	}
+	http.ServeContent(w, req, fi.Name(), fi.ModTime(), rs)
+	return nil
+}
+
+// writeFileWithStatus writes the whole file with the status code, and detects the content type if not set as http.ServeContent does.
+func writeFileWithStatus(w http.ResponseWriter, req *http.Request, code int, fi fs.FileInfo, rs io.ReadSeeker) error {
+	h := w.Header()
+	if h.Get("Content-Type") == "" {
+		ct := mime.TypeByExtension(filepath.Ext(fi.Name()))
+		if ct == "" {
+			buf := make([]byte, 512)
+			n, _ := io.ReadFull(rs, buf)
+			ct = http.DetectContentType(buf[:n])
+			if _, err := rs.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		h.Set("Content-Type", ct)
+	}
+	h.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	w.WriteHeader(code)
+	if req.Method == http.MethodHead {
+		return nil
+	}
+	_, err := io.Copy(w, rs)
+	return err
+}
+
+// commit sends the status code, headers and the data set before streaming, it does nothing if already sent.
+func (r *ServerResponse) commit(b *starlark.Builtin) error {
+	if r.writer == nil {
+		return fmt.Errorf("%s: streaming requires the response bound to the writer", b.Name())
+	}
+	if r.streamed {
+		return nil
+	}
+	d := r.Export()
+	copyHeader(r.writer.Header(), d.Header)
+	r.writer.WriteHeader(d.StatusCode)
+	r.streamed = true
+	if len(d.Data) > 0 {
+		if _, err := r.writer.Write(d.Data); err != nil {
+			return fmt.Errorf("%s: %w", b.Name(), err)
+		}
+	}
+	r.data = nil
+	return nil
+}
+
+// write writes the data to the client immediately.
+func (r *ServerResponse) write(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var data tps.StringOrBytes
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &data); err != nil {
+		return nil, err
+	}
+	if err := r.commit(b); err != nil {
+		return nil, err
+	}
+	if _, err := r.writer.Write(data.GoBytes()); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+// flush flushes the data written to the client.
+func (r *ServerResponse) flush(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	if err := r.commit(b); err != nil {
+		return nil, err
+	}
+	if f, ok := r.writer.(http.Flusher); ok {
+		f.Flush()
+	}
+	return starlark.None, nil
+}
+
+// sendEvent sends a server-sent event to the client immediately, the data is marshaled to JSON if it's not a string.
+// The content type of the response is text/event-stream if not set.
+func (r *ServerResponse) sendEvent(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		data      starlark.Value
+		event, id string
+		retry     int
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "data", &data, "event?", &event, "id?", &id, "retry?", &retry); err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(event+id, "\r\n") {
+		return nil, fmt.Errorf("%s: event and id must not contain newlines", b.Name())
+	}
+	text, ok := data.(starlark.String)
+	if !ok {
+		js, err := dataconv.MarshalStarlarkJSON(data, 0)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.Name(), err)
+		}
+		text = starlark.String(js)
+	}
+
+	// the headers for event streams
+	if !r.streamed {
+		if r.contentType == "" {
+			r.contentType = "text/event-stream"
+		}
+		if r.headers == nil {
+			r.headers = make(map[string][]string)
+		}
+		if _, ok := r.headers["Cache-Control"]; !ok {
+			r.headers["Cache-Control"] = []string{"no-cache"}
+		}
+	}
+	if err := r.commit(b); err != nil {
+		return nil, err
+	}
+
+	// the event in the text/event-stream format
+	var sb strings.Builder
+	if event != "" {
+		fmt.Fprintf(&sb, "event: %s\n", event)
+	}
+	if id != "" {
+		fmt.Fprintf(&sb, "id: %s\n", id)
+	}
+	if retry > 0 {
+		fmt.Fprintf(&sb, "retry: %d\n", retry)
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(text.GoString(), "\r\n", "\n"), "\n") {
+		fmt.Fprintf(&sb, "data: %s\n", line)
+	}
+	sb.WriteString("\n")
+	if _, err := io.WriteString(r.writer, sb.String()); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	if f, ok := r.writer.(http.Flusher); ok {
+		f.Flush()
+	}
+	return starlark.None, nil
+}
+
 type contentDataType uint
 
 const (
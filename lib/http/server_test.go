@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"errors"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -497,6 +499,251 @@ func TestServerResponse_Full(t *testing.T) {
 	}
 }
 
+func TestNewExportedServerRequest_Form(t *testing.T) {
+	// urlencoded form with cookies and path parameters
+	req := httptest.NewRequest("POST", "/users/42?q=1", strings.NewReader("name=John&tag=a&tag=b"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "sid", Value: "abc"})
+	req = lh.WithPathParams(req, map[string]string{"id": "42"})
+	sr, err := lh.NewExportedServerRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Form.Get("name") != "John" || len(sr.Form["tag"]) != 2 || sr.Params["id"] != "42" || len(sr.Cookies) != 1 {
+		t.Errorf("unexpected request: form=%v params=%v cookies=%v", sr.Form, sr.Params, sr.Cookies)
+	}
+
+	// multipart form with files
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	_ = mw.WriteField("kind", "report")
+	fw, _ := mw.CreateFormFile("doc", "a.txt")
+	_, _ = fw.Write([]byte("file content"))
+	_ = mw.Close()
+	req = httptest.NewRequest("POST", "/upload", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if sr, err = lh.NewExportedServerRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if sr.Form.Get("kind") != "report" || len(sr.Files["doc"]) != 1 || string(sr.Files["doc"][0].Data) != "file content" || sr.Files["doc"][0].Filename != "a.txt" {
+		t.Errorf("unexpected multipart request: form=%v files=%v", sr.Form, sr.Files)
+	}
+
+	// invalid multipart form is left empty
+	req = httptest.NewRequest("POST", "/upload", strings.NewReader("broken"))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=xyz")
+	if sr, err = lh.NewExportedServerRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if sr.Form != nil || sr.Files != nil || string(sr.Body) != "broken" {
+		t.Errorf("unexpected invalid request: form=%v files=%v", sr.Form, sr.Files)
+	}
+}
+
+func TestServerResponse_Modes(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "hello.txt")
+	if err := ioutil.WriteFile(file, []byte("hello world"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		script   string
+		request  func() *http.Request
+		wantCode int
+		wantBody string
+		wantHdr  map[string]string
+		wantErr  string
+	}{
+		{
+			name: "request fields",
+			script: itn.HereDoc(`
+				f = request.files["doc"][0]
+				response.set_text("%s|%s|%s|%s|%d|%s" % (request.params["id"], request.cookies["sid"], request.form["kind"][0], f.filename, f.size, f.content))
+			`),
+			request: func() *http.Request {
+				var buf bytes.Buffer
+				mw := multipart.NewWriter(&buf)
+				_ = mw.WriteField("kind", "report")
+				fw, _ := mw.CreateFormFile("doc", "a.txt")
+				_, _ = fw.Write([]byte("abc"))
+				_ = mw.Close()
+				req := httptest.NewRequest("POST", "/users/42", &buf)
+				req.Header.Set("Content-Type", mw.FormDataContentType())
+				req.AddCookie(&http.Cookie{Name: "sid", Value: "s1"})
+				return lh.WithPathParams(req, map[string]string{"id": "42"})
+			},
+			wantCode: http.StatusOK,
+			wantBody: `42|s1|report|a.txt|3|b"abc"`,
+		},
+		{
+			name: "cookies",
+			script: itn.HereDoc(`
+				response.set_cookie("sid", "abc", max_age=3600, http_only=True, same_site="lax")
+				response.set_cookie(name="old", value="", max_age=-1)
+				response.set_text("ok")
+			`),
+			wantCode: http.StatusOK,
+			wantBody: "ok",
+			wantHdr:  map[string]string{"Set-Cookie": "sid=abc; Path=/; Max-Age=3600; HttpOnly; SameSite=Lax"},
+		},
+		{
+			name:    "invalid cookie",
+			script:  `response.set_cookie("sid", "abc", same_site="loose")`,
+			wantErr: `set_cookie: invalid same_site: "loose"`,
+		},
+		{
+			name:     "redirect",
+			script:   `response.redirect("/login", code=303)`,
+			wantCode: http.StatusSeeOther,
+			wantHdr:  map[string]string{"Location": "/login"},
+		},
+		{
+			name:    "invalid redirect",
+			script:  `response.redirect("/login", code=200)`,
+			wantErr: `redirect: invalid redirect status code: 200`,
+		},
+		{
+			name:     "send file",
+			script:   `response.send_file(src_file)`,
+			wantCode: http.StatusOK,
+			wantBody: "hello world",
+			wantHdr:  map[string]string{"Content-Type": "text/plain; charset=utf-8", "Accept-Ranges": "bytes"},
+		},
+		{
+			name:   "send file with range",
+			script: `response.send_file(src_file, content_type="application/x-custom")`,
+			request: func() *http.Request {
+				req := httptest.NewRequest("GET", "/file", nil)
+				req.Header.Set("Range", "bytes=6-")
+				return req
+			},
+			wantCode: http.StatusPartialContent,
+			wantBody: "world",
+			wantHdr:  map[string]string{"Content-Type": "application/x-custom", "Content-Range": "bytes 6-10/11"},
+		},
+		{
+			name: "send file with status",
+			script: itn.HereDoc(`
+				response.set_status(404)
+				response.send_file(src_file)
+			`),
+			request: func() *http.Request {
+				req := httptest.NewRequest("GET", "/file", nil)
+				req.Header.Set("Range", "bytes=6-")
+				return req
+			},
+			wantCode: http.StatusNotFound,
+			wantBody: "hello world",
+			wantHdr:  map[string]string{"Content-Type": "text/plain; charset=utf-8", "Content-Length": "11", "Content-Range": ""},
+		},
+		{
+			name: "send file with redirect",
+			script: itn.HereDoc(`
+				response.redirect("/login")
+				response.send_file(src_file, content_type="text/html")
+			`),
+			wantCode: http.StatusFound,
+			wantBody: "hello world",
+			wantHdr:  map[string]string{"Location": "/login", "Content-Type": "text/html"},
+		},
+		{
+			name:    "send missing file",
+			script:  `response.send_file(src_file + ".missing")`,
+			wantErr: `send_file: stat`,
+		},
+		{
+			name: "stream",
+			script: itn.HereDoc(`
+				response.set_status(201)
+				response.set_content_type("text/plain")
+				response.write("hello ")
+				response.flush()
+				response.write(b"world")
+			`),
+			wantCode: http.StatusCreated,
+			wantBody: "hello world",
+			wantHdr:  map[string]string{"Content-Type": "text/plain"},
+		},
+		{
+			name: "change after streamed",
+			script: itn.HereDoc(`
+				response.write("hello")
+				response.add_header("X-Late", "1")
+			`),
+			wantErr: `add_header: response is already streamed`,
+		},
+		{
+			name: "server-sent events",
+			script: itn.HereDoc(`
+				response.send_event("hello")
+				response.send_event({"n": 1}, event="update", id="2", retry=1000)
+				response.send_event("a\nb")
+			`),
+			wantCode: http.StatusOK,
+			wantBody: "data: hello\n\nevent: update\nid: 2\nretry: 1000\ndata: {\"n\":1}\n\ndata: a\ndata: b\n\n",
+			wantHdr:  map[string]string{"Content-Type": "text/event-stream", "Cache-Control": "no-cache"},
+		},
+		{
+			name:    "invalid event",
+			script:  `response.send_event("hello", event="a\nb")`,
+			wantErr: `send_event: event and id must not contain newlines`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.request != nil {
+				req = tt.request()
+			}
+			rr := httptest.NewRecorder()
+			resp := lh.NewServerResponse()
+			resp.Bind(rr, req)
+			thread := &starlark.Thread{Name: "http"}
+			starlarktest.SetReporter(thread, nil)
+			pred := starlark.StringDict{
+				"request":  lh.ConvertServerRequest(req),
+				"response": resp.Struct(),
+				"src_file": starlark.String(file),
+			}
+			_, err := starlark.ExecFile(thread, "handler.star", tt.script, pred)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err = resp.Write(rr); err != nil {
+				t.Fatalf("unexpected write error: %v", err)
+			}
+			if rr.Code != tt.wantCode {
+				t.Errorf("unexpected status code: %d, want %d", rr.Code, tt.wantCode)
+			}
+			if body := rr.Body.String(); body != tt.wantBody {
+				t.Errorf("unexpected body: %q, want %q", body, tt.wantBody)
+			}
+			for k, v := range tt.wantHdr {
+				if got := rr.Header().Get(k); got != v {
+					t.Errorf("unexpected header %s: %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestServerResponse_StreamUnbound(t *testing.T) {
+	resp := lh.NewServerResponse()
+	thread := &starlark.Thread{Name: "http"}
+	_, err := starlark.ExecFile(thread, "handler.star", `response.write("hello")`, starlark.StringDict{"response": resp.Struct()})
+	if err == nil || !strings.Contains(err.Error(), "write: streaming requires the response bound to the writer") {
+		t.Errorf("expected unbound error, got %v", err)
+	}
+}
+
 func getMockRequest(s string) *http.Request {
 	jsonBody := []byte(s)
 	req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(jsonBody))
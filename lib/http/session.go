@@ -0,0 +1,305 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1set/starlet/dataconv"
+	"github.com/1set/starlet/dataconv/types"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+var (
+	// defaultRetryStatus is the default status codes of responses to retry for sessions.
+	defaultRetryStatus = []int{http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+)
+
+const (
+	// defaultBackoffSecond is the default delay in seconds before the first retry of sessions, it doubles for each following retry.
+	defaultBackoffSecond = 0.5
+	// drainLimit is the max size of the discarded body of responses to retry, so the connections can be reused.
+	drainLimit = 64 << 10
+)
+
+// session keeps the cookies, base URL, default headers and retry settings across the requests made by it.
+// The requests are sent by the module with its settings, so the guard, policy and recorder are also in effect.
+// A nil session makes one-shot requests as the module does.
+type session struct {
+	mod      *Module
+	baseURL  *url.URL
+	headers  http.Header
+	retries  int
+	backoff  float64
+	retryOn  map[int]bool
+	jar      http.CookieJar
+	once     sync.Once
+	insecure *http.Transport
+}
+
+// newSession creates a session object with methods mirroring the module's for making requests.
+func (m *Module) newSession(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		baseURL string
+		headers = types.NewNullableDict(starlark.NewDict(0))
+		retries = 0
+		backoff = types.FloatOrInt(defaultBackoffSecond)
+		retryOn starlark.Iterable
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "base_url?", &baseURL, "headers?", headers, "retries?", &retries, "backoff?", &backoff, "retry_on?", &retryOn); err != nil {
+		return nil, err
+	}
+	if retries < 0 {
+		return nil, fmt.Errorf("%s: retries must be non-negative", b.Name())
+	}
+	if backoff < 0 {
+		return nil, fmt.Errorf("%s: backoff must be non-negative", b.Name())
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		mod:     m,
+		headers: make(http.Header),
+		retries: retries,
+		backoff: float64(backoff),
+		retryOn: make(map[int]bool),
+		jar:     jar,
+	}
+
+	// the base URL ends with a slash, so the relative URLs are resolved under its path
+	if baseURL != "" {
+		u, err := url.Parse(baseURL)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.Name(), err)
+		}
+		if !u.IsAbs() || u.Host == "" {
+			return nil, fmt.Errorf("%s: base_url must be an absolute URL. got: %q", b.Name(), baseURL)
+		}
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		s.baseURL = u
+	}
+
+	// the default headers
+	for _, item := range headers.Value().Items() {
+		k, ok := item[0].(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected key of headers to be a string. got: %q", b.Name(), item[0].Type())
+		}
+		v, ok := item[1].(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected param value for key %s in headers to be a string. got: %q", b.Name(), k, item[1].Type())
+		}
+		s.headers.Add(k.GoString(), v.GoString())
+	}
+
+	// the status codes to retry
+	if retryOn == nil {
+		for _, code := range defaultRetryStatus {
+			s.retryOn[code] = true
+		}
+	} else {
+		iter := retryOn.Iterate()
+		defer iter.Done()
+		var v starlark.Value
+		for iter.Next(&v) {
+			code, err := starlark.AsInt32(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: for retry_on: %w", b.Name(), err)
+			}
+			s.retryOn[code] = true
+		}
+	}
+	return s.Struct(), nil
+}
+
+// Struct returns the session's methods as a starlark Struct.
+func (s *session) Struct() *starlarkstruct.Struct {
+	sd := make(starlark.StringDict, len(supportedMethods)+3)
+	for _, name := range supportedMethods {
+		sd[name] = starlark.NewBuiltin("session."+name, s.reqMethod(name))
+	}
+	sd["call"] = starlark.NewBuiltin("session.call", s.callMethod)
+	sd["cookies"] = starlark.NewBuiltin("session.cookies", s.cookies)
+	base := ""
+	if s.baseURL != nil {
+		base = s.baseURL.String()
+	}
+	sd["base_url"] = starlark.String(base)
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, sd)
+}
+
+// reqMethod generates the starlark builtin function for the http request method of the session.
+func (s *session) reqMethod(method string) builtinFunc {
+	return func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return s.mod.doRequest(thread, b, method, args, kwargs, s)
+	}
+}
+
+// callMethod makes the http request of the session with the method name and arguments.
+func (s *session) callMethod(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return callByName(thread, b, args, kwargs, s.reqMethod)
+}
+
+// cookies returns the cookies of the session to send for the URL as a dict of names to values, the URL is the base URL if not given.
+func (s *session) cookies(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var rawURL string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "url?", &rawURL); err != nil {
+		return nil, err
+	}
+	if rawURL == "" && s.baseURL == nil {
+		return nil, fmt.Errorf("%s: url is required for the session without base_url", b.Name())
+	}
+	rawURL, err := s.resolveURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	cookies := s.jar.Cookies(u)
+	d := starlark.NewDict(len(cookies))
+	for _, c := range cookies {
+		if err := d.SetKey(starlark.String(c.Name), starlark.String(c.Value)); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// resolveURL resolves the URL against the base URL of the session, the URL is returned as it is without the base URL.
+func (s *session) resolveURL(rawURL string) (string, error) {
+	if s == nil || s.baseURL == nil {
+		return rawURL, nil
+	}
+	u, err := s.baseURL.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// setHeaders sets the headers of the request, and the default headers of the session for the keys not given.
+func (s *session) setHeaders(req *http.Request, headers *starlark.Dict, userAgent string) error {
+	if s == nil {
+		return setHeaders(req, headers, userAgent)
+	}
+	if err := setHeaders(req, headers, ""); err != nil {
+		return err
+	}
+	for k, vs := range s.headers {
+		if _, ok := req.Header[k]; !ok {
+			req.Header[k] = append([]string(nil), vs...)
+		}
+	}
+	if userAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	return nil
+}
+
+// client returns the http client of the request with the cookie jar of the session.
+// The transports are shared by the requests of the session, so the connections are reused.
+func (s *session) client(cli *http.Client, timeoutSec float64, allowRedirect, verifySSL bool) *http.Client {
+	if s == nil {
+		return getHTTPClient(cli, timeoutSec, allowRedirect, verifySSL)
+	}
+	c := *getHTTPClient(cli, timeoutSec, allowRedirect, true)
+	if cli == nil && !verifySSL {
+		s.once.Do(func() {
+			s.insecure = http.DefaultTransport.(*http.Transport).Clone()
+			s.insecure.TLSClientConfig.InsecureSkipVerify = true
+		})
+		c.Transport = s.insecure
+	}
+	c.Jar = s.jar
+	return &c
+}
+
+// do sends the request by the client, and retries it for the status codes to retry with exponential backoff.
+// Requests with streaming bodies like file uploads are not retried, as the bodies can't be sent again.
+func (s *session) do(thread *starlark.Thread, cli *http.Client, req *http.Request) (*http.Response, error) {
+	if s == nil || s.retries == 0 {
+		return cli.Do(req)
+	}
+	if err := bufferBody(req); err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		res, err := cli.Do(req)
+		if err != nil || attempt >= s.retries || !s.retryOn[res.StatusCode] || (req.Body != nil && req.GetBody == nil) {
+			return res, err
+		}
+
+		// discard the response to retry, and wait before the next attempt
+		delay := s.retryDelay(attempt, res)
+		_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, drainLimit))
+		_ = res.Body.Close()
+		if err = sleep(thread, delay); err != nil {
+			return nil, err
+		}
+
+		// a new request with a fresh body for the next attempt
+		next := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if next.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		req = next
+	}
+}
+
+// retryDelay returns the delay before the next attempt, it's the seconds of the Retry-After header if given, otherwise the backoff doubled for each attempt.
+func (s *session) retryDelay(attempt int, res *http.Response) time.Duration {
+	if sec, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second
+	}
+	return time.Duration(s.backoff * math.Pow(2, float64(attempt)) * float64(time.Second))
+}
+
+// bufferBody reads the body of the request into memory, so it can be sent again by GetBody. Streaming bodies of unknown length are left as they are.
+func bufferBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil || req.ContentLength < 0 {
+		return nil
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return nil
+}
+
+// sleep waits for the duration, and stops at the cancellation of the context of the thread.
+func sleep(thread *starlark.Thread, d time.Duration) error {
+	ctx := dataconv.GetThreadContext(thread)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,148 @@
+package http_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	itn "github.com/1set/starlet/internal"
+	lh "github.com/1set/starlet/lib/http"
+	"go.starlark.net/starlark"
+)
+
+func TestSession(t *testing.T) {
+	var flaky int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/login":
+			http.SetCookie(w, &http.Cookie{Name: "token", Value: "abc", Path: "/"})
+			fmt.Fprint(w, "ok")
+		case "/api/me":
+			c, err := r.Cookie("token")
+			if err != nil {
+				http.Error(w, "no token", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, "%s|%s|%s|%s", c.Value, r.Header.Get("X-Tenant"), r.Header.Get("Accept"), r.UserAgent())
+		case "/api/flaky":
+			b, _ := ioutil.ReadAll(r.Body)
+			if n := atomic.AddInt32(&flaky, 1); n%3 != 0 {
+				w.Header().Set("Retry-After", "0")
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintf(w, "%s %s", r.Method, b)
+		case "/api/teapot":
+			w.WriteHeader(http.StatusTeapot)
+		default:
+			fmt.Fprintf(w, "%s %s", r.Method, r.URL.RequestURI())
+		}
+	}))
+	defer ts.Close()
+	predecl := starlark.StringDict{"test_server_url": starlark.String(ts.URL)}
+
+	tests := []struct {
+		name    string
+		script  string
+		wantErr string
+	}{
+		{
+			name: `base url`,
+			script: itn.HereDoc(`
+				load('http', 'session')
+				s = session(base_url=test_server_url + "/api")
+				assert.eq(s.base_url, test_server_url + "/api/")
+				assert.eq(s.get("users", params={"a": "1"}).body(), "GET /api/users?a=1")
+				assert.eq(s.delete("/root").body(), "DELETE /root")
+				assert.eq(s.call("PUT", "users/1").body(), "PUT /api/users/1")
+				assert.eq(s.get(test_server_url + "/other").body(), "GET /other")
+			`),
+		},
+		{
+			name: `cookies and headers`,
+			script: itn.HereDoc(`
+				load('http', 'session', 'get')
+				s = session(base_url=test_server_url + "/api", headers={"X-Tenant": "t1", "Accept": "text/plain"})
+				assert.eq(s.get("me").status_code, 401)
+				assert.eq(s.post("login").body(), "ok")
+				assert.eq(s.cookies(), {"token": "abc"})
+				assert.eq(s.get("me", headers={"Accept": "*/*"}).body(), "abc|t1|*/*|Starlet-http-client/test")
+				assert.eq(s.get("me", headers={"User-Agent": "custom"}).body(), "abc|t1|text/plain|custom")
+				assert.eq(get(test_server_url + "/api/me").status_code, 401)
+				assert.eq(session(headers={"User-Agent": "ua"}).get(test_server_url + "/api/me").status_code, 401)
+			`),
+		},
+		{
+			name: `retries`,
+			script: itn.HereDoc(`
+				load('http', 'session')
+				s = session(base_url=test_server_url, retries=2, backoff=0)
+				assert.eq(s.post("/api/flaky", json_body={"n": 1}).body(), 'POST {"n":1}')
+				assert.eq(session(retries=1, backoff=0).post(test_server_url + "/api/flaky", form_body={"n": "2"}).status_code, 503)
+				assert.eq(session(retries=1, backoff=0, retry_on=[418]).get(test_server_url + "/api/teapot").status_code, 418)
+			`),
+		},
+		{
+			name: `no retries`,
+			script: itn.HereDoc(`
+				load('http', 'session')
+				s = session(base_url=test_server_url)
+				assert.eq(s.get("/api/flaky").status_code, 503)
+				assert.eq(s.get("/api/flaky").status_code, 503)
+				assert.eq(s.get("/api/flaky").status_code, 200)
+			`),
+		},
+		{
+			name: `cookies without url`,
+			script: itn.HereDoc(`
+				load('http', 'session')
+				session().cookies()
+			`),
+			wantErr: `session.cookies: url is required for the session without base_url`,
+		},
+		{
+			name: `relative base url`,
+			script: itn.HereDoc(`
+				load('http', 'session')
+				session(base_url="/api")
+			`),
+			wantErr: `http.session: base_url must be an absolute URL. got: "/api"`,
+		},
+		{
+			name: `negative retries`,
+			script: itn.HereDoc(`
+				load('http', 'session')
+				session(retries=-1)
+			`),
+			wantErr: `http.session: retries must be non-negative`,
+		},
+		{
+			name: `invalid header`,
+			script: itn.HereDoc(`
+				load('http', 'session')
+				session(headers={"X-Num": 1})
+			`),
+			wantErr: `http.session: expected param value for key "X-Num" in headers to be a string. got: "int"`,
+		},
+		{
+			name: `invalid retry status`,
+			script: itn.HereDoc(`
+				load('http', 'session')
+				session(retry_on=["500"])
+			`),
+			wantErr: `http.session: for retry_on: got string, want int`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&flaky, 0)
+			md := lh.NewModule(lh.WithUserAgent("Starlet-http-client/test"))
+			if _, err := itn.ExecModuleWithErrorTest(t, lh.ModuleName, md.LoadModule, tt.script, tt.wantErr, predecl); (err != nil) != (tt.wantErr != "") {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/1set/starlet/dataconv"
+	"github.com/1set/starlet/vfs"
+	"go.starlark.net/starlark"
+)
+
+// ErrBodyTooLarge is returned for reading the response body into memory exceeding the max body size,
+// and for the request body exceeding the max request body size of Handler.
+var ErrBodyTooLarge = errors.New("body too large")
+
+// defaultChunkSize is the default size of chunks for iterating the response body.
+const defaultChunkSize = 8192
+
+// readBody reads the whole body into memory, and fails if it exceeds the max body size.
+// The body is kept for later reads, so it can be read multiple times.
+func (r *Response) readBody() ([]byte, error) {
+	if err := r.streamErr; err != nil {
+		return nil, err
+	}
+	limit := r.maxBodySize
+	if limit > 0 && r.ContentLength > limit {
+		_ = r.Body.Close()
+		return nil, fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrBodyTooLarge, r.ContentLength, limit)
+	}
+	rd := io.Reader(r.Body)
+	if limit > 0 {
+		rd = io.LimitReader(r.Body, limit+1)
+	}
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		_ = r.Body.Close()
+		return nil, fmt.Errorf("%w: exceeds the limit of %d bytes", ErrBodyTooLarge, limit)
+	}
+
+	// reset reader to allow multiple calls
+	_ = r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+// iterContent returns an iterable of the response body in chunks of bytes, the body is consumed by the iteration without the max body size.
+// As errors cannot be raised by iterations, an error ends the iteration, and it's raised by the following read() or close().
+func (r *Response) iterContent(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	size := defaultChunkSize
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "chunk_size?", &size); err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("%s: chunk_size must be positive", b.Name())
+	}
+	return &bodyChunks{resp: r, size: size}, nil
+}
+
+// read reads up to the given size of bytes from the response body, and returns empty bytes at the end.
+func (r *Response) read(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	size := defaultChunkSize
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "size?", &size); err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("%s: size must be positive", b.Name())
+	}
+	chunk, err := r.readChunk(make([]byte, size))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return starlark.Bytes(chunk), nil
+}
+
+// readChunk fills the buffer from the body as much as possible, and returns io.EOF with no data at the end.
+func (r *Response) readChunk(buf []byte) ([]byte, error) {
+	if err := r.streamErr; err != nil {
+		return nil, err
+	}
+	if r.drained {
+		return nil, io.EOF
+	}
+	n, err := io.ReadFull(r.Body, buf)
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		err = nil
+	case err == io.EOF:
+		r.drained = true
+		_ = r.Body.Close()
+	case err != nil:
+		r.streamErr = err
+	}
+	return buf[:n], err
+}
+
+// save streams the response body to the file of the path in the file system of the thread without the max body size, and returns the number of bytes written.
+func (r *Response) save(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "path", &name); err != nil {
+		return nil, err
+	}
+	if err := r.streamErr; err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	f, err := vfs.GetThreadFS(thread).OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	n, err := io.Copy(f, withContext(thread, r.Body))
+	_ = r.Body.Close()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return starlark.MakeInt64(n), nil
+}
+
+// close closes the response body, and raises the error of the previous iteration if any.
+func (r *Response) close(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	_ = r.Body.Close()
+	if err := r.streamErr; err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+// withContext returns the reader stopping at the cancellation of the context of the thread.
+func withContext(thread *starlark.Thread, rd io.Reader) io.Reader {
+	return &ctxReader{thread: thread, rd: rd}
+}
+
+type ctxReader struct {
+	thread *starlark.Thread
+	rd     io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := dataconv.GetThreadContext(c.thread).Err(); err != nil {
+		return 0, err
+	}
+	return c.rd.Read(p)
+}
+
+// bodyChunks is the iterable of the response body in chunks, the body is consumed by the iteration.
+type bodyChunks struct {
+	resp *Response
+	size int
+}
+
+var _ starlark.Iterable = (*bodyChunks)(nil)
+
+func (c *bodyChunks) String() string        { return "<body_chunks>" }
+func (c *bodyChunks) Type() string          { return "body_chunks" }
+func (c *bodyChunks) Freeze()               {}
+func (c *bodyChunks) Truth() starlark.Bool  { return starlark.True }
+func (c *bodyChunks) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %s", c.Type()) }
+
+func (c *bodyChunks) Iterate() starlark.Iterator {
+	return &bodyChunkIterator{resp: c.resp, buf: make([]byte, c.size)}
+}
+
+type bodyChunkIterator struct {
+	resp *Response
+	buf  []byte
+}
+
+func (it *bodyChunkIterator) Next(p *starlark.Value) bool {
+	chunk, err := it.resp.readChunk(it.buf)
+	if len(chunk) == 0 || (err != nil && err != io.EOF) {
+		return false
+	}
+	// copy the chunk as the buffer is reused
+	*p = starlark.Bytes(chunk)
+	return true
+}
+
+func (it *bodyChunkIterator) Done() {}
+
+// setFileBody sets the multipart body of the request streaming the files from the file system, along with the string fields of the form data.
+// The files are opened before sending, so the errors of missing files are returned here.
+func setFileBody(req *http.Request, sys vfs.System, formData *starlark.Dict, files *starlark.Dict) error {
+	type upload struct {
+		field string
+		name  string
+		file  fs.File
+	}
+	var (
+		fields  [][2]string
+		uploads []upload
+	)
+	closeAll := func() {
+		for _, u := range uploads {
+			_ = u.file.Close()
+		}
+	}
+
+	if formData != nil {
+		for _, item := range formData.Items() {
+			v, ok := item[1].(starlark.String)
+			if !ok {
+				return fmt.Errorf("expected param value for key %s in form_body to be a string with files. got: %q", item[0], item[1].Type())
+			}
+			fields = append(fields, [2]string{dataconv.StarString(item[0]), v.GoString()})
+		}
+	}
+	for _, item := range files.Items() {
+		p, ok := item[1].(starlark.String)
+		if !ok {
+			closeAll()
+			return fmt.Errorf("expected path for key %s in files to be a string. got: %q", item[0], item[1].Type())
+		}
+		f, err := sys.Open(p.GoString())
+		if err != nil {
+			closeAll()
+			return err
+		}
+		uploads = append(uploads, upload{field: dataconv.StarString(item[0]), name: filepath.Base(p.GoString()), file: f})
+	}
+
+	// stream the parts through a pipe, the writer stops when the transport closes the body
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		defer closeAll()
+		err := func() error {
+			for _, kv := range fields {
+				if err := mw.WriteField(kv[0], kv[1]); err != nil {
+					return err
+				}
+			}
+			for _, u := range uploads {
+				w, err := mw.CreateFormFile(u.field, u.name)
+				if err != nil {
+					return err
+				}
+				if _, err = io.Copy(w, u.file); err != nil {
+					return err
+				}
+			}
+			return mw.Close()
+		}()
+		_ = pw.CloseWithError(err)
+	}()
+
+	req.Body = pr
+	req.ContentLength = -1
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package http_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	itn "github.com/1set/starlet/internal"
+	lh "github.com/1set/starlet/lib/http"
+	"go.starlark.net/starlark"
+)
+
+func TestResponse_Stream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			// no content length for the streaming
+			w.(http.Flusher).Flush()
+			fmt.Fprint(w, strings.Repeat("0123456789", 2000))
+		case "/upload":
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			f, fh, err := r.FormFile("doc")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer f.Close()
+			b, _ := ioutil.ReadAll(f)
+			fmt.Fprintf(w, "%s|%s|%s|%t", r.FormValue("kind"), fh.Filename, b, r.ContentLength == -1)
+		default:
+			fmt.Fprint(w, "hello world")
+		}
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "report.txt")
+	if err := ioutil.WriteFile(src, []byte("file content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	predecl := starlark.StringDict{
+		"test_server_url": starlark.String(ts.URL),
+		"temp_dir":        starlark.String(dir),
+		"src_file":        starlark.String(src),
+	}
+
+	tests := []struct {
+		name    string
+		maxSize int64
+		script  string
+		wantErr string
+	}{
+		{
+			name: `iter_content`,
+			script: itn.HereDoc(`
+				load('http', 'get')
+				res = get(test_server_url + "/large")
+				sizes = [len(c) for c in res.iter_content(chunk_size=6000)]
+				assert.eq(sizes, [6000, 6000, 6000, 2000])
+				assert.eq([c for c in res.iter_content()], [])
+				res.close()
+			`),
+		},
+		{
+			name: `iter_content invalid size`,
+			script: itn.HereDoc(`
+				load('http', 'get')
+				get(test_server_url).iter_content(0)
+			`),
+			wantErr: `iter_content: chunk_size must be positive`,
+		},
+		{
+			name: `read`,
+			script: itn.HereDoc(`
+				load('http', 'get')
+				res = get(test_server_url)
+				assert.eq(res.read(5), b"hello")
+				assert.eq(res.read(100), b" world")
+				assert.eq(res.read(), b"")
+			`),
+		},
+		{
+			name: `save`,
+			script: itn.HereDoc(`
+				load('http', 'get')
+				res = get(test_server_url + "/large")
+				assert.eq(res.save(temp_dir + "/large.txt"), 20000)
+			`),
+		},
+		{
+			name:    `max body size`,
+			maxSize: 100,
+			script: itn.HereDoc(`
+				load('http', 'get')
+				get(test_server_url + "/large").body()
+			`),
+			wantErr: `body too large: exceeds the limit of 100 bytes`,
+		},
+		{
+			name:    `max body size by content length`,
+			maxSize: 5,
+			script: itn.HereDoc(`
+				load('http', 'get')
+				get(test_server_url).json()
+			`),
+			wantErr: `body too large: 11 bytes exceeds the limit of 5 bytes`,
+		},
+		{
+			name:    `max body size with streaming`,
+			maxSize: 100,
+			script: itn.HereDoc(`
+				load('http', 'get')
+				res = get(test_server_url)
+				assert.eq(res.body(), "hello world")
+				def total(chunks):
+					n = 0
+					for c in chunks:
+						n += len(c)
+					return n
+				assert.eq(total(get(test_server_url + "/large").iter_content()), 20000)
+			`),
+		},
+		{
+			name: `upload files`,
+			script: itn.HereDoc(`
+				load('http', 'post')
+				res = post(test_server_url + "/upload", form_body={"kind": "report"}, files={"doc": src_file})
+				assert.eq(res.body(), "report|report.txt|file content|true")
+			`),
+		},
+		{
+			name: `upload missing file`,
+			script: itn.HereDoc(`
+				load('http', 'post')
+				post(test_server_url + "/upload", files={"doc": temp_dir + "/missing.txt"})
+			`),
+			wantErr: `missing.txt: no such file or directory`,
+		},
+		{
+			name: `upload invalid path`,
+			script: itn.HereDoc(`
+				load('http', 'post')
+				post(test_server_url + "/upload", files={"doc": 1})
+			`),
+			wantErr: `expected path for key "doc" in files to be a string. got: "int"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := lh.NewModule(lh.WithMaxBodySize(tt.maxSize))
+			if _, err := itn.ExecModuleWithErrorTest(t, lh.ModuleName, md.LoadModule, tt.script, tt.wantErr, predecl); (err != nil) != (tt.wantErr != "") {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "large.txt")); err != nil || len(b) != 20000 {
+		t.Errorf("unexpected saved file: %d, %v", len(b), err)
+	}
+}
@@ -40,6 +40,7 @@ func NewDefaultLogger() *zap.SugaredLogger {
 type Module struct {
 	once      sync.Once
 	logModule starlark.StringDict
+	mu        sync.RWMutex
 	logger    *zap.SugaredLogger
 }
 
@@ -55,9 +56,11 @@ func NewModule(lg *zap.SugaredLogger) *Module {
 func (m *Module) LoadModule() (starlark.StringDict, error) {
 	m.once.Do(func() {
 		// If logger is nil, create a new development logger.
+		m.mu.Lock()
 		if m.logger == nil {
 			m.logger = NewDefaultLogger()
 		}
+		m.mu.Unlock()
 
 		// Create the log module
 		m.logModule = starlark.StringDict{
@@ -77,7 +80,10 @@ func (m *Module) LoadModule() (starlark.StringDict, error) {
 }
 
 // SetLog sets the logger of the log module from outside the package. If l is nil, a noop logger is used, which does nothing.
+// It's safe to call while scripts are logging with the module.
 func (m *Module) SetLog(l *zap.SugaredLogger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if l == nil {
 		m.logger = zap.NewNop().Sugar()
 		return
@@ -102,17 +108,20 @@ func (m *Module) genLoggerBuiltin(name string, level zapcore.Level) starlark.Cal
 			logFn  func(msg string, keysAndValues ...interface{})
 			retErr bool
 		)
+		m.mu.RLock()
+		logger := m.logger
+		m.mu.RUnlock()
 		switch level {
 		case zap.DebugLevel:
-			logFn = m.logger.Debugw
+			logFn = logger.Debugw
 		case zap.InfoLevel:
-			logFn = m.logger.Infow
+			logFn = logger.Infow
 		case zap.WarnLevel:
-			logFn = m.logger.Warnw
+			logFn = logger.Warnw
 		case zap.ErrorLevel:
-			logFn = m.logger.Errorw
+			logFn = logger.Errorw
 		case zap.FatalLevel:
-			logFn = m.logger.Errorw
+			logFn = logger.Errorw
 			retErr = true
 		default:
 			return nil, fmt.Errorf("unsupported log level: %v", level)
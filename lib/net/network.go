@@ -11,6 +11,7 @@ import (
 
 	"github.com/1set/starlet/dataconv"
 	tps "github.com/1set/starlet/dataconv/types"
+	"github.com/1set/starlet/policy"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
 )
@@ -85,6 +86,17 @@ func starLookup(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tupl
 		timeout = 10
 	}
 
+	// check the permission
+	pol := policy.GetThreadPolicy(thread)
+	if err := pol.CheckNet(domain.GoString()); err != nil {
+		return none, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	if ds := dnsServer.GoString(); ds != "" {
+		if err := pol.CheckNet(ds); err != nil {
+			return none, fmt.Errorf("%s: %w", b.Name(), err)
+		}
+	}
+
 	// get the context
 	ctx := dataconv.GetThreadContext(thread)
 
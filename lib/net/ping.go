@@ -6,12 +6,14 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptrace"
+	"net/url"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/1set/starlet/dataconv"
 	tps "github.com/1set/starlet/dataconv/types"
+	"github.com/1set/starlet/policy"
 	"github.com/montanaflynn/stats"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
@@ -142,6 +144,11 @@ func starTCPPing(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tup
 		interval = 1
 	}
 
+	// check the permission
+	if err := policy.GetThreadPolicy(thread).CheckNet(net.JoinHostPort(hostname.GoString(), strconv.Itoa(port))); err != nil {
+		return none, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+
 	// get the context for the DNS lookup and TCP ping
 	ctx := dataconv.GetThreadContext(thread)
 
@@ -182,8 +189,13 @@ func starHTTPing(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tup
 		interval = 1
 	}
 
-	// perform the HTTP ping, and get the statistics
+	// check the permission
 	address := url.GoString()
+	if err := checkURL(policy.GetThreadPolicy(thread), address); err != nil {
+		return none, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+
+	// perform the HTTP ping, and get the statistics
 	ctx := dataconv.GetThreadContext(thread)
 	rtts, err := goPingWrap(ctx, address, count, time.Duration(timeout)*time.Second, time.Duration(interval)*time.Second, httpPingFunc)
 	if err != nil {
@@ -191,3 +203,15 @@ func starHTTPing(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tup
 	}
 	return createPingStats(address, count, rtts), nil
 }
+
+// checkURL checks the network access to the host of the URL by the policy.
+func checkURL(p *policy.Policy, rawURL string) error {
+	if p == nil {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	return p.CheckNet(u.Host)
+}
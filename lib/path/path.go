@@ -8,6 +8,7 @@ import (
 	"sync"
 
 	tps "github.com/1set/starlet/dataconv/types"
+	"github.com/1set/starlet/vfs"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
 )
@@ -51,7 +52,7 @@ func absPath(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple,
 		return nil, err
 	}
 	// get absolute path
-	abs, err := filepath.Abs(path)
+	abs, err := vfs.GetThreadFS(thread).Abs(path)
 	if err != nil {
 		return nil, err
 	}
@@ -79,37 +80,37 @@ func joinPaths(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple
 }
 
 // wrapExistPath wraps the existPath function to be used in Starlark with a given function to check if the path exists.
-func wrapExistPath(funcName string, workLoad func(path string) bool) starlark.Callable {
+func wrapExistPath(funcName string, workLoad func(sys vfs.System, path string) bool) starlark.Callable {
 	return starlark.NewBuiltin(ModuleName+"."+funcName, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 		var path string
 		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "path", &path); err != nil {
 			return starlark.None, err
 		}
-		return starlark.Bool(workLoad(path)), nil
+		return starlark.Bool(workLoad(vfs.GetThreadFS(thread), path)), nil
 	})
 }
 
 // checkExistPath returns true if the path exists, if it's a symbolic link, the symbolic link is followed.
-func checkExistPath(path string) bool {
-	_, err := os.Stat(path)
+func checkExistPath(sys vfs.System, path string) bool {
+	_, err := sys.Stat(path)
 	return err == nil
 }
 
 // checkFileExist returns true if the file exists, if it's a symbolic link, the symbolic link is followed.
-func checkFileExist(path string) bool {
-	info, err := os.Stat(path)
+func checkFileExist(sys vfs.System, path string) bool {
+	info, err := sys.Stat(path)
 	return err == nil && info != nil && info.Mode().IsRegular()
 }
 
 // checkDirExist returns true if the directory exists, if it's a symbolic link, the symbolic link is followed.
-func checkDirExist(path string) bool {
-	info, err := os.Stat(path)
+func checkDirExist(sys vfs.System, path string) bool {
+	info, err := sys.Stat(path)
 	return err == nil && info != nil && info.IsDir()
 }
 
 // checkSymlinkExist returns true if the symbolic link exists.
-func checkSymlinkExist(path string) bool {
-	info, err := os.Lstat(path)
+func checkSymlinkExist(sys vfs.System, path string) bool {
+	info, err := sys.Lstat(path)
 	return err == nil && info != nil && info.Mode()&os.ModeSymlink == os.ModeSymlink
 }
 
@@ -130,7 +131,8 @@ func listDirContents(thread *starlark.Thread, b *starlark.Builtin, args starlark
 	}
 
 	// check root stat
-	rootInfo, err := os.Lstat(path)
+	sys := vfs.GetThreadFS(thread)
+	rootInfo, err := sys.Lstat(path)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", b.Name(), err)
 	}
@@ -142,12 +144,12 @@ func listDirContents(thread *starlark.Thread, b *starlark.Builtin, args starlark
 	}
 
 	// scan directory contents
-	if err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+	if err := sys.Walk(path, func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		// skip same path to avoid infinite loop in case of symbolic links
-		if os.SameFile(rootInfo, info) {
+		if sys.SameFile(rootInfo, info) {
 			return nil
 		}
 		// filter path
@@ -185,7 +187,7 @@ func getCWD(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, k
 		return nil, err
 	}
 	// get current working directory
-	cwd, err := os.Getwd()
+	cwd, err := vfs.GetThreadFS(thread).Getwd()
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", b.Name(), err)
 	}
@@ -199,7 +201,7 @@ func changeCWD(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple
 		return nil, err
 	}
 	// change working directory
-	if err := os.Chdir(path); err != nil {
+	if err := vfs.GetThreadFS(thread).Chdir(path); err != nil {
 		return nil, fmt.Errorf("%s: %w", b.Name(), err)
 	}
 	return starlark.None, nil
@@ -216,5 +218,5 @@ func makeDir(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple,
 	}
 	// do the work
 	mode := os.FileMode(modeVal)
-	return starlark.None, os.MkdirAll(pathVal.GoString(), mode)
+	return starlark.None, vfs.GetThreadFS(thread).MkdirAll(pathVal.GoString(), mode)
 }
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/1set/starlet/dataconv"
+	"github.com/1set/starlet/policy"
 	stdtime "go.starlark.net/lib/time"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
@@ -31,9 +32,8 @@ func LoadModule() (md starlark.StringDict, err error) {
 		if pwd, err = os.Getwd(); err != nil {
 			return
 		}
-		if hd, err = os.UserHomeDir(); err != nil {
-			return
-		}
+		// the home directory is left empty if it's unknown, e.g. for CGI scripts spawned by web servers without $HOME
+		hd, _ = os.UserHomeDir()
 		moduleData = starlark.StringDict{
 			ModuleName: &starlarkstruct.Module{
 				Name: ModuleName,
@@ -82,6 +82,9 @@ func getenv(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, k
 	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key, "default?", &defVal); err != nil {
 		return nil, err
 	}
+	if err := policy.GetThreadPolicy(thread).CheckEnv(key); err != nil {
+		return nil, err
+	}
 	// get the value
 	if val, ok := os.LookupEnv(key); ok {
 		return starlark.String(val), nil
@@ -99,6 +102,9 @@ func putenv(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, k
 	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key, "value", &val); err != nil {
 		return nil, err
 	}
+	if err := policy.GetThreadPolicy(thread).CheckEnv(key); err != nil {
+		return nil, err
+	}
 	// set the value
 	err := os.Setenv(key, dataconv.StarString(val))
 	return starlark.None, err
@@ -110,6 +116,9 @@ func unsetenv(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple,
 	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key); err != nil {
 		return nil, err
 	}
+	if err := policy.GetThreadPolicy(thread).CheckEnv(key); err != nil {
+		return nil, err
+	}
 	// unset the value
 	err := os.Unsetenv(key)
 	return starlark.None, err
@@ -0,0 +1,168 @@
+package starlet
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	itn "github.com/1set/starlet/internal"
+)
+
+// LRUCache is a bounded in-memory ByteCache, which evicts the least recently used values once the number of entries or the total size exceeds the limits.
+// Values can also expire after a given time to live since they are set.
+type LRUCache struct {
+	_          itn.DoNotCompare
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	ttl        time.Duration
+	lru        *list.List
+	items      map[string]*list.Element
+	stats      CacheStats
+}
+
+// lruCacheItem is an item of the LRU list in LRUCache.
+type lruCacheItem struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// CacheStats contains the metrics of a cache.
+type CacheStats struct {
+	// Hits is the number of lookups that found the value.
+	Hits uint64
+	// Misses is the number of lookups that didn't find the value, including the expired ones.
+	Misses uint64
+	// Evictions is the number of values removed for exceeding the limits.
+	Evictions uint64
+	// Expirations is the number of values removed for exceeding the time to live.
+	Expirations uint64
+	// Entries is the current number of values in the cache.
+	Entries int
+	// Bytes is the current total size of values in the cache.
+	Bytes int64
+}
+
+// NewLRUCache creates a LRUCache with the given limits of entries, total size in bytes, and time to live for each value.
+// Zero or negative value of any limit means no limit.
+func NewLRUCache(maxEntries int, maxBytes int64, ttl time.Duration) *LRUCache {
+	return &LRUCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ttl:        ttl,
+		lru:        list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value for the given key, and whether the key exists and is not expired.
+func (c *LRUCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	it := el.Value.(*lruCacheItem)
+	if c.isExpired(it) {
+		c.remove(el)
+		c.stats.Expirations++
+		c.stats.Misses++
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.stats.Hits++
+	return it.value, true
+}
+
+// Set sets the value for the given key, removes the expired values from the least recently used end, and evicts the least recently used values if the limits are exceeded.
+func (c *LRUCache) Set(key string, value []byte) error {
+	if c.maxBytes > 0 && int64(len(value)) > c.maxBytes {
+		return fmt.Errorf("value size %d exceeds cache limit %d", len(value), c.maxBytes)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+
+	// remove the expired ones, so the cache with only time to live doesn't grow without bound
+	for el := c.lru.Back(); el != nil && c.isExpired(el.Value.(*lruCacheItem)); el = c.lru.Back() {
+		c.remove(el)
+		c.stats.Expirations++
+	}
+
+	it := &lruCacheItem{key: key, value: value}
+	if c.ttl > 0 {
+		it.expires = time.Now().Add(c.ttl)
+	}
+	c.items[key] = c.lru.PushFront(it)
+	c.stats.Entries++
+	c.stats.Bytes += int64(len(value))
+
+	// evict the least recently used ones
+	for (c.maxEntries > 0 && c.stats.Entries > c.maxEntries) || (c.maxBytes > 0 && c.stats.Bytes > c.maxBytes) {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+	return nil
+}
+
+// Delete removes the value for the given key, and returns whether the key exists.
+func (c *LRUCache) Delete(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if ok {
+		c.remove(el)
+	}
+	return ok
+}
+
+// Purge removes all the values in the cache, the counters of hits, misses, evictions and expirations are kept.
+func (c *LRUCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.stats.Entries = 0
+	c.stats.Bytes = 0
+}
+
+// Len returns the number of values in the cache, including the expired ones not removed yet.
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats.Entries
+}
+
+// Stats returns the current metrics of the cache.
+func (c *LRUCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+// isExpired returns true if the item is expired.
+func (c *LRUCache) isExpired(it *lruCacheItem) bool {
+	return !it.expires.IsZero() && !time.Now().Before(it.expires)
+}
+
+// remove removes the element from the cache.
+func (c *LRUCache) remove(el *list.Element) {
+	it := el.Value.(*lruCacheItem)
+	c.lru.Remove(el)
+	delete(c.items, it.key)
+	c.stats.Entries--
+	c.stats.Bytes -= int64(len(it.value))
+}
@@ -0,0 +1,187 @@
+package starlet_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1set/starlet"
+)
+
+func TestLRUCache_GetSet(t *testing.T) {
+	c := starlet.NewLRUCache(0, 0, 0)
+	if _, ok := c.Get("none"); ok {
+		t.Errorf("expected miss for non-existing key")
+	}
+	if err := c.Set("key1", []byte("value1")); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if v, ok := c.Get("key1"); !ok || string(v) != "value1" {
+		t.Errorf("expected value1, got %q %v", v, ok)
+	}
+	if err := c.Set("key1", []byte("value11")); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if v, ok := c.Get("key1"); !ok || string(v) != "value11" {
+		t.Errorf("expected value11, got %q %v", v, ok)
+	}
+	if err := c.Set("key2", []byte("value2")); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if n := c.Len(); n != 2 {
+		t.Errorf("expected 2 entries, got %d", n)
+	}
+
+	// delete and purge
+	if !c.Delete("key1") {
+		t.Errorf("expected key1 deleted")
+	}
+	if c.Delete("key1") {
+		t.Errorf("expected key1 not found")
+	}
+	if _, ok := c.Get("key1"); ok {
+		t.Errorf("expected miss for deleted key")
+	}
+	c.Purge()
+	if _, ok := c.Get("key2"); ok {
+		t.Errorf("expected miss for purged key")
+	}
+
+	exp := starlet.CacheStats{Hits: 2, Misses: 3}
+	if s := c.Stats(); s != exp {
+		t.Errorf("expected stats %+v, got %+v", exp, s)
+	}
+}
+
+func TestLRUCache_Evict(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		maxBytes   int64
+		wantKeys   []string
+		wantEvict  uint64
+	}{
+		{
+			name:      "no limit",
+			wantKeys:  []string{"k0", "k1", "k2", "k3", "k4"},
+			wantEvict: 0,
+		},
+		{
+			name:       "max entries",
+			maxEntries: 3,
+			wantKeys:   []string{"k0", "k3", "k4"},
+			wantEvict:  2,
+		},
+		{
+			name:      "max bytes",
+			maxBytes:  25,
+			wantKeys:  []string{"k0", "k4"},
+			wantEvict: 3,
+		},
+		{
+			name:       "both limits",
+			maxEntries: 4,
+			maxBytes:   35,
+			wantKeys:   []string{"k0", "k3", "k4"},
+			wantEvict:  2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := starlet.NewLRUCache(tt.maxEntries, tt.maxBytes, 0)
+			for i := 0; i < 5; i++ {
+				if err := c.Set(fmt.Sprintf("k%d", i), []byte("0123456789")); err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				// keep the first one as recently used
+				c.Get("k0")
+			}
+			s := c.Stats()
+			if s.Evictions != tt.wantEvict {
+				t.Errorf("expected %d evictions, got %d", tt.wantEvict, s.Evictions)
+			}
+			if s.Entries != len(tt.wantKeys) || s.Bytes != int64(10*len(tt.wantKeys)) {
+				t.Errorf("unexpected stats: %+v", s)
+			}
+			for _, k := range tt.wantKeys {
+				if _, ok := c.Get(k); !ok {
+					t.Errorf("expected hit for %s", k)
+				}
+			}
+		})
+	}
+
+	// too large value
+	c := starlet.NewLRUCache(0, 5, 0)
+	if err := c.Set("large", []byte("0123456789")); err == nil {
+		t.Errorf("expected error for too large value, got nil")
+	}
+}
+
+func TestLRUCache_TTL(t *testing.T) {
+	c := starlet.NewLRUCache(0, 0, 50*time.Millisecond)
+	if err := c.Set("key", []byte("value")); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if _, ok := c.Get("key"); !ok {
+		t.Errorf("expected hit before expiration")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := c.Get("key"); ok {
+		t.Errorf("expected miss after expiration")
+	}
+	exp := starlet.CacheStats{Hits: 1, Misses: 1, Expirations: 1}
+	if s := c.Stats(); s != exp {
+		t.Errorf("expected stats %+v, got %+v", exp, s)
+	}
+}
+
+func TestLRUCache_TTLGrowth(t *testing.T) {
+	c := starlet.NewLRUCache(0, 0, 50*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		if err := c.Set(fmt.Sprintf("old%d", i), []byte("value")); err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	}
+	if _, ok := c.Get("old99"); !ok {
+		t.Errorf("expected hit before expiration")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the expired ones are removed by the following sets without being looked up
+	for i := 0; i < 10; i++ {
+		if err := c.Set(fmt.Sprintf("new%d", i), []byte("value")); err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	}
+	exp := starlet.CacheStats{Hits: 1, Expirations: 100, Entries: 10, Bytes: 50}
+	if s := c.Stats(); s != exp {
+		t.Errorf("expected stats %+v, got %+v", exp, s)
+	}
+}
+
+func TestLRUCache_Machine(t *testing.T) {
+	c := starlet.NewLRUCache(2, 0, 0)
+	m := starlet.NewDefault()
+	m.SetScriptCache(c)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		m.SetScript(fmt.Sprintf("test%d.star", i), []byte(fmt.Sprintf("x = %d", i)), nil)
+		if _, err := m.Run(); err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Get("none")
+		}()
+	}
+	wg.Wait()
+
+	s := c.Stats()
+	if s.Entries != 2 || s.Evictions != 2 || s.Misses != 8 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"sync"
 
 	itn "github.com/1set/starlet/internal"
+	"github.com/1set/starlet/policy"
+	"github.com/1set/starlet/vfs"
 	"go.starlark.net/starlark"
 )
 
@@ -44,6 +46,12 @@ type Machine struct {
 	enableInConv        bool
 	enableOutConv       bool
 	customTag           string
+	budget              ExecBudget
+	hooks               *Hooks
+	profiler            *Profiler
+	debugger            *Debugger
+	fileSys             fs.FS
+	policy              *policy.Policy
 	// source code
 	scriptName    string
 	scriptContent []byte
@@ -54,6 +62,9 @@ type Machine struct {
 	loadCache   *cache
 	thread      *starlark.Thread
 	predeclared starlark.StringDict
+	sandbox     *vfs.Sandbox
+	userNames   map[string]struct{}
+	funcSources map[string]funcSource
 }
 
 func (m *Machine) String() string {
@@ -294,6 +305,72 @@ func (m *Machine) SetCustomTag(tag string) {
 	m.customTag = tag
 }
 
+// SetExecBudget sets the resource limits for each run of the script, the zero value means no limit.
+// It takes effect from the next run, and the run is aborted with an error wrapping ErrExceedMaxSteps, ErrExceedMaxOutput or ErrExceedMaxOperatorResult once the limit is exceeded.
+func (m *Machine) SetExecBudget(b ExecBudget) {
+	m.mu.Lock() // Locking to avoid concurrent access
+	defer m.mu.Unlock()
+
+	m.budget = b
+}
+
+// GetExecBudget returns the resource limits for each run of the script.
+func (m *Machine) GetExecBudget() ExecBudget {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.budget
+}
+
+// SetHooks sets the callbacks for tracing the function calls, builtin calls, module loading and printing of each run, nil to disable tracing.
+// It takes effect from the next run, and the callbacks may be called concurrently if it's shared by multiple machines, e.g. in a MachinePool.
+func (m *Machine) SetHooks(h *Hooks) {
+	m.mu.Lock() // Locking to avoid concurrent access
+	defer m.mu.Unlock()
+
+	m.hooks = h
+}
+
+// SetProfiler sets the profiler to collect time and steps spent in each Starlark function of each run, nil to disable profiling.
+// It takes effect from the next run, and the profiler accumulates the results of all the runs until it's reset.
+func (m *Machine) SetProfiler(p *Profiler) {
+	m.mu.Lock() // Locking to avoid concurrent access
+	defer m.mu.Unlock()
+
+	m.profiler = p
+}
+
+// SetDebugger sets the debugger to stop the execution at breakpoints or steps of each run, nil to disable debugging.
+// It takes effect from the next run, and it's not copied to the machines of MachinePool.
+func (m *Machine) SetDebugger(d *Debugger) {
+	m.mu.Lock() // Locking to avoid concurrent access
+	defer m.mu.Unlock()
+
+	m.debugger = d
+}
+
+// SetFileSystem sets the file system for the file and path modules instead of the host one, nil to use the host file system.
+// The file system is an fs.FS for reads, and it's writable only if it implements vfs.WriteFS, e.g. vfs.Dir for a directory of the host, vfs.NewMemFS for an in-memory one, and vfs.ReadOnly to disable writes.
+// Paths in scripts are resolved with "/" as the root of the file system, and the working directory starts at "/" for each machine.
+// It takes effect from the next run, and it's shared by the machines of MachinePool with separate working directories.
+func (m *Machine) SetFileSystem(fsys fs.FS) {
+	m.mu.Lock() // Locking to avoid concurrent access
+	defer m.mu.Unlock()
+
+	m.fileSys = fsys
+	m.sandbox = nil
+}
+
+// SetPolicy sets the permission policy declaring the capabilities allowed for the builtin modules, nil to allow everything.
+// With a policy, the network, environment variables, file paths and exit not declared in it are denied with an error wrapping policy.ErrPermission, even for RunTrustedScript.
+// The policy is copied, and it takes effect from the next run. It's copied to the machines of MachinePool.
+func (m *Machine) SetPolicy(p *policy.Policy) {
+	m.mu.Lock() // Locking to avoid concurrent access
+	defer m.mu.Unlock()
+
+	m.policy = p.Clone()
+}
+
 // GetStarlarkPredeclared returns the Starlark predeclared names of the Starlark runtime environment.
 // It's for advanced usage only, don't use it unless you know what you are doing.
 func (m *Machine) GetStarlarkPredeclared() starlark.StringDict {
@@ -3,11 +3,16 @@ package starlet_test
 import (
 	"errors"
 	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
 
 	"github.com/1set/starlet"
+	"github.com/1set/starlet/policy"
+	"github.com/1set/starlet/vfs"
 	"go.starlark.net/starlark"
 )
 
@@ -662,6 +667,51 @@ func TestMachine_SetScriptCache(t *testing.T) {
 	}
 }
 
+func TestMachine_SetScriptCache_Key(t *testing.T) {
+	mc := starlet.NewMemoryCache()
+	scripts := MemFS{
+		"fact.star": "def fact(n):\n    return 1 if n <= 1 else n * fact(n - 1)",
+		"a.star":    "def boom():\n    return 1 // 0",
+		"b.star":    "def boom():\n    return 1 // 0",
+	}
+
+	// the same source compiled with different options
+	for _, tt := range []struct {
+		recursion bool
+		errMsg    string
+	}{
+		{true, ""},
+		{false, "called recursively"},
+		{true, ""},
+	} {
+		m := starlet.NewDefault()
+		m.SetScriptCache(mc)
+		if tt.recursion {
+			m.EnableRecursionSupport()
+		}
+		m.SetScript("main.star", []byte(`load("fact.star", "fact"); y = fact(5)`), scripts)
+		res, err := m.Run()
+		if tt.errMsg == "" {
+			if err != nil || res["y"] != int64(120) {
+				t.Errorf("recursion %v: expected 120, got %v, %v", tt.recursion, res["y"], err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+			t.Errorf("recursion %v: expected error %q, got %v", tt.recursion, tt.errMsg, err)
+		}
+	}
+
+	// the same source in different files
+	for _, name := range []string{"a.star", "b.star"} {
+		m := starlet.NewDefault()
+		m.SetScriptCache(mc)
+		m.SetScript("main.star", []byte(fmt.Sprintf(`load(%q, "boom"); boom()`, name)), scripts)
+		_, err := m.Run()
+		if exp := name + ":2:14: in boom"; err == nil || !strings.Contains(err.Error(), exp) {
+			t.Errorf("expected error at %s, got %v", exp, err)
+		}
+	}
+}
+
 func Test_SetPrintFunc(t *testing.T) {
 	m := starlet.NewDefault()
 	// set print function
@@ -792,3 +842,193 @@ func TestMachine_GetThreadLocal(t *testing.T) {
 		t.Errorf("expected 'Deeper', got %v", v)
 	}
 }
+
+func TestMachine_SetFileSystem(t *testing.T) {
+	mfs := vfs.NewMemFS()
+	if err := mfs.WriteFile("input.txt", []byte("line1\nline2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// read and write in the in-memory file system
+	m := starlet.NewWithNames(nil, []string{"file", "path"}, nil)
+	m.SetFileSystem(mfs)
+	res, err := m.RunScript([]byte(`
+lines = file.read_lines("/input.txt")
+path.mkdir("out/logs")
+path.chdir("out")
+file.write_string("logs/result.txt", "done")
+cwd = path.getcwd()
+found = path.listdir("/out", recursive=True)
+exists = path.exists("/input.txt") and not path.exists("/etc/passwd")
+abs = path.abs("logs")
+copied = file.copyfile("logs/result.txt", "/copied.txt")
+st = file.stat("/copied.txt")
+info = (st.name, st.size, st.get_md5())
+`), nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if fmt.Sprint(res["lines"]) != "[line1 line2]" {
+		t.Errorf("unexpected lines: %v", res["lines"])
+	}
+	if res["cwd"] != "/out" || res["abs"] != "/out/logs" || res["copied"] != "/copied.txt" || res["exists"] != true {
+		t.Errorf("unexpected result: %v", res)
+	}
+	if fmt.Sprint(res["found"]) != "[/out/logs /out/logs/result.txt]" {
+		t.Errorf("unexpected listdir: %v", res["found"])
+	}
+	if fmt.Sprint(res["info"]) != "[copied.txt 4 6b2ded51d81a4403d8a4bd25fa1e57ee]" {
+		t.Errorf("unexpected stat: %v", res["info"])
+	}
+	if b, err := fs.ReadFile(mfs, "out/logs/result.txt"); err != nil || string(b) != "done" {
+		t.Errorf("expected file written, got %q, %v", b, err)
+	}
+
+	// host file system is untouched
+	if _, err := os.Stat("out"); !os.IsNotExist(err) {
+		t.Errorf("expected no host file, got %v", err)
+	}
+
+	// read-only file system
+	m = starlet.NewWithNames(nil, []string{"file"}, nil)
+	m.SetFileSystem(vfs.ReadOnly(mfs))
+	_, err = m.RunScript([]byte(`print(file.read_string("input.txt")); file.write_string("input.txt", "x")`), nil)
+	if err == nil || !strings.Contains(err.Error(), "open input.txt: read-only file system") {
+		t.Errorf("expected read-only error, got %v", err)
+	}
+
+	// back to the host file system
+	m.SetFileSystem(nil)
+	_, err = m.RunScript([]byte(`file.read_string("/input.txt")`), nil)
+	if err == nil || !strings.Contains(err.Error(), "open /input.txt") {
+		t.Errorf("expected host error, got %v", err)
+	}
+}
+
+func TestMachine_SetPolicy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://localhost/", http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+	mfs := vfs.NewMemFS()
+	_ = mfs.MkdirAll("data", 0755)
+	_ = mfs.MkdirAll("out", 0755)
+	_ = mfs.WriteFile("data/a.txt", []byte("abc"), 0644)
+	_ = mfs.WriteFile("secret.txt", []byte("secret"), 0644)
+	os.Setenv("STARLET_POLICY_TEST", "yes")
+	defer os.Unsetenv("STARLET_POLICY_TEST")
+
+	m := starlet.NewWithNames(starlet.StringAnyMap{"url": ts.URL}, []string{"file", "path", "runtime", "http", "go_idiomatic"}, nil)
+	m.SetFileSystem(mfs)
+	p := &policy.Policy{
+		NetHosts:   []string{strings.TrimPrefix(ts.URL, "http://")},
+		ReadPaths:  []string{"/data"},
+		WritePaths: []string{"/out"},
+		EnvVars:    []string{"STARLET_POLICY_*"},
+	}
+	m.SetPolicy(p)
+	p.Exit = true // changes after setting take no effect
+
+	// allowed capabilities
+	res, err := m.RunScript([]byte(`
+text = file.read_string("/data/a.txt")
+file.write_string("/out/b.txt", text)
+env = runtime.getenv("STARLET_POLICY_TEST")
+body = http.get(url).body()
+`), nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if res["text"] != "abc" || res["env"] != "yes" || res["body"] != "ok" {
+		t.Errorf("unexpected result: %v", res)
+	}
+
+	// denied capabilities
+	tests := []struct {
+		name   string
+		code   string
+		errMsg string
+	}{
+		{"read", `file.read_string("/secret.txt")`, `open /secret.txt: permission denied by policy`},
+		{"read dir", `path.listdir("/")`, `permission denied by policy`},
+		{"write", `file.write_string("/data/b.txt", "x")`, `open /data/b.txt: permission denied by policy`},
+		{"mkdir", `path.mkdir("/data/x")`, `mkdir /data/x: permission denied by policy`},
+		{"escape", `file.read_string("/data/../secret.txt")`, `open /data/../secret.txt: permission denied by policy`},
+		{"env", `runtime.getenv("HOME")`, `env "HOME": permission denied by policy`},
+		{"setenv", `runtime.setenv("PATH", "")`, `env "PATH": permission denied by policy`},
+		{"net", `http.get("http://example.com")`, `net "example.com": permission denied by policy`},
+		{"redirect", `http.get(url + "/redirect")`, `net "localhost": permission denied by policy`},
+		{"exit", `exit(1)`, `exit: permission denied by policy`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.RunScript([]byte(tt.code), nil)
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("expected error %q, got %v", tt.errMsg, err)
+			}
+			if !errors.Is(err, starlet.ErrorKindPermission) || !errors.Is(err, fs.ErrPermission) {
+				t.Errorf("expected permission error, got %v", err)
+			}
+		})
+	}
+
+	// no policy allows everything
+	m.SetPolicy(nil)
+	if _, err := m.RunScript([]byte(`file.read_string("/secret.txt"); runtime.getenv("HOME")`), nil); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestMachine_SetPolicy_LoadedModule(t *testing.T) {
+	mfs := vfs.NewMemFS()
+	_ = mfs.WriteFile("secret.txt", []byte("secret"), 0644)
+	scripts := MemFS{
+		"read.star":  `text = file.read_string("/secret.txt")`,
+		"write.star": `file.write_string("/out.txt", "x")`,
+		"net.star":   `body = http.get("http://example.com").body()`,
+		"env.star":   `env = runtime.getenv("HOME")`,
+		"fs.star":    `exists = path.exists("/secret.txt")`,
+	}
+
+	tests := []struct {
+		name   string
+		module string
+		errMsg string
+	}{
+		{"read", "read.star", `open /secret.txt: permission denied by policy`},
+		{"write", "write.star", `open /out.txt: permission denied by policy`},
+		{"net", "net.star", `net "example.com": permission denied by policy`},
+		{"env", "env.star", `env "HOME": permission denied by policy`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := starlet.NewWithNames(nil, []string{"file", "path", "runtime", "http"}, nil)
+			m.SetFileSystem(mfs)
+			m.SetPolicy(&policy.Policy{})
+			m.SetScript("main.star", []byte(fmt.Sprintf(`load(%q, "*")`, tt.module)), scripts)
+			_, err := m.Run()
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("expected error %q, got %v", tt.errMsg, err)
+			}
+			if !errors.Is(err, fs.ErrPermission) {
+				t.Errorf("expected permission error, got %v", err)
+			}
+		})
+	}
+
+	// loaded modules use the file system of the machine
+	m := starlet.NewWithNames(nil, []string{"path"}, nil)
+	m.SetFileSystem(mfs)
+	m.SetScript("main.star", []byte("load(\"fs.star\", \"exists\")\nfound = exists"), scripts)
+	res, err := m.Run()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if res["found"] != true {
+		t.Errorf("expected file exists in the machine file system, got %v", res["found"])
+	}
+}
@@ -31,15 +31,15 @@ func (l ModuleLoaderList) Clone() []ModuleLoader {
 // It returns an error as second return value if any module fails to load.
 func (l ModuleLoaderList) LoadAll(d starlark.StringDict) error {
 	if d == nil {
-		return errorStarletErrorf(`load`, "cannot load modules into nil dict")
+		return errorStarletLoad(errors.New("cannot load modules into nil dict"))
 	}
 	for _, ld := range l {
 		if ld == nil {
-			return errorStarletErrorf(`load`, "nil module loader")
+			return errorStarletLoad(errors.New("nil module loader"))
 		}
 		m, err := ld()
 		if err != nil {
-			return errorStarletError(`load`, err)
+			return errorStarletLoad(err)
 		}
 		if m != nil {
 			for k, v := range m {
@@ -1,18 +1,25 @@
 package starlet_test
 
 import (
+	"fmt"
 	"io"
 	"io/fs"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/1set/starlet"
 	"github.com/1set/starlet/dataconv"
 	itn "github.com/1set/starlet/internal"
+	libhttp "github.com/1set/starlet/lib/http"
+	liblog "github.com/1set/starlet/lib/log"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
+	"go.uber.org/zap"
 )
 
 var (
@@ -1284,3 +1291,52 @@ func TestWrapStructData_Edit(t *testing.T) {
 		}
 	}
 }
+
+func TestMachine_ModulePerMachine(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.UserAgent())
+	}))
+	defer ts.Close()
+
+	// two tenants with their own http modules and loggers
+	newMachine := func(ua string) *starlet.Machine {
+		m := starlet.NewWithNames(starlet.StringAnyMap{"url": ts.URL}, nil, []string{"http"})
+		m.AddLazyloadModules(starlet.ModuleLoaderMap{
+			libhttp.ModuleName: libhttp.NewModule(libhttp.WithUserAgent(ua), libhttp.WithTimeout(5)).LoadModule,
+			liblog.ModuleName:  liblog.NewModule(zap.NewNop().Sugar()).LoadModule,
+		})
+		return m
+	}
+	code := []byte(`
+load("http", "get", "get_timeout", "set_timeout")
+load("log", "info")
+before = get_timeout()
+set_timeout(1)
+info("requesting", ua=before)
+ua = get(url).body()
+`)
+	var wg sync.WaitGroup
+	for _, ua := range []string{"tenant-a", "tenant-b"} {
+		ua := ua
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := newMachine(ua).RunScript(code, nil)
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+					return
+				}
+				if res["ua"] != ua || res["before"] != 5.0 {
+					t.Errorf("unexpected result for %s: %v", ua, res)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	// the package-level default is untouched by set_timeout
+	if libhttp.TimeoutSecond != 30 {
+		t.Errorf("expected default timeout unchanged, got %v", libhttp.TimeoutSecond)
+	}
+}
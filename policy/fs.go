@@ -0,0 +1,119 @@
+package policy
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/1set/starlet/vfs"
+)
+
+// GuardFS returns the System checking the paths against the read and write paths of the policy before the operations, or the System itself for a nil policy.
+// The paths are made absolute by the System, so the paths of a vfs.Sandbox are in its virtual namespace.
+// The paths are checked as they are, use vfs.Dir to confine scripts with symbolic links to a directory.
+func GuardFS(s vfs.System, p *Policy) vfs.System {
+	if p == nil {
+		return s
+	}
+	return &guardFS{sys: s, p: p}
+}
+
+// guardFS is the System checked by the policy.
+type guardFS struct {
+	sys vfs.System
+	p   *Policy
+}
+
+// check checks the named path for writing or reading.
+func (g *guardFS) check(op, name string, write bool) error {
+	abs, err := g.sys.Abs(name)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if write {
+		err = g.p.CheckWrite(abs)
+	} else {
+		err = g.p.CheckRead(abs)
+	}
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: ErrPermission}
+	}
+	return nil
+}
+
+func (g *guardFS) Open(name string) (fs.File, error) {
+	if err := g.check("open", name, false); err != nil {
+		return nil, err
+	}
+	return g.sys.Open(name)
+}
+
+func (g *guardFS) OpenFile(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	if err := g.check("open", name, write); err != nil {
+		return nil, err
+	}
+	return g.sys.OpenFile(name, flag, perm)
+}
+
+func (g *guardFS) Stat(name string) (fs.FileInfo, error) {
+	if err := g.check("stat", name, false); err != nil {
+		return nil, err
+	}
+	return g.sys.Stat(name)
+}
+
+func (g *guardFS) Lstat(name string) (fs.FileInfo, error) {
+	if err := g.check("lstat", name, false); err != nil {
+		return nil, err
+	}
+	return g.sys.Lstat(name)
+}
+
+func (g *guardFS) MkdirAll(name string, perm fs.FileMode) error {
+	if err := g.check("mkdir", name, true); err != nil {
+		return err
+	}
+	return g.sys.MkdirAll(name, perm)
+}
+
+func (g *guardFS) Chmod(name string, mode fs.FileMode) error {
+	if err := g.check("chmod", name, true); err != nil {
+		return err
+	}
+	return g.sys.Chmod(name, mode)
+}
+
+func (g *guardFS) Chtimes(name string, atime, mtime time.Time) error {
+	if err := g.check("chtimes", name, true); err != nil {
+		return err
+	}
+	return g.sys.Chtimes(name, atime, mtime)
+}
+
+func (g *guardFS) Walk(root string, fn filepath.WalkFunc) error {
+	if err := g.check("lstat", root, false); err != nil {
+		return fn(root, nil, err)
+	}
+	return g.sys.Walk(root, fn)
+}
+
+func (g *guardFS) Abs(name string) (string, error) {
+	return g.sys.Abs(name)
+}
+
+func (g *guardFS) Getwd() (string, error) {
+	return g.sys.Getwd()
+}
+
+func (g *guardFS) Chdir(name string) error {
+	if err := g.check("chdir", name, false); err != nil {
+		return err
+	}
+	return g.sys.Chdir(name)
+}
+
+func (g *guardFS) SameFile(fi1, fi2 fs.FileInfo) bool {
+	return g.sys.SameFile(fi1, fi2)
+}
@@ -0,0 +1,185 @@
+// Package policy provides the capability-based permission policy for the builtin modules, so a script can only touch the network, the environment and the disk as declared.
+//
+// A nil Policy allows everything, which is the behavior without a policy. A non-nil Policy denies all capabilities not declared in it,
+// and the modules fail with an error wrapping ErrPermission for the denied ones.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// threadLocalKey is the key of the policy in the thread local.
+const threadLocalKey = "policy"
+
+// Any is the pattern matching any host or environment variable name.
+const Any = "*"
+
+// ErrPermission is wrapped by the errors for the capabilities denied by the policy, it matches fs.ErrPermission by errors.Is.
+var ErrPermission error = permissionError{}
+
+type permissionError struct{}
+
+func (permissionError) Error() string {
+	return "permission denied by policy"
+}
+
+func (permissionError) Is(target error) bool {
+	return target == fs.ErrPermission
+}
+
+// Policy declares the capabilities allowed for scripts.
+type Policy struct {
+	// NetHosts is the hosts allowed for network access by http and net modules, e.g. "example.com", "*.example.com" or "localhost:8080".
+	// The patterns are matched by path.Match, the port is checked only if given in the pattern, and Any allows all hosts.
+	NetHosts []string
+	// ReadPaths is the files and directories allowed for reading by file and path modules, a directory allows all the files under it.
+	ReadPaths []string
+	// WritePaths is the files and directories allowed for writing by file and path modules, a directory allows all the files under it.
+	WritePaths []string
+	// EnvVars is the names of environment variables allowed for getting and setting by runtime module, e.g. "HOME" or "APP_*".
+	// The patterns are matched by path.Match, and Any allows all variables.
+	EnvVars []string
+	// Exit allows scripts to exit by exit() or quit().
+	Exit bool
+}
+
+// AllowAll returns a new policy allowing all capabilities, it's a start to be narrowed down.
+func AllowAll() *Policy {
+	return &Policy{
+		NetHosts:   []string{Any},
+		ReadPaths:  []string{string(filepath.Separator)},
+		WritePaths: []string{string(filepath.Separator)},
+		EnvVars:    []string{Any},
+		Exit:       true,
+	}
+}
+
+// Clone returns a deep copy of the policy.
+func (p *Policy) Clone() *Policy {
+	if p == nil {
+		return nil
+	}
+	return &Policy{
+		NetHosts:   append([]string(nil), p.NetHosts...),
+		ReadPaths:  append([]string(nil), p.ReadPaths...),
+		WritePaths: append([]string(nil), p.WritePaths...),
+		EnvVars:    append([]string(nil), p.EnvVars...),
+		Exit:       p.Exit,
+	}
+}
+
+// GetThreadPolicy returns the policy of the given thread, or nil if not found.
+func GetThreadPolicy(thread *starlark.Thread) *Policy {
+	if thread != nil {
+		if p, ok := thread.Local(threadLocalKey).(*Policy); ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// SetThreadPolicy sets the policy for the given thread, nil for allowing everything.
+func SetThreadPolicy(thread *starlark.Thread, p *Policy) {
+	if thread != nil {
+		thread.SetLocal(threadLocalKey, p)
+	}
+}
+
+// CheckNet checks the network access to the host, which may have a port, e.g. "example.com:443".
+func (p *Policy) CheckNet(host string) error {
+	if p == nil {
+		return nil
+	}
+	name, port := splitHostPort(host)
+	for _, pat := range p.NetHosts {
+		if pat == Any {
+			return nil
+		}
+		pn, pp := splitHostPort(pat)
+		if pp != "" && pp != port {
+			continue
+		}
+		if ok, _ := path.Match(strings.ToLower(pn), strings.ToLower(name)); ok {
+			return nil
+		}
+	}
+	return denied("net", host)
+}
+
+// CheckRead checks the reading of the absolute path.
+func (p *Policy) CheckRead(name string) error {
+	if p == nil || underAny(name, p.ReadPaths) {
+		return nil
+	}
+	return denied("read", name)
+}
+
+// CheckWrite checks the writing of the absolute path.
+func (p *Policy) CheckWrite(name string) error {
+	if p == nil || underAny(name, p.WritePaths) {
+		return nil
+	}
+	return denied("write", name)
+}
+
+// CheckEnv checks the access to the environment variable.
+func (p *Policy) CheckEnv(name string) error {
+	if p == nil {
+		return nil
+	}
+	for _, pat := range p.EnvVars {
+		if ok, _ := path.Match(pat, name); ok || pat == Any {
+			return nil
+		}
+	}
+	return denied("env", name)
+}
+
+// CheckExit checks the exit of scripts.
+func (p *Policy) CheckExit() error {
+	if p == nil || p.Exit {
+		return nil
+	}
+	return fmt.Errorf("exit: %w", ErrPermission)
+}
+
+// IsPermissionError returns true if the error is caused by the policy.
+func IsPermissionError(err error) bool {
+	return errors.Is(err, ErrPermission)
+}
+
+// denied returns the error for the denied capability on the target.
+func denied(capability, target string) error {
+	return fmt.Errorf("%s %q: %w", capability, target, ErrPermission)
+}
+
+// splitHostPort splits the host and the optional port, and strips the brackets of IPv6 addresses.
+func splitHostPort(s string) (host, port string) {
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		return h, p
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"), ""
+}
+
+// underAny reports whether the path is one of the roots or under them.
+func underAny(name string, roots []string) bool {
+	name = filepath.Clean(name)
+	for _, root := range roots {
+		if root == "" {
+			continue
+		}
+		rel, err := filepath.Rel(filepath.Clean(root), name)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel) {
+			return true
+		}
+	}
+	return false
+}
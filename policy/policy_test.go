@@ -0,0 +1,169 @@
+package policy_test
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/1set/starlet/policy"
+	"github.com/1set/starlet/vfs"
+	"go.starlark.net/starlark"
+)
+
+func TestPolicy_Nil(t *testing.T) {
+	var p *policy.Policy
+	for _, err := range []error{p.CheckNet("example.com"), p.CheckRead("/etc"), p.CheckWrite("/etc"), p.CheckEnv("HOME"), p.CheckExit()} {
+		if err != nil {
+			t.Errorf("expected nil policy to allow all, got %v", err)
+		}
+	}
+	if p.Clone() != nil {
+		t.Errorf("expected nil clone")
+	}
+}
+
+func TestPolicy_CheckNet(t *testing.T) {
+	p := &policy.Policy{NetHosts: []string{"example.com", "*.example.org", "localhost:8080", "[::1]"}}
+	tests := []struct {
+		host string
+		ok   bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.com:443", true},
+		{"www.example.com", false},
+		{"api.example.org", true},
+		{"example.org", false},
+		{"localhost:8080", true},
+		{"localhost:8081", false},
+		{"localhost", false},
+		{"[::1]:80", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		err := p.CheckNet(tt.host)
+		if tt.ok && err != nil {
+			t.Errorf("expected %q allowed, got %v", tt.host, err)
+		} else if !tt.ok && !errors.Is(err, policy.ErrPermission) {
+			t.Errorf("expected %q denied, got %v", tt.host, err)
+		}
+	}
+	if err := policy.AllowAll().CheckNet("anything:1"); err != nil {
+		t.Errorf("expected allowed, got %v", err)
+	}
+}
+
+func TestPolicy_CheckPaths(t *testing.T) {
+	root := filepath.FromSlash("/srv/data")
+	p := &policy.Policy{ReadPaths: []string{root}, WritePaths: []string{filepath.Join(root, "out")}}
+	tests := []struct {
+		path        string
+		read, write bool
+	}{
+		{"/srv/data", true, false},
+		{"/srv/data/a.txt", true, false},
+		{"/srv/data/out/b.txt", true, true},
+		{"/srv/data/../secret", false, false},
+		{"/srv/database", false, false},
+		{"/srv", false, false},
+	}
+	for _, tt := range tests {
+		name := filepath.FromSlash(tt.path)
+		if err := p.CheckRead(name); (err == nil) != tt.read {
+			t.Errorf("unexpected read check for %q: %v", tt.path, err)
+		}
+		if err := p.CheckWrite(name); (err == nil) != tt.write {
+			t.Errorf("unexpected write check for %q: %v", tt.path, err)
+		}
+	}
+}
+
+func TestPolicy_CheckEnvAndExit(t *testing.T) {
+	p := &policy.Policy{EnvVars: []string{"HOME", "APP_*"}}
+	if err := p.CheckEnv("HOME"); err != nil {
+		t.Errorf("expected allowed, got %v", err)
+	}
+	if err := p.CheckEnv("APP_NAME"); err != nil {
+		t.Errorf("expected allowed, got %v", err)
+	}
+	if err := p.CheckEnv("PATH"); err == nil || err.Error() != `env "PATH": permission denied by policy` {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := p.CheckExit(); !errors.Is(err, fs.ErrPermission) || !policy.IsPermissionError(err) {
+		t.Errorf("expected exit denied, got %v", err)
+	}
+
+	// clone is independent
+	c := p.Clone()
+	c.EnvVars[0] = "PATH"
+	if err := p.CheckEnv("HOME"); err != nil {
+		t.Errorf("expected original unchanged, got %v", err)
+	}
+}
+
+func TestThreadPolicy(t *testing.T) {
+	thread := &starlark.Thread{}
+	if p := policy.GetThreadPolicy(thread); p != nil {
+		t.Errorf("expected nil policy, got %v", p)
+	}
+	p := policy.AllowAll()
+	policy.SetThreadPolicy(thread, p)
+	if got := policy.GetThreadPolicy(thread); got != p {
+		t.Errorf("expected policy set, got %v", got)
+	}
+	if policy.GetThreadPolicy(nil) != nil {
+		t.Errorf("expected nil policy for nil thread")
+	}
+}
+
+func TestGuardFS(t *testing.T) {
+	if policy.GuardFS(vfs.Host, nil) != vfs.Host {
+		t.Errorf("expected the same system for nil policy")
+	}
+
+	m := vfs.NewMemFS()
+	_ = m.MkdirAll("pub/out", 0755)
+	_ = m.WriteFile("pub/a.txt", []byte("a"), 0644)
+	_ = m.WriteFile("private.txt", []byte("p"), 0644)
+	root := string(filepath.Separator)
+	s := policy.GuardFS(vfs.NewSandbox(m), &policy.Policy{
+		ReadPaths:  []string{filepath.Join(root, "pub")},
+		WritePaths: []string{filepath.Join(root, "pub", "out")},
+	})
+
+	// relative paths are resolved by the system
+	if err := s.Chdir("/pub"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open("a.txt"); err != nil {
+		t.Errorf("expected allowed, got %v", err)
+	}
+	if _, err := s.Open("../private.txt"); !errors.Is(err, policy.ErrPermission) {
+		t.Errorf("expected denied, got %v", err)
+	}
+	if _, err := s.OpenFile("a.txt", os.O_RDONLY, 0); err != nil {
+		t.Errorf("expected allowed, got %v", err)
+	}
+	if _, err := s.OpenFile("a.txt", os.O_WRONLY|os.O_APPEND, 0); !errors.Is(err, policy.ErrPermission) {
+		t.Errorf("expected denied, got %v", err)
+	}
+	if f, err := s.OpenFile("out/b.txt", os.O_WRONLY|os.O_CREATE, 0644); err != nil {
+		t.Errorf("expected allowed, got %v", err)
+	} else {
+		f.Close()
+	}
+	if err := s.MkdirAll("new", 0755); !errors.Is(err, policy.ErrPermission) {
+		t.Errorf("expected denied, got %v", err)
+	}
+	if err := s.Chdir("/"); !errors.Is(err, policy.ErrPermission) {
+		t.Errorf("expected denied, got %v", err)
+	}
+	err := s.Walk("/", func(path string, info fs.FileInfo, err error) error {
+		return err
+	})
+	var pe *fs.PathError
+	if !errors.As(err, &pe) || pe.Op != "lstat" || !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected walk denied, got %v", err)
+	}
+}
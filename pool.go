@@ -0,0 +1,261 @@
+package starlet
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+var (
+	// ErrPoolClosed is returned when acquiring a machine from a closed pool.
+	ErrPoolClosed = errors.New("machine pool is closed")
+)
+
+// MachinePool is a thread-safe pool of pre-warmed Machines sharing the same configuration, for running scripts concurrently.
+//
+// All the Machines in the pool are cloned from a template Machine, including its global variables, preload and lazyload modules, script, print function, cache and other settings.
+// The preload modules are loaded for each Machine when the pool is created and when it's released, instead of before each run.
+//
+// A Machine acquired from the pool can be used exclusively until it's released back to the pool. On release, its settings are restored from the template,
+// and the variables of the previous runs, including extra variables and results, are discarded, so the next user always gets a Machine in the initial state.
+// The preload modules are loaded again on release, so the module settings changed by scripts, e.g. http.set_timeout(), don't leak to the next user either.
+type MachinePool struct {
+	mu       sync.Mutex
+	template *Machine
+	idle     chan *Machine
+	members  map[*Machine]*poolMember
+	closed   bool
+	stats    PoolStats
+}
+
+// poolMember holds the pool-related state of a Machine in the pool.
+type poolMember struct {
+	inUse bool
+}
+
+// PoolStats contains the metrics of a MachinePool.
+type PoolStats struct {
+	// Size is the total number of machines in the pool.
+	Size int
+	// Idle is the number of machines available to acquire.
+	Idle int
+	// InUse is the number of machines acquired and not released yet.
+	InUse int
+	// Acquires is the total number of successful acquisitions.
+	Acquires uint64
+	// Waits is the number of acquisitions that had to wait for an idle machine.
+	Waits uint64
+	// WaitTime is the total time spent on waiting for idle machines.
+	WaitTime time.Duration
+	// Timeouts is the number of acquisitions that failed as the context is done before any machine is available.
+	Timeouts uint64
+	// Resets is the total number of machines reset on release.
+	Resets uint64
+}
+
+// NewMachinePool creates a pool of given size with Machines cloned from the template Machine, and pre-warms them by loading the preload modules.
+// Changes to the template Machine after the creation won't affect the pool.
+func NewMachinePool(template *Machine, size int) (*MachinePool, error) {
+	if template == nil {
+		return nil, errorStarletErrorf("pool", "nil template machine")
+	}
+	if size <= 0 {
+		return nil, errorStarletErrorf("pool", "invalid pool size: %d", size)
+	}
+
+	// snapshot the settings of template
+	template.mu.RLock()
+	tpl := &Machine{}
+	tpl.copySettings(template)
+	template.mu.RUnlock()
+
+	// create and pre-warm machines
+	p := &MachinePool{
+		template: tpl,
+		idle:     make(chan *Machine, size),
+		members:  make(map[*Machine]*poolMember, size),
+	}
+	for i := 0; i < size; i++ {
+		m := &Machine{}
+		m.copySettings(tpl)
+		if err := m.resetWithPreload(); err != nil {
+			return nil, err
+		}
+		p.members[m] = &poolMember{}
+		p.idle <- m
+	}
+	p.stats.Size = size
+	return p, nil
+}
+
+// Acquire takes an idle Machine from the pool, waiting until one is available or the context is done.
+// The Machine must be returned to the pool with Release after use.
+func (p *MachinePool) Acquire(ctx context.Context) (*Machine, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		return nil, ErrPoolClosed
+	}
+
+	// try to get an idle one, or wait for it
+	var (
+		m      *Machine
+		ok     bool
+		waited time.Duration
+	)
+	select {
+	case m, ok = <-p.idle:
+	default:
+		start := time.Now()
+		select {
+		case m, ok = <-p.idle:
+			waited = time.Since(start)
+		case <-ctx.Done():
+			p.mu.Lock()
+			p.stats.Waits++
+			p.stats.WaitTime += time.Since(start)
+			p.stats.Timeouts++
+			p.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+	if !ok {
+		return nil, ErrPoolClosed
+	}
+
+	// update the stats
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if waited > 0 {
+		p.stats.Waits++
+		p.stats.WaitTime += waited
+	}
+	p.stats.Acquires++
+	p.members[m].inUse = true
+	return m, nil
+}
+
+// Release resets the Machine to the initial state and returns it to the pool.
+// It does nothing if the Machine doesn't belong to the pool or is already released.
+func (p *MachinePool) Release(m *Machine) {
+	if m == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mb, ok := p.members[m]
+	if !ok || !mb.inUse {
+		return
+	}
+
+	// restore the settings, and discard variables and module states of previous runs
+	m.mu.Lock()
+	m.copySettings(p.template)
+	if err := m.resetWithPreload(); err != nil {
+		// fallback to reset completely, it'll be prepared again before the next run
+		m.Reset()
+	}
+	m.mu.Unlock()
+	mb.inUse = false
+	p.stats.Resets++
+
+	// return to the pool if it's not closed
+	if !p.closed {
+		p.idle <- m
+	}
+}
+
+// Do acquires a Machine from the pool, calls the function with it, and releases it back to the pool after the function returns.
+func (p *MachinePool) Do(ctx context.Context, fn func(m *Machine) error) error {
+	m, err := p.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.Release(m)
+	return fn(m)
+}
+
+// Close closes the pool, the following acquisitions will fail with ErrPoolClosed. Machines in use can still be released, but they are discarded.
+func (p *MachinePool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.idle)
+}
+
+// Stats returns the current metrics of the pool.
+func (p *MachinePool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.stats
+	for _, mb := range p.members {
+		if mb.inUse {
+			s.InUse++
+		}
+	}
+	if !p.closed {
+		s.Idle = len(p.idle)
+	}
+	return s
+}
+
+// copySettings copies the settings from another Machine, without the runtime state.
+func (m *Machine) copySettings(src *Machine) {
+	m.globals = src.globals.Clone()
+	m.preloadMods = src.preloadMods.Clone()
+	m.lazyloadMods = src.lazyloadMods.Clone()
+	m.printFunc = src.printFunc
+	m.allowGlobalReassign = src.allowGlobalReassign
+	m.allowRecursion = src.allowRecursion
+	m.enableInConv = src.enableInConv
+	m.enableOutConv = src.enableOutConv
+	m.customTag = src.customTag
+	m.budget = src.budget
+	m.hooks = src.hooks
+	m.profiler = src.profiler
+	m.debugger = src.debugger
+	m.fileSys = src.fileSys
+	m.policy = src.policy
+	m.scriptName = src.scriptName
+	m.scriptContent = src.scriptContent
+	m.scriptFS = src.scriptFS
+	m.progCache = src.progCache
+}
+
+// resetWithPreload loads the preload modules, and resets the runtime state with them.
+func (m *Machine) resetWithPreload() error {
+	mods := make(starlark.StringDict)
+	if err := m.preloadMods.LoadAll(mods); err != nil {
+		return errorStarletError("preload", err)
+	}
+	return m.resetWithModules(mods)
+}
+
+// resetWithModules resets the runtime state as it's just prepared for the first run with the given loaded preload modules.
+func (m *Machine) resetWithModules(mods starlark.StringDict) (err error) {
+	if m.predeclared, err = m.convertInput(m.globals); err != nil {
+		return errorStarlightConvert("globals", err)
+	}
+	for k, v := range mods {
+		m.predeclared[k] = v
+	}
+	m.runTimes = 0
+	m.sandbox = nil
+	m.userNames = nil
+	m.funcSources = nil
+	m.initThread()
+	return nil
+}
@@ -0,0 +1,334 @@
+package starlet_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1set/starlet"
+	"github.com/1set/starlet/vfs"
+	"go.starlark.net/starlark"
+)
+
+func TestNewMachinePool(t *testing.T) {
+	if _, err := starlet.NewMachinePool(nil, 1); err == nil {
+		t.Errorf("expected error for nil template, got nil")
+	}
+	if _, err := starlet.NewMachinePool(starlet.NewDefault(), 0); err == nil {
+		t.Errorf("expected error for zero size, got nil")
+	}
+
+	// failed preload
+	tpl := starlet.NewDefault()
+	tpl.SetPreloadModules(starlet.ModuleLoaderList{func() (starlark.StringDict, error) {
+		return nil, errors.New("failed to load")
+	}})
+	_, err := starlet.NewMachinePool(tpl, 2)
+	expectErr(t, err, "starlet: load: failed to load")
+
+	// preload modules are loaded for each machine on creation and release, instead of before each run
+	var cnt int
+	tpl = starlet.NewDefault()
+	tpl.SetPreloadModules(starlet.ModuleLoaderList{func() (starlark.StringDict, error) {
+		cnt++
+		return starlark.StringDict{"num": starlark.MakeInt(cnt)}, nil
+	}})
+	p, err := starlet.NewMachinePool(tpl, 3)
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if cnt != 3 {
+		t.Errorf("expected 3 loads, got %d", cnt)
+	}
+	for i := 0; i < 5; i++ {
+		err = p.Do(context.Background(), func(m *starlet.Machine) error {
+			m.SetScript("test.star", []byte(`x = num`), nil)
+			_, err := m.Run()
+			return err
+		})
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	}
+	if cnt != 8 {
+		t.Errorf("expected 8 loads after runs, got %d", cnt)
+	}
+	if s := p.Stats(); s.Size != 3 || s.Idle != 3 || s.InUse != 0 || s.Acquires != 5 || s.Resets != 5 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
+
+func TestMachinePool_Reset(t *testing.T) {
+	tpl := starlet.NewWithNames(starlet.StringAnyMap{"a": 10}, []string{"math"}, nil)
+	tpl.SetScript("test.star", []byte(`b = a * 2 + int(math.sqrt(c))`), nil)
+	p, err := starlet.NewMachinePool(tpl, 1)
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+
+	// changes to the template won't affect the pool
+	tpl.SetGlobals(starlet.StringAnyMap{"a": 100})
+
+	// run with extras, and change the settings
+	err = p.Do(context.Background(), func(m *starlet.Machine) error {
+		out, err := m.RunWithContext(context.Background(), starlet.StringAnyMap{"c": 16})
+		if err != nil {
+			return err
+		}
+		if b := out["b"]; b != int64(24) {
+			return fmt.Errorf("expected b=24, got %v", b)
+		}
+		m.SetScript("test.star", []byte(`d = 1`), nil)
+		m.AddGlobals(starlet.StringAnyMap{"e": 2})
+		_, err = m.RunWithContext(context.Background(), nil)
+		return err
+	})
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+
+	// variables and settings of previous runs are discarded
+	err = p.Do(context.Background(), func(m *starlet.Machine) error {
+		if v := m.Export(); v["b"] != nil || v["c"] != nil || v["d"] != nil || v["e"] != nil {
+			return fmt.Errorf("unexpected variables: %v", v)
+		}
+		_, err := m.Run()
+		return err
+	})
+	expectErr(t, err, "starlark: exec: test.star:1:27: undefined: c")
+}
+
+func TestMachinePool_ResetSandbox(t *testing.T) {
+	mfs := vfs.NewMemFS()
+	_ = mfs.MkdirAll("sub", 0755)
+	tpl := starlet.NewWithNames(nil, []string{"path"}, nil)
+	tpl.SetFileSystem(mfs)
+	p, err := starlet.NewMachinePool(tpl, 1)
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+
+	// the working directory of the previous tenant doesn't leak to the next one
+	for _, tt := range []struct {
+		code string
+		cwd  string
+	}{
+		{`path.chdir("/sub"); cwd = path.getcwd()`, "/sub"},
+		{`cwd = path.getcwd()`, "/"},
+	} {
+		err = p.Do(context.Background(), func(m *starlet.Machine) error {
+			m.SetScript("test.star", []byte(tt.code), nil)
+			out, err := m.Run()
+			if err == nil && out["cwd"] != tt.cwd {
+				err = fmt.Errorf("expected cwd %q, got %v", tt.cwd, out["cwd"])
+			}
+			return err
+		})
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	}
+}
+
+func TestMachinePool_ResetDebugger(t *testing.T) {
+	tpl := starlet.NewDefault()
+	tpl.SetScript("test.star", []byte("x = 1\ny = x + 1\nz = y + 1"), nil)
+	p, err := starlet.NewMachinePool(tpl, 1)
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+
+	// the debugger set by the previous tenant doesn't stop the next one
+	stops := 0
+	d := starlet.NewDebugger(func(s *starlet.DebugStop) starlet.DebugAction {
+		stops++
+		return starlet.DebugContinue
+	})
+	d.SetBreakpoint("test.star", 2)
+	for i, set := range []bool{true, false} {
+		err = p.Do(context.Background(), func(m *starlet.Machine) error {
+			if set {
+				m.SetDebugger(d)
+			}
+			_, err := m.Run()
+			return err
+		})
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		if stops != 1 {
+			t.Errorf("run #%d: expected 1 stop, got %d", i, stops)
+		}
+	}
+}
+
+func TestMachinePool_ResetModules(t *testing.T) {
+	tpl := starlet.NewWithNames(nil, []string{"http"}, nil)
+	p, err := starlet.NewMachinePool(tpl, 1)
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+
+	// the module settings changed by the previous tenant don't leak to the next one
+	for _, tt := range []struct {
+		code    string
+		timeout float64
+	}{
+		{`http.set_timeout(0.001); t = http.get_timeout()`, 0.001},
+		{`t = http.get_timeout()`, 30},
+	} {
+		err = p.Do(context.Background(), func(m *starlet.Machine) error {
+			m.SetScript("test.star", []byte(tt.code), nil)
+			out, err := m.Run()
+			if err == nil && out["t"] != tt.timeout {
+				err = fmt.Errorf("expected timeout %v, got %v", tt.timeout, out["t"])
+			}
+			return err
+		})
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	}
+}
+
+func TestMachinePool_ResetSnapshot(t *testing.T) {
+	p, err := starlet.NewMachinePool(starlet.NewWithGlobals(starlet.StringAnyMap{"secret": 42}), 1)
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	err = p.Do(context.Background(), func(m *starlet.Machine) error {
+		m.SetScript("test.star", []byte("secret = 1\ndef f():\n    return secret"), nil)
+		_, err := m.Run()
+		return err
+	})
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+
+	// the names assigned by the previous tenant are not in the snapshot of the next one
+	err = p.Do(context.Background(), func(m *starlet.Machine) error {
+		m.SetScript("test.star", []byte(`x = secret`), nil)
+		if _, err := m.Run(); err != nil {
+			return err
+		}
+		b, err := m.Snapshot()
+		if err != nil {
+			return err
+		}
+		if s := string(b); strings.Contains(s, `"secret"`) || strings.Contains(s, `"f"`) || !strings.Contains(s, `"x"`) {
+			return fmt.Errorf("unexpected snapshot: %s", s)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestMachinePool_Acquire(t *testing.T) {
+	p, err := starlet.NewMachinePool(starlet.NewDefault(), 1)
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+
+	// acquire the only one
+	m, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if s := p.Stats(); s.Idle != 0 || s.InUse != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	// wait for timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	// wait for release
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.Release(m)
+	}()
+	m2, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if m2 != m {
+		t.Errorf("expected the same machine")
+	}
+	p.Release(m2)
+
+	// release twice or foreign machine does nothing
+	p.Release(m2)
+	p.Release(starlet.NewDefault())
+	p.Release(nil)
+	s := p.Stats()
+	if s.Idle != 1 || s.InUse != 0 || s.Acquires != 2 || s.Waits != 2 || s.Timeouts != 1 || s.Resets != 2 || s.WaitTime <= 0 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	// closed pool
+	p.Close()
+	p.Close()
+	if _, err := p.Acquire(context.Background()); err != starlet.ErrPoolClosed {
+		t.Errorf("expected pool closed error, got %v", err)
+	}
+	if err := p.Do(context.Background(), func(m *starlet.Machine) error { return nil }); err != starlet.ErrPoolClosed {
+		t.Errorf("expected pool closed error, got %v", err)
+	}
+}
+
+func TestMachinePool_Concurrent(t *testing.T) {
+	tpl := starlet.NewWithNames(nil, []string{"json"}, nil)
+	tpl.SetScriptCacheEnabled(true)
+	tpl.SetScript("test.star", []byte(`out = json.encode({"n": n * n})`), nil)
+	p, err := starlet.NewMachinePool(tpl, 4)
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			err := p.Do(context.Background(), func(m *starlet.Machine) error {
+				out, err := m.RunWithContext(context.Background(), starlet.StringAnyMap{"n": n})
+				if err != nil {
+					return err
+				}
+				if exp := fmt.Sprintf(`{"n":%d}`, n*n); out["out"] != exp {
+					return fmt.Errorf("expected %s, got %v", exp, out["out"])
+				}
+				return nil
+			})
+			if err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if s := p.Stats(); s.Acquires != 50 || s.InUse != 0 || s.Idle != 4 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
@@ -0,0 +1,322 @@
+package starlet
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.starlark.net/syntax"
+)
+
+// Profiler collects the time and execution steps spent in each Starlark function and builtin of the scripts run by Machine.
+// It's safe for concurrent use, so one profiler can be shared by multiple machines, e.g. in a MachinePool.
+//
+// Like Hooks, it observes every execution step of the script, so the execution is noticeably slower with it set,
+// and it traces the builtins in the same way, i.e. the time of builtins called in functions compiled without tracing is counted in their callers.
+type Profiler struct {
+	mu      sync.Mutex
+	start   time.Time
+	funcs   map[profKey]*profFunc
+	order   []*profFunc
+	samples map[string]*profSample
+}
+
+// FunctionProfile is the aggregated profile of a function.
+type FunctionProfile struct {
+	// Name is the name of the function.
+	Name string
+	// Pos is the position of the function definition, and it's invalid for builtins.
+	Pos syntax.Position
+	// Calls is the number of calls to the function.
+	Calls int64
+	// Steps is the number of execution steps spent in the function itself.
+	Steps uint64
+	// Self is the time spent in the function itself, excluding the functions it calls.
+	Self time.Duration
+	// Total is the time spent in the function, including the functions it calls.
+	Total time.Duration
+}
+
+// profKey identifies a function in the profiler.
+type profKey struct {
+	name string
+	pos  string
+}
+
+// profFunc holds the statistics of a function in the profiler.
+type profFunc struct {
+	id     uint64
+	name   string
+	pos    syntax.Position
+	calls  int64
+	steps  uint64
+	self   time.Duration
+	total  time.Duration
+	active int
+	since  time.Time
+}
+
+// profSample holds the statistics of a call stack in the profiler, the first function is the innermost one.
+type profSample struct {
+	funcs []*profFunc
+	steps uint64
+	dur   time.Duration
+}
+
+// NewProfiler creates a new empty Profiler.
+func NewProfiler() *Profiler {
+	p := &Profiler{}
+	p.Reset()
+	return p
+}
+
+// Reset discards all the collected results of the profiler.
+func (p *Profiler) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.start = time.Now()
+	p.funcs = make(map[profKey]*profFunc)
+	p.order = nil
+	p.samples = make(map[string]*profSample)
+}
+
+// Functions returns the aggregated profiles of all the functions observed, sorted by self time in descending order.
+func (p *Profiler) Functions() []FunctionProfile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	res := make([]FunctionProfile, 0, len(p.order))
+	for _, f := range p.order {
+		res = append(res, FunctionProfile{
+			Name:  f.name,
+			Pos:   f.pos,
+			Calls: f.calls,
+			Steps: f.steps,
+			Self:  f.self,
+			Total: f.total,
+		})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Self > res[j].Self
+	})
+	return res
+}
+
+// WriteProfile writes the collected results as a gzip-compressed protocol buffer in pprof format, which can be analyzed by "go tool pprof".
+// The samples have two values: the execution steps and the CPU time in nanoseconds.
+func (p *Profiler) WriteProfile(w io.Writer) error {
+	p.mu.Lock()
+	data := p.encodeProfile(time.Now())
+	p.mu.Unlock()
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// lookup returns the statistics of the given function, and creates it if not found. It must be called with the lock held.
+func (p *Profiler) lookup(name string, pos syntax.Position) *profFunc {
+	k := profKey{name: name}
+	if pos.IsValid() {
+		k.pos = pos.String()
+	}
+	if f, ok := p.funcs[k]; ok {
+		return f
+	}
+	f := &profFunc{id: uint64(len(p.order) + 1), name: name, pos: pos}
+	p.funcs[k] = f
+	p.order = append(p.order, f)
+	return f
+}
+
+// enter records the entry of a function call, and returns its statistics for the exit.
+func (p *Profiler) enter(name string, pos syntax.Position, now time.Time) *profFunc {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f := p.lookup(name, pos)
+	f.calls++
+	if f.active == 0 {
+		// only the outermost call of recursive ones counts for the total time
+		f.since = now
+	}
+	f.active++
+	return f
+}
+
+// exit records the exit of a function call entered.
+func (p *Profiler) exit(f *profFunc, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if f.active--; f.active == 0 {
+		f.total += now.Sub(f.since)
+	}
+}
+
+// addSample attributes the time and steps to the top of the call stack, or to the builtin called by the top if the name is given.
+func (p *Profiler) addSample(stack []*traceFrame, builtin string, d time.Duration, steps uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// collect functions from the innermost one
+	funcs := make([]*profFunc, 0, len(stack)+1)
+	if builtin != "" {
+		f := p.lookup(builtin, syntax.Position{})
+		f.calls++
+		f.total += d
+		funcs = append(funcs, f)
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		funcs = append(funcs, stack[i].prof)
+	}
+	top := funcs[0]
+	top.self += d
+	top.steps += steps
+
+	// aggregate by the call stack
+	var sb strings.Builder
+	for _, f := range funcs {
+		sb.WriteString(strconv.FormatUint(f.id, 10))
+		sb.WriteByte(',')
+	}
+	key := sb.String()
+	s, ok := p.samples[key]
+	if !ok {
+		s = &profSample{funcs: funcs}
+		p.samples[key] = s
+	}
+	s.dur += d
+	s.steps += steps
+}
+
+// encodeProfile encodes the collected results as a protocol buffer of pprof profile.proto. It must be called with the lock held.
+func (p *Profiler) encodeProfile(now time.Time) []byte {
+	var (
+		b       protoBuffer
+		strs    = map[string]int64{"": 0}
+		strList = []string{""}
+	)
+	str := func(s string) int64 {
+		if i, ok := strs[s]; ok {
+			return i
+		}
+		i := int64(len(strList))
+		strs[s] = i
+		strList = append(strList, s)
+		return i
+	}
+	valueType := func(typ, unit string) []byte {
+		var vb protoBuffer
+		vb.int64(1, str(typ))
+		vb.int64(2, str(unit))
+		return vb.data
+	}
+
+	// sample types: steps, cpu
+	b.bytes(1, valueType("steps", "count"))
+	b.bytes(1, valueType("cpu", "nanoseconds"))
+
+	// samples, in a stable order
+	keys := make([]string, 0, len(p.samples))
+	for k := range p.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := p.samples[k]
+		var sb protoBuffer
+		ids := make([]uint64, len(s.funcs))
+		for i, f := range s.funcs {
+			ids[i] = f.id
+		}
+		sb.packed(1, ids)
+		sb.packed(2, []uint64{s.steps, uint64(s.dur.Nanoseconds())})
+		b.bytes(2, sb.data)
+	}
+
+	// locations and functions, one for each function with the same id
+	for _, f := range p.order {
+		var lb, fb, ln protoBuffer
+		fb.uint64(1, f.id)
+		fb.int64(2, str(strings.Trim(f.name, "<>"))) // pprof trims "<...>" as template arguments, e.g. "<toplevel>"
+		fb.int64(3, str(f.name))
+		ln.uint64(1, f.id)
+		if f.pos.IsValid() {
+			fb.int64(4, str(f.pos.Filename()))
+			fb.int64(5, int64(f.pos.Line))
+			ln.int64(2, int64(f.pos.Line))
+		}
+		lb.uint64(1, f.id)
+		lb.bytes(4, ln.data)
+		b.bytes(4, lb.data)
+		b.bytes(5, fb.data)
+	}
+
+	// time and period
+	periodType := valueType("cpu", "nanoseconds")
+	for _, s := range strList {
+		b.string(6, s)
+	}
+	b.int64(9, p.start.UnixNano())
+	b.int64(10, now.Sub(p.start).Nanoseconds())
+	b.bytes(11, periodType)
+	b.int64(12, 1)
+	return b.data
+}
+
+// protoBuffer is a minimal encoder of protocol buffer wire format for the pprof profile.
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) tag(field, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.tag(field, 0)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+func (b *protoBuffer) bytes(field int, x []byte) {
+	b.tag(field, 2)
+	b.varint(uint64(len(x)))
+	b.data = append(b.data, x...)
+}
+
+func (b *protoBuffer) string(field int, s string) {
+	b.tag(field, 2)
+	b.varint(uint64(len(s)))
+	b.data = append(b.data, s...)
+}
+
+func (b *protoBuffer) packed(field int, xs []uint64) {
+	var pb protoBuffer
+	for _, x := range xs {
+		pb.varint(x)
+	}
+	b.bytes(field, pb.data)
+}
@@ -0,0 +1,526 @@
+package starlet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	libgoid "github.com/1set/starlet/lib/goidiomatic"
+	"github.com/chzyer/readline"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+const (
+	replPrompt         = ">>> "
+	replContinuePrompt = "... "
+	replIndent         = "    "
+)
+
+// REPLConfig is the settings of the interactive REPL of Machine.
+type REPLConfig struct {
+	// HistoryFile is the file to load and save the input history, the history is not saved if it's empty.
+	HistoryFile string
+	// Stdin is the input of the REPL, os.Stdin is used if it's nil.
+	Stdin io.ReadCloser
+	// Stdout is the output of results, os.Stdout is used if it's nil.
+	Stdout io.Writer
+	// Stderr is the output of errors, os.Stderr is used if it's nil.
+	Stderr io.Writer
+}
+
+// replCommand is the meta-command of the REPL, the input starting with a colon.
+type replCommand struct {
+	usage string
+	help  string
+	run   func(r *replSession, arg string) error
+}
+
+var (
+	// replCommands are the meta-commands of the REPL by names.
+	replCommands map[string]*replCommand
+	// errREPLQuit is returned by the quit command to stop the REPL.
+	errREPLQuit = errors.New("quit")
+)
+
+func init() {
+	replCommands = map[string]*replCommand{
+		"help":  {":help", "show the meta-commands", (*replSession).cmdHelp},
+		"load":  {":load <file>", "execute the script file in the REPL, the globals defined by it are kept", (*replSession).cmdLoad},
+		"reset": {":reset", "discard all the variables and start over with the initial globals and modules", (*replSession).cmdReset},
+		"vars":  {":vars", "list the variables defined in the REPL with types", (*replSession).cmdVars},
+		"doc":   {":doc <name>", "show the signature and docstring of the function, or the members of the module or struct", (*replSession).cmdDoc},
+		"time":  {":time <code>", "execute the code and show the time it takes", (*replSession).cmdTime},
+		"quit":  {":quit", "exit the REPL", (*replSession).cmdQuit},
+	}
+}
+
+// REPL is a Read-Eval-Print-Loop for Starlark.
+// It loads the predeclared symbols and modules into the global environment, and no history is saved, see REPLWithConfig for details.
+func (m *Machine) REPL() {
+	m.REPLWithConfig(REPLConfig{})
+}
+
+// REPLWithConfig starts an interactive read-eval-print loop with the settings of the Machine, until the input ends or the quit command.
+//
+// The results of expressions are pretty-printed by pprint of the go_idiomatic module, and multi-line statements are read until a blank line.
+// Tab completes the names of globals and the members of modules and structs, and the meta-commands starting with a colon are available, see :help for details.
+// Control-C cancels the running code, and the variables defined in the REPL are kept for following runs of the Machine.
+func (m *Machine) REPLWithConfig(cfg REPLConfig) {
+	if cfg.Stdout == nil {
+		cfg.Stdout = os.Stdout
+	}
+	if cfg.Stderr == nil {
+		cfg.Stderr = os.Stderr
+	}
+	r := &replSession{m: m, out: cfg.Stdout, errOut: cfg.Stderr}
+	if err := r.init(); err != nil {
+		r.printError(err)
+		return
+	}
+
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:       replPrompt,
+		HistoryFile:  cfg.HistoryFile,
+		AutoComplete: r,
+		Stdin:        cfg.Stdin,
+		Stdout:       cfg.Stdout,
+		Stderr:       cfg.Stderr,
+	})
+	if err != nil {
+		r.printError(err)
+		return
+	}
+	defer rl.Close()
+	r.rl = rl
+	r.interactive = rl.Config.FuncIsTerminal()
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	defer signal.Stop(interrupted)
+	r.interrupted = interrupted
+
+	for {
+		if err := r.rep(); err != nil {
+			if err == readline.ErrInterrupt {
+				fmt.Fprintln(r.out, err)
+				continue
+			}
+			break
+		}
+	}
+}
+
+// replSession is the state of the REPL running on the Machine.
+type replSession struct {
+	m           *Machine
+	rl          *readline.Instance
+	out         io.Writer
+	errOut      io.Writer
+	interactive bool
+	interrupted chan os.Signal
+	initNames   map[string]struct{}
+	pprint      starlark.Value
+}
+
+// init prepares the thread of the Machine, and records the initial names to tell the variables defined in the REPL.
+func (r *replSession) init() error {
+	if err := r.m.prepareThread(nil); err != nil {
+		return err
+	}
+	r.initNames = make(map[string]struct{}, len(r.m.predeclared))
+	for name := range r.m.predeclared {
+		if _, ok := r.m.userNames[name]; !ok {
+			r.initNames[name] = struct{}{}
+		}
+	}
+	if r.pprint == nil {
+		mod, err := libgoid.LoadModule()
+		if err != nil {
+			return err
+		}
+		r.pprint = mod["pprint"]
+	}
+	return nil
+}
+
+// rep reads, evaluates, and prints one item. It returns an error only if the REPL should stop or readline is interrupted.
+func (r *replSession) rep() error {
+	r.rl.SetPrompt(replPrompt)
+	first, err := r.rl.Readline()
+	if err != nil {
+		return err
+	}
+
+	// meta-commands
+	if trimmed := strings.TrimSpace(first); strings.HasPrefix(trimmed, ":") {
+		if err := r.runCommand(trimmed[1:]); err != nil {
+			if err == errREPLQuit {
+				return err
+			}
+			r.printError(err)
+		}
+		return nil
+	}
+
+	// the continuation lines are indented as the previous line in terminals, and more after a colon
+	var (
+		pending = []byte(first + "\n")
+		prev    = first
+		eof     = false
+	)
+	readLine := func() ([]byte, error) {
+		if pending != nil {
+			line := pending
+			pending = nil
+			return line, nil
+		}
+		r.rl.SetPrompt(replContinuePrompt)
+		var line string
+		if r.interactive {
+			line, err = r.rl.ReadlineWithDefault(nextIndent(prev))
+		} else {
+			line, err = r.rl.Readline()
+		}
+		if err != nil {
+			if err == io.EOF {
+				eof = true
+			}
+			return nil, err
+		}
+		prev = line
+		return []byte(line + "\n"), nil
+	}
+
+	f, err := r.fileOptions().ParseCompoundStmt("<stdin>", readLine)
+	if err != nil {
+		if eof {
+			return io.EOF
+		}
+		r.printError(err)
+		return nil
+	}
+	if err := r.exec(f); err != nil {
+		r.printError(err)
+	}
+	return nil
+}
+
+// nextIndent returns the indentation for the line following the given line.
+func nextIndent(line string) string {
+	indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	if strings.HasSuffix(strings.TrimSpace(line), ":") {
+		indent += replIndent
+	}
+	return indent
+}
+
+// fileOptions returns the options of the Machine for parsing, and the load bindings are global in the REPL.
+func (r *replSession) fileOptions() *syntax.FileOptions {
+	opts := r.m.getFileOptions()
+	opts.LoadBindsGlobally = true
+	return opts
+}
+
+// exec evaluates the sole expression and prints the result, or executes the statements, with the thread cancelled by Control-C.
+func (r *replSession) exec(f *syntax.File) error {
+	m := r.m
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.interrupted:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	m.thread.Uncancel()
+	_, stopWatch := m.watchContext(ctx)
+	defer stopWatch()
+
+	if expr := soleExpr(f); expr != nil {
+		v, err := starlark.EvalExprOptions(f.Options, m.thread, expr, m.predeclared)
+		if err != nil {
+			return err
+		}
+		return r.print(v)
+	}
+	return starlark.ExecREPLChunk(f, m.thread, m.predeclared)
+}
+
+// print pretty-prints the value by pprint, None is not printed.
+func (r *replSession) print(v starlark.Value) error {
+	if v == starlark.None {
+		return nil
+	}
+	thread := &starlark.Thread{
+		Name: "pprint",
+		Print: func(_ *starlark.Thread, msg string) {
+			fmt.Fprintln(r.out, msg)
+		},
+	}
+	_, err := starlark.Call(thread, r.pprint, starlark.Tuple{v}, nil)
+	return err
+}
+
+// printError prints the error, or its backtrace if it's a Starlark evaluation error.
+func (r *replSession) printError(err error) {
+	var evalErr *starlark.EvalError
+	if errors.As(err, &evalErr) {
+		fmt.Fprintln(r.errOut, evalErr.Backtrace())
+	} else {
+		fmt.Fprintln(r.errOut, err)
+	}
+}
+
+// runCommand runs the meta-command with the argument.
+func (r *replSession) runCommand(line string) error {
+	name, arg := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	cmd, ok := replCommands[name]
+	if !ok {
+		return fmt.Errorf("unknown command :%s, see :help for the commands", name)
+	}
+	return cmd.run(r, arg)
+}
+
+func (r *replSession) cmdHelp(string) error {
+	names := make([]string, 0, len(replCommands))
+	for name := range replCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := replCommands[name]
+		fmt.Fprintf(r.out, "%-14s %s\n", cmd.usage, cmd.help)
+	}
+	return nil
+}
+
+func (r *replSession) cmdLoad(file string) error {
+	if file == "" {
+		return errors.New("usage: :load <file>")
+	}
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	f, err := r.fileOptions().Parse(file, src, 0)
+	if err != nil {
+		return err
+	}
+	return r.exec(f)
+}
+
+func (r *replSession) cmdReset(string) error {
+	r.m.Reset()
+	return r.init()
+}
+
+func (r *replSession) cmdVars(string) error {
+	var names []string
+	for name := range r.m.predeclared {
+		if _, ok := r.initNames[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(r.out, "%s: %s\n", name, r.m.predeclared[name].Type())
+	}
+	return nil
+}
+
+func (r *replSession) cmdDoc(name string) error {
+	if name == "" {
+		return errors.New("usage: :doc <name>")
+	}
+	v, err := r.lookup(name)
+	if err != nil {
+		return err
+	}
+	switch t := v.(type) {
+	case *starlark.Function:
+		fmt.Fprintln(r.out, funcSignature(t))
+		if doc := strings.TrimSpace(t.Doc()); doc != "" {
+			fmt.Fprintln(r.out, doc)
+		}
+	case *starlark.Builtin:
+		fmt.Fprintf(r.out, "built-in function %s\n", t.Name())
+	case starlark.HasAttrs:
+		fmt.Fprintf(r.out, "%s %s\n", t.Type(), name)
+		for _, attr := range t.AttrNames() {
+			av, err := t.Attr(attr)
+			if err != nil || av == nil {
+				continue
+			}
+			fmt.Fprintf(r.out, "%s%s: %s\n", replIndent, attr, av.Type())
+		}
+	default:
+		fmt.Fprintf(r.out, "%s: %s\n", name, v.Type())
+	}
+	return nil
+}
+
+func (r *replSession) cmdTime(code string) error {
+	if code == "" {
+		return errors.New("usage: :time <code>")
+	}
+	f, err := r.fileOptions().Parse("<stdin>", code, 0)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = r.exec(f)
+	fmt.Fprintf(r.out, "time: %v\n", time.Since(start))
+	return err
+}
+
+func (r *replSession) cmdQuit(string) error {
+	return errREPLQuit
+}
+
+// lookup returns the value of the name in the globals or universe, and the dotted name is resolved as attributes of modules or structs.
+func (r *replSession) lookup(name string) (starlark.Value, error) {
+	parts := strings.Split(name, ".")
+	v, ok := r.m.predeclared[parts[0]]
+	if !ok {
+		if v, ok = starlark.Universe[parts[0]]; !ok {
+			return nil, fmt.Errorf("undefined: %s", parts[0])
+		}
+	}
+	for i, attr := range parts[1:] {
+		ha, ok := v.(starlark.HasAttrs)
+		if !ok {
+			return nil, fmt.Errorf("no attributes in %s: %s", strings.Join(parts[:i+1], "."), v.Type())
+		}
+		av, err := ha.Attr(attr)
+		if err != nil || av == nil {
+			return nil, fmt.Errorf("undefined: %s", strings.Join(parts[:i+2], "."))
+		}
+		v = av
+	}
+	return v, nil
+}
+
+// Do implements readline.AutoCompleter, it completes the meta-commands, or the dotted names of globals and their members before the cursor.
+func (r *replSession) Do(line []rune, pos int) ([][]rune, int) {
+	head := string(line[:pos])
+
+	// meta-commands at the beginning
+	if trimmed := strings.TrimLeft(head, " \t"); strings.HasPrefix(trimmed, ":") && !strings.ContainsAny(trimmed, " \t") {
+		var names []string
+		for name := range replCommands {
+			names = append(names, name)
+		}
+		return completeSuffixes(names, trimmed[1:])
+	}
+
+	// the dotted name before the cursor
+	start := len(head)
+	for start > 0 && isNameChar(head[start-1]) {
+		start--
+	}
+	word := head[start:]
+	if word == "" || (word[0] >= '0' && word[0] <= '9') {
+		return nil, 0
+	}
+	var names []string
+	if i := strings.LastIndex(word, "."); i >= 0 {
+		v, err := r.lookup(word[:i])
+		if err != nil {
+			return nil, 0
+		}
+		ha, ok := v.(starlark.HasAttrs)
+		if !ok {
+			return nil, 0
+		}
+		names, word = ha.AttrNames(), word[i+1:]
+	} else {
+		for name := range r.m.predeclared {
+			names = append(names, name)
+		}
+		for name := range starlark.Universe {
+			if _, ok := r.m.predeclared[name]; !ok {
+				names = append(names, name)
+			}
+		}
+	}
+	return completeSuffixes(names, word)
+}
+
+// completeSuffixes returns the sorted suffixes of the names with the prefix, and the length of the prefix.
+func completeSuffixes(names []string, prefix string) ([][]rune, int) {
+	sort.Strings(names)
+	var res [][]rune
+	for _, name := range names {
+		// the private names are hidden unless the prefix is given
+		if !strings.HasPrefix(name, prefix) || (prefix == "" && strings.HasPrefix(name, "_")) {
+			continue
+		}
+		res = append(res, []rune(name[len(prefix):]))
+	}
+	return res, len([]rune(prefix))
+}
+
+// isNameChar reports whether the byte can be a part of dotted names.
+func isNameChar(c byte) bool {
+	return c == '_' || c == '.' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// funcSignature returns the signature of the function, e.g. def f(a, b=1, *args, c=2, **kwargs).
+// The parameters are ordered as positional, keyword-only, *args and **kwargs by Function.Param.
+func funcSignature(fn *starlark.Function) string {
+	n, nKwonly := fn.NumParams(), fn.NumKwonlyParams()
+	nPos := n - nKwonly
+	if fn.HasVarargs() {
+		nPos--
+	}
+	if fn.HasKwargs() {
+		nPos--
+	}
+	param := func(i int) string {
+		name, _ := fn.Param(i)
+		if d := fn.ParamDefault(i); d != nil {
+			name += "=" + d.String()
+		}
+		return name
+	}
+
+	var params []string
+	for i := 0; i < nPos; i++ {
+		params = append(params, param(i))
+	}
+	if fn.HasVarargs() {
+		name, _ := fn.Param(nPos + nKwonly)
+		params = append(params, "*"+name)
+	} else if nKwonly > 0 {
+		params = append(params, "*")
+	}
+	for i := nPos; i < nPos+nKwonly; i++ {
+		params = append(params, param(i))
+	}
+	if fn.HasKwargs() {
+		name, _ := fn.Param(n - 1)
+		params = append(params, "**"+name)
+	}
+	return fmt.Sprintf("def %s(%s)", fn.Name(), strings.Join(params, ", "))
+}
+
+// soleExpr returns the expression if the file is a sole expression statement.
+func soleExpr(f *syntax.File) syntax.Expr {
+	if len(f.Stmts) == 1 {
+		if stmt, ok := f.Stmts[0].(*syntax.ExprStmt); ok {
+			return stmt.X
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package starlet_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/1set/starlet"
+	"github.com/1set/starlet/internal"
+	"go.starlark.net/starlark"
+)
+
+func TestMachine_REPLWithConfig(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib.star")
+	if err := ioutil.WriteFile(lib, []byte("def double(n):\n    return n * 2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	history := filepath.Join(dir, "history")
+
+	input := internal.HereDoc(`
+		x = 1
+		def f(a, b=2, *args, c, d=4, **kw):
+		    "Return a as it is."
+		    return a
+
+		f(x, c=3)
+		{"a": [1, 2], "b": x}
+		print("printed")
+		None
+		:vars
+		:doc f
+		:doc json
+		:load ` + lib + `
+		double(21)
+		:reset
+		:vars
+		x
+		1 / 0
+		:bogus
+		:quit
+		y = 2
+	`)
+	var out, errOut bytes.Buffer
+	m := starlet.NewWithNames(nil, []string{"json"}, nil)
+	m.SetPrintFunc(func(_ *starlark.Thread, msg string) { out.WriteString(msg + "\n") })
+	m.REPLWithConfig(starlet.REPLConfig{
+		HistoryFile: history,
+		Stdin:       ioutil.NopCloser(strings.NewReader(input)),
+		Stdout:      &out,
+		Stderr:      &errOut,
+	})
+
+	expOut := internal.HereDoc(`
+		1
+		{
+		    "a": [
+		        1,
+		        2
+		    ],
+		    "b": 1
+		}
+		printed
+		f: function
+		x: int
+		def f(a, b=2, *args, c, d=4, **kw)
+		Return a as it is.
+		module json
+		    decode: builtin_function_or_method
+	`)
+	if got := out.String(); !strings.HasPrefix(got, expOut) || !strings.HasSuffix(got, "42\n") {
+		t.Errorf("unexpected output: %s", got)
+	}
+	for _, exp := range []string{"undefined: x", "floating-point division by zero", "unknown command :bogus"} {
+		if !strings.Contains(errOut.String(), exp) {
+			t.Errorf("expected error %q, got: %s", exp, errOut.String())
+		}
+	}
+	if pd := m.GetStarlarkPredeclared(); pd["x"] != nil || pd["y"] != nil {
+		t.Errorf("unexpected globals after reset and quit: %v", pd)
+	}
+
+	// history is saved
+	if b, err := ioutil.ReadFile(history); err != nil || !strings.Contains(string(b), "double(21)") {
+		t.Errorf("unexpected history: %q, %v", b, err)
+	}
+}
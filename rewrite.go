@@ -0,0 +1,179 @@
+package starlet
+
+import (
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// programRewrite is the set of rewrites applied to the syntax tree of the programs executed by a thread.
+type programRewrite uint8
+
+const (
+	// rewriteSizeGuard rewrites the repetition and concatenation operators into calls of the size guard builtins.
+	rewriteSizeGuard programRewrite = 1 << iota
+	// rewriteTraceCall rewrites the function calls to pass the callees through the trace builtin.
+	rewriteTraceCall
+)
+
+// getProgramRewrite returns the rewrites required by the budget tracker and the tracer of the thread.
+func getProgramRewrite(thread *starlark.Thread) programRewrite {
+	var rw programRewrite
+	if isSizeGuarded(thread) {
+		rw |= rewriteSizeGuard
+	}
+	if isCallTraced(thread) {
+		rw |= rewriteTraceCall
+	}
+	return rw
+}
+
+// cacheKeySuffix returns the suffix of the cache key for the rewritten programs, so they're cached separately from the original ones.
+func (rw programRewrite) cacheKeySuffix() string {
+	var s string
+	if rw&rewriteSizeGuard != 0 {
+		s += ":guarded"
+	}
+	if rw&rewriteTraceCall != 0 {
+		s += ":traced"
+	}
+	return s
+}
+
+// predeclared returns a copy of the predeclared values with the builtins called by the rewritten programs.
+func (rw programRewrite) predeclared(predeclared starlark.StringDict) starlark.StringDict {
+	if rw == 0 {
+		return predeclared
+	}
+	d := make(starlark.StringDict, len(predeclared)+len(sizeGuards)+1)
+	for k, v := range predeclared {
+		d[k] = v
+	}
+	if rw&rewriteSizeGuard != 0 {
+		for k, v := range sizeGuards {
+			d[k] = v
+		}
+	}
+	if rw&rewriteTraceCall != 0 {
+		d[traceNameCall] = traceCall
+	}
+	return d
+}
+
+// isRewriteName returns true if the name is of the builtins called by the rewritten programs.
+func (rw programRewrite) isRewriteName(name string) bool {
+	return (rw&rewriteSizeGuard != 0 && isSizeGuardName(name)) || (rw&rewriteTraceCall != 0 && name == traceNameCall)
+}
+
+// apply rewrites the syntax tree of the file. The calls are traced before the operators are guarded, so the guard builtins are not traced.
+func (rw programRewrite) apply(f *syntax.File) {
+	if rw&rewriteTraceCall != 0 {
+		traceFile(f)
+	}
+	if rw&rewriteSizeGuard != 0 {
+		guardFile(f)
+	}
+}
+
+// syntaxRewriter rewrites the syntax tree in place, and each expression is rewritten after its children.
+type syntaxRewriter struct {
+	// expr returns the replacement of the expression whose children are already rewritten.
+	expr func(e syntax.Expr) syntax.Expr
+	// assign is called for the assignment whose operands are already rewritten, it's optional.
+	assign func(s *syntax.AssignStmt)
+}
+
+func (r *syntaxRewriter) stmts(stmts []syntax.Stmt) {
+	for _, s := range stmts {
+		r.stmt(s)
+	}
+}
+
+func (r *syntaxRewriter) stmt(stmt syntax.Stmt) {
+	switch s := stmt.(type) {
+	case *syntax.AssignStmt:
+		s.LHS = r.rewrite(s.LHS)
+		s.RHS = r.rewrite(s.RHS)
+		if r.assign != nil {
+			r.assign(s)
+		}
+	case *syntax.DefStmt:
+		r.exprs(s.Params)
+		r.stmts(s.Body)
+	case *syntax.ExprStmt:
+		s.X = r.rewrite(s.X)
+	case *syntax.ForStmt:
+		s.Vars = r.rewrite(s.Vars)
+		s.X = r.rewrite(s.X)
+		r.stmts(s.Body)
+	case *syntax.WhileStmt:
+		s.Cond = r.rewrite(s.Cond)
+		r.stmts(s.Body)
+	case *syntax.IfStmt:
+		s.Cond = r.rewrite(s.Cond)
+		r.stmts(s.True)
+		r.stmts(s.False)
+	case *syntax.ReturnStmt:
+		s.Result = r.rewrite(s.Result)
+	}
+}
+
+func (r *syntaxRewriter) rewrite(expr syntax.Expr) syntax.Expr {
+	switch e := expr.(type) {
+	case nil:
+		return nil
+	case *syntax.BinaryExpr:
+		e.X = r.rewrite(e.X)
+		e.Y = r.rewrite(e.Y)
+	case *syntax.CallExpr:
+		e.Fn = r.rewrite(e.Fn)
+		r.exprs(e.Args)
+	case *syntax.Comprehension:
+		e.Body = r.rewrite(e.Body)
+		for _, c := range e.Clauses {
+			switch c := c.(type) {
+			case *syntax.ForClause:
+				c.Vars = r.rewrite(c.Vars)
+				c.X = r.rewrite(c.X)
+			case *syntax.IfClause:
+				c.Cond = r.rewrite(c.Cond)
+			}
+		}
+	case *syntax.CondExpr:
+		e.Cond = r.rewrite(e.Cond)
+		e.True = r.rewrite(e.True)
+		e.False = r.rewrite(e.False)
+	case *syntax.DictEntry:
+		e.Key = r.rewrite(e.Key)
+		e.Value = r.rewrite(e.Value)
+	case *syntax.DictExpr:
+		r.exprs(e.List)
+	case *syntax.DotExpr:
+		e.X = r.rewrite(e.X)
+	case *syntax.IndexExpr:
+		e.X = r.rewrite(e.X)
+		e.Y = r.rewrite(e.Y)
+	case *syntax.LambdaExpr:
+		r.exprs(e.Params)
+		e.Body = r.rewrite(e.Body)
+	case *syntax.ListExpr:
+		r.exprs(e.List)
+	case *syntax.ParenExpr:
+		e.X = r.rewrite(e.X)
+	case *syntax.SliceExpr:
+		e.X = r.rewrite(e.X)
+		e.Lo = r.rewrite(e.Lo)
+		e.Hi = r.rewrite(e.Hi)
+		e.Step = r.rewrite(e.Step)
+	case *syntax.TupleExpr:
+		r.exprs(e.List)
+	case *syntax.UnaryExpr:
+		e.X = r.rewrite(e.X)
+	}
+	return r.expr(expr)
+}
+
+func (r *syntaxRewriter) exprs(list []syntax.Expr) {
+	for i, e := range list {
+		list[i] = r.rewrite(e)
+	}
+}
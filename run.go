@@ -2,28 +2,20 @@ package starlet
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"sync"
 	"time"
 
 	"github.com/1set/starlet/lib/goidiomatic"
+	"github.com/1set/starlet/policy"
+	"github.com/1set/starlet/vfs"
 	"github.com/1set/starlight/convert"
-	"go.starlark.net/repl"
 	"go.starlark.net/starlark"
 	"go.starlark.net/syntax"
 )
 
-// REPL is a Read-Eval-Print-Loop for Starlark.
-// It loads the predeclared symbols and modules into the global environment,
-func (m *Machine) REPL() {
-	if err := m.prepareThread(nil); err != nil {
-		repl.PrintError(err)
-		return
-	}
-	repl.REPLOptions(m.getFileOptions(), m.thread, m.predeclared)
-}
-
 // RunScript initiates a Machine, executes a script with extra variables, and returns the Machine and the execution result.
 func RunScript(content []byte, extras StringAnyMap) (*Machine, StringAnyMap, error) {
 	m := NewDefault()
@@ -110,30 +102,13 @@ func (m *Machine) runInternal(ctx context.Context, extras StringAnyMap, allowCac
 	}()
 
 	// either script content or name and FS must be set
-	var (
-		scriptName = m.scriptName
-		source     interface{}
-	)
-	if m.scriptContent != nil {
-		if scriptName == "" {
-			// for default name, and disable cache to avoid conflict
-			scriptName = "eval.star"
-			allowCache = false
-		}
-		source = m.scriptContent
-	} else if m.scriptFS != nil {
-		if scriptName == "" {
-			// if no name, cannot load
-			return nil, errorStarletErrorf("run", "no script name")
-		}
-		// load script from FS
-		rd, e := m.scriptFS.Open(scriptName)
-		if e != nil {
-			return nil, errorStarletError("run", e)
-		}
-		source = rd
-	} else {
-		return nil, errorStarletErrorf("run", "no script to execute")
+	if m.scriptContent != nil && m.scriptName == "" {
+		// for default name, and disable cache to avoid conflict
+		allowCache = false
+	}
+	scriptName, source, err := m.readScriptSource()
+	if err != nil {
+		return nil, err
 	}
 
 	// prepare thread
@@ -142,65 +117,128 @@ func (m *Machine) runInternal(ctx context.Context, extras StringAnyMap, allowCac
 	}
 
 	// cancel thread when context cancelled
-	if ctx == nil || ctx.Err() != nil {
-		// for nil context, or context already cancelled, use a new one
-		ctx = context.TODO()
-	}
-	m.thread.SetLocal("context", ctx)
-
-	// wait for the routine to finish, or cancel it when context cancelled
-	var wg sync.WaitGroup
-	defer wg.Wait()
-	wg.Add(1)
+	ctx, stopWatch := m.watchContext(ctx)
+	defer stopWatch()
 
-	// if context is not cancelled, cancel the routine when execution is done, or panic
-	done := make(chan struct{}, 1)
-	defer close(done)
+	// trace calls for hooks and profiler, the programs are compiled with the calls traced
+	var (
+		tracer   *tracer
+		tracker  *budgetTracker
+		watchers []stepWatcher
+	)
+	if m.hooks != nil || m.profiler != nil {
+		tracer = newTracer(m.hooks, m.profiler)
+		tracer.attach(m.thread)
+		watchers = append(watchers, tracer)
+	}
 
-	go func() {
-		defer wg.Done()
-		select {
-		case <-ctx.Done():
-			m.thread.Cancel("context cancelled")
-		case <-done:
-			// No action if the script has finished
-		}
-	}()
+	// track resource usage against the budget
+	if !m.budget.IsUnlimited() {
+		tracker = newBudgetTracker(m.budget, m.thread)
+		tracker.attach(m.thread)
+		watchers = append(watchers, tracker)
+	}
+	// stop at breakpoints and steps for debugger
+	var session *debugSession
+	if m.debugger != nil {
+		session = newDebugSession(m.debugger, m.predeclared, m.getFileOptions(), func(name string) ([]byte, error) {
+			if name == scriptName {
+				return source, nil
+			}
+			return m.loadCache.readFile(name)
+		})
+		watchers = append(watchers, session)
+	}
+	steps := newStepDispatcher(watchers...)
+	steps.attach(m.thread)
 
 	// run with everything prepared
 	m.runTimes++
-	res, err := m.execStarlarkFile(scriptName, source, allowCache)
-	done <- struct{}{}
+	res, err := m.execStarlarkFile(scriptName, m.cacheSource(source), allowCache)
+	stopWatch()
+	steps.detach(m.thread)
+	if tracker != nil {
+		tracker.detach(m.thread)
+	}
+	if tracer != nil {
+		tracer.detach(m.thread)
+	}
 
 	// merge result as predeclared for next run
 	for k, v := range res {
 		m.predeclared[k] = v
 	}
+	m.recordUserGlobals(scriptName, source, res)
 
 	// handle result and convert
 	out = m.convertOutput(res)
-	if err != nil {
+	if tracker != nil && tracker.exceeded != nil {
+		// for exceeded budget, it may also happen after the script finished, e.g. the last print
+		err = errorStarletError("exec", tracker.exceeded)
+	} else if session != nil && session.aborted {
+		err = errorStarletError("exec", ErrDebugAborted)
+	} else if err != nil {
 		// for exit code
-		if err.Error() == goidiomatic.ErrSystemExit.Error() {
-			var exitCode uint8
-			if c := m.thread.Local("exit_code"); c != nil {
-				if co, ok := c.(uint8); ok {
-					exitCode = co
-				}
-			}
-			// exit code 0 means success
-			if exitCode == 0 {
-				err = nil
-			} else {
-				err = errorStarletErrorf("run", "exit code: %d", exitCode)
-			}
+		if isSystemExit(err) {
+			err = m.exitCodeError()
 		} else {
 			// wrap starlark errors
-			err = errorStarlarkError("exec", err)
+			err = errorStarlarkError("exec", err).withContext(ctx)
 		}
-		return out, err
 	}
-	return out, nil
+	return out, err
+}
+
+// isSystemExit returns true if the error is caused by exit() in the script, but not in the loaded modules.
+func isSystemExit(err error) bool {
+	var le loadError
+	return errors.Is(err, goidiomatic.ErrSystemExit) && !errors.As(err, &le)
+}
+
+// exitCodeError returns the error for the exit code set by exit() in the script, and nil for exit code 0 which means success.
+func (m *Machine) exitCodeError() error {
+	var exitCode uint8
+	if c := m.thread.Local("exit_code"); c != nil {
+		if co, ok := c.(uint8); ok {
+			exitCode = co
+		}
+	}
+	if exitCode == 0 {
+		return nil
+	}
+	return errorStarletExit(exitCode)
+}
+
+// watchContext sets the context to the thread, and cancels the thread once the context is done, until the returned function is called.
+// For nil context, or context already cancelled, a new one is used instead and returned.
+func (m *Machine) watchContext(ctx context.Context) (context.Context, func()) {
+	if ctx == nil || ctx.Err() != nil {
+		ctx = context.TODO()
+	}
+	m.thread.SetLocal("context", ctx)
+
+	// wait for the routine to finish, or cancel it when context cancelled
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+	)
+	wg.Add(1)
+	done := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			m.thread.Cancel("context cancelled")
+		case <-done:
+			// No action if the execution has finished
+		}
+	}()
+	return ctx, func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
 }
 
 // prepareThread prepares the thread for execution, including preset globals, preload modules and extras.
@@ -240,22 +278,7 @@ func (m *Machine) prepareThread(extras StringAnyMap) (err error) {
 		}
 
 		// cache load&read + printf -> thread
-		m.loadCache = &cache{
-			cache:    make(map[string]*entry),
-			execOpts: m.getFileOptions(),
-			loadMod:  m.lazyloadMods.GetLazyLoader(),
-			readFile: func(name string) ([]byte, error) {
-				return readScriptFile(name, m.scriptFS)
-			},
-			globals: m.predeclared,
-		}
-		m.thread = &starlark.Thread{
-			Name:  "starlet",
-			Print: m.printFunc,
-			Load: func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
-				return m.loadCache.Load(module)
-			},
-		}
+		m.initThread()
 	} else {
 		// -- for the second and following runs
 
@@ -266,15 +289,52 @@ func (m *Machine) prepareThread(extras StringAnyMap) (err error) {
 
 		// set globals for cache
 		m.loadCache.loadMod = m.lazyloadMods.GetLazyLoader()
+		m.loadCache.progCache = m.progCache
 		m.loadCache.globals = m.predeclared
 
 		// reset for each run
 		m.thread.Print = m.printFunc
 		m.thread.Uncancel()
 	}
+
+	// file system and policy for modules
+	sys := vfs.Host
+	if m.fileSys != nil {
+		if m.sandbox == nil {
+			m.sandbox = vfs.NewSandbox(m.fileSys)
+		}
+		sys = m.sandbox
+	}
+	vfs.SetThreadFS(m.thread, policy.GuardFS(sys, m.policy))
+	policy.SetThreadPolicy(m.thread, m.policy)
 	return nil
 }
 
+// initThread creates a new thread and load cache for the predeclared names, as the first run.
+func (m *Machine) initThread() {
+	m.loadCache = &cache{
+		cache:     make(map[string]*entry),
+		execOpts:  m.getFileOptions(),
+		progCache: m.progCache,
+		loadMod:   m.lazyloadMods.GetLazyLoader(),
+		readFile: func(name string) ([]byte, error) {
+			return readScriptFile(name, m.scriptFS)
+		},
+		globals: m.predeclared,
+	}
+	m.thread = &starlark.Thread{
+		Name:  "starlet",
+		Print: m.printFunc,
+		Load: func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+			d, err := m.loadCache.Load(thread, module)
+			if err != nil {
+				return nil, loadError{module: module, cause: err}
+			}
+			return d, nil
+		},
+	}
+}
+
 // Reset resets the machine to initial state before the first run.
 // Attention: It does not reset the compiled program cache.
 func (m *Machine) Reset() {
@@ -282,6 +342,9 @@ func (m *Machine) Reset() {
 	m.thread = nil
 	m.loadCache = nil
 	m.predeclared = nil
+	m.sandbox = nil
+	m.userNames = nil
+	m.funcSources = nil
 }
 
 // convertInput converts a StringAnyMap to a starlark.StringDict, usually for output variable.
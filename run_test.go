@@ -429,6 +429,12 @@ f = 6
 `), nil)
 	out, err = m.Run()
 	expectErr(t, err, `starlet: run: exit code: 1`)
+	var ee starlet.ExitError
+	if !errors.As(err, &ee) {
+		t.Errorf("expected ExitError, got %T", err)
+	} else if ee.ExitCode() != 1 {
+		t.Errorf("expected exit code 1, got %d", ee.ExitCode())
+	}
 	if out == nil {
 		t.Errorf("unexpected nil output")
 	} else if out["e"].(int64) != int64(5) {
@@ -445,6 +451,11 @@ h = 8
 `), nil)
 	out, err = m.Run()
 	expectErr(t, err, `starlet: run: exit code: 2`)
+	if !errors.As(err, &ee) {
+		t.Errorf("expected ExitError, got %T", err)
+	} else if ee.ExitCode() != 2 {
+		t.Errorf("expected exit code 2, got %d", ee.ExitCode())
+	}
 	if out == nil {
 		t.Errorf("unexpected nil output")
 	} else if out["g"].(int64) != int64(7) {
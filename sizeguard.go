@@ -0,0 +1,179 @@
+package starlet
+
+import (
+	"math"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Names of the predeclared builtins for the operators guarded by the operator result size limit.
+// They're not valid identifiers, so scripts can't reference or override them.
+const (
+	guardNameAdd  = "$add"
+	guardNameMul  = "$mul"
+	guardNameIAdd = "$iadd"
+	guardNameIMul = "$imul"
+)
+
+// sizeGuards are the builtins called by the guarded programs instead of the repetition and concatenation operators.
+var sizeGuards = starlark.StringDict{
+	guardNameAdd:  starlark.NewBuiltin("+", guardBinary(syntax.PLUS)),
+	guardNameMul:  starlark.NewBuiltin("*", guardBinary(syntax.STAR)),
+	guardNameIAdd: starlark.NewBuiltin("+=", guardOperand(syntax.PLUS)),
+	guardNameIMul: starlark.NewBuiltin("*=", guardOperand(syntax.STAR)),
+}
+
+// isSizeGuarded returns true if the programs executed by the thread should be guarded by the operator result size limit.
+func isSizeGuarded(thread *starlark.Thread) bool {
+	t, _ := thread.Local(localBudgetTracker).(*budgetTracker)
+	return t != nil && t.budget.MaxOperatorResultSize > 0
+}
+
+// isSizeGuardName returns true if the name is of the guard builtins.
+func isSizeGuardName(name string) bool {
+	_, ok := sizeGuards[name]
+	return ok
+}
+
+// guardBinary returns the implementation of the guarded binary operator, which checks the size of the result before computing it.
+func guardBinary(op syntax.Token) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+	return func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+		x, y := args[0], args[1]
+		if err := checkResultSize(thread, op, x, y); err != nil {
+			return nil, err
+		}
+		return starlark.Binary(op, x, y)
+	}
+}
+
+// guardOperand returns the implementation of the guarded augmented assignment, which checks the size of the result and returns the right operand as it is.
+func guardOperand(op syntax.Token) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+	return func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+		x, y := args[0], args[1]
+		if err := checkResultSize(thread, op, x, y); err != nil {
+			return nil, err
+		}
+		return y, nil
+	}
+}
+
+// checkResultSize checks the size of the sequence resulting from the repetition or concatenation against the budget of the thread.
+func checkResultSize(thread *starlark.Thread, op syntax.Token, x, y starlark.Value) error {
+	t, _ := thread.Local(localBudgetTracker).(*budgetTracker)
+	if t == nil || t.budget.MaxOperatorResultSize == 0 {
+		return nil
+	}
+
+	var size uint64
+	switch op {
+	case syntax.PLUS:
+		lx, ly := starlark.Len(x), starlark.Len(y)
+		if lx < 0 || ly < 0 {
+			return nil
+		}
+		size = uint64(lx) + uint64(ly)
+	case syntax.STAR:
+		if _, ok := x.(starlark.Int); ok {
+			x, y = y, x
+		}
+		n, ok := y.(starlark.Int)
+		l := starlark.Len(x)
+		if !ok || l <= 0 || n.Sign() <= 0 {
+			return nil
+		}
+		if c, ok := n.Uint64(); !ok || c > math.MaxUint64/uint64(l) {
+			size = math.MaxUint64
+		} else {
+			size = c * uint64(l)
+		}
+	}
+	if size > t.budget.MaxOperatorResultSize {
+		t.abort(thread, ErrExceedMaxOperatorResult, t.budget.MaxOperatorResultSize)
+		return t.exceeded
+	}
+	return nil
+}
+
+// guardFile rewrites the repetition and concatenation operators in the syntax tree into calls of the guard builtins.
+// The calls are at the same positions as the operators, so the positions in errors and backtraces are unchanged.
+func guardFile(f *syntax.File) {
+	r := &syntaxRewriter{expr: guardExpr, assign: guardAssign}
+	r.stmts(f.Stmts)
+}
+
+// guardExpr returns the call of the guard builtin for the repetition and concatenation operators, or the expression as it is for others.
+func guardExpr(expr syntax.Expr) syntax.Expr {
+	if e, ok := expr.(*syntax.BinaryExpr); ok {
+		switch e.Op {
+		case syntax.PLUS:
+			return guardCall(guardNameAdd, e.OpPos, e, e.X, e.Y)
+		case syntax.STAR:
+			return guardCall(guardNameMul, e.OpPos, e, e.X, e.Y)
+		}
+	}
+	return expr
+}
+
+// guardAssign checks the operand of the augmented assignment by the guard builtin.
+// x += y is in-place for lists, so only the operand is checked, and the left side is evaluated twice if it has no side effects.
+func guardAssign(s *syntax.AssignStmt) {
+	if name := augmentedGuard(s.Op); name != "" && isPureExpr(s.LHS) {
+		s.RHS = guardCall(name, s.OpPos, s.RHS, cloneExpr(s.LHS), s.RHS)
+	}
+}
+
+// guardCall returns the call of the guard builtin at the position, and ends where the original expression ends.
+func guardCall(name string, pos syntax.Position, orig syntax.Expr, args ...syntax.Expr) *syntax.CallExpr {
+	_, end := orig.Span()
+	return &syntax.CallExpr{
+		Fn:     &syntax.Ident{NamePos: pos, Name: name},
+		Lparen: pos,
+		Args:   args,
+		Rparen: end,
+	}
+}
+
+// augmentedGuard returns the name of the guard builtin for the augmented assignment operator, or empty for others.
+func augmentedGuard(op syntax.Token) string {
+	switch op {
+	case syntax.PLUS_EQ:
+		return guardNameIAdd
+	case syntax.STAR_EQ:
+		return guardNameIMul
+	}
+	return ""
+}
+
+// isPureExpr returns true if evaluating the expression has no side effects, so it can be evaluated again.
+func isPureExpr(expr syntax.Expr) bool {
+	switch e := expr.(type) {
+	case *syntax.Ident, *syntax.Literal:
+		return true
+	case *syntax.DotExpr:
+		return isPureExpr(e.X)
+	case *syntax.IndexExpr:
+		return isPureExpr(e.X) && isPureExpr(e.Y)
+	case *syntax.ParenExpr:
+		return isPureExpr(e.X)
+	}
+	return false
+}
+
+// cloneExpr returns a copy of the pure expression, as the syntax tree can't share nodes.
+func cloneExpr(expr syntax.Expr) syntax.Expr {
+	switch e := expr.(type) {
+	case *syntax.Ident:
+		return &syntax.Ident{NamePos: e.NamePos, Name: e.Name}
+	case *syntax.Literal:
+		c := *e
+		return &c
+	case *syntax.DotExpr:
+		return &syntax.DotExpr{X: cloneExpr(e.X), Dot: e.Dot, NamePos: e.NamePos, Name: cloneExpr(e.Name).(*syntax.Ident)}
+	case *syntax.IndexExpr:
+		return &syntax.IndexExpr{X: cloneExpr(e.X), Lbrack: e.Lbrack, Y: cloneExpr(e.Y), Rbrack: e.Rbrack}
+	case *syntax.ParenExpr:
+		return &syntax.ParenExpr{Lparen: e.Lparen, X: cloneExpr(e.X), Rparen: e.Rparen}
+	}
+	return expr
+}
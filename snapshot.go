@@ -0,0 +1,452 @@
+package starlet
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/1set/starlet/dataconv"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+const (
+	// snapshotVersion is the version of the snapshot format.
+	snapshotVersion = 1
+	// snapshotMaxDepth is the maximum nesting depth of values in the snapshot, to detect cyclic values.
+	snapshotMaxDepth = 256
+)
+
+// machineSnapshot is the serialized state of a Machine.
+type machineSnapshot struct {
+	Version int                       `json:"version"`
+	Runs    uint                      `json:"runs"`
+	Globals map[string]*snapshotValue `json:"globals"`
+}
+
+// snapshotValue is the serialized form of a Starlark value.
+type snapshotValue struct {
+	Type   string                    `json:"type"`
+	Value  string                    `json:"value,omitempty"`
+	Name   string                    `json:"name,omitempty"`
+	Items  []*snapshotValue          `json:"items,omitempty"`
+	Fields map[string]*snapshotValue `json:"fields,omitempty"`
+	File   string                    `json:"file,omitempty"`
+	Line   int32                     `json:"line,omitempty"`
+	Source string                    `json:"source,omitempty"`
+}
+
+// funcSource is the source of a function defined at the top level of a script, keyed by the function name for restoring it from the snapshot.
+// For the functions defined by runs, the source is extracted from the script only when the snapshot is taken, so runs don't parse the scripts again.
+type funcSource struct {
+	fn     *starlark.Function
+	script string
+	source string
+}
+
+// getSource returns the source of the function, and extracts it from the script if needed.
+func (s funcSource) getSource(opts *syntax.FileOptions) (string, bool) {
+	if s.script == "" {
+		return s.source, s.source != ""
+	}
+	file, err := opts.Parse(s.fn.Position().Filename(), s.script, 0)
+	if err != nil {
+		return "", false
+	}
+	return extractFuncSource(file, s.script, s.fn)
+}
+
+// Snapshot serializes the global variables defined by the scripts in previous runs to bytes, which can be restored by Restore.
+// Only the names assigned by the scripts are included, the global variables, preload modules and extras set by the host are expected to be set again before restoring.
+//
+// Supported values are None, bool, int, float, string, bytes, list, tuple, dict, set, struct and SharedDict, and the nesting of them.
+// Functions are supported only if they're defined by def statements at the top level of the scripts, and they're saved as references to their source code.
+// It returns an error if any of the values is not supported.
+func (m *Machine) Snapshot() ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	snap := machineSnapshot{
+		Version: snapshotVersion,
+		Runs:    m.runTimes,
+		Globals: make(map[string]*snapshotValue, len(m.userNames)),
+	}
+	for name := range m.userNames {
+		v, ok := m.predeclared[name]
+		if !ok {
+			continue
+		}
+		sv, err := m.encodeSnapshotValue(v, 0)
+		if err != nil {
+			return nil, errorStarletErrorf("snapshot", "global %q: %v", name, err)
+		}
+		snap.Globals[name] = sv
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return nil, errorStarletError("snapshot", err)
+	}
+	return b, nil
+}
+
+// Restore resets the machine and rebuilds the global variables from the bytes created by Snapshot, so that following runs continue from the state of the snapshot.
+// The global variables and preload modules of the machine are loaded first as the first run, and then overridden by the restored ones.
+// Restored values are not frozen, and functions are recreated by executing their def statements along with the load statements of their source files.
+func (m *Machine) Restore(data []byte) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = errorStarlarkPanic("restore", r)
+		}
+	}()
+
+	// parse the snapshot
+	var snap machineSnapshot
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return errorStarletError("restore", err)
+	}
+	if snap.Version != snapshotVersion {
+		return errorStarletErrorf("restore", "unsupported snapshot version: %d", snap.Version)
+	}
+
+	// start over with the global variables and preload modules
+	m.Reset()
+	if err = m.prepareThread(nil); err != nil {
+		return err
+	}
+	m.userNames = make(map[string]struct{}, len(snap.Globals))
+	m.funcSources = make(map[string]funcSource)
+	m.thread.Print = NoopPrintFunc
+
+	// restore data first, and use placeholders for functions, so functions can refer to any restored names
+	names := make([]string, 0, len(snap.Globals))
+	for name := range snap.Globals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var funcNames []string
+	for _, name := range names {
+		sv := snap.Globals[name]
+		if sv == nil {
+			return errorStarletErrorf("restore", "global %q: missing value", name)
+		}
+		if sv.Type == "function" {
+			funcNames = append(funcNames, name)
+			m.predeclared[name] = starlark.None
+			continue
+		}
+		v, err := decodeSnapshotValue(sv, 0)
+		if err != nil {
+			return errorStarletErrorf("restore", "global %q: %v", name, err)
+		}
+		m.predeclared[name] = v
+		m.userNames[name] = struct{}{}
+	}
+
+	// restore functions from their sources
+	for _, name := range funcNames {
+		sv := snap.Globals[name]
+		fn, err := m.restoreFunction(sv)
+		if err != nil {
+			return errorStarletErrorf("restore", "global %q: %v", name, err)
+		}
+		m.predeclared[name] = fn
+		m.userNames[name] = struct{}{}
+		m.funcSources[fn.Name()] = funcSource{fn: fn, source: sv.Source}
+	}
+
+	m.thread.Print = m.printFunc
+	m.runTimes = snap.Runs
+	return nil
+}
+
+// recordUserGlobals records the names assigned by the script of a run, and the script of the functions defined by it for extracting their sources later.
+func (m *Machine) recordUserGlobals(filename string, source []byte, res starlark.StringDict) {
+	if m.userNames == nil {
+		m.userNames = make(map[string]struct{})
+	}
+	if m.funcSources == nil {
+		m.funcSources = make(map[string]funcSource)
+	}
+	var script string
+	for name, v := range res {
+		m.userNames[name] = struct{}{}
+
+		// for functions defined in the script
+		fn, ok := v.(*starlark.Function)
+		if !ok || fn.Position().Filename() != filename {
+			continue
+		}
+		if script == "" {
+			script = string(source)
+		}
+		m.funcSources[fn.Name()] = funcSource{fn: fn, script: script}
+	}
+}
+
+// extractFuncSource returns the source of the top-level def statement of the function along with the load statements in the file.
+// Other lines are blanked out, so the positions in the extracted source remain the same as the original.
+func extractFuncSource(file *syntax.File, source string, fn *starlark.Function) (string, bool) {
+	lines := strings.SplitAfter(source, "\n")
+	keep := make([]bool, len(lines))
+	mark := func(stmt syntax.Stmt) {
+		start, end := stmt.Span()
+		for l := start.Line; l <= end.Line && int(l) <= len(lines); l++ {
+			keep[l-1] = true
+		}
+	}
+	found := false
+	for _, stmt := range file.Stmts {
+		switch s := stmt.(type) {
+		case *syntax.LoadStmt:
+			mark(s)
+		case *syntax.DefStmt:
+			if s.Name.Name == fn.Name() && s.Def.Line == fn.Position().Line {
+				mark(s)
+				found = true
+			}
+		}
+	}
+	if !found {
+		return "", false
+	}
+	var sb strings.Builder
+	for i, l := range lines {
+		if keep[i] {
+			sb.WriteString(l)
+		} else if strings.HasSuffix(l, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String(), true
+}
+
+// restoreFunction recreates the function from its source in the snapshot.
+func (m *Machine) restoreFunction(sv *snapshotValue) (*starlark.Function, error) {
+	if sv.Source == "" || sv.Name == "" {
+		return nil, fmt.Errorf("missing source of function")
+	}
+	g, err := starlark.ExecFileOptions(m.getFileOptions(), m.thread, sv.File, sv.Source, m.predeclared)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := g[sv.Name].(*starlark.Function)
+	if !ok {
+		return nil, fmt.Errorf("function %s not found in source", sv.Name)
+	}
+	return fn, nil
+}
+
+// encodeSnapshotValue converts the Starlark value into the serialized form.
+func (m *Machine) encodeSnapshotValue(v starlark.Value, depth int) (*snapshotValue, error) {
+	if depth > snapshotMaxDepth {
+		return nil, fmt.Errorf("nesting too deep or cyclic value")
+	}
+	encodeAll := func(typ string, it starlark.Iterable) (*snapshotValue, error) {
+		sv := &snapshotValue{Type: typ}
+		iter := it.Iterate()
+		defer iter.Done()
+		var x starlark.Value
+		for iter.Next(&x) {
+			e, err := m.encodeSnapshotValue(x, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			sv.Items = append(sv.Items, e)
+		}
+		return sv, nil
+	}
+
+	switch x := v.(type) {
+	case starlark.NoneType:
+		return &snapshotValue{Type: "none"}, nil
+	case starlark.Bool:
+		return &snapshotValue{Type: "bool", Value: strconv.FormatBool(bool(x))}, nil
+	case starlark.Int:
+		return &snapshotValue{Type: "int", Value: x.String()}, nil
+	case starlark.Float:
+		return &snapshotValue{Type: "float", Value: strconv.FormatFloat(float64(x), 'g', -1, 64)}, nil
+	case starlark.String:
+		return &snapshotValue{Type: "string", Value: string(x)}, nil
+	case starlark.Bytes:
+		return &snapshotValue{Type: "bytes", Value: base64.StdEncoding.EncodeToString([]byte(x))}, nil
+	case *starlark.List:
+		return encodeAll("list", x)
+	case starlark.Tuple:
+		return encodeAll("tuple", x)
+	case *starlark.Set:
+		return encodeAll("set", x)
+	case *starlark.Dict:
+		sv := &snapshotValue{Type: "dict"}
+		for _, kv := range x.Items() {
+			for _, e := range kv {
+				ev, err := m.encodeSnapshotValue(e, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				sv.Items = append(sv.Items, ev)
+			}
+		}
+		return sv, nil
+	case *dataconv.SharedDict:
+		d, err := x.CloneDict()
+		if err != nil {
+			return nil, err
+		}
+		sv, err := m.encodeSnapshotValue(d, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return &snapshotValue{Type: "shared_dict", Name: x.Type(), Items: sv.Items}, nil
+	case *starlarkstruct.Struct:
+		sv := &snapshotValue{Type: "struct", Fields: make(map[string]*snapshotValue)}
+		if c, ok := x.Constructor().(starlark.String); ok {
+			sv.Name = string(c)
+		} else {
+			return nil, fmt.Errorf("unsupported struct constructor: %s", x.Constructor().Type())
+		}
+		for _, name := range x.AttrNames() {
+			f, err := x.Attr(name)
+			if err != nil {
+				return nil, err
+			}
+			fv, err := m.encodeSnapshotValue(f, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			sv.Fields[name] = fv
+		}
+		return sv, nil
+	case *starlark.Function:
+		if depth == 0 {
+			if fs, ok := m.funcSources[x.Name()]; ok && fs.fn == x {
+				if src, ok := fs.getSource(m.getFileOptions()); ok {
+					pos := x.Position()
+					return &snapshotValue{Type: "function", Name: x.Name(), File: pos.Filename(), Line: pos.Line, Source: src}, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("unsupported function %s: only top-level def statements can be saved", x.Name())
+	}
+	return nil, fmt.Errorf("unsupported type: %s", v.Type())
+}
+
+// decodeSnapshotValue converts the serialized form back to the Starlark value.
+func decodeSnapshotValue(sv *snapshotValue, depth int) (starlark.Value, error) {
+	if sv == nil {
+		return nil, fmt.Errorf("missing value")
+	}
+	if depth > snapshotMaxDepth {
+		return nil, fmt.Errorf("nesting too deep")
+	}
+	decodeAll := func() ([]starlark.Value, error) {
+		vs := make([]starlark.Value, 0, len(sv.Items))
+		for _, e := range sv.Items {
+			v, err := decodeSnapshotValue(e, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			vs = append(vs, v)
+		}
+		return vs, nil
+	}
+	decodeDict := func() (*starlark.Dict, error) {
+		vs, err := decodeAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(vs)%2 != 0 {
+			return nil, fmt.Errorf("odd number of dict items")
+		}
+		d := starlark.NewDict(len(vs) / 2)
+		for i := 0; i < len(vs); i += 2 {
+			if err := d.SetKey(vs[i], vs[i+1]); err != nil {
+				return nil, err
+			}
+		}
+		return d, nil
+	}
+
+	switch sv.Type {
+	case "none":
+		return starlark.None, nil
+	case "bool":
+		b, err := strconv.ParseBool(sv.Value)
+		if err != nil {
+			return nil, err
+		}
+		return starlark.Bool(b), nil
+	case "int":
+		i, ok := new(big.Int).SetString(sv.Value, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid int: %q", sv.Value)
+		}
+		return starlark.MakeBigInt(i), nil
+	case "float":
+		f, err := strconv.ParseFloat(sv.Value, 64)
+		if err != nil {
+			return nil, err
+		}
+		return starlark.Float(f), nil
+	case "string":
+		return starlark.String(sv.Value), nil
+	case "bytes":
+		b, err := base64.StdEncoding.DecodeString(sv.Value)
+		if err != nil {
+			return nil, err
+		}
+		return starlark.Bytes(b), nil
+	case "list":
+		vs, err := decodeAll()
+		if err != nil {
+			return nil, err
+		}
+		return starlark.NewList(vs), nil
+	case "tuple":
+		vs, err := decodeAll()
+		if err != nil {
+			return nil, err
+		}
+		return starlark.Tuple(vs), nil
+	case "set":
+		vs, err := decodeAll()
+		if err != nil {
+			return nil, err
+		}
+		s := starlark.NewSet(len(vs))
+		for _, v := range vs {
+			if err := s.Insert(v); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case "dict":
+		return decodeDict()
+	case "shared_dict":
+		d, err := decodeDict()
+		if err != nil {
+			return nil, err
+		}
+		sd := dataconv.NewSharedDictFromDict(d)
+		sd.SetTypeName(sv.Name)
+		return sd, nil
+	case "struct":
+		fields := make(starlark.StringDict, len(sv.Fields))
+		for name, f := range sv.Fields {
+			v, err := decodeSnapshotValue(f, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			fields[name] = v
+		}
+		return starlarkstruct.FromStringDict(starlark.String(sv.Name), fields), nil
+	}
+	return nil, fmt.Errorf("unsupported type: %s", sv.Type)
+}
@@ -0,0 +1,194 @@
+package starlet_test
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/1set/starlet"
+	"github.com/1set/starlet/dataconv"
+	"go.starlark.net/starlark"
+)
+
+func TestMachine_Snapshot_Restore(t *testing.T) {
+	fsys := fstest.MapFS{
+		"lib.star": {Data: []byte("def double(x):\n    return x * 2\n")},
+	}
+	shared := dataconv.NewNamedSharedDict("store")
+	_ = shared.SetKey(starlark.String("count"), starlark.MakeInt(1))
+
+	// run a few steps
+	m := starlet.NewWithNames(starlet.StringAnyMap{"factor": 10}, []string{"struct"}, nil)
+	steps := []string{
+		`
+load("lib.star", "double")
+a = 1
+b = [1, 2.5, "three", b"four", None, True, (5, 6)]
+c = {"x": set([1, 2]), 2: [3], "t": (1, 2)}
+big = 1 << 100
+
+def scale(n):
+    return double(n) * factor + a
+`,
+		`
+s = struct(name="alice", tags=["a", "b"])
+d = shared
+x = scale(3)
+`,
+	}
+	for i, code := range steps {
+		m.SetScript("step.star", []byte(code), fsys)
+		if _, err := m.RunWithContext(nil, starlet.StringAnyMap{"shared": shared}); err != nil {
+			t.Errorf("step %d: expected no error, got %v", i, err)
+			return
+		}
+	}
+	data, err := m.Snapshot()
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	for _, s := range []string{`"factor":`, `"shared":`, `"struct":`} {
+		if strings.Contains(string(data), s) {
+			t.Errorf("expected host-provided %s not in snapshot: %s", s, data)
+		}
+	}
+
+	// restore on another machine with the same settings
+	n := starlet.NewWithNames(starlet.StringAnyMap{"factor": 10}, []string{"struct"}, nil)
+	n.SetScript("step.star", []byte(`
+y = scale(5)
+b2 = len(b[3]) == 4 and b[3] == b"four"
+has = c["t"] == (1, 2) and 2 in c["x"] and c[2] == [3]
+d["count"] += 1
+name = s.name
+`), fsys)
+	if err := n.Restore(data); err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	out, err := n.Run()
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	exp := starlet.StringAnyMap{
+		"y":    int64(101),
+		"b2":   true,
+		"has":  true,
+		"name": "alice",
+	}
+	for k, v := range exp {
+		if act := out[k]; act != v {
+			t.Errorf("expected %s=%v, got %v (%T)", k, v, act, act)
+		}
+	}
+	pd := n.GetStarlarkPredeclared()
+	if v := pd["big"].String(); v != "1267650600228229401496703205376" {
+		t.Errorf("unexpected big: %s", v)
+	}
+	if v := pd["d"]; v.Type() != "store" || v.String() != `store({"count": 2})` {
+		t.Errorf("unexpected shared dict: %s", v)
+	}
+	if v := pd["x"].String(); v != "61" {
+		t.Errorf("unexpected x: %s", v)
+	}
+
+	// snapshot again from the restored one
+	if _, err := n.Snapshot(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestMachine_Snapshot_Unsupported(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   string
+		errMsg string
+	}{
+		{
+			name:   "lambda",
+			code:   `f = lambda x: x`,
+			errMsg: `starlet: snapshot: global "f": unsupported function lambda: only top-level def statements can be saved`,
+		},
+		{
+			name: "nested function",
+			code: `
+def outer():
+    def inner():
+        pass
+    return inner
+f = outer()
+`,
+			errMsg: `starlet: snapshot: global "f": unsupported function inner: only top-level def statements can be saved`,
+		},
+		{
+			name:   "function in list",
+			code:   "def f():\n    pass\nl = [f]",
+			errMsg: `starlet: snapshot: global "l": unsupported function f: only top-level def statements can be saved`,
+		},
+		{
+			name:   "builtin",
+			code:   `l = [len]`,
+			errMsg: `starlet: snapshot: global "l": unsupported type: builtin_function_or_method`,
+		},
+		{
+			name:   "cyclic",
+			code:   "l = [1]\nl.append(l)",
+			errMsg: `starlet: snapshot: global "l": nesting too deep or cyclic value`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := starlet.NewDefault()
+			m.SetScript("test.star", []byte(tt.code), nil)
+			if _, err := m.Run(); err != nil {
+				t.Errorf("expected no error, got %v", err)
+				return
+			}
+			_, err := m.Snapshot()
+			expectErr(t, err, tt.errMsg)
+		})
+	}
+}
+
+func TestMachine_Restore_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		errMsg string
+	}{
+		{
+			name:   "invalid json",
+			data:   `{`,
+			errMsg: `starlet: restore: unexpected end of JSON input`,
+		},
+		{
+			name:   "wrong version",
+			data:   `{"version": 99}`,
+			errMsg: `starlet: restore: unsupported snapshot version: 99`,
+		},
+		{
+			name:   "invalid value",
+			data:   `{"version": 1, "globals": {"a": {"type": "int", "value": "abc"}}}`,
+			errMsg: `starlet: restore: global "a": invalid int: "abc"`,
+		},
+		{
+			name:   "unknown type",
+			data:   `{"version": 1, "globals": {"a": {"type": "object"}}}`,
+			errMsg: `starlet: restore: global "a": unsupported type: object`,
+		},
+		{
+			name:   "missing function",
+			data:   `{"version": 1, "globals": {"f": {"type": "function", "name": "f", "file": "a.star", "source": "def g():\n    pass\n"}}}`,
+			errMsg: `starlet: restore: global "f": function f not found in source`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := starlet.NewDefault()
+			err := m.Restore([]byte(tt.data))
+			expectErr(t, err, tt.errMsg)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package starlet
+
+import (
+	"math"
+
+	"go.starlark.net/starlark"
+)
+
+// stepWatcher is notified when the Starlark thread reaches the step count it asks for.
+type stepWatcher interface {
+	// nextStep returns the absolute step count of the thread for the first notification.
+	nextStep(steps uint64) uint64
+	// onStep is called when the thread reaches the requested step count, and returns the step count for the next notification.
+	onStep(thread *starlark.Thread, steps uint64) uint64
+}
+
+// stepDispatcher shares the step limit of the Starlark thread among multiple watchers, e.g. budget tracker and tracer.
+type stepDispatcher struct {
+	watchers []stepWatcher
+	nexts    []uint64
+}
+
+// newStepDispatcher creates a dispatcher for the given watchers.
+func newStepDispatcher(watchers ...stepWatcher) *stepDispatcher {
+	return &stepDispatcher{
+		watchers: watchers,
+		nexts:    make([]uint64, len(watchers)),
+	}
+}
+
+// attach sets up the step limit of the thread for the watchers.
+func (d *stepDispatcher) attach(thread *starlark.Thread) {
+	steps := thread.ExecutionSteps()
+	for i, w := range d.watchers {
+		d.nexts[i] = w.nextStep(steps)
+	}
+	thread.OnMaxSteps = d.onMaxSteps
+	thread.SetMaxExecutionSteps(d.minNext())
+}
+
+// detach removes the step limit of the thread.
+func (d *stepDispatcher) detach(thread *starlark.Thread) {
+	thread.OnMaxSteps = nil
+	thread.SetMaxExecutionSteps(math.MaxUint64)
+}
+
+// onMaxSteps notifies the watchers reaching their step counts, and sets the step limit for the next notification.
+func (d *stepDispatcher) onMaxSteps(thread *starlark.Thread) {
+	steps := thread.ExecutionSteps()
+	for i, w := range d.watchers {
+		if steps >= d.nexts[i] {
+			d.nexts[i] = w.onStep(thread, steps)
+		}
+	}
+	thread.SetMaxExecutionSteps(d.minNext())
+}
+
+// minNext returns the nearest step count requested by the watchers.
+func (d *stepDispatcher) minNext() uint64 {
+	next := uint64(math.MaxUint64)
+	for _, n := range d.nexts {
+		if n < next {
+			next = n
+		}
+	}
+	return next
+}
@@ -0,0 +1,326 @@
+package starlet
+
+import (
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+const (
+	// traceNameCall is the name of the predeclared builtin which the callees are passed through in the traced programs.
+	// It's not a valid identifier, so scripts can't reference or override it.
+	traceNameCall = "$trace"
+	// localTracer is the thread local key of the tracer for the run.
+	localTracer = "starlet_tracer"
+)
+
+// traceCall is the builtin called by the traced programs with the callee of each call, it returns the callee traced by the tracer of the thread if it's a builtin.
+var traceCall = starlark.NewBuiltin(traceNameCall, func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+	fn := args[0]
+	t, _ := thread.Local(localTracer).(*tracer)
+	if b, ok := fn.(*starlark.Builtin); ok && t != nil {
+		return t.wrapBuiltin(b), nil
+	}
+	return fn, nil
+})
+
+// isCallTraced returns true if the programs executed by the thread should be compiled with the calls traced.
+func isCallTraced(thread *starlark.Thread) bool {
+	t, _ := thread.Local(localTracer).(*tracer)
+	return t != nil
+}
+
+// traceFile rewrites the calls in the syntax tree to pass the callees through the trace builtin, i.e. f(x) into $trace(f)(x).
+// The calls of the trace builtin are at the same positions as the original calls, so the positions in errors and backtraces are unchanged.
+func traceFile(f *syntax.File) {
+	r := &syntaxRewriter{expr: traceExpr}
+	r.stmts(f.Stmts)
+}
+
+// traceExpr passes the callee of the call expression through the trace builtin, or returns the expression as it is for others.
+func traceExpr(expr syntax.Expr) syntax.Expr {
+	if e, ok := expr.(*syntax.CallExpr); ok {
+		e.Fn = &syntax.CallExpr{
+			Fn:     &syntax.Ident{NamePos: e.Lparen, Name: traceNameCall},
+			Lparen: e.Lparen,
+			Args:   []syntax.Expr{e.Fn},
+			Rparen: e.Lparen,
+		}
+	}
+	return expr
+}
+
+// Hooks defines the callbacks for tracing the execution of scripts run by Machine, and all of them are optional.
+// The callbacks are called synchronously on the goroutine running the script, so they should return quickly.
+//
+// Since it observes every execution step of the script to find function calls, the execution is noticeably slower with hooks set.
+//
+// The builtin calls are traced at the call sites, as the script and the modules it loads are compiled with each callee passed through the tracer,
+// so all the builtins including the universal ones like len and range and the methods like list.append are traced, and the values are left as they are.
+// The calls in functions compiled without tracing, e.g. defined by the previous runs without hooks, are not traced,
+// and the execution steps counted for the budget include the ones for tracing.
+type Hooks struct {
+	// OnCallEnter is called when a Starlark function or a builtin calling back Starlark code is entered.
+	OnCallEnter func(ev CallEvent)
+	// OnCallExit is called when the function entered is returned, with the duration of the call.
+	OnCallExit func(ev CallEvent)
+	// OnBuiltin is called when a builtin function or method called by the script returns, with the duration and the error.
+	OnBuiltin func(ev BuiltinEvent)
+	// OnLoad is called when a module is loaded by load() in the script, with the duration and the error.
+	OnLoad func(ev LoadEvent)
+	// OnPrint is called when the script prints a message by print().
+	OnPrint func(ev PrintEvent)
+}
+
+// CallEvent describes a function call observed by the hooks.
+type CallEvent struct {
+	// Name is the name of the function, e.g. "<toplevel>" for the top level of the script.
+	Name string
+	// Pos is the position of the function definition, and it's invalid for builtins.
+	Pos syntax.Position
+	// Depth is the depth of the call in the call stack, and it's 0 for the top level of the script.
+	Depth int
+	// Duration is the time spent in the call, it's only set for the exit events.
+	Duration time.Duration
+}
+
+// BuiltinEvent describes a builtin function call observed by the hooks.
+type BuiltinEvent struct {
+	// Name is the name of the builtin function.
+	Name string
+	// Pos is the position of the call site in the script.
+	Pos syntax.Position
+	// Duration is the time spent in the builtin function.
+	Duration time.Duration
+	// Err is the error returned by the builtin function.
+	Err error
+}
+
+// LoadEvent describes a module loading observed by the hooks.
+type LoadEvent struct {
+	// Module is the name of the module to load.
+	Module string
+	// Duration is the time spent in loading the module.
+	Duration time.Duration
+	// Err is the error of loading the module.
+	Err error
+}
+
+// PrintEvent describes a message printed by the script.
+type PrintEvent struct {
+	// Message is the printed message, without the trailing newline.
+	Message string
+	// Pos is the position of the print() call in the script.
+	Pos syntax.Position
+}
+
+// tracer observes each execution step of the Starlark thread to find function calls, and dispatches them to the hooks and the profiler.
+type tracer struct {
+	hooks     Hooks
+	profiler  *Profiler
+	active    bool
+	stack     []*traceFrame
+	last      time.Time
+	excluded  time.Duration
+	printFunc PrintFunc
+	loadFunc  func(thread *starlark.Thread, module string) (starlark.StringDict, error)
+}
+
+// traceFrame is a frame in the shadow call stack maintained by the tracer.
+type traceFrame struct {
+	fn    starlark.Callable
+	name  string
+	pos   syntax.Position
+	start time.Time
+	prof  *profFunc
+}
+
+// newTracer creates a tracer for the hooks and the profiler, either of them can be nil.
+func newTracer(hooks *Hooks, profiler *Profiler) *tracer {
+	t := &tracer{profiler: profiler}
+	if hooks != nil {
+		t.hooks = *hooks
+	}
+	return t
+}
+
+// attach wraps the print and load functions of the thread, and starts tracing.
+func (t *tracer) attach(thread *starlark.Thread) {
+	t.active = true
+	t.last = time.Now()
+	thread.SetLocal(localTracer, t)
+
+	// wrap print function
+	t.printFunc = thread.Print
+	if t.hooks.OnPrint != nil {
+		print := thread.Print
+		thread.Print = func(th *starlark.Thread, msg string) {
+			if t.active {
+				t.hooks.OnPrint(PrintEvent{Message: msg, Pos: callerPosition(th)})
+			}
+			if print != nil {
+				print(th, msg)
+			} else {
+				defaultPrint(th, msg)
+			}
+		}
+	}
+
+	// wrap load function
+	t.loadFunc = thread.Load
+	if load := thread.Load; load != nil {
+		thread.Load = func(th *starlark.Thread, module string) (starlark.StringDict, error) {
+			start := time.Now()
+			d, err := load(th, module)
+			if t.active && t.hooks.OnLoad != nil {
+				t.hooks.OnLoad(LoadEvent{Module: module, Duration: time.Since(start), Err: err})
+			}
+			return d, err
+		}
+	}
+}
+
+// detach exits all the frames left, restores the print and load functions of the thread, and stops tracing.
+func (t *tracer) detach(thread *starlark.Thread) {
+	now := time.Now()
+	t.sample(now)
+	t.popTo(0, now)
+	thread.Print = t.printFunc
+	thread.Load = t.loadFunc
+	thread.SetLocal(localTracer, nil)
+	t.active = false
+}
+
+// nextStep returns the next step count to observe, i.e. every step.
+func (t *tracer) nextStep(steps uint64) uint64 {
+	return steps + 1
+}
+
+// onStep synchronizes the shadow call stack with the thread, and attributes the time since last step to the previous stack.
+func (t *tracer) onStep(thread *starlark.Thread, steps uint64) uint64 {
+	now := time.Now()
+	t.sample(now)
+	t.sync(thread, now)
+	return steps + 1
+}
+
+// sample attributes the time since last step to the current shadow call stack for the profiler.
+func (t *tracer) sample(now time.Time) {
+	if t.profiler != nil && len(t.stack) > 0 {
+		d := now.Sub(t.last) - t.excluded
+		if d < 0 {
+			d = 0
+		}
+		t.profiler.addSample(t.stack, "", d, 1)
+	}
+	t.excluded = 0
+	t.last = now
+}
+
+// sync updates the shadow call stack to match the call stack of the thread, and emits events for the frames exited and entered.
+func (t *tracer) sync(thread *starlark.Thread, now time.Time) {
+	depth := thread.CallStackDepth()
+	n := len(t.stack)
+	if depth == n && n > 0 && sameCallable(t.stack[n-1].fn, thread.DebugFrame(0).Callable()) {
+		return
+	}
+
+	// find the first different frame from the bottom
+	i := 0
+	for ; i < n && i < depth; i++ {
+		if !sameCallable(t.stack[i].fn, thread.DebugFrame(depth-1-i).Callable()) {
+			break
+		}
+	}
+
+	// exit the frames gone, and enter the new ones
+	t.popTo(i, now)
+	for ; i < depth; i++ {
+		t.push(thread.DebugFrame(depth-1-i).Callable(), now)
+	}
+}
+
+// push enters a new frame of the given function.
+func (t *tracer) push(fn starlark.Callable, now time.Time) {
+	fr := &traceFrame{fn: fn, name: fn.Name(), start: now}
+	if f, ok := fn.(*starlark.Function); ok {
+		fr.pos = f.Position()
+	}
+	if t.profiler != nil {
+		fr.prof = t.profiler.enter(fr.name, fr.pos, now)
+	}
+	depth := len(t.stack)
+	t.stack = append(t.stack, fr)
+	if t.hooks.OnCallEnter != nil {
+		t.hooks.OnCallEnter(CallEvent{Name: fr.name, Pos: fr.pos, Depth: depth})
+	}
+}
+
+// popTo exits the frames above the given depth.
+func (t *tracer) popTo(depth int, now time.Time) {
+	for j := len(t.stack) - 1; j >= depth; j-- {
+		fr := t.stack[j]
+		if t.profiler != nil {
+			t.profiler.exit(fr.prof, now)
+		}
+		if t.hooks.OnCallExit != nil {
+			t.hooks.OnCallExit(CallEvent{Name: fr.name, Pos: fr.pos, Depth: j, Duration: now.Sub(fr.start)})
+		}
+	}
+	if depth < len(t.stack) {
+		t.stack = t.stack[:depth]
+	}
+}
+
+// builtinDone records a returned builtin call, and excludes its duration from the caller's step.
+func (t *tracer) builtinDone(thread *starlark.Thread, fn *starlark.Builtin, d time.Duration, err error) {
+	// for builtins calling back Starlark code, they're already in the shadow call stack and sampled as frames
+	inStack := false
+	for _, fr := range t.stack {
+		if fr.fn == starlark.Callable(fn) {
+			inStack = true
+			break
+		}
+	}
+	if !inStack {
+		if t.profiler != nil && len(t.stack) > 0 {
+			t.profiler.addSample(t.stack, fn.Name(), d, 0)
+		}
+		t.excluded += d
+	}
+	if t.hooks.OnBuiltin != nil {
+		t.hooks.OnBuiltin(BuiltinEvent{Name: fn.Name(), Pos: callerPosition(thread), Duration: d, Err: err})
+	}
+}
+
+// wrapBuiltin returns a builtin of the same name calling the given one and reporting its duration.
+// The given builtin is called directly, so it sees the same call stack and receiver as called by the script.
+func (t *tracer) wrapBuiltin(b *starlark.Builtin) *starlark.Builtin {
+	var w *starlark.Builtin
+	w = starlark.NewBuiltin(b.Name(), func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		start := time.Now()
+		v, err := b.CallInternal(thread, args, kwargs)
+		t.builtinDone(thread, w, time.Since(start), err)
+		return v, err
+	})
+	return w
+}
+
+// callerPosition returns the position of the caller of the current builtin function in the thread.
+func callerPosition(thread *starlark.Thread) syntax.Position {
+	if thread.CallStackDepth() < 2 {
+		return syntax.Position{}
+	}
+	return thread.CallFrame(1).Pos
+}
+
+// sameCallable returns true if the two callables are the same, and false for uncomparable ones.
+func sameCallable(a, b starlark.Callable) (same bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			same = false
+		}
+	}()
+	return a == b
+}
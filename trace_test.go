@@ -0,0 +1,295 @@
+package starlet_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/1set/starlet"
+	"github.com/google/pprof/profile"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+func TestMachine_SetHooks(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		enters   []string
+		exits    []string
+		builtins []string
+		loads    []string
+		prints   []string
+	)
+	hooks := &starlet.Hooks{
+		OnCallEnter: func(ev starlet.CallEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			enters = append(enters, ev.Name)
+		},
+		OnCallExit: func(ev starlet.CallEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			exits = append(exits, ev.Name)
+		},
+		OnBuiltin: func(ev starlet.BuiltinEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			builtins = append(builtins, ev.Name)
+		},
+		OnLoad: func(ev starlet.LoadEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			loads = append(loads, ev.Module)
+		},
+		OnPrint: func(ev starlet.PrintEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			prints = append(prints, ev.Message)
+			if ev.Pos.Line != 8 {
+				t.Errorf("expected print at line 8, got %v", ev.Pos)
+			}
+		},
+	}
+
+	code := `
+load("math", "sqrt")
+def square(x):
+    return x * x
+def calc(n):
+    return sqrt(square(n))
+x = calc(3)
+print("x =", x)
+`
+	m := starlet.NewWithNames(nil, nil, []string{"math"})
+	m.SetPrintFunc(starlet.NoopPrintFunc)
+	m.SetHooks(hooks)
+	m.SetScript("test.star", []byte(code), nil)
+	out, err := m.Run()
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if x := out["x"]; x != float64(3) {
+		t.Errorf("expected x=3, got %v", x)
+	}
+
+	expectStrs := func(name string, act, exp []string) {
+		if strings.Join(act, ",") != strings.Join(exp, ",") {
+			t.Errorf("expected %s %v, got %v", name, exp, act)
+		}
+	}
+	expectStrs("enters", enters, []string{"<toplevel>", "calc", "square"})
+	expectStrs("exits", exits, []string{"square", "calc", "<toplevel>"})
+	expectStrs("builtins", builtins, []string{"sqrt", "print"})
+	expectStrs("loads", loads, []string{"math"})
+	expectStrs("prints", prints, []string{"x = 3.0"})
+
+	// remove hooks
+	enters = nil
+	m.SetHooks(nil)
+	m.SetScript("test.star", []byte(`y = square(2)`), nil)
+	if _, err := m.Run(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if len(enters) != 0 {
+		t.Errorf("expected no calls traced, got %v", enters)
+	}
+}
+
+func TestMachine_SetHooks_Builtins(t *testing.T) {
+	var (
+		enters   []string
+		builtins []string
+	)
+	hooks := &starlet.Hooks{
+		OnCallEnter: func(ev starlet.CallEvent) {
+			enters = append(enters, ev.Name)
+		},
+		OnBuiltin: func(ev starlet.BuiltinEvent) {
+			builtins = append(builtins, fmt.Sprintf("%s@%d", ev.Name, ev.Pos.Line))
+		},
+	}
+
+	// the values are not copied for tracing
+	mod := &starlarkstruct.Module{Name: "mod", Members: starlark.StringDict{"one": starlark.MakeInt(1)}}
+	getMod := starlark.NewBuiltin("get_mod", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+		return mod, nil
+	})
+	code := `
+def neg(x):
+    return -x
+def build(n):
+    l = []
+    for i in range(n):
+        l.append(i)
+    return l
+s = sorted(build(2), key=neg)
+n = len(s)
+same = get_mod() == mod
+`
+	m := starlet.NewWithGlobals(starlet.StringAnyMap{"mod": mod, "get_mod": getMod})
+	m.SetHooks(hooks)
+	m.SetScript("test.star", []byte(code), nil)
+	out, err := m.Run()
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	if n, same := out["n"], out["same"]; n != int64(2) || same != true {
+		t.Errorf("unexpected results: n=%v, same=%v", n, same)
+	}
+
+	// the universal builtins and methods are traced
+	if act, exp := strings.Join(builtins, ","), "range@6,append@7,append@7,sorted@9,len@10,get_mod@11"; act != exp {
+		t.Errorf("expected builtins %s, got %s", exp, act)
+	}
+	if act, exp := strings.Join(enters, ","), "<toplevel>,build,sorted,neg"; act != exp {
+		t.Errorf("expected enters %s, got %s", exp, act)
+	}
+
+	// the errors of calls are reported as they are
+	m.SetScript("test.star", []byte("x = 1\ny = len(x)"), nil)
+	_, err = m.Run()
+	expectErr(t, err, "starlark: exec: len: value of type int has no len")
+	if e, ok := err.(starlet.ExecError); !ok || e.Position().String() != "test.star:2:8" {
+		t.Errorf("unexpected error position: %v", err)
+	}
+}
+
+func TestMachine_SetHooks_WithBudget(t *testing.T) {
+	var calls int
+	m := starlet.NewDefault()
+	m.SetHooks(&starlet.Hooks{
+		OnCallEnter: func(ev starlet.CallEvent) {
+			calls++
+		},
+	})
+	m.SetExecBudget(starlet.ExecBudget{MaxSteps: 1000})
+	m.SetScript("test.star", []byte(`
+def loop():
+    for i in range(1 << 30):
+        pass
+loop()
+`), nil)
+	if _, err := m.Run(); err == nil || !strings.Contains(err.Error(), "exceeded max execution steps") {
+		t.Errorf("expected exceeded steps error, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+}
+
+func TestMachine_SetProfiler(t *testing.T) {
+	code := `
+def add(a, b):
+    return a + b
+def fib(n):
+    a, b = 0, 1
+    for i in range(n):
+        a, b = b, add(a, b)
+    return a
+x = fib(10)
+s = math.sqrt(16)
+`
+	p := starlet.NewProfiler()
+	m := starlet.NewWithNames(nil, []string{"math"}, nil)
+	m.SetProfiler(p)
+	m.SetScript("test.star", []byte(code), nil)
+	for i := 0; i < 2; i++ {
+		if _, err := m.Run(); err != nil {
+			t.Errorf("expected no error, got %v", err)
+			return
+		}
+	}
+
+	// check the aggregated functions
+	funcs := make(map[string]starlet.FunctionProfile)
+	for _, f := range p.Functions() {
+		funcs[f.Name] = f
+	}
+	if f, ok := funcs["fib"]; !ok {
+		t.Errorf("expected fib in profile, got %v", funcs)
+	} else {
+		if f.Calls != 2 {
+			t.Errorf("expected 2 calls of fib, got %d", f.Calls)
+		}
+		if f.Steps == 0 || f.Total < f.Self {
+			t.Errorf("unexpected profile of fib: %+v", f)
+		}
+		if f.Pos.Line != 4 {
+			t.Errorf("expected fib at line 4, got %v", f.Pos)
+		}
+	}
+	if f, ok := funcs["add"]; !ok || f.Calls != 20 {
+		t.Errorf("expected 20 calls of add, got %+v", f)
+	}
+	if f, ok := funcs["sqrt"]; !ok || f.Calls != 2 {
+		t.Errorf("expected 2 calls of sqrt, got %+v", f)
+	}
+	if f, ok := funcs["<toplevel>"]; !ok || f.Calls != 2 {
+		t.Errorf("expected 2 calls of toplevel, got %+v", f)
+	}
+
+	// write pprof output
+	var buf bytes.Buffer
+	if err := p.WriteProfile(&buf); err != nil {
+		t.Errorf("expected no error, got %v", err)
+		return
+	}
+	prof, err := profile.Parse(&buf)
+	if err != nil {
+		t.Errorf("expected valid pprof output, got %v", err)
+		return
+	}
+	if err = prof.CheckValid(); err != nil {
+		t.Errorf("expected valid profile, got %v", err)
+	}
+	var types []string
+	for _, st := range prof.SampleType {
+		types = append(types, st.Type+"/"+st.Unit)
+	}
+	if s := strings.Join(types, ","); s != "steps/count,cpu/nanoseconds" {
+		t.Errorf("unexpected sample types: %s", s)
+	}
+
+	// the samples are attributed to the call stacks from the innermost function
+	stacks := make(map[string]int64)
+	for _, s := range prof.Sample {
+		var names []string
+		for _, loc := range s.Location {
+			for _, ln := range loc.Line {
+				names = append(names, ln.Function.SystemName)
+			}
+		}
+		stacks[strings.Join(names, "<")] += s.Value[0]
+	}
+	for _, s := range []string{"add<fib<<toplevel>", "fib<<toplevel>", "range<fib<<toplevel>", "sqrt<<toplevel>"} {
+		if _, ok := stacks[s]; !ok {
+			t.Errorf("expected sample of %s, got %v", s, stacks)
+		}
+	}
+	if stacks["add<fib<<toplevel>"] == 0 || stacks["sqrt<<toplevel>"] != 0 {
+		t.Errorf("unexpected steps of samples: %v", stacks)
+	}
+	var fibLine int64
+	for _, fn := range prof.Function {
+		if fn.SystemName == "fib" {
+			if fn.Filename != "test.star" {
+				t.Errorf("expected fib in test.star, got %q", fn.Filename)
+			}
+			fibLine = fn.StartLine
+		}
+	}
+	if fibLine != 4 {
+		t.Errorf("expected fib at line 4, got %d", fibLine)
+	}
+
+	// reset it
+	p.Reset()
+	if fs := p.Functions(); len(fs) != 0 {
+		t.Errorf("expected empty profile after reset, got %v", fs)
+	}
+}
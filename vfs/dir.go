@@ -0,0 +1,154 @@
+package vfs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DirFS is a file system rooted at a directory of the host with writes, like a jail.
+// Paths escaping the root directory by symbolic links are rejected with ErrEscape, and the host paths are not exposed in errors.
+type DirFS struct {
+	root string
+}
+
+// Dir returns the file system rooted at the given directory of the host.
+func Dir(root string) *DirFS {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	return &DirFS{root: root}
+}
+
+// Root returns the root directory in the host.
+func (d *DirFS) Root() string {
+	return d.root
+}
+
+// join returns the host path of the name, and checks the symbolic links in it not to escape from the root.
+// If followLast is false, the last element is not resolved, e.g. for Lstat.
+func (d *DirFS) join(op, name string, followLast bool) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	full := filepath.Join(d.root, filepath.FromSlash(name))
+	check := full
+	if !followLast {
+		check = filepath.Dir(full)
+	}
+	if !d.inside(check) {
+		return "", &fs.PathError{Op: op, Path: name, Err: ErrEscape}
+	}
+	return full, nil
+}
+
+// inside reports whether the host path is still inside the root after resolving the symbolic links of the existing part.
+func (d *DirFS) inside(p string) bool {
+	root, err := filepath.EvalSymlinks(d.root)
+	if err != nil {
+		// nothing to escape from a missing root
+		return true
+	}
+	// find the longest existing part, and keep the rest as is
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			p = filepath.Join(real, rest)
+			break
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return false
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = parent
+	}
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Open opens the named file for reading.
+func (d *DirFS) Open(name string) (fs.File, error) {
+	p, err := d.join("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fixPathError(err, name)
+	}
+	return f, nil
+}
+
+// Stat returns the file info of the named file, the symbolic link is followed.
+func (d *DirFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := d.join("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	return fi, fixPathError(err, name)
+}
+
+// Lstat returns the file info of the named file, the symbolic link is not followed.
+func (d *DirFS) Lstat(name string) (fs.FileInfo, error) {
+	p, err := d.join("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Lstat(p)
+	return fi, fixPathError(err, name)
+}
+
+// ReadDir reads the named directory and returns the entries sorted by name.
+func (d *DirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := d.join("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	es, err := os.ReadDir(p)
+	return es, fixPathError(err, name)
+}
+
+// OpenFile opens the named file with the flag and perm.
+func (d *DirFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	p, err := d.join("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p, flag, perm)
+	if err != nil {
+		return nil, fixPathError(err, name)
+	}
+	return f, nil
+}
+
+// MkdirAll creates the named directory and any necessary parents.
+func (d *DirFS) MkdirAll(name string, perm fs.FileMode) error {
+	p, err := d.join("mkdir", name, true)
+	if err != nil {
+		return err
+	}
+	return fixPathError(os.MkdirAll(p, perm), name)
+}
+
+// Chmod changes the mode of the named file.
+func (d *DirFS) Chmod(name string, mode fs.FileMode) error {
+	p, err := d.join("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	return fixPathError(os.Chmod(p, mode), name)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (d *DirFS) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := d.join("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	return fixPathError(os.Chtimes(p, atime, mtime), name)
+}
@@ -0,0 +1,334 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNotDir = errors.New("not a directory")
+	errIsDir  = errors.New("is a directory")
+)
+
+// MemFS is an in-memory file system with writes, it's safe for concurrent use.
+type MemFS struct {
+	mu   sync.RWMutex
+	root *memNode
+}
+
+// memNode is a file or directory in MemFS.
+type memNode struct {
+	name     string
+	mode     fs.FileMode
+	modTime  time.Time
+	data     []byte
+	children map[string]*memNode
+}
+
+// NewMemFS creates an empty in-memory file system.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		root: &memNode{name: ".", mode: fs.ModeDir | 0755, modTime: time.Now(), children: make(map[string]*memNode)},
+	}
+}
+
+// lookup returns the node of the name, the caller must hold the lock.
+func (m *MemFS) lookup(op, name string) (*memNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	n := m.root
+	if name == "." {
+		return n, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !n.mode.IsDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errNotDir}
+		}
+		c, ok := n.children[elem]
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// Open opens the named file or directory for reading.
+func (m *MemFS) Open(name string) (fs.File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	n, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{fsys: m, node: n, name: name, readable: true}, nil
+}
+
+// Stat returns the file info of the named file.
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	n, err := m.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(), nil
+}
+
+// ReadDir reads the named directory and returns the entries sorted by name.
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	n, err := m.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	return n.entries(), nil
+}
+
+// OpenFile opens the named file with the flag and perm, the parent directory must exist.
+func (m *MemFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	dir, err := m.lookup("open", path.Dir(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.Unwrap(err)}
+	}
+	if !dir.mode.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errNotDir}
+	}
+
+	base := path.Base(name)
+	n, ok := dir.children[base]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case ok && n.mode.IsDir():
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errIsDir}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		n = &memNode{name: base, mode: perm.Perm(), modTime: time.Now()}
+		dir.children[base] = n
+	}
+	if flag&os.O_TRUNC != 0 {
+		n.data = nil
+		n.modTime = time.Now()
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	return &memFile{
+		fsys:     m,
+		node:     n,
+		name:     name,
+		readable: flag&os.O_WRONLY == 0,
+		writable: writable,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+// WriteFile writes the data to the named file, creating it with perm if necessary, it's for preparing the file system.
+func (m *MemFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	f, err := m.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+// MkdirAll creates the named directory and any necessary parents.
+func (m *MemFS) MkdirAll(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return nil
+	}
+	n := m.root
+	for _, elem := range strings.Split(name, "/") {
+		c, ok := n.children[elem]
+		if !ok {
+			c = &memNode{name: elem, mode: fs.ModeDir | perm.Perm(), modTime: time.Now(), children: make(map[string]*memNode)}
+			n.children[elem] = c
+		} else if !c.mode.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: errNotDir}
+		}
+		n = c
+	}
+	return nil
+}
+
+// Chmod changes the permission bits of the named file.
+func (m *MemFS) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.lookup("chmod", name)
+	if err != nil {
+		return err
+	}
+	n.mode = n.mode.Type() | mode.Perm()
+	return nil
+}
+
+// Chtimes changes the modification time of the named file, the access time is not kept.
+func (m *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.lookup("chtimes", name)
+	if err != nil {
+		return err
+	}
+	n.modTime = mtime
+	return nil
+}
+
+// info returns a snapshot of the file info of the node, the caller must hold the lock.
+func (n *memNode) info() *memInfo {
+	return &memInfo{name: n.name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime, node: n}
+}
+
+// entries returns the directory entries sorted by name, the caller must hold the lock.
+func (n *memNode) entries() []fs.DirEntry {
+	es := make([]fs.DirEntry, 0, len(n.children))
+	for _, c := range n.children {
+		es = append(es, fs.FileInfoToDirEntry(c.info()))
+	}
+	sort.Slice(es, func(i, j int) bool {
+		return es[i].Name() < es[j].Name()
+	})
+	return es
+}
+
+// memInfo is the file info of memNode.
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	node    *memNode
+}
+
+func (fi *memInfo) Name() string       { return fi.name }
+func (fi *memInfo) Size() int64        { return fi.size }
+func (fi *memInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *memInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memInfo) Sys() interface{}   { return fi.node }
+
+// memFile is an open file or directory of MemFS.
+type memFile struct {
+	fsys     *MemFS
+	node     *memNode
+	name     string
+	offset   int64
+	dirRead  int
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fsys.mu.RLock()
+	defer f.fsys.mu.RUnlock()
+	return f.node.info(), nil
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	f.fsys.mu.RLock()
+	defer f.fsys.mu.RUnlock()
+
+	switch {
+	case f.closed:
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	case f.node.mode.IsDir():
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errIsDir}
+	case !f.readable:
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrPermission}
+	case f.offset >= int64(len(f.node.data)):
+		return 0, io.EOF
+	}
+	n := copy(b, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+
+	switch {
+	case f.closed:
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrClosed}
+	case !f.writable:
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+	if end := f.offset + int64(len(b)); end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	n := copy(f.node.data[f.offset:], b)
+	f.offset += int64(n)
+	f.node.modTime = time.Now()
+	return n, nil
+}
+
+// ReadDir reads the entries of the directory like fs.ReadDirFile.
+func (f *memFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	f.fsys.mu.RLock()
+	defer f.fsys.mu.RUnlock()
+
+	if !f.node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errNotDir}
+	}
+	es := f.node.entries()[f.dirRead:]
+	if count > 0 {
+		if len(es) == 0 {
+			return nil, io.EOF
+		}
+		if count < len(es) {
+			es = es[:count]
+		}
+	}
+	f.dirRead += len(es)
+	return es, nil
+}
+
+func (f *memFile) Close() error {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,227 @@
+package vfs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sandbox is the System on a file system, which resolves the OS-like paths of scripts in a virtual namespace rooted at the file system.
+// Both "/" and ".." at the top refer to the root of the file system, and relative paths are resolved against the virtual working directory, which is "/" at first.
+// It's safe for concurrent use.
+type Sandbox struct {
+	fsys fs.FS
+	mu   sync.RWMutex
+	cwd  string
+}
+
+// NewSandbox creates a Sandbox on the given file system.
+func NewSandbox(fsys fs.FS) *Sandbox {
+	return &Sandbox{fsys: fsys, cwd: "/"}
+}
+
+// FS returns the underlying file system.
+func (s *Sandbox) FS() fs.FS {
+	return s.fsys
+}
+
+// resolve converts the OS-like path to the name in the file system.
+func (s *Sandbox) resolve(op, name string) (string, error) {
+	if name == "" {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	p := filepath.ToSlash(strings.TrimPrefix(name, filepath.VolumeName(name)))
+	if !path.IsAbs(p) {
+		s.mu.RLock()
+		p = path.Join(s.cwd, p)
+		s.mu.RUnlock()
+	}
+	if p = strings.TrimPrefix(path.Clean("/"+p), "/"); p == "" {
+		p = "."
+	}
+	return p, nil
+}
+
+// writeFS returns the write extension of the file system, or ErrReadOnly if not available.
+func (s *Sandbox) writeFS(op, name string) (WriteFS, error) {
+	if wf, ok := s.fsys.(WriteFS); ok {
+		return wf, nil
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: ErrReadOnly}
+}
+
+// Open opens the named file for reading.
+func (s *Sandbox) Open(name string) (fs.File, error) {
+	p, err := s.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.fsys.Open(p)
+	if err != nil {
+		return nil, fixPathError(err, name)
+	}
+	return f, nil
+}
+
+// OpenFile opens the named file for writing with the flag and perm, it fails with ErrReadOnly if the file system has no write extension.
+func (s *Sandbox) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	p, err := s.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	wf, err := s.writeFS("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := wf.OpenFile(p, flag, perm)
+	if err != nil {
+		return nil, fixPathError(err, name)
+	}
+	return f, nil
+}
+
+// Stat returns the file info of the named file, the symbolic link is followed.
+func (s *Sandbox) Stat(name string) (fs.FileInfo, error) {
+	p, err := s.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fs.Stat(s.fsys, p)
+	return fi, fixPathError(err, name)
+}
+
+// Lstat returns the file info of the named file, the symbolic link is not followed if the file system implements LstatFS.
+func (s *Sandbox) Lstat(name string) (fs.FileInfo, error) {
+	p, err := s.resolve("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	var fi fs.FileInfo
+	if lf, ok := s.fsys.(LstatFS); ok {
+		fi, err = lf.Lstat(p)
+	} else {
+		fi, err = fs.Stat(s.fsys, p)
+	}
+	return fi, fixPathError(err, name)
+}
+
+// MkdirAll creates the named directory and any necessary parents.
+func (s *Sandbox) MkdirAll(name string, perm fs.FileMode) error {
+	p, err := s.resolve("mkdir", name)
+	if err != nil {
+		return err
+	}
+	wf, err := s.writeFS("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return fixPathError(wf.MkdirAll(p, perm), name)
+}
+
+// Chmod changes the mode of the named file.
+func (s *Sandbox) Chmod(name string, mode fs.FileMode) error {
+	p, err := s.resolve("chmod", name)
+	if err != nil {
+		return err
+	}
+	wf, err := s.writeFS("chmod", name)
+	if err != nil {
+		return err
+	}
+	return fixPathError(wf.Chmod(p, mode), name)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (s *Sandbox) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := s.resolve("chtimes", name)
+	if err != nil {
+		return err
+	}
+	wf, err := s.writeFS("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return fixPathError(wf.Chtimes(p, atime, mtime), name)
+}
+
+// Walk walks the file tree rooted at root like filepath.Walk, and the paths passed to fn are prefixed with root as given.
+func (s *Sandbox) Walk(root string, fn filepath.WalkFunc) error {
+	p, err := s.resolve("lstat", root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	// convert to the path for scripts
+	scriptPath := func(name string) string {
+		if name == p {
+			return root
+		}
+		rel := name
+		if p != "." {
+			rel = name[len(p)+1:]
+		}
+		return filepath.Join(root, filepath.FromSlash(rel))
+	}
+	return fs.WalkDir(s.fsys, p, func(name string, d fs.DirEntry, err error) error {
+		sp := scriptPath(name)
+		if err != nil {
+			return fn(sp, nil, fixPathError(err, sp))
+		}
+		info, err := d.Info()
+		if err != nil {
+			return fn(sp, nil, fixPathError(err, sp))
+		}
+		return fn(sp, info, nil)
+	})
+}
+
+// Abs returns the absolute path in the virtual namespace.
+func (s *Sandbox) Abs(name string) (string, error) {
+	if name == "" {
+		name = "."
+	}
+	p, err := s.resolve("abs", name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.FromSlash(path.Join("/", p)), nil
+}
+
+// Getwd returns the virtual working directory.
+func (s *Sandbox) Getwd() (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return filepath.FromSlash(s.cwd), nil
+}
+
+// Chdir changes the virtual working directory to the named directory.
+func (s *Sandbox) Chdir(name string) error {
+	p, err := s.resolve("chdir", name)
+	if err != nil {
+		return err
+	}
+	fi, err := fs.Stat(s.fsys, p)
+	if err != nil {
+		return fixPathError(err, name)
+	}
+	if !fi.IsDir() {
+		return &fs.PathError{Op: "chdir", Path: name, Err: errNotDir}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cwd = path.Join("/", p)
+	return nil
+}
+
+// SameFile reports whether the two file infos describe the same file.
+func (s *Sandbox) SameFile(fi1, fi2 fs.FileInfo) bool {
+	if n1, ok := fi1.Sys().(*memNode); ok {
+		n2, ok := fi2.Sys().(*memNode)
+		return ok && n1 == n2
+	}
+	return os.SameFile(fi1, fi2)
+}
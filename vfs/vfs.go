@@ -0,0 +1,181 @@
+// Package vfs provides the file systems for the file and path modules, so scripts can be confined to a directory, a read-only or an in-memory file system instead of the host one.
+//
+// A file system is a standard fs.FS for reads, and it may implement WriteFS for writes. It's wrapped as a Sandbox to be used by modules with OS-like paths,
+// in which "/" is the root of the file system, and relative paths are resolved against a virtual working directory.
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// threadLocalKey is the key of the file system in the thread local.
+const threadLocalKey = "vfs"
+
+var (
+	// ErrReadOnly is returned for writes to a file system without the write extension.
+	ErrReadOnly = fmt.Errorf("read-only file system: %w", fs.ErrPermission)
+	// ErrEscape is returned for paths escaping the root directory of DirFS, e.g. by symbolic links.
+	ErrEscape = fmt.Errorf("path escapes from root: %w", fs.ErrPermission)
+)
+
+// File is an open file for writing.
+type File interface {
+	fs.File
+	io.Writer
+}
+
+// WriteFS is the write extension of fs.FS. As fs.FS, the names are unrooted slash-separated paths, e.g. "dir/file.txt".
+type WriteFS interface {
+	fs.FS
+	// OpenFile opens the named file with the flag like os.O_CREATE and perm for creation, it's used for writes.
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	// MkdirAll creates the named directory and any necessary parents.
+	MkdirAll(name string, perm fs.FileMode) error
+	// Chmod changes the mode of the named file.
+	Chmod(name string, mode fs.FileMode) error
+	// Chtimes changes the access and modification times of the named file.
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// LstatFS is the file system with Lstat, which describes the symbolic link itself instead of following it.
+type LstatFS interface {
+	fs.FS
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// System is the file operations with OS-like paths used by modules.
+type System interface {
+	Open(name string) (fs.File, error)
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	MkdirAll(name string, perm fs.FileMode) error
+	Chmod(name string, mode fs.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Walk(root string, fn filepath.WalkFunc) error
+	Abs(name string) (string, error)
+	Getwd() (string, error)
+	Chdir(name string) error
+	SameFile(fi1, fi2 fs.FileInfo) bool
+}
+
+// Host is the System of the host file system, it's used by modules if no file system is set for the thread.
+var Host System = hostSystem{}
+
+// GetThreadFS returns the file system of the given thread, or Host if not found.
+func GetThreadFS(thread *starlark.Thread) System {
+	if thread != nil {
+		if s, ok := thread.Local(threadLocalKey).(System); ok && s != nil {
+			return s
+		}
+	}
+	return Host
+}
+
+// SetThreadFS sets the file system for the given thread, nil for Host.
+func SetThreadFS(thread *starlark.Thread, s System) {
+	if thread != nil {
+		thread.SetLocal(threadLocalKey, s)
+	}
+}
+
+// ReadOnly returns the file system without the write extension, so all writes are rejected with ErrReadOnly.
+func ReadOnly(fsys fs.FS) fs.FS {
+	return readOnlyFS{fsys: fsys}
+}
+
+type readOnlyFS struct {
+	fsys fs.FS
+}
+
+func (r readOnlyFS) Open(name string) (fs.File, error) {
+	return r.fsys.Open(name)
+}
+
+func (r readOnlyFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(r.fsys, name)
+}
+
+func (r readOnlyFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(r.fsys, name)
+}
+
+func (r readOnlyFS) Lstat(name string) (fs.FileInfo, error) {
+	if lf, ok := r.fsys.(LstatFS); ok {
+		return lf.Lstat(name)
+	}
+	return fs.Stat(r.fsys, name)
+}
+
+// hostSystem is the System of the host file system by os package.
+type hostSystem struct{}
+
+func (hostSystem) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (hostSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// avoid returning a typed nil
+		return nil, err
+	}
+	return f, nil
+}
+
+func (hostSystem) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (hostSystem) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (hostSystem) MkdirAll(name string, perm fs.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (hostSystem) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (hostSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (hostSystem) Walk(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, fn)
+}
+
+func (hostSystem) Abs(name string) (string, error) {
+	return filepath.Abs(name)
+}
+
+func (hostSystem) Getwd() (string, error) {
+	return os.Getwd()
+}
+
+func (hostSystem) Chdir(name string) error {
+	return os.Chdir(name)
+}
+
+func (hostSystem) SameFile(fi1, fi2 fs.FileInfo) bool {
+	return os.SameFile(fi1, fi2)
+}
+
+// fixPathError replaces the path of the error with the given name, so the underlying paths are not exposed to scripts.
+func fixPathError(err error, name string) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		pe.Path = name
+	}
+	return err
+}
@@ -0,0 +1,242 @@
+package vfs_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/1set/starlet/vfs"
+)
+
+func readAll(t *testing.T, s vfs.System, name string) string {
+	t.Helper()
+	f, err := s.Open(name)
+	if err != nil {
+		t.Fatalf("open %q: %v", name, err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("read %q: %v", name, err)
+	}
+	return string(b)
+}
+
+func writeAll(s vfs.System, name string, flag int, data string) error {
+	f, err := s.OpenFile(name, flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write([]byte(data))
+	return err
+}
+
+func TestMemFS(t *testing.T) {
+	m := vfs.NewMemFS()
+	if err := m.MkdirAll("a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFile("a/b/c.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFile("a/d.txt", []byte("world"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(m, "a/b/c.txt", "a/d.txt"); err != nil {
+		t.Errorf("fstest: %v", err)
+	}
+
+	// errors
+	if err := m.WriteFile("x/y.txt", nil, 0644); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist, got %v", err)
+	}
+	if err := m.MkdirAll("a/d.txt/e", 0755); err == nil {
+		t.Errorf("expected error for file as dir")
+	}
+	if _, err := m.OpenFile("a/d.txt", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected exist, got %v", err)
+	}
+	if _, err := m.Open("../a"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("expected invalid, got %v", err)
+	}
+
+	// chmod and chtimes
+	mt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := m.Chmod("a/d.txt", 0444); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Chtimes("a/d.txt", mt, mt); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := m.Stat("a/d.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0444 || !fi.ModTime().Equal(mt) || fi.Size() != 5 {
+		t.Errorf("unexpected file info: %v %v %v", fi.Mode(), fi.ModTime(), fi.Size())
+	}
+}
+
+func TestSandbox_MemFS(t *testing.T) {
+	s := vfs.NewSandbox(vfs.NewMemFS())
+
+	// write and read with absolute and relative paths
+	if err := s.MkdirAll("/data/logs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAll(s, "/data/a.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAll(s, "data/a.txt", os.O_WRONLY|os.O_CREATE|os.O_APPEND, "def"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, s, "/data/a.txt"); got != "abcdef" {
+		t.Errorf("expected abcdef, got %q", got)
+	}
+
+	// working directory
+	if err := s.Chdir("data/logs"); err != nil {
+		t.Fatal(err)
+	}
+	if wd, _ := s.Getwd(); wd != filepath.FromSlash("/data/logs") {
+		t.Errorf("unexpected working directory: %s", wd)
+	}
+	if got := readAll(t, s, "../a.txt"); got != "abcdef" {
+		t.Errorf("expected abcdef, got %q", got)
+	}
+	if err := s.Chdir("/data/a.txt"); err == nil {
+		t.Errorf("expected error for chdir to file")
+	}
+	if abs, _ := s.Abs("x.txt"); abs != filepath.FromSlash("/data/logs/x.txt") {
+		t.Errorf("unexpected abs: %s", abs)
+	}
+
+	// no escape from root
+	if got := readAll(t, s, "../../../../data/a.txt"); got != "abcdef" {
+		t.Errorf("expected abcdef, got %q", got)
+	}
+	if abs, _ := s.Abs("/../../etc/passwd"); abs != filepath.FromSlash("/etc/passwd") {
+		t.Errorf("unexpected abs: %s", abs)
+	}
+
+	// errors show the paths of scripts
+	_, err := s.Open("missing.txt")
+	if !errors.Is(err, fs.ErrNotExist) || err.Error() != "open missing.txt: file does not exist" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// walk and same file
+	var walked []string
+	if err := s.Walk("/data", func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, filepath.ToSlash(p))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(walked)
+	if exp := []string{"/data", "/data/a.txt", "/data/logs"}; len(walked) != 3 || walked[0] != exp[0] || walked[1] != exp[1] || walked[2] != exp[2] {
+		t.Errorf("unexpected walked: %v", walked)
+	}
+	fi1, _ := s.Stat("/data/a.txt")
+	fi2, _ := s.Stat("../a.txt")
+	fi3, _ := s.Stat("/data/logs")
+	if !s.SameFile(fi1, fi2) || s.SameFile(fi1, fi3) {
+		t.Errorf("unexpected same file result")
+	}
+}
+
+func TestSandbox_ReadOnly(t *testing.T) {
+	mfs := fstest.MapFS{
+		"conf/app.json": &fstest.MapFile{Data: []byte(`{"a":1}`)},
+	}
+	for name, fsys := range map[string]fs.FS{
+		"map":      mfs,
+		"readonly": vfs.ReadOnly(vfs.NewMemFS()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := vfs.NewSandbox(fsys)
+			err := writeAll(s, "/conf/new.json", os.O_WRONLY|os.O_CREATE, "{}")
+			if !errors.Is(err, vfs.ErrReadOnly) || !errors.Is(err, fs.ErrPermission) {
+				t.Errorf("expected read-only error, got %v", err)
+			}
+			if err := s.MkdirAll("/x", 0755); !errors.Is(err, vfs.ErrReadOnly) {
+				t.Errorf("expected read-only error, got %v", err)
+			}
+			if err := s.Chmod("/conf/app.json", 0600); !errors.Is(err, vfs.ErrReadOnly) {
+				t.Errorf("expected read-only error, got %v", err)
+			}
+		})
+	}
+	if got := readAll(t, vfs.NewSandbox(vfs.ReadOnly(mfs)), "/conf/app.json"); got != `{"a":1}` {
+		t.Errorf("unexpected content: %q", got)
+	}
+}
+
+func TestSandbox_Dir(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := vfs.Dir(root)
+	s := vfs.NewSandbox(d)
+	if err := s.MkdirAll("/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAll(s, "/sub/a.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, "inside"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(root, "sub", "a.txt")); err != nil || string(b) != "inside" {
+		t.Errorf("unexpected file in host: %q, %v", b, err)
+	}
+	if got := readAll(t, s, "/../sub/a.txt"); got != "inside" {
+		t.Errorf("unexpected content: %q", got)
+	}
+
+	// errors don't expose the host paths
+	_, err := s.Open("/nope.txt")
+	if !errors.Is(err, fs.ErrNotExist) || strings.Contains(err.Error(), root) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// symbolic links escaping from root
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links need privileges on Windows")
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open("/link/secret.txt"); !errors.Is(err, vfs.ErrEscape) {
+		t.Errorf("expected escape error, got %v", err)
+	}
+	if err := writeAll(s, "/link/new.txt", os.O_WRONLY|os.O_CREATE, "x"); !errors.Is(err, vfs.ErrEscape) {
+		t.Errorf("expected escape error, got %v", err)
+	}
+	if fi, err := s.Lstat("/link"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected symlink info, got %v, %v", fi, err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected no file created outside, got %v", err)
+	}
+
+	// symbolic links inside root are fine
+	if err := os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "inner")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, s, "/inner/a.txt"); got != "inside" {
+		t.Errorf("unexpected content: %q", got)
+	}
+}